@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// One mutating request. Each entry carries the hash of the one before it,
+// and its own hash covers everything else in it, so editing or dropping an
+// entry anywhere breaks the chain from there on.
+type AuditEntry struct {
+	Seq       int
+	Time      time.Time
+	Actor     string
+	SourceIP  string
+	RequestID string
+	Method    string
+	Path      string
+	BookID    int
+	Before    *Book
+	After     *Book
+	Outcome   int
+	PrevHash  string
+	Hash      string
+}
+
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil { // nothing in here can fail to marshal
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type auditLog struct {
+	lock sync.Mutex
+	// the latest entries, keep of them at most. With a file, the rest are
+	// read back from it when they're asked for. Without one, they're gone.
+	entries []AuditEntry
+	keep    int
+	// how many have gone from the front of entries, and the last one's hash
+	dropped     int
+	droppedHash string
+	last        string
+	// the checkouts, worked out as the entries go by, so loans don't need
+	// every entry there's ever been
+	ledger loanLedger
+	// if set, each entry is appended here as a line of JSON
+	out io.Writer
+	// the file out is, if it is one
+	path string
+}
+
+var audit *auditLog
+
+func newAuditLog() *auditLog {
+	return &auditLog{keep: cfg.AuditMemory}
+}
+
+// openAuditLog picks up the chain from the file at path, if there is one,
+// and appends to it from then on. It refuses to carry on from a broken chain.
+func openAuditLog(path string) (*auditLog, error) {
+	a := newAuditLog()
+	broken := false
+	err := readAuditFile(path, 0, func(e AuditEntry) bool {
+		if e.Seq != a.seq()+1 || e.PrevHash != a.last || e.computeHash() != e.Hash {
+			broken = true
+			return false
+		}
+		a.add(e)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if broken {
+		return nil, errors.New(path + ": audit chain is broken at entry " + strconv.Itoa(a.seq()+1))
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a.out, a.path = f, path
+	return a, nil
+}
+
+// readAuditFile hands fn each entry in the file at path, oldest first, up
+// to and including entry upTo, or all of them if it's 0, until fn says
+// stop. No file is no entries.
+func readAuditFile(path string, upTo int, fn func(AuditEntry) bool) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return errors.New("reading " + path + ": " + err.Error())
+		}
+		if !fn(e) || e.Seq == upTo {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// close closes the file, if there is one. Nothing gets appended after.
+func (a *auditLog) close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	c, ok := a.out.(io.Closer)
+	a.out = nil
+	if ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// seq is the Seq of the latest entry, with the lock held
+func (a *auditLog) seq() int {
+	return a.dropped + len(a.entries)
+}
+
+// add keeps e, letting the oldest go if that's too many, with the lock held
+func (a *auditLog) add(e AuditEntry) {
+	a.entries = append(a.entries, e)
+	a.last = e.Hash
+	a.ledger.note(e)
+	if n := len(a.entries) - a.keep; n > 0 {
+		a.dropped += n
+		a.droppedHash = a.entries[n-1].Hash
+		a.entries = a.entries[n:]
+	}
+}
+
+// append chains e on. If it can't be written to the file, it isn't kept
+// either, so the chain doesn't go on without it.
+func (a *auditLog) append(e AuditEntry) (AuditEntry, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	e.Seq = a.seq() + 1
+	e.PrevHash = a.last
+	e.Hash = e.computeHash()
+	if a.out != nil {
+		line, _ := json.Marshal(e)
+		if _, err := a.out.Write(append(line, '\n')); err != nil {
+			return AuditEntry{}, err
+		}
+	}
+	a.add(e)
+	return e, nil
+}
+
+// query returns the entries from from up to but not including to. Zero
+// times leave that end open, and a book ID below 0 means any book. If
+// that goes back further than the entries in memory, they're read from
+// the file.
+func (a *auditLog) query(from, to time.Time, bookID int) []AuditEntry {
+	l := []AuditEntry{}
+	match := func(e AuditEntry) bool {
+		if (from.IsZero() || !e.Time.Before(from)) && (to.IsZero() || e.Time.Before(to)) && (bookID < 0 || e.BookID == bookID) {
+			l = append(l, e)
+		}
+		return true
+	}
+	a.lock.Lock()
+	if a.dropped == 0 || a.path == "" || len(a.entries) > 0 && from.After(a.entries[0].Time) {
+		defer a.lock.Unlock()
+		for _, e := range a.entries {
+			match(e)
+		}
+		return l
+	}
+	upTo := a.seq()
+	a.lock.Unlock()
+	// not under the lock, so appends can carry on while it's read
+	if err := readAuditFile(a.path, upTo, match); err != nil {
+		log.Println("querying the audit log", err)
+	}
+	return l
+}
+
+// verify checks the whole chain when it's in a file, and what's in memory
+// when it isn't
+func (a *auditLog) verify() (bool, int) {
+	a.lock.Lock()
+	if a.path == "" {
+		defer a.lock.Unlock()
+		return verifyChain(a.entries, a.dropped, a.droppedHash)
+	}
+	upTo := a.seq()
+	a.lock.Unlock()
+	var entries []AuditEntry
+	seq, prev, ok, at := 0, "", true, 0
+	err := readAuditFile(a.path, upTo, func(e AuditEntry) bool {
+		// a chunk at a time, so it's never all in memory
+		if entries = append(entries, e); len(entries) == 1000 {
+			if ok, at = verifyChain(entries, seq, prev); !ok {
+				return false
+			}
+			seq, prev, entries = seq+len(entries), entries[len(entries)-1].Hash, entries[:0]
+		}
+		return true
+	})
+	if ok {
+		ok, at = verifyChain(entries, seq, prev)
+		seq += len(entries)
+	}
+	if ok && (err != nil || seq != upTo) {
+		// there's less in the file than there should be
+		return false, seq + 1
+	}
+	return ok, at
+}
+
+// verifyChain says whether the hashes all line up, going on from entry seq
+// with hash prev, and if not, the Seq of the first entry that doesn't.
+func verifyChain(entries []AuditEntry, seq int, prev string) (bool, int) {
+	for i, e := range entries {
+		if e.Seq != seq+i+1 || e.PrevHash != prev || e.computeHash() != e.Hash {
+			return false, seq + i + 1
+		}
+		prev = e.Hash
+	}
+	return true, 0
+}
+
+// loans are the checkouts, oldest first
+func (a *auditLog) loans() []*loan {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	// copies, since the last may be returned while they're being read
+	l := make([]*loan, len(a.ledger.loans))
+	for i, o := range a.ledger.loans {
+		c := *o
+		l[i] = &c
+	}
+	return l
+}
+
+// What the handler saw. The handlers fill in the books, and audited does the
+// rest.
+type auditRecord struct {
+	BookID int
+	Before *Book
+	After  *Book
+	// if set, the outcome to record instead of the status code. gRPC
+	// answers everything with a 200.
+	Outcome int
+	// for requests that change several books, like a GraphQL mutation.
+	// Each gets an entry of its own, in place of the one above.
+	changes []auditRecord
+}
+
+type auditKey struct{}
+
+func auditFrom(req *http.Request) *auditRecord {
+	r, _ := req.Context().Value(auditKey{}).(*auditRecord)
+	return r
+}
+
+// auditBooks notes the book before and after a mutating request. Either can
+// be nil. Harmless on requests that aren't being audited.
+func auditBooks(req *http.Request, id int, before, after *Book) {
+	if r := auditFrom(req); r != nil {
+		r.BookID = id
+		r.Before = before
+		r.After = after
+	}
+}
+
+// auditChange notes one of several changes a request makes, with how it
+// went
+func auditChange(req *http.Request, id int, before, after *Book, outcome int) {
+	if r := auditFrom(req); r != nil {
+		r.changes = append(r.changes, auditRecord{BookID: id, Before: before, After: after, Outcome: outcome})
+	}
+}
+
+// auditOutcome overrides the status code as the outcome of the request
+func auditOutcome(req *http.Request, code int) {
+	if r := auditFrom(req); r != nil {
+		r.Outcome = code
+	}
+}
+
+// heldResponse keeps what the handler answers until it's been audited,
+// so if it can't be, the answer can be a 500 instead
+type heldResponse struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (r *heldResponse) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *heldResponse) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = 200
+	}
+	return r.body.Write(b)
+}
+
+// audited goes outside authenticate, so rejected requests are logged too.
+// Only POST, PUT and DELETE are recorded. Reads aren't interesting. The
+// answer waits until it's recorded, and if it can't be, it's a 500, though
+// whatever the request changed stays changed.
+func audited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if audit == nil || (req.Method != http.MethodPost && req.Method != http.MethodPut && req.Method != http.MethodDelete) {
+			next(w, req)
+			return
+		}
+		req = withRequestInfo(w, req)
+		info := infoFrom(req)
+		rec := &auditRecord{BookID: -1}
+		if bid, err := getIDFromPath(req.URL.Path); err == nil {
+			rec.BookID = bid
+		}
+		header := w.Header().Clone()
+		hr := &heldResponse{ResponseWriter: w}
+		next(hr, req.WithContext(context.WithValue(req.Context(), auditKey{}, rec)))
+		code := hr.code
+		if code == 0 {
+			code = 200
+		}
+		if rec.Outcome == 0 {
+			rec.Outcome = code
+		}
+		changes := rec.changes
+		if len(changes) == 0 {
+			changes = []auditRecord{*rec}
+		}
+		for _, c := range changes {
+			_, err := audit.append(AuditEntry{
+				Time:      time.Now().UTC(),
+				Actor:     info.Caller,
+				SourceIP:  sourceIP(req),
+				RequestID: info.ID,
+				Method:    req.Method,
+				Path:      req.URL.Path,
+				BookID:    c.BookID,
+				Before:    c.Before,
+				After:     c.After,
+				Outcome:   c.Outcome})
+			if err != nil {
+				log.Println("writing the audit log", err)
+				// none of what the handler said goes out
+				for k := range w.Header() {
+					delete(w.Header(), k)
+				}
+				for k, v := range header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(500)
+				io.WriteString(w, "Error writing the audit log. The change may have been made, but it isn't recorded.")
+				return
+			}
+		}
+		if hr.code != 0 {
+			w.WriteHeader(hr.code)
+		}
+		w.Write(hr.body.Bytes())
+	}
+}
+
+// GET /audit?from=...&to=...&book=...  entries, oldest first. from and to
+// are RFC3339 times, or days the way PublishDate takes them: in the date
+// format, or ISO 8601, and a year or month is its first day.
+// GET /audit/verify                    whether the chain is intact
+func auditHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet || audit == nil {
+		w.WriteHeader(404)
+		return
+	}
+	if req.URL.Path == "/audit/verify" {
+		ok, at := audit.verify()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Valid    bool
+			BrokenAt int `json:",omitempty"`
+		}{ok, at})
+		return
+	}
+	kvPairs, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, "Error parsing query: "+err.Error())
+		return
+	}
+	var from, to time.Time
+	bookID := -1
+	message := ""
+	for k, v := range kvPairs {
+		if len(v) != 1 {
+			message = message + "Each query key must have exactly one value.\n"
+			continue
+		}
+		switch k {
+		case "from", "to":
+			t, err := time.Parse(time.RFC3339, v[0])
+			if err != nil {
+				t, _, err = parsePublishDate(v[0])
+			}
+			if err != nil {
+				message = message + "Error parsing " + k + ". Please use RFC3339, " + cfg.DateFormat + " or ISO 8601 (YYYY-MM-DD, YYYY-MM or YYYY).\n"
+			} else if k == "from" {
+				from = t
+			} else {
+				to = t
+			}
+		case "book":
+			bookID, err = strconv.Atoi(v[0])
+			if err != nil || bookID < 0 {
+				message = message + "Error parsing book. Value must be a book ID.\n"
+			}
+		default:
+			message = message + "Invalid query key " + k + ". Valid keys are from, to and book.\n"
+		}
+	}
+	if message != "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, message)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(audit.query(from, to, bookID))
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sets up the in-process list and audit log for tests that call the
+// handlers directly rather than going through the container
+func freshAudit() {
+	store = newMemStore()
+	audit = newAuditLog()
+}
+
+func auditedRequest(method, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("X-Request-ID", "req-"+method+"-"+target)
+	audited(authenticate(authorize(bookActions, bookHandler)))(rec, req)
+	return rec
+}
+
+func TestAuditEntries(t *testing.T) {
+	freshAudit()
+	defer func() { audit = nil }()
+
+	auditedRequest(http.MethodPost, "/book/4")
+	auditedRequest(http.MethodPost, "/book/4")
+	auditedRequest(http.MethodGet, "/book/4")
+	auditedRequest(http.MethodPut, "/book/4?Title=Audited")
+	auditedRequest(http.MethodPut, "/book/4?Rating=9")
+	auditedRequest(http.MethodDelete, "/book/4")
+
+	l := audit.query(time.Time{}, time.Time{}, -1)
+	if len(l) != 5 {
+		t.Fatalf("got %d audit entries, expected 5 (the GET shouldn't count)", len(l))
+	}
+	expected := []struct {
+		method  string
+		outcome int
+		before  bool
+		after   bool
+	}{
+		{http.MethodPost, 201, false, true},
+		{http.MethodPost, 409, true, true},
+		{http.MethodPut, 200, true, true},
+		{http.MethodPut, 400, false, false},
+		{http.MethodDelete, 200, true, false},
+	}
+	for i, e := range expected {
+		got := l[i]
+		if got.Method != e.method || got.Outcome != e.outcome || (got.Before != nil) != e.before || (got.After != nil) != e.after {
+			t.Errorf("entry %d: got %v %d before %v after %v, expected %v", i+1, got.Method, got.Outcome, got.Before, got.After, e)
+		}
+		if got.BookID != 4 {
+			t.Errorf("entry %d: got book %d, expected 4", i+1, got.BookID)
+		}
+		if got.RequestID == "" || got.SourceIP == "" {
+			t.Errorf("entry %d: missing request ID or source IP %+v", i+1, got)
+		}
+	}
+	if l[2].Before.Title != "Untitled" || l[2].After.Title != "Audited" {
+		t.Errorf("update entry before/after titles %v/%v, expected Untitled/Audited", l[2].Before.Title, l[2].After.Title)
+	}
+	if ok, at := audit.verify(); !ok {
+		t.Errorf("fresh chain broken at %d", at)
+	}
+}
+
+func TestAuditRecordsRejectedCallers(t *testing.T) {
+	freshAudit()
+	auth = testAuthenticator(t)
+	defer func() { audit = nil; auth = nil }()
+
+	auditedRequest(http.MethodDelete, "/book/2")
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodDelete, "/book/2", nil)
+	req.Header.Set("X-API-Key", "current-key")
+	audited(authenticate(authorize(bookActions, bookHandler)))(rec, req)
+
+	l := audit.query(time.Time{}, time.Time{}, 2)
+	if len(l) != 2 {
+		t.Fatalf("got %d audit entries, expected 2", len(l))
+	}
+	if l[0].Outcome != 401 || l[0].Actor != "" {
+		t.Errorf("unauthenticated delete logged as %d by %q, expected 401 by nobody", l[0].Outcome, l[0].Actor)
+	}
+	if l[1].Outcome != 403 || l[1].Actor != "frontdesk" {
+		t.Errorf("unauthorized delete logged as %d by %q, expected 403 by frontdesk", l[1].Outcome, l[1].Actor)
+	}
+}
+
+type brokenWriter struct{}
+
+func (brokenWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+// a change that can't be written down is a 500, and the chain doesn't go
+// on without it
+func TestAuditWriteFails(t *testing.T) {
+	freshAudit()
+	defer func() { audit = nil }()
+	auditedRequest(http.MethodPost, "/book/4")
+	last := audit.last
+	audit.out = brokenWriter{}
+
+	rec := auditedRequest(http.MethodPut, "/book/4?Title=Unrecorded")
+	if rec.Code != 500 || !strings.Contains(rec.Body.String(), "audit log") || strings.Contains(rec.Body.String(), "Unrecorded") {
+		t.Errorf("PUT with the audit log failing gave %d %s", rec.Code, rec.Body)
+	}
+	if len(audit.entries) != 1 || audit.last != last {
+		t.Errorf("the chain went on to %d entries without the file", len(audit.entries))
+	}
+	audit.out = nil
+	if rec := auditedRequest(http.MethodPut, "/book/4?Title=Recorded"); rec.Code != 200 || !strings.Contains(rec.Body.String(), "Recorded") {
+		t.Errorf("PUT after it came back gave %d %s", rec.Code, rec.Body)
+	}
+	if ok, at := audit.verify(); !ok || len(audit.entries) != 2 {
+		t.Errorf("chain broken at %d with %d entries", at, len(audit.entries))
+	}
+}
+
+func TestAuditChainTamperEvident(t *testing.T) {
+	a := newAuditLog()
+	for i := 0; i < 5; i++ {
+		b := NewBook()
+		a.append(AuditEntry{Time: time.Now(), Method: http.MethodPost, BookID: i, After: &b, Outcome: 201})
+	}
+	if ok, _ := a.verify(); !ok {
+		t.Fatal("untouched chain doesn't verify")
+	}
+	a.entries[2].Outcome = 200
+	if ok, at := a.verify(); ok || at != 3 {
+		t.Errorf("edited chain verified %v at %d, expected broken at 3", ok, at)
+	}
+	a.entries[2].Outcome = 201
+	a.entries = append(a.entries[:1], a.entries[2:]...)
+	if ok, at := a.verify(); ok || at != 2 {
+		t.Errorf("chain with a dropped entry verified %v at %d, expected broken at 2", ok, at)
+	}
+}
+
+func TestAuditFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.append(AuditEntry{Time: time.Now(), Method: http.MethodPost, BookID: 1, Outcome: 201})
+	a.append(AuditEntry{Time: time.Now(), Method: http.MethodDelete, BookID: 1, Outcome: 200})
+
+	// picking it back up should continue the same chain
+	a2, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := a2.append(AuditEntry{Time: time.Now(), Method: http.MethodPost, BookID: 2, Outcome: 201})
+	if e.Seq != 3 || e.PrevHash != a.entries[1].Hash {
+		t.Errorf("reopened log started a new chain: %+v", e)
+	}
+	if ok, _ := a2.verify(); !ok {
+		t.Error("reopened chain doesn't verify")
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	audit = newAuditLog()
+	defer func() { audit = nil }()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		audit.append(AuditEntry{Time: start.Add(time.Duration(i) * 24 * time.Hour), BookID: i % 2, Outcome: 200})
+	}
+	rec := httptest.NewRecorder()
+	auditHandler(rec, httptest.NewRequest(http.MethodGet, "/audit?from=2020-Jan-02&to=2020-01-05T00:00:00Z&book=1", nil))
+	var l []AuditEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &l); err != nil {
+		t.Fatal("error unmarshalling audit query. json: ", rec.Body.String())
+	}
+	// Jan 2 and Jan 4 are book 1
+	if len(l) != 2 || l[0].Seq != 2 || l[1].Seq != 4 {
+		t.Errorf("unexpected query result %v", rec.Body.String())
+	}
+
+	// days go the way PublishDate does, in the configured format or ISO 8601
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = defaultConfig()
+	cfg.DateFormat = "02/01/2006"
+	for _, c := range []struct {
+		query string
+		code  int
+		seqs  []int
+	}{
+		{"from=03/01/2020&to=05/01/2020", 200, []int{3, 4}},
+		{"from=2020-01-03&to=20200105", 200, []int{3, 4}},
+		{"from=2020-01&to=2020-01-02", 200, []int{1}},
+		{"from=2020&book=0", 200, []int{1, 3, 5}},
+		{"from=2020-01-05T00:00:00Z", 200, []int{5, 6}},
+		{"from=2020-Jan-02", 400, nil},
+		{"from=last+tuesday", 400, nil},
+	} {
+		rec = httptest.NewRecorder()
+		auditHandler(rec, httptest.NewRequest(http.MethodGet, "/audit?"+c.query, nil))
+		var seqs []int
+		l = nil
+		json.Unmarshal(rec.Body.Bytes(), &l)
+		for _, e := range l {
+			seqs = append(seqs, e.Seq)
+		}
+		if rec.Code != c.code || !reflect.DeepEqual(seqs, c.seqs) {
+			t.Errorf("audit query %s gave %d %v, expected %d %v", c.query, rec.Code, seqs, c.code, c.seqs)
+		}
+	}
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "02/01/2006") {
+		t.Errorf("bad audit query said %s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	auditHandler(rec, httptest.NewRequest(http.MethodGet, "/audit/verify", nil))
+	var v struct{ Valid bool }
+	json.Unmarshal(rec.Body.Bytes(), &v)
+	if !v.Valid {
+		t.Error("verify says the chain is broken: ", rec.Body.String())
+	}
+}
+
+func TestAuditMemoryCap(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = defaultConfig()
+	cfg.AuditMemory = 3
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	out, back := NewBook(), NewBook()
+	out.Status = CheckedOut
+	fill := func(a *auditLog) {
+		for i := 0; i < 8; i++ {
+			e := AuditEntry{Time: start.Add(time.Duration(i) * time.Hour), Method: http.MethodPut, BookID: i % 2, Outcome: 200}
+			// book 0 goes out first thing, and comes back at the end
+			switch i {
+			case 0:
+				e.Before, e.After = &back, &out
+			case 6:
+				e.Before, e.After = &out, &back
+			}
+			a.append(e)
+		}
+	}
+	seqs := func(l []AuditEntry) []int {
+		s := []int{}
+		for _, e := range l {
+			s = append(s, e.Seq)
+		}
+		return s
+	}
+
+	// without a file, only the latest are left
+	a := newAuditLog()
+	fill(a)
+	if len(a.entries) != 3 {
+		t.Errorf("kept %d entries, expected 3", len(a.entries))
+	}
+	if l := a.query(time.Time{}, time.Time{}, -1); !reflect.DeepEqual(seqs(l), []int{6, 7, 8}) {
+		t.Errorf("query gave %v", seqs(l))
+	}
+	if ok, at := a.verify(); !ok {
+		t.Errorf("what's left doesn't verify, at %d", at)
+	}
+	// loans still go back to the start
+	if l := a.loans(); len(l) != 1 || !l[0].Out.Equal(start) || !l[0].Returned.Equal(start.Add(6*time.Hour)) {
+		t.Errorf("loans gave %+v", l)
+	}
+
+	// with one, older entries come from it
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(a)
+	if len(a.entries) != 3 {
+		t.Errorf("kept %d entries, expected 3", len(a.entries))
+	}
+	for _, c := range []struct {
+		from, to time.Time
+		book     int
+		seqs     []int
+	}{
+		{time.Time{}, time.Time{}, -1, []int{1, 2, 3, 4, 5, 6, 7, 8}},
+		{time.Time{}, start.Add(2 * time.Hour), 1, []int{2}},
+		{start.Add(6 * time.Hour), time.Time{}, -1, []int{7, 8}},
+	} {
+		if l := a.query(c.from, c.to, c.book); !reflect.DeepEqual(seqs(l), c.seqs) {
+			t.Errorf("query from %v to %v of %d gave %v, expected %v", c.from, c.to, c.book, seqs(l), c.seqs)
+		}
+	}
+	if ok, at := a.verify(); !ok {
+		t.Errorf("file doesn't verify, at %d", at)
+	}
+	a, err = openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := a.append(AuditEntry{Time: time.Now(), Method: http.MethodDelete, BookID: 1}); e.Seq != 9 || len(a.entries) != 3 {
+		t.Errorf("reopened log went on from %d with %d in memory", e.Seq, len(a.entries))
+	}
+	if l := a.loans(); len(l) != 1 {
+		t.Errorf("reopened loans gave %+v", l)
+	}
+
+	// and tampering with what's only in the file still shows
+	data, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, []byte(strings.Replace(string(data), `"Outcome":200`, `"Outcome":201`, 1)), 0600)
+	if ok, at := a.verify(); ok || at != 1 {
+		t.Errorf("edited file verified %v at %d, expected broken at 1", ok, at)
+	}
+}
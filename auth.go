@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The keys file looks like
+//
+//	{
+//	  "APIKeys": [
+//	    {"Caller": "frontdesk", "Hash": "<hex sha256 of the key>", "NotAfter": "2027-01-01T00:00:00Z"}
+//	  ],
+//	  "TokenKeys": [
+//	    {"ID": "2026-10", "Secret": "<long random string>"}
+//	  ]
+//	}
+//
+// API keys are only ever stored hashed. To rotate, add the new key, hand it
+// out, and put a NotAfter on the old one. Same goes for TokenKeys. New tokens
+// are signed with the last key in the list that is currently valid, and
+// tokens signed with the older ones keep working until those expire.
+type keyFile struct {
+	APIKeys   []apiKey
+	TokenKeys []tokenKey
+}
+
+type apiKey struct {
+	Caller    string
+	Hash      string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+type tokenKey struct {
+	ID        string
+	Secret    string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// zero times mean no limit
+func inWindow(now, notBefore, notAfter time.Time) bool {
+	return !now.Before(notBefore) && (notAfter.IsZero() || now.Before(notAfter))
+}
+
+// the bearer token payload
+type tokenClaims struct {
+	Sub string `json:"sub"`
+	Kid string `json:"kid"`
+	Exp int64  `json:"exp"`
+}
+
+// whoever is making the request
+type Caller struct {
+	Name string
+	// got in with a bearer token, rather than a key or certificate
+	Token bool
+}
+
+type authenticator struct {
+	lock sync.RWMutex
+	path string
+	keys keyFile
+	// hex sha256 -> key, so we never handle the plain key beyond hashing it
+	byHash map[string]apiKey
+}
+
+var auth *authenticator
+
+var errBadToken = errors.New("invalid bearer token")
+
+// when client certificates are how callers are known, and there isn't one
+var errNoClientCert = errors.New("no client certificate")
+
+func loadAuthenticator(path string) (*authenticator, error) {
+	a := &authenticator{path: path}
+	return a, a.reload()
+}
+
+// reload re-reads the keys file. Called at startup and on SIGHUP.
+func (a *authenticator) reload() error {
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var kf keyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return errors.New("parsing " + a.path + ": " + err.Error())
+	}
+	byHash := make(map[string]apiKey)
+	for _, k := range kf.APIKeys {
+		if k.Caller == "" || len(k.Hash) != sha256.Size*2 {
+			return errors.New("parsing " + a.path + ": each API key needs a Caller and a hex SHA-256 Hash")
+		}
+		byHash[strings.ToLower(k.Hash)] = k
+	}
+	for _, k := range kf.TokenKeys {
+		if k.ID == "" || len(k.Secret) < 16 {
+			return errors.New("parsing " + a.path + ": each token key needs an ID and a Secret of at least 16 characters")
+		}
+	}
+	a.lock.Lock()
+	a.keys = kf
+	a.byHash = byHash
+	a.lock.Unlock()
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *authenticator) checkAPIKey(key string, now time.Time) (Caller, bool) {
+	h := hashAPIKey(key)
+	a.lock.RLock()
+	k, there := a.byHash[h]
+	a.lock.RUnlock()
+	// the map lookup already matched, but compare anyway so a near miss
+	// and a far miss look the same
+	if !there || subtle.ConstantTimeCompare([]byte(h), []byte(strings.ToLower(k.Hash))) != 1 {
+		return Caller{}, false
+	}
+	if !inWindow(now, k.NotBefore, k.NotAfter) {
+		return Caller{}, false
+	}
+	return Caller{Name: k.Caller}, true
+}
+
+func signToken(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueToken makes a bearer token for caller, good for ttl.
+func (a *authenticator) issueToken(caller Caller, ttl time.Duration, now time.Time) (string, error) {
+	a.lock.RLock()
+	var key *tokenKey
+	for i := range a.keys.TokenKeys {
+		if inWindow(now, a.keys.TokenKeys[i].NotBefore, a.keys.TokenKeys[i].NotAfter) {
+			key = &a.keys.TokenKeys[i]
+		}
+	}
+	a.lock.RUnlock()
+	if key == nil {
+		return "", errors.New("no token signing key is currently valid")
+	}
+	claims, _ := json.Marshal(tokenClaims{Sub: caller.Name, Kid: key.ID, Exp: now.Add(ttl).Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + signToken(key.Secret, payload), nil
+}
+
+func (a *authenticator) checkToken(token string, now time.Time) (Caller, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return Caller{}, errBadToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Caller{}, errBadToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(raw, &claims); err != nil || claims.Sub == "" {
+		return Caller{}, errBadToken
+	}
+	a.lock.RLock()
+	var key *tokenKey
+	for i := range a.keys.TokenKeys {
+		if a.keys.TokenKeys[i].ID == claims.Kid {
+			key = &a.keys.TokenKeys[i]
+		}
+	}
+	a.lock.RUnlock()
+	if key == nil || !inWindow(now, key.NotBefore, key.NotAfter) {
+		return Caller{}, errBadToken
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(signToken(key.Secret, parts[0]))) {
+		return Caller{}, errBadToken
+	}
+	if now.Unix() >= claims.Exp {
+		return Caller{}, errors.New("bearer token expired")
+	}
+	return Caller{Name: claims.Sub, Token: true}, nil
+}
+
+// identify works out who is calling from either an X-API-Key header, or an
+// Authorization header of "ApiKey <key>" or "Bearer <token>".
+func (a *authenticator) identify(req *http.Request) (Caller, error) {
+	now := time.Now()
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		if c, ok := a.checkAPIKey(key, now); ok {
+			return c, nil
+		}
+		return Caller{}, errors.New("invalid API key")
+	}
+	h := req.Header.Get("Authorization")
+	switch {
+	case h == "":
+		return Caller{}, errors.New("no credentials")
+	case strings.HasPrefix(h, "ApiKey "):
+		if c, ok := a.checkAPIKey(strings.TrimPrefix(h, "ApiKey "), now); ok {
+			return c, nil
+		}
+		return Caller{}, errors.New("invalid API key")
+	case strings.HasPrefix(h, "Bearer "):
+		return a.checkToken(strings.TrimPrefix(h, "Bearer "), now)
+	}
+	return Caller{}, errors.New("unsupported Authorization scheme")
+}
+
+type callerKey struct{}
+
+func withCaller(req *http.Request, c Caller) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), callerKey{}, c))
+}
+
+func callerFrom(req *http.Request) (Caller, bool) {
+	c, ok := req.Context().Value(callerKey{}).(Caller)
+	return c, ok
+}
+
+// authenticate sits in front of a handler and turns away anyone without
+// good credentials. A verified client certificate counts, when the request
+// doesn't carry anything else. With no keys file configured and client
+// certificates off it lets everything through, which is how this thing
+// has always worked. With them on, certificates are the only way in, so
+// a request without one is turned away like one with a bad key.
+func authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if c, ok := certCaller(req); ok && req.Header.Get("X-API-Key") == "" && req.Header.Get("Authorization") == "" {
+			noteCaller(req, c)
+			next(w, withCaller(req, c))
+			return
+		}
+		if auth == nil && cfg.TLSClientAuth == "none" {
+			next(w, req)
+			return
+		}
+		ip := sourceIP(req)
+		if limiter != nil {
+			if retry := limiter.authBlocked(ip); retry > 0 {
+				// audited like any other rejected request, if it changes
+				// anything, and logged either way
+				warn(req, "too many failed authentications", slog.Int("retry_after", retry))
+				w.Header().Set("Retry-After", strconv.Itoa(retry))
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(429)
+				io.WriteString(w, "Too many failed authentications. Try again in "+strconv.Itoa(retry)+" seconds.")
+				return
+			}
+		}
+		c, err := Caller{}, errNoClientCert
+		if auth != nil {
+			c, err = auth.identify(req)
+		}
+		if err != nil {
+			if limiter != nil {
+				limiter.authFailed(ip)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="booklist"`)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(401)
+			io.WriteString(w, "Unauthorized: "+err.Error())
+			return
+		}
+		noteCaller(req, c)
+		next(w, withCaller(req, c))
+	}
+}
+
+// POST /auth/token trades the API key or client certificate that got the
+// caller through authenticate for a bearer token good for an hour. Not a
+// token, though, or one could be traded for the next forever, long after
+// the key it came from had expired or gone.
+func tokenHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(405)
+		return
+	}
+	c, ok := callerFrom(req)
+	if auth == nil || !ok {
+		w.WriteHeader(404)
+		return
+	}
+	if c.Token {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(403)
+		io.WriteString(w, "Forbidden: a token can't be traded for another. Use an API key or client certificate.")
+		return
+	}
+	ttl := time.Hour
+	token, err := auth.issueToken(c, ttl, time.Now())
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(503)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Token     string
+		ExpiresIn int
+	}{token, int(ttl.Seconds())})
+}
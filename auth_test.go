@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeKeyFile(t *testing.T, kf keyFile) string {
+	data, err := json.Marshal(kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testAuthenticator(t *testing.T) *authenticator {
+	now := time.Now()
+	a, err := loadAuthenticator(writeKeyFile(t, keyFile{
+		APIKeys: []apiKey{
+			{Caller: "frontdesk", Hash: hashAPIKey("current-key")},
+			{Caller: "frontdesk", Hash: hashAPIKey("old-key"), NotAfter: now.Add(-time.Minute)},
+		},
+		TokenKeys: []tokenKey{
+			{ID: "old", Secret: "0123456789abcdef-old", NotAfter: now.Add(time.Hour)},
+			{ID: "new", Secret: "0123456789abcdef-new"},
+		}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// runs req through authenticate, returning the code and who the handler
+// thought was calling
+func authRequest(req *http.Request) (int, string) {
+	who := ""
+	rec := httptest.NewRecorder()
+	authenticate(func(w http.ResponseWriter, req *http.Request) {
+		c, _ := callerFrom(req)
+		who = c.Name
+	})(rec, req)
+	return rec.Code, who
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	auth = testAuthenticator(t)
+	defer func() { auth = nil }()
+
+	req := httptest.NewRequest(http.MethodGet, "/book/1", nil)
+	if code, _ := authRequest(req); code != 401 {
+		t.Errorf("request with no credentials returned code %d, expected 401", code)
+	}
+	req.Header.Set("X-API-Key", "current-key")
+	if code, who := authRequest(req); code != 200 || who != "frontdesk" {
+		t.Errorf("request with good key returned code %d caller %q, expected 200 frontdesk", code, who)
+	}
+	req.Header.Set("X-API-Key", "old-key")
+	if code, _ := authRequest(req); code != 401 {
+		t.Errorf("request with expired key returned code %d, expected 401", code)
+	}
+	req.Header.Del("X-API-Key")
+	req.Header.Set("Authorization", "ApiKey current-key")
+	if code, who := authRequest(req); code != 200 || who != "frontdesk" {
+		t.Errorf("request with good key returned code %d caller %q, expected 200 frontdesk", code, who)
+	}
+	req.Header.Set("Authorization", "ApiKey guessing")
+	if code, _ := authRequest(req); code != 401 {
+		t.Errorf("request with bad key returned code %d, expected 401", code)
+	}
+}
+
+func TestBearerTokenAuth(t *testing.T) {
+	auth = testAuthenticator(t)
+	defer func() { auth = nil }()
+
+	now := time.Now()
+	token, err := auth.issueToken(Caller{Name: "cataloger"}, time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// should be signed with the newest key
+	raw, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	var claims tokenClaims
+	json.Unmarshal(raw, &claims)
+	if claims.Kid != "new" {
+		t.Errorf("token signed with key %q, expected new", claims.Kid)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/book/1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if code, who := authRequest(req); code != 200 || who != "cataloger" {
+		t.Errorf("request with good token returned code %d caller %q, expected 200 cataloger", code, who)
+	}
+
+	// swap in a different subject and keep the signature
+	forged, _ := json.Marshal(tokenClaims{Sub: "admin", Kid: "new", Exp: now.Add(time.Hour).Unix()})
+	req.Header.Set("Authorization", "Bearer "+base64.RawURLEncoding.EncodeToString(forged)+"."+strings.Split(token, ".")[1])
+	if code, _ := authRequest(req); code != 401 {
+		t.Errorf("request with forged token returned code %d, expected 401", code)
+	}
+
+	expired, _ := auth.issueToken(Caller{Name: "cataloger"}, -time.Minute, now)
+	req.Header.Set("Authorization", "Bearer "+expired)
+	if code, _ := authRequest(req); code != 401 {
+		t.Errorf("request with expired token returned code %d, expected 401", code)
+	}
+
+	// a token from the rotated-out key is still good until the key expires
+	old, _ := json.Marshal(tokenClaims{Sub: "clerk", Kid: "old", Exp: now.Add(time.Hour).Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(old)
+	req.Header.Set("Authorization", "Bearer "+payload+"."+signToken("0123456789abcdef-old", payload))
+	if code, who := authRequest(req); code != 200 || who != "clerk" {
+		t.Errorf("request with old key token returned code %d caller %q, expected 200 clerk", code, who)
+	}
+	if _, err := auth.checkToken(payload+"."+signToken("0123456789abcdef-old", payload), now.Add(2*time.Hour)); err == nil {
+		t.Error("token from expired signing key accepted")
+	}
+}
+
+func TestTokenHandler(t *testing.T) {
+	auth = testAuthenticator(t)
+	defer func() { auth = nil }()
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/token", nil)
+	req.Header.Set("X-API-Key", "current-key")
+	rec := httptest.NewRecorder()
+	authenticate(tokenHandler)(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("getting token returned code %d, expected 200", rec.Code)
+	}
+	var resp struct{ Token string }
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	c, err := auth.checkToken(resp.Token, time.Now())
+	if err != nil || c.Name != "frontdesk" {
+		t.Errorf("issued token didn't check out: %v %v", c, err)
+	}
+
+	// a token doesn't get another, so it can't outlive its key
+	req = httptest.NewRequest(http.MethodPost, "/auth/token", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.Token)
+	rec = httptest.NewRecorder()
+	authenticate(tokenHandler)(rec, req)
+	if rec.Code != 403 || strings.Contains(rec.Body.String(), "Token") {
+		t.Errorf("trading a token gave %d %s, expected 403", rec.Code, rec.Body)
+	}
+}
+
+func TestKeyFileReload(t *testing.T) {
+	path := writeKeyFile(t, keyFile{APIKeys: []apiKey{{Caller: "a", Hash: hashAPIKey("first")}}})
+	a, err := loadAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(keyFile{APIKeys: []apiKey{{Caller: "a", Hash: hashAPIKey("second")}}})
+	ioutil.WriteFile(path, data, 0600)
+	if err := a.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.checkAPIKey("first", time.Now()); ok {
+		t.Error("removed key still accepted after reload")
+	}
+	if _, ok := a.checkAPIKey("second", time.Now()); !ok {
+		t.Error("new key not accepted after reload")
+	}
+
+	ioutil.WriteFile(path, []byte(`{"APIKeys":[{"Caller":"a","Hash":"plaintext"}]}`), 0600)
+	if err := a.reload(); err == nil {
+		t.Error("reload accepted an unhashed key")
+	}
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 )
 
@@ -18,141 +20,335 @@ const (
 	CheckedIn  Status = iota
 	CheckedOut Status = iota
 )
+
+func (s Status) String() string {
+	if s == CheckedOut {
+		return "CheckedOut"
+	}
+	return "CheckedIn"
+}
+
+// the default date format. cfg.DateFormat is what's actually used.
 const TIME_FMT string = "2006-Jan-02"
 
 type Book struct {
 	Title, Author, Publisher string
 	PublishDate              time.Time
-	Rating                   int
-	Status                   Status
+	// how much of PublishDate is known. See dates.go.
+	PublishPrecision DatePrecision `json:",omitempty" xml:",omitempty"`
+	Rating           int
+	Status           Status
+	// the rest is optional, and left out when it's empty. See metadata.go.
+	Edition     string   `json:",omitempty" xml:",omitempty"`
+	Language    string   `json:",omitempty" xml:",omitempty"`
+	Pages       int      `json:",omitempty" xml:",omitempty"`
+	Format      string   `json:",omitempty" xml:",omitempty"`
+	Series      string   `json:",omitempty" xml:",omitempty"`
+	Volume      int      `json:",omitempty" xml:",omitempty"`
+	Subjects    []string `json:",omitempty" xml:"-"`
+	Description string   `json:",omitempty" xml:",omitempty"`
+	Cover       string   `json:",omitempty" xml:",omitempty"`
+	// free-form, for grouping books. See tags.go.
+	Tags []string `json:",omitempty" xml:"-"`
+	// what readers make of it: the mean of the published ratings in their
+	// reviews, and how many there are. Worked out from the reviews, never
+	// set. See reviews.go.
+	AverageRating float64 `json:",omitempty" xml:",omitempty"`
+	RatingCount   int     `json:",omitempty" xml:",omitempty"`
 }
 
-var bookList map[int]Book
-var listLock *sync.Mutex
-
 func NewBook() Book {
-	d, err := time.Parse(TIME_FMT, time.Now().Format(TIME_FMT))
+	d, err := time.Parse(cfg.DateFormat, time.Now().Format(cfg.DateFormat))
 	if err != nil { // this should never happen...
 		panic(err)
 	}
 	return Book{
-		Author:      "Unknown",
-		Title:       "Untitled",
-		Publisher:   "Not Published",
+		Author:      cfg.DefaultAuthor,
+		Title:       cfg.DefaultTitle,
+		Publisher:   cfg.DefaultPublisher,
 		PublishDate: d,
-		Rating:      2,
-		Status:      CheckedIn}
+		Rating:      cfg.DefaultRating,
+		Status:      cfg.DefaultStatus}
 }
 
 func main() {
 
-	bookList = make(map[int]Book)
-	listLock = &sync.Mutex{}
+	var err error
+	cfg, err = loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err = openStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	covers, err = openCovers(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	collections, err = openCollections(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reviews, err = openReviews(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hooks = newWebhookDispatcher()
+
+	if cfg.AuthFile != "" {
+		auth, err = loadAuthenticator(cfg.AuthFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Println("No auth.file configured. Running without authentication.")
+	}
+	if cfg.AuditFile != "" {
+		audit, err = openAuditLog(cfg.AuditFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		audit = newAuditLog()
+	}
+	if cfg.PolicyFile != "" {
+		policy.path = cfg.PolicyFile
+		if err := policy.reload(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.RateLimitFile != "" {
+		limiter, err = loadRateLimiter(cfg.RateLimitFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		// no limits, except on getting credentials wrong
+		limiter, _ = newRateLimiter(nil)
+	}
 
-	http.HandleFunc("/book/", bookHandler)
+	accessLog = newAccessLog(cfg.AccessLog)
+	tracer = newTracer(cfg.TraceExport, cfg.TraceEndpoint, 5*time.Second)
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// /book/ is v1 too. The versions share the /book/ rate limits.
+	for _, route := range []string{"/book/", "/v1/book/", "/v2/book/"} {
+		http.HandleFunc(route, instrumented(route, traced(route, logged(route, readBody(audited(authenticate(rateLimited("/book/", authorize(bookActions, bookHandler)))))))))
+	}
+	http.HandleFunc("/tags", instrumented("/tags", traced("/tags", logged("/tags", authenticate(rateLimited("/tags", authorize(readActions, tagsHandler)))))))
+	http.HandleFunc("/collections/", instrumented("/collections/", traced("/collections/", logged("/collections/", audited(authenticate(rateLimited("/collections/", authorize(collectionActions, collectionsHandler))))))))
+	http.HandleFunc("/reviews/", instrumented("/reviews/", traced("/reviews/", logged("/reviews/", audited(authenticate(rateLimited("/reviews/", authorize(moderateActions, reviewsHandler))))))))
+	http.HandleFunc("/audit", instrumented("/audit", traced("/audit", logged("/audit", authenticate(rateLimited("/audit", authorize(adminActions, auditHandler)))))))
+	http.HandleFunc("/audit/", instrumented("/audit/", traced("/audit/", logged("/audit/", authenticate(rateLimited("/audit/", authorize(adminActions, auditHandler)))))))
+	http.HandleFunc("/webhooks/", instrumented("/webhooks/", traced("/webhooks/", logged("/webhooks/", authenticate(rateLimited("/webhooks/", authorize(adminActions, webhookHandler)))))))
+	http.HandleFunc("/auth/token", instrumented("/auth/token", traced("/auth/token", logged("/auth/token", authenticate(rateLimited("/auth/token", tokenHandler))))))
+	http.HandleFunc("/"+grpcService+"/", grpcHandler(func(route string, m *grpcMethod, h http.HandlerFunc) http.HandlerFunc {
+		h = authenticate(rateLimited(route, authorize(m.actions, h)))
+		if m.mutates {
+			h = audited(h)
+		}
+		return instrumented(route, traced(route, logged(route, h)))
+	}))
+	http.HandleFunc("/graphql", instrumented("/graphql", traced("/graphql", logged("/graphql", graphqlHandler(func(mutates bool, h http.HandlerFunc) http.HandlerFunc {
+		h = authenticate(rateLimited("/graphql", authorize(graphqlActions, h)))
+		if mutates {
+			h = audited(h)
+		}
+		return h
+	})))))
+	http.HandleFunc("/ui/", instrumented("/ui/", traced("/ui/", logged("/ui/", uiSession(audited(authenticate(rateLimited("/ui/", authorize(uiActions, uiHandler)))))))))
+	http.HandleFunc("/ui/login", instrumented("/ui/login", traced("/ui/login", logged("/ui/login", rateLimited("/ui/login", uiLogin)))))
+	// these stay open, for the container runtime, the scraper and the SDK
+	// generators
+	http.HandleFunc("/healthz", healthHandler)
+	http.HandleFunc("/readyz", readyHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/openapi.json", openAPIHandler)
+
+	srv := newServer(cfg, nil)
+	if cfg.TLSCert != "" {
+		certs, err = newCertReloader(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = certs.tlsConfig()
+	}
+	go reloadOnHangup()
+	stopped := make(chan struct{})
+	go func() {
+		waitForStop()
+		log.Println("Shutting down.")
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		drain(ctx, srv)
+		close(stopped)
+	}()
+	if certs != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+// SIGHUP re-reads the keys, policy and certificate files, so keys and
+// certificates can be rotated and roles changed without a restart
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if auth != nil {
+			if err := auth.reload(); err != nil {
+				log.Println("reloading keys:", err)
+			}
+		}
+		if err := policy.reload(); err != nil {
+			log.Println("reloading policy:", err)
+		}
+		if certs != nil {
+			if err := certs.reload(); err != nil {
+				log.Println("reloading certificates:", err)
+			}
+		}
+	}
 }
 
+// bookHandler is every version of /book/. See router.go.
 func bookHandler(w http.ResponseWriter, req *http.Request) {
-	switch req.Method {
-	case http.MethodGet:
-		getBook(w, req)
-	case http.MethodPost:
-		createBook(w, req)
-	case http.MethodPut:
-		updateBook(w, req)
-	case http.MethodDelete:
-		deleteBook(w, req)
-	default:
+	req, ok := readBookRequest(w, req)
+	if !ok {
+		return
 	}
+	books.ServeHTTP(w, req)
 }
 
+// getIDFromPath is the {id} in a path to a book
 func getIDFromPath(p string) (int, error) {
-	p = strings.TrimPrefix(p, "/")
-	p = strings.TrimPrefix(p, "book")
-	p = strings.TrimPrefix(p, "/")
-	return strconv.Atoi(p)
+	return strconv.Atoi(books.param(p, "id"))
+}
+
+// for when the store itself falls over
+func storageError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(500)
+	io.WriteString(w, "Storage error: "+err.Error())
 }
 
 func deleteBook(w http.ResponseWriter, req *http.Request) {
-	path := req.URL.Path
-	id, err := getIDFromPath(path)
+	id, err := bookID(req)
 	if err != nil {
 		w.WriteHeader(404)
 		return
 	}
-	listLock.Lock()
-	book, there := bookList[id]
-	if !there {
-		listLock.Unlock()
+	book, err := storeFor(req).Delete(id)
+	if err == errNotFound {
 		w.WriteHeader(404)
 		return
+	} else if err != nil {
+		storageError(w, err)
+		return
 	}
-	delete(bookList, id)
-	listLock.Unlock()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(book) // should automagically set status code to 200 OK
+	forgetCover(id)
+	forgetBook(id)
+	forgetReviews(id)
+	auditBooks(req, id, &book, nil)
+	publish(EventDeleted, id, book)
+	writeBook(w, req, 200, id, book)
 }
 func createBook(w http.ResponseWriter, req *http.Request) {
-	path := req.URL.Path
-	id, err := getIDFromPath(path)
+	id, err := bookID(req)
 	if err != nil {
 		w.WriteHeader(404)
 		return
 	}
-	listLock.Lock()
-	book, there := bookList[id]
-	if there {
-		listLock.Unlock()
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(409) // conflict
-		json.NewEncoder(w).Encode(book)
+	book := NewBook()
+	// the body can fill in some of it
+	if kvPairs := requestChanges(req); kvPairs != nil {
+		valid, message := validateQuery(kvPairs)
+		if !valid {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(400)
+			io.WriteString(w, message)
+			return
+		}
+		// it's checked in already
+		if kvPairs.Get("Status") == "CheckedIn" {
+			kvPairs.Del("Status")
+		}
+		statusEvent := ""
+		changeBook(kvPairs, &statusEvent)(&book)
+	}
+	book, err = storeFor(req).Create(id, book)
+	if err == errExists {
+		auditBooks(req, id, &book, &book)
+		writeBook(w, req, 409, id, book) // conflict
+		return
+	} else if err != nil {
+		storageError(w, err)
 		return
 	}
-	book = NewBook()
-	bookList[id] = book
-	listLock.Unlock()
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(201) // created
-	json.NewEncoder(w).Encode(book)
+	auditBooks(req, id, nil, &book)
+	publish(EventCreated, id, book)
+	writeBook(w, req, 201, id, book) // created
 }
 func getBook(w http.ResponseWriter, req *http.Request) {
-	path := req.URL.Path
-	id, err := getIDFromPath(path)
+	id, err := bookID(req)
 	if err != nil {
 		w.WriteHeader(404)
 		return
 	}
-	listLock.Lock()
-	book, there := bookList[id]
-	listLock.Unlock()
-	if !there {
+	book, err := storeFor(req).Get(id)
+	if err == errNotFound {
 		w.WriteHeader(404)
 		return
+	} else if err != nil {
+		storageError(w, err)
+		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(book)
+	writeBook(w, req, 200, id, book)
+}
+
+// GET /book/ is every book, as an object keyed by ID
+func listBooks(w http.ResponseWriter, req *http.Request) {
+	match, message := bookFilter(req)
+	if match == nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, message)
+		return
+	}
+	books, err := storeFor(req).List()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	for id, b := range books {
+		if !match(b) {
+			delete(books, id)
+		}
+	}
+	writeBooks(w, req, books)
 }
 func updateBook(w http.ResponseWriter, req *http.Request) {
-	path := req.URL.Path
-	id, err := getIDFromPath(path)
+	id, err := bookID(req)
 	if err != nil {
 		w.WriteHeader(404)
 		return
 	}
+	kvPairs := requestChanges(req)
 	// update with no query is meaningless
-	if len(req.URL.RawQuery) == 0 {
+	if kvPairs == nil {
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(400)
 		io.WriteString(w, "No query in update. Nothing to do.")
 		return
-	}
-	kvPairs, err := url.ParseQuery(req.URL.RawQuery)
-	if err != nil {
+	} else if len(kvPairs) == 0 && len(req.URL.RawQuery) == 0 {
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(400)
-		io.WriteString(w, "Error parsing query: "+err.Error())
+		io.WriteString(w, "No changes in the body. Nothing to do.")
 		return
 	}
 	valid, message := validateQuery(kvPairs)
@@ -162,55 +358,111 @@ func updateBook(w http.ResponseWriter, req *http.Request) {
 		io.WriteString(w, message)
 		return
 	}
-	listLock.Lock()
-	book, there := bookList[id]
-	if !there {
-		listLock.Unlock()
+	statusEvent := ""
+	change := changeBook(kvPairs, &statusEvent)
+	if changesFromBody(req) {
+		change = changeBookFromBody(kvPairs, &statusEvent)
+	}
+	before, book, err := storeFor(req).Update(id, change)
+	switch err {
+	case nil:
+	case errNotFound:
 		w.WriteHeader(404)
 		return
+	case errConflict:
+		auditBooks(req, id, &before, &before)
+		w.WriteHeader(409)
+		return
+	default:
+		storageError(w, err)
+		return
 	}
-	// check status first, to release lock quickly on match
-	v, there := kvPairs["Status"]
-	if there {
-		if v[0] == "CheckedIn" && book.Status == CheckedIn || v[0] == "CheckedOut" && book.Status == CheckedOut {
-			listLock.Unlock()
-			w.WriteHeader(409)
-			return
-		}
-		if v[0] == "CheckedIn" {
-			book.Status = CheckedIn
-		} else {
-			book.Status = CheckedOut
+	auditBooks(req, id, &before, &book)
+	publishUpdate(id, book, kvPairs, statusEvent)
+	writeBook(w, req, 200, id, book)
+	return
+}
+
+// changeBookFromBody is changeBook for changes sent in a body. A body is
+// usually the whole book, often just as it was got, so a Status it already
+// has is left alone rather than being a 409.
+func changeBookFromBody(kvPairs url.Values, statusEvent *string) func(*Book) error {
+	return func(book *Book) error {
+		if v := kvPairs["Status"]; len(v) == 1 && isStatus(v[0], book.Status) {
+			rest := url.Values{}
+			for k, v := range kvPairs {
+				if k != "Status" {
+					rest[k] = v
+				}
+			}
+			return changeBook(rest, statusEvent)(book)
 		}
+		return changeBook(kvPairs, statusEvent)(book)
 	}
-	for k, v := range kvPairs {
-		switch k {
-		case "Title":
-			book.Title = v[0]
-		case "Author":
-			book.Author = v[0]
-		case "Publisher":
-			book.Publisher = v[0]
-		case "PublishDate":
-			// already checked for parse error in validateQuery
-			d, _ := time.Parse(TIME_FMT, v[0])
-			book.PublishDate = d
-		case "Rating":
-			// already checked for parse error in validateQuery
-			r, _ := strconv.Atoi(v[0])
-			book.Rating = r
+}
+
+// isStatus says whether v, as it is in a query, is s
+func isStatus(v string, s Status) bool {
+	return v == "CheckedIn" && s == CheckedIn || v == "CheckedOut" && s == CheckedOut
+}
+
+// changeBook is what an update does to the book, given a query that got
+// past validateQuery. If it checks the book in or out, it says which in
+// statusEvent.
+func changeBook(kvPairs url.Values, statusEvent *string) func(*Book) error {
+	return func(book *Book) error {
+		// check status first, to bail quickly on match
+		v, there := kvPairs["Status"]
+		if there {
+			if isStatus(v[0], book.Status) {
+				return errConflict
+			}
+			if v[0] == "CheckedIn" {
+				book.Status = CheckedIn
+				*statusEvent = EventReturned
+			} else {
+				book.Status = CheckedOut
+				*statusEvent = EventCheckedOut
+			}
+		}
+		for k, v := range kvPairs {
+			switch k {
+			case "Title":
+				book.Title = v[0]
+			case "Author":
+				book.Author = v[0]
+			case "Publisher":
+				book.Publisher = v[0]
+			case "PublishDate":
+				// already checked for parse error in validateQuery
+				book.PublishDate, book.PublishPrecision, _ = parsePublishDate(v[0])
+			case "Rating":
+				// already checked for parse error in validateQuery
+				r, _ := strconv.Atoi(v[0])
+				book.Rating = r
+			default:
+				changeMetadata(book, k, v)
+			}
 		}
+		return nil
+	}
+}
+
+// publishUpdate sends out the events for an update that went through
+func publishUpdate(id int, book Book, kvPairs url.Values, statusEvent string) {
+	if statusEvent != "" {
+		publish(statusEvent, id, book)
+	}
+	// anything besides Status is a metadata change
+	if len(kvPairs) > 1 || statusEvent == "" {
+		publish(EventUpdated, id, book)
 	}
-	bookList[id] = book
-	listLock.Unlock()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(book) // sets status 200
-	return
 }
 func validateQuery(kvPairs map[string][]string) (valid bool, message string) {
 	valid = true
 	message = ""
 	oneValMessage := "Each query key must have exactly one value.\n"
+	ratingRange := "from " + strconv.Itoa(cfg.MinRating) + " to " + strconv.Itoa(cfg.MaxRating)
 	for k, v := range kvPairs {
 		switch k {
 		case "Title":
@@ -233,9 +485,9 @@ func validateQuery(kvPairs map[string][]string) (valid bool, message string) {
 				message = message + oneValMessage
 				valid = false
 			} else {
-				_, err := time.Parse(TIME_FMT, v[0])
+				_, _, err := parsePublishDate(v[0])
 				if err != nil {
-					message = message + "Error parsing PublishDate. Please use the format " + TIME_FMT + "\n"
+					message = message + "Error parsing PublishDate. Please use the format " + cfg.DateFormat + " or ISO 8601 (YYYY-MM-DD), or YYYY-MM or YYYY when the day isn't known.\n"
 					valid = false
 				}
 			}
@@ -246,10 +498,10 @@ func validateQuery(kvPairs map[string][]string) (valid bool, message string) {
 			} else {
 				i, err := strconv.Atoi(v[0])
 				if err != nil {
-					message = message + "Error parsing Rating. Value must be a decimal digit from 1 to 3.\n"
+					message = message + "Error parsing Rating. Value must be a whole number " + ratingRange + ".\n"
 					valid = false
-				} else if i < 1 || i > 3 {
-					message = message + "Invalid Rating. Value must be a decimal digit from 1 to 3.\n"
+				} else if i < cfg.MinRating || i > cfg.MaxRating {
+					message = message + "Invalid Rating. Value must be a whole number " + ratingRange + ".\n"
 					valid = false
 				}
 			}
@@ -262,8 +514,12 @@ func validateQuery(kvPairs map[string][]string) (valid bool, message string) {
 				valid = false
 			}
 		default:
-			message = message + "Invalid query key " + k + ". Valid keys are Title, Author, Publisher, PublishDate, Rating, and Status.\n"
-			valid = false
+			known, m := validateMetadata(k, v)
+			if !known {
+				m = "Invalid query key " + k + ". Valid keys are " + strings.Join(queryKeys[:len(queryKeys)-1], ", ") + ", and " + queryKeys[len(queryKeys)-1] + ".\n"
+			}
+			message = message + m
+			valid = valid && m == ""
 		}
 	}
 	return valid, message
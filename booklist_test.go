@@ -18,7 +18,7 @@ import (
 const LOCAL_BASE = "http://localhost:8080"
 
 func TestMain(m *testing.M) {
-	cmd := exec.Command("go", "build", "-o", "./booklist", "booklist.go")
+	cmd := exec.Command("go", "build", "-o", "./booklist")
 	if err := cmd.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -30,8 +30,21 @@ func TestMain(m *testing.M) {
 	if err := cmd.Run(); err != nil {
 		log.Fatal(err)
 	}
-	// wait 1 sec for it to start
-	time.Sleep(time.Second)
+	// wait for it to say it's ready, rather than hoping a second is enough
+	ready := false
+	for start := time.Now(); !ready && time.Since(start) < 30*time.Second; {
+		resp, err := http.Get(LOCAL_BASE + "/readyz")
+		if err == nil {
+			ready = resp.StatusCode == 200
+			resp.Body.Close()
+		}
+		if !ready {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if !ready {
+		log.Fatal("booklist container never became ready")
+	}
 	exitCode := m.Run()
 
 	// clean up
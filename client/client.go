@@ -0,0 +1,371 @@
+// Package client talks to a booklist server over its HTTP API, so nobody has
+// to write sendGet and sendPut again.
+//
+//	c := client.New("http://localhost:8080")
+//	c.APIKey = "..."
+//	book, err := c.GetBook(ctx, 1)
+//	var nf *client.NotFoundError
+//	if errors.As(err, &nf) {
+//		...
+//	}
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Status int
+
+const (
+	CheckedIn  Status = iota
+	CheckedOut Status = iota
+)
+
+func (s Status) String() string {
+	if s == CheckedOut {
+		return "CheckedOut"
+	}
+	return "CheckedIn"
+}
+
+// Book is the same as the server's. PublishPrecision is "month" or "year"
+// when that's all that's known of PublishDate, which is then the first day
+// of it, and empty when the day is known.
+type Book struct {
+	Title, Author, Publisher string
+	PublishDate              time.Time
+	PublishPrecision         string `json:",omitempty"`
+	Rating                   int
+	Status                   Status
+	// the rest are empty, or 0, when they aren't known. Language is a BCP
+	// 47 tag, Format hardcover, paperback, ebook or audio, and Cover an
+	// http or https URL.
+	Edition, Language string   `json:",omitempty"`
+	Pages             int      `json:",omitempty"`
+	Format, Series    string   `json:",omitempty"`
+	Volume            int      `json:",omitempty"`
+	Subjects          []string `json:",omitempty"`
+	Description       string   `json:",omitempty"`
+	Cover             string   `json:",omitempty"`
+	Tags              []string `json:",omitempty"`
+	// from readers' reviews, read only
+	AverageRating float64 `json:",omitempty"`
+	RatingCount   int     `json:",omitempty"`
+}
+
+// Changes is what UpdateBook sends. Zero values are left alone, so a book
+// can't be given an empty title this way. PublishPrecision is as in Book.
+type Changes struct {
+	Title, Author, Publisher string
+	PublishDate              time.Time
+	PublishPrecision         string
+	Rating                   int
+	Edition, Language        string
+	Pages                    int
+	Format, Series           string
+	Volume                   int
+	// replaces all of them
+	Subjects           []string
+	Description, Cover string
+	// so does this
+	Tags []string
+}
+
+// FormatDate writes d in layout, or as YYYY-MM or YYYY if that's all
+// precision says is known.
+func FormatDate(d time.Time, precision, layout string) string {
+	switch precision {
+	case "year":
+		return d.Format("2006")
+	case "month":
+		return d.Format("2006-01")
+	}
+	return d.Format(layout)
+}
+
+// ParseDate reads a day in layout, or a YYYY-MM or YYYY, and says which it
+// was the way Book does.
+func ParseDate(v, layout string) (time.Time, string, error) {
+	if d, err := time.Parse(layout, v); err == nil {
+		return d, "", nil
+	}
+	if len(v) == len("2006-01") {
+		if d, err := time.Parse("2006-01", v); err == nil {
+			return d, "month", nil
+		}
+	}
+	if len(v) == len("2006") {
+		if d, err := time.Parse("2006", v); err == nil {
+			return d, "year", nil
+		}
+	}
+	return time.Time{}, "", errors.New("a date must look like " + layout + ", YYYY-MM or YYYY, not " + strconv.Quote(v))
+}
+
+func (c Changes) query(dateFormat string) url.Values {
+	q := url.Values{}
+	if c.Title != "" {
+		q.Set("Title", c.Title)
+	}
+	if c.Author != "" {
+		q.Set("Author", c.Author)
+	}
+	if c.Publisher != "" {
+		q.Set("Publisher", c.Publisher)
+	}
+	if !c.PublishDate.IsZero() {
+		q.Set("PublishDate", FormatDate(c.PublishDate, c.PublishPrecision, dateFormat))
+	}
+	if c.Rating != 0 {
+		q.Set("Rating", strconv.Itoa(c.Rating))
+	}
+	for key, v := range map[string]string{"Edition": c.Edition, "Language": c.Language, "Format": c.Format,
+		"Series": c.Series, "Description": c.Description, "Cover": c.Cover} {
+		if v != "" {
+			q.Set(key, v)
+		}
+	}
+	if c.Pages != 0 {
+		q.Set("Pages", strconv.Itoa(c.Pages))
+	}
+	if c.Volume != 0 {
+		q.Set("Volume", strconv.Itoa(c.Volume))
+	}
+	if len(c.Subjects) > 0 {
+		q["Subjects"] = c.Subjects
+	}
+	if len(c.Tags) > 0 {
+		q["Tags"] = c.Tags
+	}
+	return q
+}
+
+// APIError is any answer from the server that wasn't a success. The 400,
+// 404 and 409 cases come back as the types below, which embed one of these.
+type APIError struct {
+	StatusCode int
+	// the server's message, without the request ID on the end
+	Message   string
+	RequestID string
+}
+
+func (e *APIError) Error() string {
+	s := "booklist: " + strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode)
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	if e.RequestID != "" {
+		s += " (request " + e.RequestID + ")"
+	}
+	return s
+}
+
+// 404: no such book
+type NotFoundError struct {
+	*APIError
+	ID int
+}
+
+// 409: the book already exists (from CreateBook, with the book that's there
+// in Book), or is already checked in or out (from Checkout and Return)
+type ConflictError struct {
+	*APIError
+	ID   int
+	Book *Book
+}
+
+// 400: the server didn't like the update. Message says why.
+type BadRequestError struct {
+	*APIError
+}
+
+// Client is safe to use from more than one goroutine, as long as nobody
+// changes the fields while it's in use.
+type Client struct {
+	// where the server is, e.g. http://localhost:8080
+	BaseURL    string
+	HTTPClient *http.Client
+	// sent as X-API-Key, or as a bearer token, if set
+	APIKey, Token string
+	// the server's date_format. Only matters for PublishDate in Changes.
+	DateFormat string
+	// how many times to try again when the server says it's busy (429 or
+	// 503) or the request never got a connection. Reads are also tried
+	// again after a 502 or 504 or any other network error. Creates, updates
+	// and deletes aren't, since they may have been done already, and the
+	// second go would get a 409, or a 404 for a delete.
+	Retries int
+	// wait before the first retry. It doubles after each one, unless the
+	// server says how long in Retry-After.
+	Backoff time.Duration
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+		DateFormat: "2006-Jan-02",
+		Retries:    3,
+		Backoff:    200 * time.Millisecond}
+}
+
+func (c *Client) GetBook(ctx context.Context, id int) (Book, error) {
+	var b Book
+	return b, c.do(ctx, http.MethodGet, id, nil, &b)
+}
+
+// CreateBook makes book id with the server's defaults. Use UpdateBook to
+// fill it in.
+func (c *Client) CreateBook(ctx context.Context, id int) (Book, error) {
+	var b Book
+	return b, c.do(ctx, http.MethodPost, id, nil, &b)
+}
+
+func (c *Client) UpdateBook(ctx context.Context, id int, ch Changes) (Book, error) {
+	var b Book
+	return b, c.do(ctx, http.MethodPut, id, ch.query(c.dateFormat()), &b)
+}
+
+// DeleteBook returns the book as it was.
+func (c *Client) DeleteBook(ctx context.Context, id int) (Book, error) {
+	var b Book
+	return b, c.do(ctx, http.MethodDelete, id, nil, &b)
+}
+
+// ListBooks is every book, by ID.
+func (c *Client) ListBooks(ctx context.Context) (map[int]Book, error) {
+	var l map[int]Book
+	return l, c.do(ctx, http.MethodGet, -1, nil, &l)
+}
+
+// Checkout returns a *ConflictError if the book is already out.
+func (c *Client) Checkout(ctx context.Context, id int) (Book, error) {
+	var b Book
+	return b, c.do(ctx, http.MethodPut, id, url.Values{"Status": {CheckedOut.String()}}, &b)
+}
+
+// Return returns a *ConflictError if the book is already in.
+func (c *Client) Return(ctx context.Context, id int) (Book, error) {
+	var b Book
+	return b, c.do(ctx, http.MethodPut, id, url.Values{"Status": {CheckedIn.String()}}, &b)
+}
+
+func (c *Client) dateFormat() string {
+	if c.DateFormat == "" {
+		return "2006-Jan-02"
+	}
+	return c.DateFormat
+}
+
+// do sends the request for book id (or the list, if id < 0), retrying as
+// described on Client, and decodes a success into out.
+func (c *Client) do(ctx context.Context, method string, id int, query url.Values, out interface{}) error {
+	target := c.BaseURL + "/book/"
+	if id >= 0 {
+		target += strconv.Itoa(id)
+	}
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	wait := c.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target, nil)
+		if err != nil {
+			return err
+		}
+		if c.APIKey != "" {
+			req.Header.Set("X-API-Key", c.APIKey)
+		}
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			if ctx.Err() != nil || attempt >= c.Retries || !retryable(method, err) {
+				return err
+			}
+		} else {
+			body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 32<<20))
+			resp.Body.Close()
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return json.Unmarshal(body, out)
+			}
+			if attempt >= c.Retries || !busy(method, resp.StatusCode) {
+				return apiError(resp, body, id)
+			}
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+				wait = time.Duration(s) * time.Second
+			}
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		wait *= 2
+	}
+}
+
+// busy says whether an answer with code means method can go again. 429
+// and 503 mean the server turned it away, so it wasn't done; 502 and 504
+// mean something in between gave up, maybe after it was.
+func busy(method string, code int) bool {
+	if code == 502 || code == 504 {
+		return method == http.MethodGet
+	}
+	return code == 429 || code == 503
+}
+
+// retryable says whether a request that failed with err can safely go
+// again. Reads can. Anything else only if it never got a connection.
+func retryable(method string, err error) bool {
+	if method == http.MethodGet {
+		return true
+	}
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+func apiError(resp *http.Response, body []byte, id int) error {
+	e := &APIError{StatusCode: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID")}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		msg := string(body)
+		if e.RequestID != "" {
+			msg = strings.TrimSuffix(msg, "\nRequest ID: "+e.RequestID+"\n")
+		}
+		e.Message = strings.TrimSpace(msg)
+	}
+	switch resp.StatusCode {
+	case 400:
+		return &BadRequestError{e}
+	case 404:
+		return &NotFoundError{e, id}
+	case 409:
+		ce := &ConflictError{APIError: e, ID: id}
+		var b Book
+		if json.Unmarshal(body, &b) == nil {
+			ce.Book = &b
+		}
+		return ce
+	}
+	return e
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTypedErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Request-ID", "r1")
+		switch req.Method {
+		case http.MethodGet:
+			w.WriteHeader(404)
+		case http.MethodPost:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(409)
+			io.WriteString(w, `{"Title":"Already Here","Rating":2}`)
+		case http.MethodPut:
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(400)
+			io.WriteString(w, "Invalid Rating. Value must be a whole number from 1 to 3.\n\nRequest ID: r1\n")
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(403)
+			io.WriteString(w, "Forbidden: needs delete\nRequest ID: r1\n")
+		}
+	}))
+	defer srv.Close()
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	_, err := c.GetBook(ctx, 5)
+	var nf *NotFoundError
+	if !errors.As(err, &nf) || nf.ID != 5 || nf.RequestID != "r1" {
+		t.Errorf("GetBook of a missing book returned %v, expected a NotFoundError", err)
+	}
+	_, err = c.CreateBook(ctx, 5)
+	var ce *ConflictError
+	if !errors.As(err, &ce) || ce.Book == nil || ce.Book.Title != "Already Here" {
+		t.Errorf("CreateBook of an existing book returned %v, expected a ConflictError with the book", err)
+	}
+	_, err = c.UpdateBook(ctx, 5, Changes{Rating: 9})
+	var br *BadRequestError
+	if !errors.As(err, &br) || br.Message != "Invalid Rating. Value must be a whole number from 1 to 3." {
+		t.Errorf("bad update returned %#v, expected a BadRequestError with the message", err)
+	}
+	_, err = c.DeleteBook(ctx, 5)
+	var ae *APIError
+	if !errors.As(err, &ae) || ae.StatusCode != 403 || errors.As(err, &nf) {
+		t.Errorf("forbidden delete returned %v, expected a plain APIError", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if req.Method == http.MethodGet && n == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(429)
+			return
+		}
+		if n <= 2 {
+			w.WriteHeader(503)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"Title":"Third Time"}`)
+	}))
+	defer srv.Close()
+	c := New(srv.URL)
+	c.Backoff = time.Millisecond
+
+	b, err := c.GetBook(context.Background(), 1)
+	if err != nil || b.Title != "Third Time" || calls != 3 {
+		t.Errorf("got %v %v after %d calls, expected success after 3", b, err, calls)
+	}
+
+	atomic.StoreInt32(&calls, 1)
+	c.Retries = 0
+	_, err = c.GetBook(context.Background(), 1)
+	var ae *APIError
+	if !errors.As(err, &ae) || ae.StatusCode != 503 || calls != 2 {
+		t.Errorf("with no retries got %v after %d calls, expected a 503 after 1", err, calls-1)
+	}
+}
+
+// only reads go again when the server may have done it already
+func TestRetriesByMethod(t *testing.T) {
+	var calls int32
+	var code int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(int(atomic.LoadInt32(&code)))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"Title":"Second Time"}`)
+	}))
+	defer srv.Close()
+	c := New(srv.URL)
+	c.Backoff = time.Millisecond
+	ctx := context.Background()
+
+	for _, r := range []struct {
+		name    string
+		call    func() error
+		retried map[int32]bool
+	}{
+		{"GET", func() error { _, err := c.GetBook(ctx, 1); return err }, map[int32]bool{429: true, 502: true, 503: true, 504: true}},
+		{"POST", func() error { _, err := c.CreateBook(ctx, 1); return err }, map[int32]bool{429: true, 503: true}},
+		{"PUT", func() error { _, err := c.UpdateBook(ctx, 1, Changes{Title: "x"}); return err }, map[int32]bool{429: true, 503: true}},
+		{"DELETE", func() error { _, err := c.DeleteBook(ctx, 1); return err }, map[int32]bool{429: true, 503: true}},
+	} {
+		for _, busy := range []int32{429, 502, 503, 504} {
+			atomic.StoreInt32(&calls, 0)
+			atomic.StoreInt32(&code, busy)
+			err := r.call()
+			if r.retried[busy] && (err != nil || calls != 2) {
+				t.Errorf("%s after a %d gave %v after %d calls, expected success after 2", r.name, busy, err, calls)
+			}
+			if !r.retried[busy] && (err == nil || calls != 1) {
+				t.Errorf("%s after a %d gave %v after %d calls, expected the %d after 1", r.name, busy, err, calls, busy)
+			}
+		}
+	}
+
+	// a delete that may have got there isn't tried again
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer srv.Close()
+	c.BaseURL = srv.URL
+	atomic.StoreInt32(&calls, 0)
+	if _, err := c.DeleteBook(ctx, 1); err == nil || calls != 1 {
+		t.Errorf("DELETE after the connection dropped gave %v after %d calls, expected the error after 1", err, calls)
+	}
+	atomic.StoreInt32(&calls, 0)
+	if _, err := c.GetBook(ctx, 1); err == nil || calls < 4 {
+		t.Errorf("GET after the connection dropped gave %v after %d calls, expected the error after at least 4", err, calls)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer srv.Close()
+	c := New(srv.URL)
+	c.Backoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.ListBooks(ctx)
+	if err != context.DeadlineExceeded || time.Since(start) > 5*time.Second {
+		t.Errorf("got %v after %v, expected the deadline to cut the backoff short", err, time.Since(start))
+	}
+}
+
+func TestPartialDates(t *testing.T) {
+	for v, precision := range map[string]string{"1965-Aug-01": "", "1965-08": "month", "1965": "year"} {
+		d, p, err := ParseDate(v, "2006-Jan-02")
+		if err != nil || p != precision || FormatDate(d, p, "2006-Jan-02") != v {
+			t.Errorf("%s gave %v %q %v", v, d, p, err)
+		}
+	}
+	if _, _, err := ParseDate("1965-Aug", "2006-Jan-02"); err == nil {
+		t.Error("1965-Aug parsed")
+	}
+	q := Changes{PublishDate: time.Date(1965, 8, 1, 0, 0, 0, 0, time.UTC), PublishPrecision: "year"}.query("2006-Jan-02")
+	if q.Get("PublishDate") != "1965" {
+		t.Errorf("got %v", q)
+	}
+}
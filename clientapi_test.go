@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/LiamLeFey/booklist/client"
+)
+
+// the client package against the real handlers
+func TestClientAgainstServer(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil }()
+	srv := httptest.NewServer(logged("/book/", bookHandler))
+	defer srv.Close()
+	c := client.New(srv.URL)
+	ctx := context.Background()
+
+	if _, err := c.CreateBook(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	var ce *client.ConflictError
+	if _, err := c.CreateBook(ctx, 1); !errors.As(err, &ce) || ce.Book == nil {
+		t.Errorf("second create returned %v, expected a ConflictError with the book", err)
+	}
+	date := time.Date(1951, 7, 16, 0, 0, 0, 0, time.UTC)
+	b, err := c.UpdateBook(ctx, 1, client.Changes{Title: "The Catcher in the Rye", Author: "J. D. Salinger", PublishDate: date, Rating: 3})
+	if err != nil || b.Title != "The Catcher in the Rye" || !b.PublishDate.Equal(date) || b.Rating != 3 {
+		t.Errorf("update returned %+v %v", b, err)
+	}
+	var br *client.BadRequestError
+	if _, err := c.UpdateBook(ctx, 1, client.Changes{Rating: 7}); !errors.As(err, &br) || br.Message == "" || br.RequestID == "" {
+		t.Errorf("bad rating returned %#v, expected a BadRequestError with a message and request ID", err)
+	}
+	if b, err := c.Checkout(ctx, 1); err != nil || b.Status != client.CheckedOut {
+		t.Errorf("checkout returned %+v %v", b, err)
+	}
+	if _, err := c.Checkout(ctx, 1); !errors.As(err, &ce) {
+		t.Errorf("second checkout returned %v, expected a ConflictError", err)
+	}
+	if b, err := c.Return(ctx, 1); err != nil || b.Status != client.CheckedIn {
+		t.Errorf("return returned %+v %v", b, err)
+	}
+	c.CreateBook(ctx, 2)
+	if l, err := c.ListBooks(ctx); err != nil || len(l) != 2 || l[1].Author != "J. D. Salinger" {
+		t.Errorf("list returned %+v %v", l, err)
+	}
+	if _, err := c.DeleteBook(ctx, 1); err != nil {
+		t.Error(err)
+	}
+	var nf *client.NotFoundError
+	if _, err := c.GetBook(ctx, 1); !errors.As(err, &nf) {
+		t.Errorf("get after delete returned %v, expected a NotFoundError", err)
+	}
+}
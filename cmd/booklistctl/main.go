@@ -0,0 +1,590 @@
+// booklistctl manages a booklist server's catalog from the command line, so
+// nobody has to escape query strings for curl by hand.
+//
+//	booklistctl [global flags] command [flags] [args]
+//
+// Run it with no arguments for the list of commands.
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/LiamLeFey/booklist/client"
+)
+
+const usage = `usage: booklistctl [global flags] command [flags] [args]
+
+commands:
+  get ID...                  show books
+  add [fields] ID            create a book, with the defaults for any field not given
+  update [fields] ID         change a book
+  rm ID...                   delete books
+  ls                         list every book
+  search [filters] [WORD...] list the books matching all the filters, and with
+                             every WORD in the title, author or publisher
+  checkout ID                check a book out
+  return ID                  check a book in
+  import FILE                add or update books from a JSON or CSV file, as
+                             written by export. - is standard input.
+  export [FILE]              write every book, as JSON or CSV by -o or the
+                             file's extension. Standard output by default.
+
+fields: -title, -author, -publisher, -date, -rating
+filters: the fields, matched exactly (but ignoring case), and -status in|out
+
+global flags:
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr, os.Getenv)
+	stop()
+	os.Exit(code)
+}
+
+// a book and its ID, which is how everything here prints them
+type row struct {
+	ID int
+	client.Book
+}
+
+type cli struct {
+	c      *client.Client
+	format string
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+// errUsage means print the usage and exit 2
+var errUsage = errors.New("usage")
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer, getenv func(string) string) int {
+	fs := flag.NewFlagSet("booklistctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		io.WriteString(stderr, usage)
+		fs.PrintDefaults()
+	}
+	server := fs.String("server", envOr(getenv, "BOOKLIST_URL", "http://localhost:8080"), "booklist server `URL` (BOOKLIST_URL)")
+	key := fs.String("key", getenv("BOOKLIST_API_KEY"), "API `key` (BOOKLIST_API_KEY)")
+	token := fs.String("token", getenv("BOOKLIST_TOKEN"), "bearer `token` (BOOKLIST_TOKEN)")
+	format := fs.String("o", "table", "output `format`: table, json or csv")
+	dateFormat := fs.String("date-format", "2006-Jan-02", "the server's date_format, for -date and for table and csv output")
+	timeout := fs.Duration("timeout", 30*time.Second, "give up after this long")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	switch *format {
+	case "table", "json", "csv":
+	default:
+		fmt.Fprintln(stderr, "booklistctl: -o must be table, json or csv")
+		return 2
+	}
+	c := client.New(*server)
+	c.APIKey, c.Token, c.DateFormat = *key, *token, *dateFormat
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	cl := &cli{c: c, format: *format, stdin: stdin, stdout: stdout}
+	commands := map[string]func(context.Context, []string) error{
+		"get":      cl.get,
+		"add":      cl.add,
+		"update":   cl.update,
+		"rm":       cl.rm,
+		"ls":       cl.ls,
+		"search":   cl.search,
+		"checkout": cl.checkout,
+		"return":   cl.checkin,
+		"import":   cl.importBooks,
+		"export":   cl.export,
+	}
+	cmd, there := commands[fs.Arg(0)]
+	if !there {
+		fmt.Fprintln(stderr, "booklistctl: unknown command", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+	err := cmd(ctx, fs.Args()[1:])
+	switch {
+	case err == nil:
+		return 0
+	case err == errUsage:
+		fs.Usage()
+		return 2
+	}
+	fmt.Fprintln(stderr, "booklistctl:", err)
+	return 1
+}
+
+func envOr(getenv func(string) string, key, def string) string {
+	if v := getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func parseIDs(args []string) ([]int, error) {
+	if len(args) == 0 {
+		return nil, errUsage
+	}
+	ids := make([]int, len(args))
+	for i, a := range args {
+		id, err := strconv.Atoi(a)
+		if err != nil || id < 0 {
+			return nil, errors.New("not a book ID: " + a)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+func oneID(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, errUsage
+	}
+	ids, err := parseIDs(args)
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// fields are the flags add, update and search share
+type fields struct {
+	title, author, publisher, date string
+	rating                         int
+}
+
+func (f *fields) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.title, "title", "", "title")
+	fs.StringVar(&f.author, "author", "", "author")
+	fs.StringVar(&f.publisher, "publisher", "", "publisher")
+	fs.StringVar(&f.date, "date", "", "publish date, in -date-format, or YYYY-MM or YYYY")
+	fs.IntVar(&f.rating, "rating", 0, "rating")
+}
+
+func (f *fields) changes(dateFormat string) (client.Changes, error) {
+	ch := client.Changes{Title: f.title, Author: f.author, Publisher: f.publisher, Rating: f.rating}
+	if f.date != "" {
+		d, precision, err := client.ParseDate(f.date, dateFormat)
+		if err != nil {
+			return ch, errors.New("-date must look like " + dateFormat + ", YYYY-MM or YYYY")
+		}
+		ch.PublishDate, ch.PublishPrecision = d, precision
+	}
+	return ch, nil
+}
+
+func (f fields) empty() bool {
+	return f == fields{}
+}
+
+func subcommand(name string, args []string, setup func(*flag.FlagSet)) (*flag.FlagSet, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if setup != nil {
+		setup(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, errUsage
+		}
+		return nil, errors.New(name + ": " + err.Error())
+	}
+	return fs, nil
+}
+
+func (cl *cli) get(ctx context.Context, args []string) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	var rows []row
+	for _, id := range ids {
+		b, err := cl.c.GetBook(ctx, id)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row{id, b})
+	}
+	if len(ids) == 1 {
+		return cl.printOne(rows[0])
+	}
+	return cl.print(rows)
+}
+
+func (cl *cli) add(ctx context.Context, args []string) error {
+	var f fields
+	fs, err := subcommand("add", args, f.register)
+	if err != nil {
+		return err
+	}
+	id, err := oneID(fs.Args())
+	if err != nil {
+		return err
+	}
+	ch, err := f.changes(cl.c.DateFormat)
+	if err != nil {
+		return err
+	}
+	b, err := cl.c.CreateBook(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !f.empty() {
+		if b, err = cl.c.UpdateBook(ctx, id, ch); err != nil {
+			return errors.New("created book " + strconv.Itoa(id) + " with the defaults, but " + err.Error())
+		}
+	}
+	return cl.printOne(row{id, b})
+}
+
+func (cl *cli) update(ctx context.Context, args []string) error {
+	var f fields
+	fs, err := subcommand("update", args, f.register)
+	if err != nil {
+		return err
+	}
+	id, err := oneID(fs.Args())
+	if err != nil {
+		return err
+	}
+	if f.empty() {
+		return errors.New("update: nothing to change")
+	}
+	ch, err := f.changes(cl.c.DateFormat)
+	if err != nil {
+		return err
+	}
+	b, err := cl.c.UpdateBook(ctx, id, ch)
+	if err != nil {
+		return err
+	}
+	return cl.printOne(row{id, b})
+}
+
+func (cl *cli) rm(ctx context.Context, args []string) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	var rows []row
+	for _, id := range ids {
+		b, err := cl.c.DeleteBook(ctx, id)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row{id, b})
+	}
+	return cl.print(rows)
+}
+
+func (cl *cli) checkout(ctx context.Context, args []string) error {
+	id, err := oneID(args)
+	if err != nil {
+		return err
+	}
+	b, err := cl.c.Checkout(ctx, id)
+	if err != nil {
+		return err
+	}
+	return cl.printOne(row{id, b})
+}
+
+func (cl *cli) checkin(ctx context.Context, args []string) error {
+	id, err := oneID(args)
+	if err != nil {
+		return err
+	}
+	b, err := cl.c.Return(ctx, id)
+	if err != nil {
+		return err
+	}
+	return cl.printOne(row{id, b})
+}
+
+// all is every book, in ID order
+func (cl *cli) all(ctx context.Context) ([]row, error) {
+	l, err := cl.c.ListBooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]row, 0, len(l))
+	for id, b := range l {
+		rows = append(rows, row{id, b})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+	return rows, nil
+}
+
+func (cl *cli) ls(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	rows, err := cl.all(ctx)
+	if err != nil {
+		return err
+	}
+	return cl.print(rows)
+}
+
+// within says whether d is in the year, month or day date stands for
+func within(d, date time.Time, precision string) bool {
+	switch precision {
+	case "year":
+		return d.Year() == date.Year()
+	case "month":
+		return d.Year() == date.Year() && d.Month() == date.Month()
+	}
+	return d.Equal(date)
+}
+
+func (cl *cli) search(ctx context.Context, args []string) error {
+	var f fields
+	var status string
+	fs, err := subcommand("search", args, func(fs *flag.FlagSet) {
+		f.register(fs)
+		fs.StringVar(&status, "status", "", "in or out")
+	})
+	if err != nil {
+		return err
+	}
+	if status != "" && status != "in" && status != "out" {
+		return errors.New("search: -status must be in or out")
+	}
+	var date time.Time
+	var precision string
+	if f.date != "" {
+		if date, precision, err = client.ParseDate(f.date, cl.c.DateFormat); err != nil {
+			return errors.New("-date must look like " + cl.c.DateFormat + ", YYYY-MM or YYYY")
+		}
+	}
+	rows, err := cl.all(ctx)
+	if err != nil {
+		return err
+	}
+	match := func(r row) bool {
+		if f.title != "" && !strings.EqualFold(r.Title, f.title) ||
+			f.author != "" && !strings.EqualFold(r.Author, f.author) ||
+			f.publisher != "" && !strings.EqualFold(r.Publisher, f.publisher) ||
+			f.date != "" && !within(r.PublishDate, date, precision) ||
+			f.rating != 0 && r.Rating != f.rating ||
+			status == "in" && r.Status != client.CheckedIn ||
+			status == "out" && r.Status != client.CheckedOut {
+			return false
+		}
+		text := strings.ToLower(r.Title + "\n" + r.Author + "\n" + r.Publisher)
+		for _, w := range fs.Args() {
+			if !strings.Contains(text, strings.ToLower(w)) {
+				return false
+			}
+		}
+		return true
+	}
+	found := []row{}
+	for _, r := range rows {
+		if match(r) {
+			found = append(found, r)
+		}
+	}
+	return cl.print(found)
+}
+
+func (cl *cli) export(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	rows, err := cl.all(ctx)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || args[0] == "-" {
+		if cl.format == "table" {
+			return writeJSON(cl.stdout, rows)
+		}
+		return cl.print(rows)
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if fileFormat(args[0], cl.format) == "csv" {
+		err = writeCSV(f, rows, cl.c.DateFormat)
+	} else {
+		err = writeJSON(f, rows)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fileFormat goes by the extension, then by -o. Tables don't import.
+func fileFormat(name, format string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return "csv"
+	case ".json":
+		return "json"
+	}
+	if format == "csv" {
+		return "csv"
+	}
+	return "json"
+}
+
+// importBooks creates each book that isn't there and sets every field on
+// it, checking it in or out to match.
+func (cl *cli) importBooks(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	var in io.Reader = cl.stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var rows []row
+	var err error
+	if fileFormat(args[0], cl.format) == "csv" {
+		rows, err = readCSV(in, cl.c.DateFormat)
+	} else {
+		err = json.NewDecoder(in).Decode(&rows)
+	}
+	if err != nil {
+		return errors.New("reading " + args[0] + ": " + err.Error())
+	}
+	for _, r := range rows {
+		b, err := cl.c.CreateBook(ctx, r.ID)
+		var conflict *client.ConflictError
+		if errors.As(err, &conflict) && conflict.Book != nil {
+			b = *conflict.Book
+		} else if err != nil {
+			return err
+		}
+		ch := client.Changes{Title: r.Title, Author: r.Author, Publisher: r.Publisher, PublishDate: r.PublishDate, PublishPrecision: r.PublishPrecision, Rating: r.Rating,
+			Edition: r.Edition, Language: r.Language, Pages: r.Pages, Format: r.Format, Series: r.Series, Volume: r.Volume,
+			Subjects: r.Subjects, Description: r.Description, Cover: r.Cover, Tags: r.Tags}
+		if !reflect.DeepEqual(ch, client.Changes{}) {
+			if b, err = cl.c.UpdateBook(ctx, r.ID, ch); err != nil {
+				return errors.New("book " + strconv.Itoa(r.ID) + ": " + err.Error())
+			}
+		}
+		if b.Status != r.Status {
+			if r.Status == client.CheckedOut {
+				_, err = cl.c.Checkout(ctx, r.ID)
+			} else {
+				_, err = cl.c.Return(ctx, r.ID)
+			}
+			if err != nil {
+				return errors.New("book " + strconv.Itoa(r.ID) + ": " + err.Error())
+			}
+		}
+	}
+	fmt.Fprintln(cl.stdout, "imported", len(rows), "books")
+	return nil
+}
+
+// printOne is print, but a single JSON object rather than a list of one
+func (cl *cli) printOne(r row) error {
+	if cl.format == "json" {
+		return writeJSON(cl.stdout, r)
+	}
+	return cl.print([]row{r})
+}
+
+func (cl *cli) print(rows []row) error {
+	switch cl.format {
+	case "json":
+		return writeJSON(cl.stdout, rows)
+	case "csv":
+		return writeCSV(cl.stdout, rows, cl.c.DateFormat)
+	}
+	tw := tabwriter.NewWriter(cl.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTITLE\tAUTHOR\tPUBLISHER\tPUBLISHED\tRATING\tSTATUS")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%s\n", r.ID, r.Title, r.Author, r.Publisher,
+			client.FormatDate(r.PublishDate, r.PublishPrecision, cl.c.DateFormat), r.Rating, r.Status)
+	}
+	return tw.Flush()
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+var csvHeader = []string{"ID", "Title", "Author", "Publisher", "PublishDate", "Rating", "Status"}
+
+func writeCSV(w io.Writer, rows []row, dateFormat string) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, r := range rows {
+		cw.Write([]string{strconv.Itoa(r.ID), r.Title, r.Author, r.Publisher,
+			client.FormatDate(r.PublishDate, r.PublishPrecision, dateFormat), strconv.Itoa(r.Rating), r.Status.String()})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func readCSV(r io.Reader, dateFormat string) ([]row, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || strings.Join(records[0], ",") != strings.Join(csvHeader, ",") {
+		return nil, errors.New("the first line must be " + strings.Join(csvHeader, ","))
+	}
+	var rows []row
+	for i, rec := range records[1:] {
+		line := "line " + strconv.Itoa(i+2) + ": "
+		var r row
+		if r.ID, err = strconv.Atoi(rec[0]); err != nil {
+			return nil, errors.New(line + "bad ID " + strconv.Quote(rec[0]))
+		}
+		r.Title, r.Author, r.Publisher = rec[1], rec[2], rec[3]
+		if rec[4] != "" {
+			if r.PublishDate, r.PublishPrecision, err = client.ParseDate(rec[4], dateFormat); err != nil {
+				return nil, errors.New(line + "PublishDate must look like " + dateFormat + ", YYYY-MM or YYYY")
+			}
+		}
+		if rec[5] != "" {
+			if r.Rating, err = strconv.Atoi(rec[5]); err != nil {
+				return nil, errors.New(line + "bad Rating " + strconv.Quote(rec[5]))
+			}
+		}
+		switch rec[6] {
+		case "CheckedIn", "":
+		case "CheckedOut":
+			r.Status = client.CheckedOut
+		default:
+			return nil, errors.New(line + "Status must be CheckedIn or CheckedOut")
+		}
+		rows = append(rows, r)
+	}
+	return rows, nil
+}
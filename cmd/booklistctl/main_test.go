@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LiamLeFey/booklist/client"
+)
+
+// just enough of the server to drive the commands
+type fakeServer struct {
+	lock  sync.Mutex
+	books map[int]client.Book
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p := strings.TrimPrefix(req.URL.Path, "/book/")
+	if p == "" && req.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(f.books)
+		return
+	}
+	id, err := strconv.Atoi(p)
+	b, there := f.books[id]
+	if err != nil || (!there && req.Method != http.MethodPost) {
+		w.WriteHeader(404)
+		return
+	}
+	switch req.Method {
+	case http.MethodPost:
+		if there {
+			w.WriteHeader(409)
+			json.NewEncoder(w).Encode(b)
+			return
+		}
+		b = client.Book{Title: "Untitled", Author: "Unknown", Publisher: "Not Published", Rating: 2}
+		w.WriteHeader(201)
+	case http.MethodPut:
+		q := req.URL.Query()
+		if s := q.Get("Status"); s != "" {
+			if s == b.Status.String() {
+				w.WriteHeader(409)
+				return
+			}
+			b.Status = 1 - b.Status
+		}
+		for k, v := range map[string]*string{"Title": &b.Title, "Author": &b.Author, "Publisher": &b.Publisher} {
+			if q.Get(k) != "" {
+				*v = q.Get(k)
+			}
+		}
+		if q.Get("PublishDate") != "" {
+			b.PublishDate, _ = time.Parse("2006-Jan-02", q.Get("PublishDate"))
+		}
+		if q.Get("Rating") != "" {
+			b.Rating, _ = strconv.Atoi(q.Get("Rating"))
+		}
+	case http.MethodDelete:
+		delete(f.books, id)
+		json.NewEncoder(w).Encode(b)
+		return
+	}
+	f.books[id] = b
+	json.NewEncoder(w).Encode(b)
+}
+
+func ctl(t *testing.T, url string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	env := map[string]string{"BOOKLIST_URL": url}
+	code := run(context.Background(), args, strings.NewReader(""), &stdout, &stderr, func(k string) string { return env[k] })
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	fake := &fakeServer{books: map[int]client.Book{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	code, out, errs := ctl(t, srv.URL, "add", "-title", "The Catcher in the Rye", "-author", "J. D. Salinger", "-date", "1951-Jul-16", "-rating", "3", "1")
+	if code != 0 || !strings.Contains(out, "The Catcher in the Rye") || !strings.Contains(out, "1951-Jul-16") {
+		t.Fatalf("add exited %d with %q %q", code, out, errs)
+	}
+	ctl(t, srv.URL, "add", "-title", "Nine Stories", "-author", "J. D. Salinger", "2")
+	ctl(t, srv.URL, "add", "-title", "Dune", "-author", "Frank Herbert", "3")
+	if code, _, errs := ctl(t, srv.URL, "checkout", "3"); code != 0 {
+		t.Errorf("checkout exited %d: %s", code, errs)
+	}
+	if code, _, errs := ctl(t, srv.URL, "checkout", "3"); code != 1 || !strings.Contains(errs, "409") {
+		t.Errorf("second checkout exited %d with %q, expected a conflict", code, errs)
+	}
+
+	_, out, _ = ctl(t, srv.URL, "-o", "csv", "search", "-author", "j. d. salinger", "stories")
+	if out != "ID,Title,Author,Publisher,PublishDate,Rating,Status\n2,Nine Stories,J. D. Salinger,Not Published,0001-Jan-01,2,CheckedIn\n" {
+		t.Errorf("search gave\n%s", out)
+	}
+	_, out, _ = ctl(t, srv.URL, "-o", "json", "search", "-status", "out")
+	var found []row
+	if err := json.Unmarshal([]byte(out), &found); err != nil || len(found) != 1 || found[0].ID != 3 {
+		t.Errorf("search for checked out books gave %s", out)
+	}
+
+	// round trip through export, rm and import, in both formats
+	for _, name := range []string{"books.json", "books.csv"} {
+		file := filepath.Join(t.TempDir(), name)
+		if code, _, errs := ctl(t, srv.URL, "export", file); code != 0 {
+			t.Fatalf("export exited %d: %s", code, errs)
+		}
+		before := fake.books
+		ctl(t, srv.URL, "rm", "1", "2", "3")
+		if len(fake.books) != 0 {
+			t.Fatalf("%d books left after rm", len(fake.books))
+		}
+		if code, _, errs := ctl(t, srv.URL, "import", file); code != 0 {
+			t.Fatalf("import exited %d: %s", code, errs)
+		}
+		for id, b := range before {
+			if got := fake.books[id]; !reflect.DeepEqual(got, b) {
+				t.Errorf("%s: book %d imported as %+v, expected %+v", name, id, got, b)
+			}
+		}
+	}
+
+	if code, _, errs := ctl(t, srv.URL, "get", "9"); code != 1 || !strings.Contains(errs, "404") {
+		t.Errorf("get of a missing book exited %d with %q", code, errs)
+	}
+	if code, _, _ := ctl(t, srv.URL, "update", "1"); code != 1 {
+		t.Errorf("update with nothing to change exited %d", code)
+	}
+	for _, args := range [][]string{{}, {"frobnicate"}, {"get"}, {"-o", "xml", "ls"}, {"checkout", "1", "2"}} {
+		if code, _, _ := ctl(t, srv.URL, args...); code != 2 {
+			t.Errorf("%q exited %d, expected 2", args, code)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Collections are named, ordered lists of books, like Staff Picks or
+// Summer Reading.
+//
+//	GET    /collections/      all of them, by ID
+//	GET    /collections/{id}  one
+//	POST   /collections/{id}  makes it. 409 if there's one already.
+//	PUT    /collections/{id}  changes the fields the body has
+//	DELETE /collections/{id}  gets rid of it, and answers with it
+//
+// The body is JSON, a Collection without the ID, or with the one in the
+// path. Books is the whole list, in order, and every one of them has to
+// be in the book list. Deleting a book takes it out of the collections.
+
+// Collection is what the endpoints send and take
+type Collection struct {
+	ID          string
+	Name        string
+	Description string `json:",omitempty"`
+	Books       []int
+}
+
+var errCollectionExists = errors.New("collection already exists")
+
+// Where the collections live. All the methods are safe to call
+// concurrently.
+type CollectionStore interface {
+	// errNotFound if there's no such collection
+	Get(id string) (Collection, error)
+	// errCollectionExists if the ID's taken
+	Create(c Collection) error
+	// Update hands fn a copy of collection id, under the lock, and saves
+	// whatever fn leaves in it, unless fn returns an error
+	Update(id string, fn func(*Collection) error) (Collection, error)
+	Delete(id string) (Collection, error)
+	// by ID
+	List() ([]Collection, error)
+	// RemoveBook takes book id out of every collection it's in
+	RemoveBook(id int) error
+}
+
+var collections CollectionStore = newMemCollections()
+
+// a collection ID goes in the path, so it's kept to a slug
+var collectionIDPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+const maxCollectionID = 64
+
+type memCollections struct {
+	lock        sync.Mutex
+	collections map[string]Collection
+	// called with the lock held after every change. If it fails, the
+	// change is undone.
+	changed func() error
+}
+
+func newMemCollections() *memCollections {
+	return &memCollections{collections: map[string]Collection{}}
+}
+
+func (s *memCollections) Get(id string) (Collection, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, there := s.collections[id]
+	if !there {
+		return Collection{}, errNotFound
+	}
+	return c, nil
+}
+
+func (s *memCollections) Create(c Collection) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, there := s.collections[c.ID]; there {
+		return errCollectionExists
+	}
+	s.collections[c.ID] = c
+	if err := s.save(); err != nil {
+		delete(s.collections, c.ID)
+		return err
+	}
+	return nil
+}
+
+func (s *memCollections) Update(id string, fn func(*Collection) error) (Collection, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	before, there := s.collections[id]
+	if !there {
+		return Collection{}, errNotFound
+	}
+	after := before
+	after.Books = append([]int(nil), before.Books...)
+	if err := fn(&after); err != nil {
+		return before, err
+	}
+	s.collections[id] = after
+	if err := s.save(); err != nil {
+		s.collections[id] = before
+		return before, err
+	}
+	return after, nil
+}
+
+func (s *memCollections) Delete(id string) (Collection, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, there := s.collections[id]
+	if !there {
+		return Collection{}, errNotFound
+	}
+	delete(s.collections, id)
+	if err := s.save(); err != nil {
+		s.collections[id] = c
+		return Collection{}, err
+	}
+	return c, nil
+}
+
+func (s *memCollections) List() ([]Collection, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l := make([]Collection, 0, len(s.collections))
+	for _, c := range s.collections {
+		l = append(l, c)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].ID < l[j].ID })
+	return l, nil
+}
+
+func (s *memCollections) RemoveBook(id int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	before := map[string]Collection{}
+	for cid, c := range s.collections {
+		var books []int
+		for _, b := range c.Books {
+			if b != id {
+				books = append(books, b)
+			}
+		}
+		if len(books) != len(c.Books) {
+			before[cid] = c
+			c.Books = books
+			s.collections[cid] = c
+		}
+	}
+	if len(before) == 0 {
+		return nil
+	}
+	if err := s.save(); err != nil {
+		for cid, c := range before {
+			s.collections[cid] = c
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *memCollections) save() error {
+	if s.changed == nil {
+		return nil
+	}
+	return s.changed()
+}
+
+// fileCollections writes them all out to a JSON file after every change,
+// the same as fileStore does the books
+type fileCollections struct {
+	*memCollections
+	path string
+}
+
+func openFileCollections(path string) (*fileCollections, error) {
+	s := &fileCollections{memCollections: newMemCollections(), path: path}
+	if err := readJSONFile(path, &s.collections); err != nil {
+		return nil, err
+	}
+	s.changed = s.write
+	return s, nil
+}
+
+func (s *fileCollections) write() error {
+	return writeJSONFile(s.path, s.collections)
+}
+
+// openCollections keeps the collections next to the books when they're
+// in a file, and in memory when the books are
+func openCollections(c *Config) (CollectionStore, error) {
+	if c.Storage == "file" {
+		return openFileCollections(c.StoragePath + ".collections")
+	}
+	return newMemCollections(), nil
+}
+
+// forgetBook takes a deleted book out of the collections, so the next
+// book with its ID doesn't turn up in them
+func forgetBook(id int) {
+	if err := collections.RemoveBook(id); err != nil {
+		log.Println("taking book", id, "out of collections", err)
+	}
+}
+
+// collectionActions is what a request to /collections/ needs. Changing
+// them is cataloging.
+func collectionActions(req *http.Request) []string {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return []string{ActionRead}
+	}
+	return []string{ActionCatalog}
+}
+
+func collectionsHandler(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/collections/")
+	switch {
+	case id == "" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		l, err := collections.List()
+		if err != nil {
+			storageError(w, err)
+			return
+		}
+		for i := range l {
+			if l[i].Books == nil {
+				l[i].Books = []int{}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l)
+	case id == "":
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(405)
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		c, err := collections.Get(id)
+		if err == errNotFound {
+			w.WriteHeader(404)
+			return
+		} else if err != nil {
+			storageError(w, err)
+			return
+		}
+		writeCollection(w, 200, c)
+	case req.Method == http.MethodPost:
+		createCollection(w, req, id)
+	case req.Method == http.MethodPut:
+		updateCollection(w, req, id)
+	case req.Method == http.MethodDelete:
+		c, err := collections.Delete(id)
+		if err == errNotFound {
+			w.WriteHeader(404)
+			return
+		} else if err != nil {
+			storageError(w, err)
+			return
+		}
+		writeCollection(w, 200, c)
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		w.WriteHeader(405)
+	}
+}
+
+func createCollection(w http.ResponseWriter, req *http.Request, id string) {
+	if id == "" || len(id) > maxCollectionID || !collectionIDPattern.MatchString(id) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid collection ID. It can be up to "+strconv.Itoa(maxCollectionID)+
+			" lowercase letters, digits and hyphens, like summer-reading.")
+		return
+	}
+	ch, ok := readCollection(w, req, id)
+	if !ok {
+		return
+	}
+	c := Collection{ID: id}
+	ch.apply(&c)
+	if code, message := validateCollection(req, c); code != 0 {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(code)
+		io.WriteString(w, message)
+		return
+	}
+	if err := collections.Create(c); err == errCollectionExists {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(409)
+		io.WriteString(w, "Collection "+id+" already exists.")
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	writeCollection(w, 201, c)
+}
+
+func updateCollection(w http.ResponseWriter, req *http.Request, id string) {
+	ch, ok := readCollection(w, req, id)
+	if !ok {
+		return
+	}
+	code, message := 0, ""
+	c, err := collections.Update(id, func(c *Collection) error {
+		ch.apply(c)
+		if code, message = validateCollection(req, *c); code != 0 {
+			return errConflict
+		}
+		return nil
+	})
+	switch {
+	case code != 0:
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(code)
+		io.WriteString(w, message)
+	case err == errNotFound:
+		w.WriteHeader(404)
+	case err != nil:
+		storageError(w, err)
+	default:
+		writeCollection(w, 200, c)
+	}
+}
+
+// collectionChanges is a request body. What it leaves out is left alone.
+type collectionChanges struct {
+	ID          *string
+	Name        *string
+	Description *string
+	Books       *[]int
+}
+
+func (ch collectionChanges) apply(c *Collection) {
+	if ch.Name != nil {
+		c.Name = strings.TrimSpace(*ch.Name)
+	}
+	if ch.Description != nil {
+		c.Description = strings.TrimSpace(*ch.Description)
+	}
+	if ch.Books != nil {
+		c.Books = *ch.Books
+	}
+}
+
+// readCollection reads the body of a POST or PUT, answering the request
+// itself if it won't do
+func readCollection(w http.ResponseWriter, req *http.Request, id string) (collectionChanges, bool) {
+	var ch collectionChanges
+	if mt, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(415)
+		io.WriteString(w, "Unsupported Media Type: send the collection as application/json.")
+		return ch, false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBookBody))
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(413)
+		io.WriteString(w, "Request body too large.")
+		return ch, false
+	}
+	if err := json.Unmarshal(body, &ch); err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, "Error parsing body: "+err.Error())
+		return ch, false
+	}
+	if ch.ID != nil && *ch.ID != id {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, "The ID in the body doesn't match the one in the path.")
+		return ch, false
+	}
+	return ch, true
+}
+
+// validateCollection says what's wrong with c, if anything, and what to
+// answer with
+func validateCollection(req *http.Request, c Collection) (code int, message string) {
+	if c.Name == "" {
+		return 400, "A collection needs a Name."
+	}
+	seen := map[int]bool{}
+	for _, id := range c.Books {
+		if seen[id] {
+			return 400, "Book " + strconv.Itoa(id) + " is in Books more than once."
+		}
+		seen[id] = true
+		if _, err := storeFor(req).Get(id); err == errNotFound {
+			return 400, "There's no book " + strconv.Itoa(id) + "."
+		} else if err != nil {
+			return 500, "Storage error: " + err.Error()
+		}
+	}
+	return 0, ""
+}
+
+func writeCollection(w http.ResponseWriter, code int, c Collection) {
+	if c.Books == nil {
+		c.Books = []int{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func collectionRequest(method, target, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	collectionsHandler(rec, req)
+	return rec
+}
+
+func TestCollections(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil; collections = newMemCollections() }()
+	collections = newMemCollections()
+	for id := 1; id <= 3; id++ {
+		store.Create(id, NewBook())
+	}
+
+	for _, c := range []struct {
+		method, target, contentType, body string
+		code                              int
+		expected                          string
+	}{
+		{"GET", "/collections/", "", "", 200, "[]"},
+		{"POST", "/collections/staff-picks", "application/json", `{"Name": " Staff Picks ", "Books": [3, 1]}`, 201,
+			`{"ID":"staff-picks","Name":"Staff Picks","Books":[3,1]}`},
+		{"POST", "/collections/staff-picks", "application/json", `{"Name": "Again"}`, 409, "already exists"},
+		{"POST", "/collections/summer", "application/json", `{"ID": "summer", "Name": "Summer Reading", "Description": "Beach books."}`, 201,
+			`{"ID":"summer","Name":"Summer Reading","Description":"Beach books.","Books":[]}`},
+		{"GET", "/collections/staff-picks", "", "", 200, `{"ID":"staff-picks","Name":"Staff Picks","Books":[3,1]}`},
+		{"GET", "/collections/nope", "", "", 404, ""},
+		// just what's given changes, and Books in the order given
+		{"PUT", "/collections/staff-picks", "application/json", `{"Books": [1, 2, 3]}`, 200,
+			`{"ID":"staff-picks","Name":"Staff Picks","Books":[1,2,3]}`},
+		{"PUT", "/collections/nope", "application/json", `{"Name": "Nope"}`, 404, ""},
+		{"GET", "/collections/", "", "", 200,
+			`[{"ID":"staff-picks","Name":"Staff Picks","Books":[1,2,3]},{"ID":"summer","Name":"Summer Reading","Description":"Beach books.","Books":[]}]`},
+
+		{"POST", "/collections/Staff_Picks", "application/json", `{"Name": "x"}`, 400, "Invalid collection ID"},
+		{"POST", "/collections/" + strings.Repeat("a", 65), "application/json", `{"Name": "x"}`, 400, "Invalid collection ID"},
+		{"POST", "/collections/new", "application/json", `{"Books": [1]}`, 400, "needs a Name"},
+		{"POST", "/collections/new", "application/json", `{"Name": "x", "Books": [1, 9]}`, 400, "no book 9"},
+		{"POST", "/collections/new", "application/json", `{"Name": "x", "Books": [1, 1]}`, 400, "more than once"},
+		{"POST", "/collections/new", "application/json", `{"ID": "old", "Name": "x"}`, 400, "doesn't match"},
+		{"POST", "/collections/new", "application/json", `{"Name": 1}`, 400, "Error parsing body"},
+		{"POST", "/collections/new", "application/xml", `<Name>x</Name>`, 415, "application/json"},
+		{"PUT", "/collections/summer", "application/json", `{"Name": ""}`, 400, "needs a Name"},
+		{"PUT", "/collections/summer", "application/json", strings.Repeat(" ", maxBookBody+1), 413, "too large"},
+		{"POST", "/collections/", "application/json", `{"Name": "x"}`, 405, ""},
+
+		{"DELETE", "/collections/summer", "", "", 200, `{"ID":"summer","Name":"Summer Reading","Description":"Beach books.","Books":[]}`},
+		{"DELETE", "/collections/summer", "", "", 404, ""},
+	} {
+		rec := collectionRequest(c.method, c.target, c.contentType, c.body)
+		if rec.Code != c.code || !strings.Contains(rec.Body.String(), c.expected) {
+			t.Errorf("%s %s %s gave %d %s, expected %d %s", c.method, c.target, c.body, rec.Code, rec.Body, c.code, c.expected)
+		}
+	}
+	if _, err := collections.Get("new"); err != errNotFound {
+		t.Errorf("a bad POST made a collection")
+	}
+
+	// a deleted book drops out of them
+	formatRequest(http.MethodDelete, "/book/2", "", "", "")
+	if c, _ := collections.Get("staff-picks"); !reflect.DeepEqual(c.Books, []int{1, 3}) {
+		t.Errorf("deleting book 2 left %v", c.Books)
+	}
+}
+
+func TestCollectionPermissions(t *testing.T) {
+	auth = testAuthenticator(t)
+	saved := policy.current()
+	defer func() { auth = nil; policy.policy = saved; collections = newMemCollections() }()
+	collections = newMemCollections()
+	h := authenticate(authorize(collectionActions, collectionsHandler))
+	do := func(method string) int {
+		req := httptest.NewRequest(method, "/collections/picks", strings.NewReader(`{"Name": "Picks"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "current-key")
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+	if code := do(http.MethodPost); code != 403 {
+		t.Errorf("reader made a collection, %d", code)
+	}
+	if code := do(http.MethodGet); code != 404 {
+		t.Errorf("reader's GET gave %d", code)
+	}
+	policy.policy = &Policy{Roles: saved.Roles, Callers: map[string]string{"frontdesk": "cataloger"}}
+	if code := do(http.MethodPost); code != 201 {
+		t.Errorf("cataloger's POST gave %d", code)
+	}
+	if code := do(http.MethodDelete); code != 200 {
+		t.Errorf("cataloger's DELETE gave %d", code)
+	}
+}
+
+func TestFileCollections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.json.collections")
+	s, err := openFileCollections(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(Collection{ID: "picks", Name: "Picks", Books: []int{2, 1, 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(Collection{ID: "picks", Name: "Again"}); err != errCollectionExists {
+		t.Errorf("second create gave %v", err)
+	}
+	if err := s.RemoveBook(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// and it's all still there when it's opened again
+	s, err = openFileCollections(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := s.List()
+	if expected := []Collection{{ID: "picks", Name: "Picks", Books: []int{2, 3}}}; err != nil || !reflect.DeepEqual(l, expected) {
+		t.Errorf("reopened, got %+v %v", l, err)
+	}
+	if _, err := s.Delete("picks"); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ = openFileCollections(path); len(s.collections) != 0 {
+		t.Errorf("deleted collection came back: %+v", s.collections)
+	}
+
+	cfg := defaultConfig()
+	cfg.Storage, cfg.StoragePath = "file", filepath.Join(t.TempDir(), "books.json")
+	if c, err := openCollections(cfg); err != nil || c.(*fileCollections).path != cfg.StoragePath+".collections" {
+		t.Errorf("file storage gave %v %v", c, err)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Listen string
+	// "memory" or "file"
+	Storage     string
+	StoragePath string
+	// where cover images go. Empty is next to StoragePath with the file
+	// backend, and in memory otherwise.
+	CoverDir      string
+	MaxCoverBytes int
+
+	DefaultTitle, DefaultAuthor, DefaultPublisher string
+	DefaultRating                                 int
+	DefaultStatus                                 Status
+
+	MinRating, MaxRating int
+	DateFormat           string
+
+	// the scale readers rate books on in their reviews, and "pre" to hold
+	// reviews with text back until a moderator's seen them, or "post" to
+	// publish them straight away
+	MinReviewRating, MaxReviewRating int
+	ReviewModeration                 string
+
+	ReadTimeout, WriteTimeout, IdleTimeout time.Duration
+	// how long to wait for requests in flight when asked to stop
+	ShutdownTimeout time.Duration
+	MaxHeaderBytes  int
+
+	AuthFile, PolicyFile, AuditFile, RateLimitFile string
+	// how many of the latest audit entries are kept in memory. Older ones
+	// are read back from AuditFile when they're asked for.
+	AuditMemory int
+
+	// serve HTTPS if both are set
+	TLSCert, TLSKey string
+	// CA bundle for client certificates, and whether they're
+	// "none", "optional" or "require"d
+	TLSClientCA, TLSClientAuth string
+
+	// "stdout", "stderr" or "off"
+	AccessLog string
+	// "off", "stdout" or "otlp", and where the OTLP/HTTP collector is
+	TraceExport, TraceEndpoint string
+
+	// when v1 of the API is deprecated and when it goes away, for the
+	// Deprecation and Sunset headers. Zero for neither.
+	V1Deprecated, V1Sunset time.Time
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:           ":8080",
+		Storage:          "memory",
+		MaxCoverBytes:    5 << 20,
+		DefaultTitle:     "Untitled",
+		DefaultAuthor:    "Unknown",
+		DefaultPublisher: "Not Published",
+		DefaultRating:    2,
+		DefaultStatus:    CheckedIn,
+		MinRating:        1,
+		MaxRating:        3,
+		MinReviewRating:  1,
+		MaxReviewRating:  5,
+		ReviewModeration: "post",
+		DateFormat:       TIME_FMT,
+		ReadTimeout:      10 * time.Second,
+		WriteTimeout:     10 * time.Second,
+		IdleTimeout:      2 * time.Minute,
+		ShutdownTimeout:  15 * time.Second,
+		MaxHeaderBytes:   64 * 1024,
+		AuditMemory:      10000,
+		TLSClientAuth:    "none",
+		AccessLog:        "stdout",
+		TraceExport:      "off",
+		TraceEndpoint:    "http://localhost:4318",
+		// when v2 came out, and a year on
+		V1Deprecated: time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC),
+		V1Sunset:     time.Date(2027, 10, 19, 0, 0, 0, 0, time.UTC)}
+}
+
+// the running config. main replaces it.
+var cfg = defaultConfig()
+
+// One knob. The same setting is "storage.path" in the config file,
+// BOOKLIST_STORAGE_PATH in the environment and -storage-path on the command
+// line. Later ones win.
+type setting struct {
+	key   string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+func (s setting) envName() string {
+	return "BOOKLIST_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(s.key))
+}
+
+func (s setting) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.key)
+}
+
+func setString(p func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		*p(c) = v
+		return nil
+	}
+}
+
+func setInt(p func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("must be a whole number, not " + strconv.Quote(v))
+		}
+		*p(c) = i
+		return nil
+	}
+}
+
+func setDuration(p func(c *Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return errors.New("must be a duration like 10s or 2m, not " + strconv.Quote(v))
+		}
+		*p(c) = d
+		return nil
+	}
+}
+
+// a day, YYYY-MM-DD, or "never"
+func setDay(p func(c *Config) *time.Time) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		if v == "never" {
+			*p(c) = time.Time{}
+			return nil
+		}
+		d, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return errors.New("must be a day like 2027-10-19, or never, not " + strconv.Quote(v))
+		}
+		*p(c) = d
+		return nil
+	}
+}
+
+var settings = []setting{
+	{"listen", "address to listen on", setString(func(c *Config) *string { return &c.Listen })},
+	{"storage.backend", "where books are kept: memory or file", setString(func(c *Config) *string { return &c.Storage })},
+	{"storage.path", "the file, for the file backend", setString(func(c *Config) *string { return &c.StoragePath })},
+	{"covers.dir", "directory for cover images. Unset is storage.path.covers with the file backend, memory otherwise", setString(func(c *Config) *string { return &c.CoverDir })},
+	{"covers.max_bytes", "largest cover image that can be uploaded", setInt(func(c *Config) *int { return &c.MaxCoverBytes })},
+	{"defaults.title", "Title for new books", setString(func(c *Config) *string { return &c.DefaultTitle })},
+	{"defaults.author", "Author for new books", setString(func(c *Config) *string { return &c.DefaultAuthor })},
+	{"defaults.publisher", "Publisher for new books", setString(func(c *Config) *string { return &c.DefaultPublisher })},
+	{"defaults.rating", "Rating for new books", setInt(func(c *Config) *int { return &c.DefaultRating })},
+	{"defaults.status", "Status for new books: CheckedIn or CheckedOut", func(c *Config, v string) error {
+		switch v {
+		case "CheckedIn":
+			c.DefaultStatus = CheckedIn
+		case "CheckedOut":
+			c.DefaultStatus = CheckedOut
+		default:
+			return errors.New("must be CheckedIn or CheckedOut, not " + strconv.Quote(v))
+		}
+		return nil
+	}},
+	{"rating.min", "lowest allowed Rating", setInt(func(c *Config) *int { return &c.MinRating })},
+	{"rating.max", "highest allowed Rating", setInt(func(c *Config) *int { return &c.MaxRating })},
+	{"reviews.min", "lowest rating a review can give", setInt(func(c *Config) *int { return &c.MinReviewRating })},
+	{"reviews.max", "highest rating a review can give", setInt(func(c *Config) *int { return &c.MaxReviewRating })},
+	{"reviews.moderation", "pre to hold reviews with text until a moderator publishes them, post to publish them at once", setString(func(c *Config) *string { return &c.ReviewModeration })},
+	{"date_format", "Go time layout for PublishDate", setString(func(c *Config) *string { return &c.DateFormat })},
+	{"timeouts.read", "time allowed to read a request", setDuration(func(c *Config) *time.Duration { return &c.ReadTimeout })},
+	{"timeouts.write", "time allowed to write a response", setDuration(func(c *Config) *time.Duration { return &c.WriteTimeout })},
+	{"timeouts.idle", "time a keep-alive connection may sit idle", setDuration(func(c *Config) *time.Duration { return &c.IdleTimeout })},
+	{"timeouts.shutdown", "time to let requests finish on SIGTERM", setDuration(func(c *Config) *time.Duration { return &c.ShutdownTimeout })},
+	{"max_header_bytes", "largest request header allowed", setInt(func(c *Config) *int { return &c.MaxHeaderBytes })},
+	{"auth.file", "API keys file. Unset means no authentication", setString(func(c *Config) *string { return &c.AuthFile })},
+	{"policy.file", "role policy file", setString(func(c *Config) *string { return &c.PolicyFile })},
+	{"audit.file", "file to append the audit log to", setString(func(c *Config) *string { return &c.AuditFile })},
+	{"audit.memory", "how many of the latest audit entries to keep in memory", setInt(func(c *Config) *int { return &c.AuditMemory })},
+	{"ratelimit.file", "rate limit rules file. Unset means no limits", setString(func(c *Config) *string { return &c.RateLimitFile })},
+	{"tls.cert", "certificate file (PEM). Set this and tls.key to serve HTTPS", setString(func(c *Config) *string { return &c.TLSCert })},
+	{"tls.key", "private key file (PEM)", setString(func(c *Config) *string { return &c.TLSKey })},
+	{"tls.client_ca", "CA bundle (PEM) to check client certificates against", setString(func(c *Config) *string { return &c.TLSClientCA })},
+	{"tls.client_auth", "client certificates: none, optional or require", setString(func(c *Config) *string { return &c.TLSClientAuth })},
+	{"log.access", "where the JSON access log goes: stdout, stderr or off", setString(func(c *Config) *string { return &c.AccessLog })},
+	{"trace.export", "where trace spans go: off, stdout or otlp", setString(func(c *Config) *string { return &c.TraceExport })},
+	{"trace.endpoint", "OTLP/HTTP collector to send spans to", setString(func(c *Config) *string { return &c.TraceEndpoint })},
+	{"api.v1.deprecated", "day v1 of the API is deprecated from, or never", setDay(func(c *Config) *time.Time { return &c.V1Deprecated })},
+	{"api.v1.sunset", "day v1 of the API goes away, or never", setDay(func(c *Config) *time.Time { return &c.V1Sunset })},
+}
+
+// loadConfig builds the config from the defaults, then the config file (from
+// -config or BOOKLIST_CONFIG, if either is set), then BOOKLIST_* environment
+// variables, then the command line.
+func loadConfig(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("booklist", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configPath := fs.String("config", "", "config file (TOML)")
+	flagValues := make(map[string]*string)
+	for _, s := range settings {
+		flagValues[s.key] = fs.String(s.flagName(), "", s.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, errors.New("command line: " + err.Error())
+	}
+	if fs.NArg() > 0 {
+		return nil, errors.New("command line: unexpected argument " + fs.Arg(0))
+	}
+
+	c := defaultConfig()
+	path := *configPath
+	if path == "" {
+		path = getenv("BOOKLIST_CONFIG")
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = c.readFile(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.New(path + ": " + err.Error())
+		}
+	}
+	for _, s := range settings {
+		if v := getenv(s.envName()); v != "" {
+			if err := s.set(c, v); err != nil {
+				return nil, errors.New(s.envName() + " " + err.Error())
+			}
+		}
+	}
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flagName() == f.Name && flagErr == nil {
+				if err := s.set(c, *flagValues[s.key]); err != nil {
+					flagErr = errors.New("-" + f.Name + " " + err.Error())
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readFile reads the little bit of TOML we need: [sections], key = value,
+// strings in double or single quotes, bare numbers and # comments.
+func (c *Config) readFile(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	section := ""
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		where := "line " + strconv.Itoa(n) + ": "
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 || strings.TrimSpace(stripComment(line[end+1:])) != "" {
+				return errors.New(where + "bad section header " + line)
+			}
+			section = strings.TrimSpace(line[1:end])
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return errors.New(where + "expected key = value")
+		}
+		key := strings.TrimSpace(line[:eq])
+		if section != "" {
+			key = section + "." + key
+		}
+		v, err := tomlValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return errors.New(where + err.Error())
+		}
+		known := false
+		for _, s := range settings {
+			if s.key == key {
+				known = true
+				if err := s.set(c, v); err != nil {
+					return errors.New(where + key + " " + err.Error())
+				}
+			}
+		}
+		if !known {
+			return errors.New(where + "unknown setting " + key)
+		}
+	}
+	return scanner.Err()
+}
+
+func stripComment(s string) string {
+	if i := strings.Index(s, "#"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func tomlValue(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := 1
+		for ; end < len(s); end++ {
+			if s[end] == '\\' {
+				end++
+			} else if s[end] == '"' {
+				break
+			}
+		}
+		if end >= len(s) {
+			return "", errors.New("unterminated string")
+		}
+		if strings.TrimSpace(stripComment(s[end+1:])) != "" {
+			return "", errors.New("unexpected text after string")
+		}
+		return strconv.Unquote(s[:end+1])
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", errors.New("unterminated string")
+		}
+		if strings.TrimSpace(stripComment(s[end+2:])) != "" {
+			return "", errors.New("unexpected text after string")
+		}
+		return s[1 : end+1], nil
+	}
+	v := strings.TrimSpace(stripComment(s))
+	if v == "" {
+		return "", errors.New("missing value")
+	}
+	return v, nil
+}
+
+func (c *Config) validate() error {
+	msgs := []string{}
+	if c.Listen == "" {
+		msgs = append(msgs, "listen must not be empty")
+	}
+	switch c.Storage {
+	case "memory":
+	case "file":
+		if c.StoragePath == "" {
+			msgs = append(msgs, "storage.path is needed for the file backend")
+		}
+	default:
+		msgs = append(msgs, "storage.backend must be memory or file, not "+strconv.Quote(c.Storage))
+	}
+	if c.MinRating > c.MaxRating {
+		msgs = append(msgs, "rating.min ("+strconv.Itoa(c.MinRating)+") is above rating.max ("+strconv.Itoa(c.MaxRating)+")")
+	} else if c.DefaultRating < c.MinRating || c.DefaultRating > c.MaxRating {
+		msgs = append(msgs, "defaults.rating ("+strconv.Itoa(c.DefaultRating)+") is outside rating.min to rating.max")
+	}
+	if c.MinReviewRating > c.MaxReviewRating {
+		msgs = append(msgs, "reviews.min ("+strconv.Itoa(c.MinReviewRating)+") is above reviews.max ("+strconv.Itoa(c.MaxReviewRating)+")")
+	}
+	switch c.ReviewModeration {
+	case "pre", "post":
+	default:
+		msgs = append(msgs, "reviews.moderation must be pre or post, not "+strconv.Quote(c.ReviewModeration))
+	}
+	// a layout that can't read back what it writes is no good for PublishDate
+	probe := time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC)
+	if d, err := time.Parse(c.DateFormat, probe.Format(c.DateFormat)); err != nil || !d.Equal(probe) {
+		msgs = append(msgs, "date_format "+strconv.Quote(c.DateFormat)+" doesn't keep the year, month and day. Try something like 2006-01-02")
+	}
+	for _, d := range []struct {
+		name string
+		d    time.Duration
+	}{{"timeouts.read", c.ReadTimeout}, {"timeouts.write", c.WriteTimeout}, {"timeouts.idle", c.IdleTimeout}, {"timeouts.shutdown", c.ShutdownTimeout}} {
+		if d.d <= 0 {
+			msgs = append(msgs, d.name+" must be more than 0")
+		}
+	}
+	if !c.V1Deprecated.IsZero() && !c.V1Sunset.IsZero() && c.V1Sunset.Before(c.V1Deprecated) {
+		msgs = append(msgs, "api.v1.sunset is before api.v1.deprecated")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		msgs = append(msgs, "tls.cert and tls.key go together")
+	}
+	switch c.TLSClientAuth {
+	case "none":
+	case "optional", "require":
+		if c.TLSClientCA == "" {
+			msgs = append(msgs, "tls.client_auth "+c.TLSClientAuth+" needs tls.client_ca")
+		}
+		if c.TLSCert == "" {
+			msgs = append(msgs, "client certificates need tls.cert and tls.key")
+		}
+	default:
+		msgs = append(msgs, "tls.client_auth must be none, optional or require, not "+strconv.Quote(c.TLSClientAuth))
+	}
+	switch c.AccessLog {
+	case "stdout", "stderr", "off":
+	default:
+		msgs = append(msgs, "log.access must be stdout, stderr or off, not "+strconv.Quote(c.AccessLog))
+	}
+	switch c.TraceExport {
+	case "off", "stdout":
+	case "otlp":
+		if u, err := url.Parse(c.TraceEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			msgs = append(msgs, "trace.endpoint must be an http or https URL, not "+strconv.Quote(c.TraceEndpoint))
+		}
+	default:
+		msgs = append(msgs, "trace.export must be off, stdout or otlp, not "+strconv.Quote(c.TraceExport))
+	}
+	if c.MaxCoverBytes < 1024 {
+		msgs = append(msgs, "covers.max_bytes must be at least 1024")
+	}
+	if c.MaxHeaderBytes < 1024 {
+		msgs = append(msgs, "max_header_bytes must be at least 1024")
+	}
+	if c.AuditMemory < 1 {
+		msgs = append(msgs, "audit.memory must be at least 1")
+	}
+	if len(msgs) > 0 {
+		return errors.New("invalid config: " + strings.Join(msgs, "; "))
+	}
+	return nil
+}
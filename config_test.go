@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envFrom(m map[string]string) func(string) string {
+	return func(k string) string { return m[k] }
+}
+
+func TestConfigDefaults(t *testing.T) {
+	c, err := loadConfig(nil, envFrom(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != ":8080" || c.Storage != "memory" || c.DateFormat != TIME_FMT || c.MinRating != 1 || c.MaxRating != 3 {
+		t.Errorf("unexpected defaults %+v", c)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "booklist.toml")
+	ioutil.WriteFile(path, []byte(`
+# where to listen
+listen = ":9000"
+date_format = '2006-01-02'
+
+[storage]
+backend = "file"
+path = "/tmp/books.json"   # trailing comment
+
+[defaults]
+title = "Untitled \"Work\""
+rating = 5
+
+[rating]
+min = 1
+max = 5
+
+[timeouts]
+read = "3s"
+`), 0600)
+
+	c, err := loadConfig([]string{"-config", path, "-listen", ":9002"},
+		envFrom(map[string]string{"BOOKLIST_LISTEN": ":9001", "BOOKLIST_DEFAULTS_AUTHOR": "Anon"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flag beats env beats file
+	if c.Listen != ":9002" {
+		t.Errorf("Listen is %q, expected the flag's :9002", c.Listen)
+	}
+	if c.DefaultAuthor != "Anon" {
+		t.Errorf("DefaultAuthor is %q, expected the env's Anon", c.DefaultAuthor)
+	}
+	if c.Storage != "file" || c.StoragePath != "/tmp/books.json" || c.DateFormat != "2006-01-02" ||
+		c.DefaultTitle != `Untitled "Work"` || c.DefaultRating != 5 || c.MaxRating != 5 || c.ReadTimeout != 3*time.Second {
+		t.Errorf("file settings not applied %+v", c)
+	}
+
+	// the config file can come from the environment too
+	c, err = loadConfig(nil, envFrom(map[string]string{"BOOKLIST_CONFIG": path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != ":9000" {
+		t.Errorf("Listen is %q, expected the file's :9000", c.Listen)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		args []string
+		env  map[string]string
+		file string
+		want string
+	}{
+		{args: []string{"-rating-max", "lots"}, want: "-rating-max must be a whole number"},
+		{args: []string{"-nonsense"}, want: "flag provided but not defined"},
+		{env: map[string]string{"BOOKLIST_TIMEOUTS_IDLE": "forever"}, want: "BOOKLIST_TIMEOUTS_IDLE must be a duration"},
+		{args: []string{"-rating-min", "4"}, want: "rating.min (4) is above rating.max (3)"},
+		{args: []string{"-defaults-rating", "9"}, want: "defaults.rating (9) is outside"},
+		{args: []string{"-storage-backend", "postgres"}, want: "storage.backend must be memory or file"},
+		{args: []string{"-storage-backend", "file"}, want: "storage.path is needed"},
+		{args: []string{"-date-format", "Jan"}, want: "doesn't keep the year, month and day"},
+		{args: []string{"-defaults-status", "Lost"}, want: "must be CheckedIn or CheckedOut"},
+		{args: []string{"-api-v1-sunset", "next year"}, want: "-api-v1-sunset must be a day like"},
+		{args: []string{"-api-v1-sunset", "2026-01-01"}, want: "api.v1.sunset is before api.v1.deprecated"},
+		{args: []string{"-reviews-min", "6"}, want: "reviews.min (6) is above reviews.max (5)"},
+		{args: []string{"-reviews-moderation", "never"}, want: "reviews.moderation must be pre or post"},
+		{args: []string{"-audit-memory", "0"}, want: "audit.memory must be at least 1"},
+		{file: "[storage]\nbackend = \"memory\"\ncolour = \"blue\"\n", want: "line 3: unknown setting storage.colour"},
+		{file: "listen = \":80\n", want: "line 1: unterminated string"},
+		{file: "[timeouts\n", want: "line 1: bad section header"},
+		{file: "listen\n", want: "line 1: expected key = value"},
+	}
+	for i, c := range cases {
+		args := c.args
+		if c.file != "" {
+			path := filepath.Join(dir, "c.toml")
+			ioutil.WriteFile(path, []byte(c.file), 0600)
+			args = append([]string{"-config", path}, args...)
+		}
+		_, err := loadConfig(args, envFrom(c.env))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("case %d: got error %v, expected one containing %q", i+1, err, c.want)
+		}
+	}
+}
+
+func TestConfiguredDefaultsAndBounds(t *testing.T) {
+	old := cfg
+	defer func() { cfg = old }()
+	cfg = defaultConfig()
+	cfg.DefaultTitle = "Mystery"
+	cfg.DefaultRating = 7
+	cfg.MinRating = 0
+	cfg.MaxRating = 10
+	cfg.DateFormat = "2006-01-02"
+
+	b := NewBook()
+	if b.Title != "Mystery" || b.Rating != 7 {
+		t.Errorf("configured defaults not used %+v", b)
+	}
+	if ok, msg := validateQuery(map[string][]string{"Rating": {"10"}, "PublishDate": {"1999-12-31"}}); !ok {
+		t.Error("valid query rejected: ", msg)
+	}
+	ok, msg := validateQuery(map[string][]string{"Rating": {"11"}})
+	if ok || !strings.Contains(msg, "from 0 to 10") {
+		t.Error("out of range rating accepted, or message doesn't give the range: ", msg)
+	}
+	if ok, _ := validateQuery(map[string][]string{"PublishDate": {"1999-Dec-31"}}); ok {
+		t.Error("date in the wrong format accepted")
+	}
+}
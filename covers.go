@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cover images. PUT /book/{id}/cover takes a JPEG or PNG, going by what's
+// in it rather than what the Content-Type says, and GET /book/{id}/cover
+// gives it back, or with ?size= a thumbnail that fits in that many pixels
+// square. Thumbnails are made the first time they're asked for, with
+// nothing but the standard library, and kept for a while after, and the
+// ETag lets browsers keep them too. Sizes go down to the nearest of
+// thumbnailSizes, so there are only so many of each to make. The images
+// are too big to go in with the books, so they're kept on their own: in a
+// directory with the file backend, or covers.dir, and in memory otherwise.
+
+// the biggest thumbnail, in pixels. Anything bigger may as well be the
+// original.
+const maxThumbnailSize = 1024
+
+// the sizes thumbnails are actually made in. One asked for in between gets
+// the next size down, and below the smallest, the size asked for.
+var thumbnailSizes = []int{16, 24, 32, 48, 64, 96, 128, 160, 200, 240, 320, 400, 480, 640, 800, maxThumbnailSize}
+
+// how much the thumbnails kept in memory can come to, in bytes
+const thumbnailCacheBytes = 32 << 20
+
+// a cover that decodes to more than this many pixels would take too much
+// memory to make thumbnails of
+const maxCoverPixels = 25000000
+
+// what a cover can be, by their file extensions
+var coverTypes = map[string]string{"image/jpeg": ".jpg", "image/png": ".png"}
+
+type Cover struct {
+	// image/jpeg or image/png
+	Type     string
+	Data     []byte
+	Modified time.Time
+}
+
+// Where the covers live, by book ID. All the methods are safe to call
+// concurrently.
+type CoverStore interface {
+	// Get returns errNotFound if the book hasn't got one.
+	Get(id int) (Cover, error)
+	Has(id int) bool
+	Put(id int, c Cover) error
+	// Delete is harmless if there's nothing to delete.
+	Delete(id int) error
+}
+
+// main replaces it, going by the config
+var covers CoverStore = newMemCovers()
+
+type memCovers struct {
+	lock   sync.RWMutex
+	covers map[int]Cover
+}
+
+func newMemCovers() *memCovers {
+	return &memCovers{covers: make(map[int]Cover)}
+}
+
+func (s *memCovers) Get(id int) (Cover, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	c, there := s.covers[id]
+	if !there {
+		return Cover{}, errNotFound
+	}
+	return c, nil
+}
+
+func (s *memCovers) Has(id int) bool {
+	_, err := s.Get(id)
+	return err == nil
+}
+
+func (s *memCovers) Put(id int, c Cover) error {
+	s.lock.Lock()
+	s.covers[id] = c
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *memCovers) Delete(id int) error {
+	s.lock.Lock()
+	delete(s.covers, id)
+	s.lock.Unlock()
+	return nil
+}
+
+// dirCovers keeps each cover in a file of its own, 12.jpg or 12.png, and
+// the file's modification time is the cover's
+type dirCovers struct {
+	// so a Put and a Delete of the same cover don't cross
+	lock sync.Mutex
+	dir  string
+}
+
+func openDirCovers(dir string) (*dirCovers, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirCovers{dir: dir}, nil
+}
+
+func (s *dirCovers) path(id int, mediaType string) string {
+	return filepath.Join(s.dir, strconv.Itoa(id)+coverTypes[mediaType])
+}
+
+func (s *dirCovers) Get(id int) (Cover, error) {
+	for t := range coverTypes {
+		f, err := os.Open(s.path(id, t))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return Cover{}, err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return Cover{}, err
+		}
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return Cover{}, err
+		}
+		return Cover{Type: t, Data: data, Modified: info.ModTime()}, nil
+	}
+	return Cover{}, errNotFound
+}
+
+func (s *dirCovers) Has(id int) bool {
+	for t := range coverTypes {
+		if _, err := os.Stat(s.path(id, t)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Put writes the cover to a temp file and renames it over the old one, like
+// fileStore, and then gets rid of the old one if it was the other type
+func (s *dirCovers) Put(id int, c Cover) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tmp, err := ioutil.TempFile(s.dir, strconv.Itoa(id)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(c.Data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), c.Modified, c.Modified); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(id, c.Type)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	for t := range coverTypes {
+		if t != c.Type {
+			if err := os.Remove(s.path(id, t)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *dirCovers) Delete(id int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for t := range coverTypes {
+		if err := os.Remove(s.path(id, t)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func openCovers(c *Config) (CoverStore, error) {
+	dir := c.CoverDir
+	if dir == "" && c.Storage == "file" {
+		dir = c.StoragePath + ".covers"
+	}
+	if dir == "" {
+		return newMemCovers(), nil
+	}
+	return openDirCovers(dir)
+}
+
+// isCoverPath says whether p is a book's cover, which isn't a book, and
+// doesn't come in any of the book formats
+func isCoverPath(p string) bool {
+	_, rest := apiVersion(p)
+	segments := strings.Split(rest, "/")
+	return len(segments) == 4 && segments[1] == "book" && segments[3] == "cover"
+}
+
+// readCover checks an uploaded cover. Whatever Content-Type it came with,
+// it's what's in it that counts, so curl --data-binary does. If it won't
+// do, code and message say why.
+func readCover(data []byte) (c Cover, code int, message string) {
+	if len(data) > cfg.MaxCoverBytes {
+		return Cover{}, 413, "Cover too large. It can be at most " + strconv.Itoa(cfg.MaxCoverBytes) + " bytes."
+	}
+	sniffed := http.DetectContentType(data)
+	if _, ok := coverTypes[sniffed]; !ok {
+		return Cover{}, 415, "Unsupported Media Type: a cover has to be a JPEG or PNG image."
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Cover{}, 400, "Error reading the image: " + err.Error()
+	}
+	if config.Width*config.Height > maxCoverPixels {
+		return Cover{}, 400, "The image is too big, at " + strconv.Itoa(config.Width) + "x" + strconv.Itoa(config.Height) + ". Covers can be up to 25 megapixels."
+	}
+	// the header can be fine and the rest not
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return Cover{}, 400, "Error reading the image: " + err.Error()
+	}
+	return Cover{Type: sniffed, Data: data, Modified: time.Now().UTC()}, 0, ""
+}
+
+// PUT /book/{id}/cover. The body is the image.
+func putCover(w http.ResponseWriter, req *http.Request) {
+	id, err := bookID(req)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	if _, err := storeFor(req).Get(id); err == errNotFound {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, int64(cfg.MaxCoverBytes)))
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(413)
+		io.WriteString(w, "Cover too large. It can be at most "+strconv.Itoa(cfg.MaxCoverBytes)+" bytes.")
+		return
+	}
+	c, code, message := readCover(data)
+	if code != 0 {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(code)
+		io.WriteString(w, message)
+		return
+	}
+	if err := covers.Put(id, c); err != nil {
+		storageError(w, err)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// GET /book/{id}/cover?size=
+func getCover(w http.ResponseWriter, req *http.Request) {
+	id, err := bookID(req)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	serveCover(w, req, id)
+}
+
+// serveCover answers with book id's cover, or a thumbnail of it if the
+// query has a size. The web UI serves them this way too.
+func serveCover(w http.ResponseWriter, req *http.Request, id int) {
+	size := 0
+	if v := req.URL.Query().Get("size"); v != "" {
+		var err error
+		size, err = strconv.Atoi(v)
+		if err != nil || size < 1 || size > maxThumbnailSize {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(400)
+			io.WriteString(w, "Error parsing size. Value must be a whole number of pixels from 1 to "+strconv.Itoa(maxThumbnailSize)+".")
+			return
+		}
+		asked := size
+		for _, s := range thumbnailSizes {
+			if s <= asked {
+				size = s
+			}
+		}
+	}
+	c, err := covers.Get(id)
+	if err == errNotFound {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	// it's the same thumbnail for as long as it's the same cover. Browsers
+	// keep it, but ask each time, since it can be replaced.
+	etag := `"` + strconv.FormatInt(c.Modified.UnixNano(), 36) + "-" + strconv.Itoa(size) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if match := req.Header.Get("If-None-Match"); match == "*" || strings.Contains(match, etag) {
+		// before going to the trouble of making it
+		w.WriteHeader(304)
+		return
+	}
+	data := c.Data
+	if size > 0 {
+		key := thumbnailKey{id, c.Modified.UnixNano(), size}
+		var there bool
+		if data, there = thumbnails.get(key); !there {
+			if data, err = thumbnailOf(c, size); err != nil {
+				storageError(w, err)
+				return
+			}
+			thumbnails.put(key, data)
+		}
+	}
+	w.Header().Set("Content-Type", c.Type)
+	http.ServeContent(w, req, "", c.Modified, bytes.NewReader(data))
+}
+
+// thumbnailKey is a thumbnail of one version of a cover. A new cover has a
+// new Modified, so its old thumbnails are never asked for again, and go
+// when they're the oldest.
+type thumbnailKey struct {
+	id       int
+	modified int64
+	size     int
+}
+
+// thumbnailCache keeps the thumbnails used last, up to max bytes of them
+type thumbnailCache struct {
+	lock  sync.Mutex
+	max   int
+	used  int
+	items map[thumbnailKey]*list.Element
+	// most recently used first
+	order *list.List
+}
+
+type thumbnailItem struct {
+	key  thumbnailKey
+	data []byte
+}
+
+var thumbnails = newThumbnailCache(thumbnailCacheBytes)
+
+func newThumbnailCache(max int) *thumbnailCache {
+	return &thumbnailCache{max: max, items: map[thumbnailKey]*list.Element{}, order: list.New()}
+}
+
+func (c *thumbnailCache) get(key thumbnailKey) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, there := c.items[key]
+	if !there {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*thumbnailItem).data, true
+}
+
+func (c *thumbnailCache) put(key thumbnailKey, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, there := c.items[key]; there || len(data) > c.max {
+		return
+	}
+	c.items[key] = c.order.PushFront(&thumbnailItem{key, data})
+	c.used += len(data)
+	for c.used > c.max {
+		oldest := c.order.Back().Value.(*thumbnailItem)
+		c.order.Remove(c.order.Back())
+		delete(c.items, oldest.key)
+		c.used -= len(oldest.data)
+	}
+}
+
+// thumbnailOf is c scaled down to fit in size pixels square, in the same
+// format. A cover that fits already is left as it is.
+func thumbnailOf(c Cover, size int) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(c.Data))
+	if err != nil {
+		return nil, errors.New("reading cover: " + err.Error())
+	}
+	if config.Width <= size && config.Height <= size {
+		return c.Data, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(c.Data))
+	if err != nil {
+		return nil, errors.New("reading cover: " + err.Error())
+	}
+	var buf bytes.Buffer
+	if c.Type == "image/png" {
+		err = png.Encode(&buf, thumbnail(img, size))
+	} else {
+		err = jpeg.Encode(&buf, thumbnail(img, size), &jpeg.Options{Quality: 85})
+	}
+	return buf.Bytes(), err
+}
+
+// thumbnail scales img down to fit in size pixels square, keeping its
+// shape. Each pixel is the average of the ones it stands for, which is as
+// good as anything for shrinking.
+func thumbnail(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := size, size
+	if w > h {
+		th = h * size / w
+	} else {
+		tw = w * size / h
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	// RGBA, so it's the same whatever the image was, and quick to get at
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := y*h/th, (y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := x*w/tw, (x+1)*w/tw
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			for i, s := range sum {
+				dst.Pix[y*dst.Stride+x*4+i] = uint8((s + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
+
+// forgetCover gets rid of a deleted book's cover, so the next book with its
+// ID doesn't get it
+func forgetCover(id int) {
+	if err := covers.Delete(id); err != nil {
+		log.Println("deleting cover of book", id, err)
+	}
+}
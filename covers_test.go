@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a w by h image, red on the left half and blue on the right
+func testCover(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= w/2 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func testPNG(w, h int) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, testCover(w, h))
+	return buf.Bytes()
+}
+
+func testJPEG(w, h int) []byte {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, testCover(w, h), nil)
+	return buf.Bytes()
+}
+
+// the start of a PNG that says it's w by h, and nothing else
+func pngHeader(w, h uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, w)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, h)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+	b := append([]byte("\x89PNG\r\n\x1a\n"), 0, 0, 0, 13)
+	b = append(b, ihdr...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(ihdr))
+}
+
+func coverRequest(method, target, contentType string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	bookHandler(rec, req)
+	return rec
+}
+
+func TestThumbnail(t *testing.T) {
+	for _, c := range []struct {
+		w, h, size, tw, th int
+	}{
+		{400, 200, 100, 100, 50},
+		{200, 400, 100, 50, 100},
+		{300, 300, 64, 64, 64},
+		{1000, 3, 10, 10, 1},
+	} {
+		thumb := thumbnail(testCover(c.w, c.h), c.size)
+		if b := thumb.Bounds(); b.Dx() != c.tw || b.Dy() != c.th {
+			t.Errorf("%dx%d at %d came out %dx%d, expected %dx%d", c.w, c.h, c.size, b.Dx(), b.Dy(), c.tw, c.th)
+			continue
+		}
+		if left, right := thumb.RGBAAt(0, 0), thumb.RGBAAt(c.tw-1, c.th-1); left != (color.RGBA{255, 0, 0, 255}) || right != (color.RGBA{0, 0, 255, 255}) {
+			t.Errorf("%dx%d at %d has %v on the left and %v on the right", c.w, c.h, c.size, left, right)
+		}
+	}
+	// the middle of an odd one is half and half
+	if mid := thumbnail(testCover(3, 1), 1).RGBAAt(0, 0); mid != (color.RGBA{85, 0, 170, 255}) {
+		t.Errorf("averaged to %v", mid)
+	}
+
+	small := Cover{Type: "image/png", Data: testPNG(40, 20)}
+	if data, err := thumbnailOf(small, 100); err != nil || !bytes.Equal(data, small.Data) {
+		t.Errorf("a cover that fits was changed, %v", err)
+	}
+	for _, c := range []Cover{{Type: "image/png", Data: testPNG(400, 200)}, {Type: "image/jpeg", Data: testJPEG(400, 200)}} {
+		data, err := thumbnailOf(c, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || "image/"+format != c.Type || config.Width != 100 || config.Height != 50 {
+			t.Errorf("%s thumbnail is a %dx%d %s, %v", c.Type, config.Width, config.Height, format, err)
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	store = newMemStore()
+	saved := cfg
+	defer func() { store = nil; covers = newMemCovers(); cfg = saved }()
+	covers = newMemCovers()
+	cfg = defaultConfig()
+	store.Create(1, NewBook())
+	doc := servedSpec(t)
+
+	if rec := coverRequest(http.MethodGet, "/book/1/cover", "", nil); rec.Code != 404 {
+		t.Errorf("no cover gave %d", rec.Code)
+	}
+	cover := testPNG(400, 200)
+	// what curl --data-binary sends; it's what's in it that counts
+	rec := coverRequest(http.MethodPut, "/book/1/cover", "application/x-www-form-urlencoded", cover)
+	if rec.Code != 204 {
+		t.Fatalf("PUT gave %d %s", rec.Code, rec.Body)
+	}
+	for _, p := range checkResponse(doc, http.MethodPut, "/book/{id}/cover", rec) {
+		t.Error(p)
+	}
+
+	rec = coverRequest(http.MethodGet, "/book/1/cover", "", nil)
+	etag := rec.Header().Get("ETag")
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "image/png" || !bytes.Equal(rec.Body.Bytes(), cover) || etag == "" ||
+		rec.Header().Get("Last-Modified") == "" || rec.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Errorf("GET gave %d %v", rec.Code, rec.Header())
+	}
+	for _, p := range checkResponse(doc, http.MethodGet, "/book/{id}/cover", rec) {
+		t.Error(p)
+	}
+
+	// 50 goes down to 48
+	rec = coverRequest(http.MethodGet, "/v2/book/1/cover?size=50", "", nil)
+	thumbnail, thumbnailETag := rec.Body.Bytes(), rec.Header().Get("ETag")
+	config, _, err := image.DecodeConfig(rec.Body)
+	if rec.Code != 200 || err != nil || config.Width != 48 || config.Height != 24 || thumbnailETag == etag {
+		t.Errorf("thumbnail gave %d %dx%d %v, ETag %s", rec.Code, config.Width, config.Height, err, thumbnailETag)
+	}
+	c, _ := covers.Get(1)
+	if data, there := thumbnails.get(thumbnailKey{1, c.Modified.UnixNano(), 48}); !there || !bytes.Equal(data, thumbnail) {
+		t.Errorf("the thumbnail wasn't kept")
+	}
+	rec = coverRequest(http.MethodGet, "/book/1/cover?size=48", "", nil)
+	if rec.Code != 200 || !bytes.Equal(rec.Body.Bytes(), thumbnail) || rec.Header().Get("ETag") != thumbnailETag {
+		t.Errorf("size=48 gave %d, ETag %s, not the same as size=50", rec.Code, rec.Header().Get("ETag"))
+	}
+	req := httptest.NewRequest(http.MethodGet, "/book/1/cover", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	bookHandler(rec, req)
+	if rec.Code != 304 || rec.Body.Len() != 0 {
+		t.Errorf("If-None-Match gave %d", rec.Code)
+	}
+	for _, p := range checkResponse(doc, http.MethodGet, "/book/{id}/cover", rec) {
+		t.Error(p)
+	}
+	// a new one is a new ETag
+	time.Sleep(time.Millisecond)
+	if rec := coverRequest(http.MethodPut, "/book/1/cover", "", testJPEG(100, 100)); rec.Code != 204 {
+		t.Errorf("JPEG with no Content-Type gave %d %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	bookHandler(rec, req)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("after replacing it, If-None-Match gave %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	for _, c := range []struct {
+		method, target, contentType string
+		body                        []byte
+		code                        int
+		message                     string
+	}{
+		{"GET", "/book/1/cover?size=0", "", nil, 400, "Error parsing size."},
+		{"GET", "/book/1/cover?size=2000", "", nil, 400, "from 1 to 1024"},
+		{"GET", "/book/1/cover?size=big", "", nil, 400, "Error parsing size."},
+		{"GET", "/book/2/cover", "", nil, 404, ""},
+		{"PUT", "/book/2/cover", "image/png", cover, 404, ""},
+		{"PUT", "/book/x/cover", "image/png", cover, 404, ""},
+		{"PUT", "/book/1/cover", "image/png", []byte("<svg xmlns='http://www.w3.org/2000/svg'/>"), 415, "JPEG or PNG"},
+		{"PUT", "/book/1/cover", "image/gif", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"), 415, "JPEG or PNG"},
+		{"PUT", "/book/1/cover", "image/png", cover[:len(cover)/2], 400, "Error reading the image"},
+		{"PUT", "/book/1/cover", "image/png", pngHeader(30000, 30000), 400, "too big, at 30000x30000"},
+		{"DELETE", "/book/1/cover", "", nil, 405, ""},
+	} {
+		rec := coverRequest(c.method, c.target, c.contentType, c.body)
+		if rec.Code != c.code || !strings.Contains(rec.Body.String(), c.message) {
+			t.Errorf("%s %s gave %d %q, expected %d %q", c.method, c.target, rec.Code, rec.Body, c.code, c.message)
+		}
+		if c.method == http.MethodDelete {
+			continue
+		}
+		for _, p := range checkResponse(doc, c.method, "/book/{id}/cover", rec) {
+			t.Error(p)
+		}
+	}
+	if c, _ := covers.Get(1); c.Type != "image/jpeg" {
+		t.Errorf("a bad upload replaced the cover with a %s", c.Type)
+	}
+
+	cfg.MaxCoverBytes = 1024
+	if rec := coverRequest(http.MethodPut, "/book/1/cover", "image/png", append(cover, make([]byte, 1024)...)); rec.Code != 413 {
+		t.Errorf("too large gave %d %s", rec.Code, rec.Body)
+	}
+	cfg.MaxCoverBytes = saved.MaxCoverBytes
+
+	// it goes with the book
+	coverRequest(http.MethodDelete, "/book/1", "", nil)
+	store.Create(1, NewBook())
+	if rec := coverRequest(http.MethodGet, "/book/1/cover", "", nil); rec.Code != 404 {
+		t.Errorf("deleted book's cover gave %d", rec.Code)
+	}
+}
+
+func TestThumbnailCache(t *testing.T) {
+	c := newThumbnailCache(10)
+	c.put(thumbnailKey{1, 1, 48}, make([]byte, 4))
+	c.put(thumbnailKey{2, 1, 48}, make([]byte, 4))
+	// 1 was used last, so 2 is the one to go
+	c.get(thumbnailKey{1, 1, 48})
+	c.put(thumbnailKey{3, 1, 48}, make([]byte, 4))
+	if _, there := c.get(thumbnailKey{2, 1, 48}); there {
+		t.Error("kept more than fits")
+	}
+	for _, id := range []int{1, 3} {
+		if _, there := c.get(thumbnailKey{id, 1, 48}); !there {
+			t.Errorf("%d went", id)
+		}
+	}
+	c.put(thumbnailKey{4, 1, 48}, make([]byte, 11))
+	if _, there := c.get(thumbnailKey{4, 1, 48}); there || c.used != 8 {
+		t.Errorf("kept one bigger than the whole cache, using %d", c.used)
+	}
+}
+
+func TestCoverPermissions(t *testing.T) {
+	store = newMemStore()
+	auth = testAuthenticator(t)
+	saved := policy.current()
+	defer func() { store = nil; auth = nil; covers = newMemCovers(); policy.policy = saved }()
+	covers = newMemCovers()
+	store.Create(1, NewBook())
+	h := readBody(authenticate(authorize(bookActions, bookHandler)))
+	put := func() int {
+		req := httptest.NewRequest(http.MethodPut, "/book/1/cover", bytes.NewReader(testPNG(10, 10)))
+		req.Header.Set("X-API-Key", "current-key")
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+	// the default role reads, and that's all
+	if code := put(); code != 403 {
+		t.Errorf("reader uploaded a cover, %d", code)
+	}
+	policy.policy = &Policy{Roles: saved.Roles, Callers: map[string]string{"frontdesk": "cataloger"}}
+	if code := put(); code != 204 {
+		t.Errorf("cataloger's upload gave %d", code)
+	}
+}
+
+func TestDirCovers(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "covers")
+	s, err := openDirCovers(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(1); err != errNotFound || s.Has(1) {
+		t.Errorf("empty dir gave %v", err)
+	}
+	if err := s.Delete(1); err != nil {
+		t.Errorf("deleting nothing gave %v", err)
+	}
+	modified := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	if err := s.Put(1, Cover{Type: "image/png", Data: testPNG(10, 10), Modified: modified}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(1, Cover{Type: "image/jpeg", Data: testJPEG(10, 10), Modified: modified}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.Get(1)
+	if err != nil || c.Type != "image/jpeg" || !bytes.Equal(c.Data, testJPEG(10, 10)) || !c.Modified.Equal(modified) || !s.Has(1) {
+		t.Errorf("got %s %v %v", c.Type, c.Modified, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 || filepath.Base(files[0]) != "1.jpg" {
+		t.Errorf("left %v behind", files)
+	}
+	if err := s.Delete(1); err != nil || s.Has(1) {
+		t.Errorf("delete gave %v", err)
+	}
+
+	// next to the books, with the file backend
+	c2 := defaultConfig()
+	c2.Storage, c2.StoragePath = "file", filepath.Join(t.TempDir(), "books.json")
+	if cs, err := openCovers(c2); err != nil {
+		t.Error(err)
+	} else if _, err := os.Stat(c2.StoragePath + ".covers"); err != nil || cs.(*dirCovers).dir != c2.StoragePath+".covers" {
+		t.Errorf("file backend covers went elsewhere, %v", err)
+	}
+	if cs, _ := openCovers(defaultConfig()); cs == nil {
+		t.Error("no covers with the memory backend")
+	} else if _, ok := cs.(*memCovers); !ok {
+		t.Errorf("memory backend covers are a %T", cs)
+	}
+}
+
+func TestUICover(t *testing.T) {
+	freshAudit()
+	defer func() { store = nil; audit = nil; covers = newMemCovers() }()
+	covers = newMemCovers()
+	store.Create(1, Book{Title: "Dune"})
+	srv := uiServer(t)
+	b := newUIBrowser(t, srv)
+	if _, page := b.get("/ui/book/1"); strings.Contains(page, `<img class="cover"`) || !strings.Contains(page, "Upload a cover") {
+		t.Error("a book without a cover shows one")
+	}
+
+	upload := func(name string, data []byte) (int, string) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("csrf", b.csrf)
+		if name != "" {
+			fw, _ := mw.CreateFormFile("cover", name)
+			fw.Write(data)
+		}
+		mw.Close()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/ui/book/1/cover", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		return b.do(req)
+	}
+	if code, page := upload("", nil); code != 400 || !strings.Contains(page, "Choose a JPEG or PNG") {
+		t.Errorf("no file gave %d", code)
+	}
+	if code, page := upload("cover.txt", []byte("not a picture")); code != 415 || !strings.Contains(page, "has to be a JPEG or PNG") {
+		t.Errorf("text file gave %d", code)
+	}
+	if code, where := upload("cover.png", testPNG(300, 450)); code != 303 || where != "/ui/book/1?note=cover" {
+		t.Errorf("upload gave %d %s", code, where)
+	}
+	if _, page := b.get("/ui/book/1?note=cover"); !strings.Contains(page, `<img class="cover" src="/ui/book/1/cover?size=240"`) || !strings.Contains(page, "Cover uploaded.") {
+		t.Error("the book page doesn't show the cover")
+	}
+	if _, page := b.get("/ui/"); !strings.Contains(page, `src="/ui/book/1/cover?size=48"`) {
+		t.Error("the list doesn't show the cover")
+	}
+	resp, err := b.c.Get(srv.URL + "/ui/book/1/cover?size=48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := image.DecodeConfig(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || err != nil || config.Width != 32 || config.Height != 48 {
+		t.Errorf("thumbnail gave %d %dx%d %v", resp.StatusCode, config.Width, config.Height, err)
+	}
+
+	saved := cfg.MaxCoverBytes
+	cfg.MaxCoverBytes = 1024
+	defer func() { cfg.MaxCoverBytes = saved }()
+	if code, _ := upload("big.png", make([]byte, 1024+uiFormSlack)); code != 413 {
+		t.Errorf("too large gave %d", code)
+	}
+	if e := audit.query(time.Time{}, time.Time{}, 1); len(e) == 0 || e[len(e)-1].Path != "/ui/book/1/cover" {
+		t.Errorf("uploads weren't audited: %v", e)
+	}
+}
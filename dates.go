@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Publish dates. Plenty of old books only have a year, or a year and a
+// month, so a PublishDate says how much of it is known: a partial date is
+// kept as the first day of its year or month, with its PublishPrecision.
+// They're read in cfg.DateFormat or ISO 8601, and partial ones are written
+// the ISO way, 1815 or 1815-12, in every format.
+
+type DatePrecision int
+
+const (
+	DayPrecision DatePrecision = iota
+	MonthPrecision
+	YearPrecision
+)
+
+var precisionNames = []string{"day", "month", "year"}
+
+func (p DatePrecision) String() string {
+	if p < DayPrecision || p > YearPrecision {
+		return "day"
+	}
+	return precisionNames[p]
+}
+
+// so it's "year" in JSON and XML, not 2
+func (p DatePrecision) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *DatePrecision) UnmarshalText(text []byte) error {
+	for i, name := range precisionNames {
+		if string(text) == name {
+			*p = DatePrecision(i)
+			return nil
+		}
+	}
+	return errors.New("precision must be day, month or year, not " + string(text))
+}
+
+// the ISO 8601 layouts, most precise first
+var isoDates = []struct {
+	layout    string
+	precision DatePrecision
+}{
+	{"2006-01-02", DayPrecision},
+	{"20060102", DayPrecision},
+	{"2006-01", MonthPrecision},
+	{"2006", YearPrecision},
+}
+
+// parseISODate reads a calendar date, a year and month, or a year, or a
+// date and time, of which only the date counts
+func parseISODate(v string) (time.Time, DatePrecision, error) {
+	if strings.Contains(v, "T") {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, DayPrecision, err
+		}
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), DayPrecision, nil
+	}
+	for _, f := range isoDates {
+		// time.Parse takes 2006 for 20060102's year, so the length has to match
+		if len(v) != len(f.layout) {
+			continue
+		}
+		if d, err := time.Parse(f.layout, v); err == nil {
+			return d, f.precision, nil
+		}
+	}
+	return time.Time{}, DayPrecision, errors.New("not an ISO 8601 date")
+}
+
+// parsePublishDate reads a PublishDate as the query has it: in the
+// server's date format, or ISO 8601
+func parsePublishDate(v string) (time.Time, DatePrecision, error) {
+	if d, err := time.Parse(cfg.DateFormat, v); err == nil {
+		return d, DayPrecision, nil
+	}
+	return parseISODate(v)
+}
+
+// formatDate writes a day in layout, and anything less the ISO way
+func formatDate(d time.Time, p DatePrecision, layout string) string {
+	switch p {
+	case YearPrecision:
+		return d.Format("2006")
+	case MonthPrecision:
+		return d.Format("2006-01")
+	}
+	return d.Format(layout)
+}
+
+// the book's PublishDate, the way the query takes it
+func (b Book) publishDate() string {
+	return formatDate(b.PublishDate, b.PublishPrecision, cfg.DateFormat)
+}
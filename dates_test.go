@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePublishDate(t *testing.T) {
+	defer func(f string) { cfg.DateFormat = f }(cfg.DateFormat)
+	cfg.DateFormat = TIME_FMT
+	for v, expected := range map[string]struct {
+		date      time.Time
+		precision DatePrecision
+	}{
+		"1815-Dec-23":          {time.Date(1815, 12, 23, 0, 0, 0, 0, time.UTC), DayPrecision},
+		"1815-12-23":           {time.Date(1815, 12, 23, 0, 0, 0, 0, time.UTC), DayPrecision},
+		"18151223":             {time.Date(1815, 12, 23, 0, 0, 0, 0, time.UTC), DayPrecision},
+		"1815-12-23T22:10:00Z": {time.Date(1815, 12, 23, 0, 0, 0, 0, time.UTC), DayPrecision},
+		// the day it was there, not in UTC
+		"1815-12-23T23:30:00-05:00": {time.Date(1815, 12, 23, 0, 0, 0, 0, time.UTC), DayPrecision},
+		"1815-12":                   {time.Date(1815, 12, 1, 0, 0, 0, 0, time.UTC), MonthPrecision},
+		"1815":                      {time.Date(1815, 1, 1, 0, 0, 0, 0, time.UTC), YearPrecision},
+	} {
+		d, p, err := parsePublishDate(v)
+		if err != nil || !d.Equal(expected.date) || p != expected.precision {
+			t.Errorf("%s gave %v %v %v", v, d, p, err)
+		}
+		if got := formatDate(d, p, cfg.DateFormat); p != DayPrecision && got != v {
+			t.Errorf("%s was written as %s", v, got)
+		}
+	}
+	for _, v := range []string{"", "181", "18151", "1815-13", "1815-Dec", "1815-12-32", "23/12/1815", "1815-12-23T", "815-12-23"} {
+		if _, _, err := parsePublishDate(v); err == nil {
+			t.Errorf("%q parsed", v)
+		}
+	}
+
+	var p DatePrecision
+	if b, _ := json.Marshal(Book{PublishPrecision: MonthPrecision}); !strings.Contains(string(b), `"PublishPrecision":"month"`) {
+		t.Errorf("got %s", b)
+	}
+	if err := json.Unmarshal([]byte(`"year"`), &p); err != nil || p != YearPrecision {
+		t.Errorf("got %v %v", p, err)
+	}
+	if err := json.Unmarshal([]byte(`"century"`), &p); err == nil {
+		t.Error("a century parsed")
+	}
+}
+
+func TestPartialDates(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil }()
+	store.Create(1, NewBook())
+
+	for _, c := range []struct {
+		method, target, contentType, body string
+		date                              time.Time
+		precision                         DatePrecision
+	}{
+		{"PUT", "/book/1?PublishDate=1605", "", "", time.Date(1605, 1, 1, 0, 0, 0, 0, time.UTC), YearPrecision},
+		{"PUT", "/book/1?PublishDate=1605-03", "", "", time.Date(1605, 3, 1, 0, 0, 0, 0, time.UTC), MonthPrecision},
+		{"PUT", "/book/1?PublishDate=1605-03-04", "", "", time.Date(1605, 3, 4, 0, 0, 0, 0, time.UTC), DayPrecision},
+		{"PUT", "/v2/book/1?publishDate=1812", "", "", time.Date(1812, 1, 1, 0, 0, 0, 0, time.UTC), YearPrecision},
+		{"PUT", "/v2/book/1", "application/json", `{"publishDate": "1813-01-28"}`, time.Date(1813, 1, 28, 0, 0, 0, 0, time.UTC), DayPrecision},
+		// what v1 JSON says goes back in
+		{"PUT", "/book/1", "application/json", `{"PublishDate": "1605-01-01T00:00:00Z", "PublishPrecision": "year"}`, time.Date(1605, 1, 1, 0, 0, 0, 0, time.UTC), YearPrecision},
+		{"PUT", "/book/1", "application/xml", `<Book><PublishDate>1605-03-04T00:00:00Z</PublishDate><PublishPrecision>month</PublishPrecision></Book>`, time.Date(1605, 3, 1, 0, 0, 0, 0, time.UTC), MonthPrecision},
+		{"PUT", "/book/1", "text/csv", "PublishDate\n1605-03\n", time.Date(1605, 3, 1, 0, 0, 0, 0, time.UTC), MonthPrecision},
+	} {
+		rec := formatRequest(c.method, c.target, "", c.contentType, c.body)
+		b, _ := store.Get(1)
+		if rec.Code != 200 || !b.PublishDate.Equal(c.date) || b.PublishPrecision != c.precision {
+			t.Errorf("%s %s %s gave %d %s, left %v %v", c.method, c.target, c.body, rec.Code, rec.Body, b.PublishDate, b.PublishPrecision)
+		}
+	}
+
+	store.Update(1, func(b *Book) error {
+		b.PublishDate, b.PublishPrecision = time.Date(1605, 3, 1, 0, 0, 0, 0, time.UTC), MonthPrecision
+		return nil
+	})
+	for _, c := range []struct {
+		target, accept, expected string
+	}{
+		{"/book/1", "", `"PublishDate":"1605-03-01T00:00:00Z","PublishPrecision":"month","Rating"`},
+		{"/book/1", "application/xml", `<PublishDate>1605-03-01T00:00:00Z</PublishDate><PublishPrecision>month</PublishPrecision>`},
+		{"/book/1", "text/csv", ",1605-03,"},
+		{"/book/1", "application/yaml", "PublishDate: \"1605-03-01T00:00:00Z\"\nPublishPrecision: month\nRating:"},
+		{"/v2/book/1", "", `"publishDate":"1605-03",`},
+		{"/v2/book/1", "text/csv", ",1605-03,"},
+	} {
+		if rec := formatRequest(http.MethodGet, c.target, c.accept, "", ""); !strings.Contains(rec.Body.String(), c.expected) {
+			t.Errorf("GET %s as %q gave %s, expected %s in it", c.target, c.accept, rec.Body, c.expected)
+		}
+	}
+
+	for _, c := range []struct {
+		target, contentType, body, message string
+	}{
+		{"/book/1?PublishDate=1605-Mar", "", "", "or YYYY-MM or YYYY when the day isn't known"},
+		{"/book/1?PublishDate=16050", "", "", "Error parsing PublishDate."},
+		{"/v2/book/1?publishDate=1605-Mar-04", "", "", "use YYYY-MM or YYYY."},
+		{"/book/1", "application/json", `{"PublishPrecision": "year"}`, "with a PublishDate"},
+		{"/book/1", "application/json", `{"PublishDate": "1605", "PublishPrecision": "decade"}`, "must be day, month or year"},
+	} {
+		before, _ := store.Get(1)
+		rec := formatRequest(http.MethodPut, c.target, "", c.contentType, c.body)
+		if rec.Code != 400 || !strings.Contains(rec.Body.String(), c.message) {
+			t.Errorf("PUT %s %s gave %d %q, expected 400 %q", c.target, c.body, rec.Code, rec.Body, c.message)
+		}
+		if after, _ := store.Get(1); !reflect.DeepEqual(after, before) {
+			t.Errorf("PUT %s %s changed the book", c.target, c.body)
+		}
+	}
+}
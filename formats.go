@@ -0,0 +1,837 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content negotiation for /book/. Books go out as JSON, XML, CSV or YAML,
+// whichever the Accept header likes best, and a PUT or POST can send its
+// changes in the body in any of those, or as a form, instead of in the
+// query. A body is turned into the query it stands for, so it's checked
+// and authorized exactly like one. Each format writes both versions of the
+// wire format, v1 and v2 (see v2.go).
+
+// how big a body can be. A book is a few hundred bytes.
+const maxBookBody = 1 << 20
+
+type bookFormat struct {
+	mediaType string
+	// other names it goes by
+	aliases []string
+	book    func(w io.Writer, version, id int, b Book) error
+	books   func(w io.Writer, version int, books map[int]Book) error
+	read    func(r io.Reader) (url.Values, error)
+}
+
+// in order of preference, for when the client likes them all the same
+var bookFormats = []*bookFormat{
+	{mediaType: "application/json", book: jsonBook, books: jsonBooks, read: readJSONBook},
+	{mediaType: "application/xml", aliases: []string{"text/xml"}, book: xmlBookOut, books: xmlBooksOut, read: readXMLBook},
+	{mediaType: "text/csv", book: csvBook, books: csvBooks, read: readCSVBook},
+	{mediaType: "application/yaml", aliases: []string{"application/x-yaml", "text/yaml"}, book: yamlBook, books: yamlBooks, read: readYAMLBook},
+}
+
+const (
+	formatsOut = "application/json, application/xml, text/csv or application/yaml"
+	formatsIn  = "application/json, application/xml, text/csv, application/yaml or application/x-www-form-urlencoded"
+)
+
+// negotiate picks the format for an Accept header, nil if it won't take
+// any of them. No header means JSON.
+func negotiate(accept string) *bookFormat {
+	if strings.TrimSpace(accept) == "" {
+		return bookFormats[0]
+	}
+	type accepted struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []accepted
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, there := params["q"]; there {
+			if q, err = strconv.ParseFloat(s, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, accepted{mt, q})
+	}
+	var best *bookFormat
+	bestQ := 0.0
+	for _, f := range bookFormats {
+		// the most specific range that matches says how much it's wanted
+		q, specific := 0.0, -1
+		for _, r := range ranges {
+			s := -1
+			switch {
+			case r.mediaType == f.mediaType || contains(f.aliases, r.mediaType):
+				s = 2
+			case strings.HasSuffix(r.mediaType, "/*") && strings.HasPrefix(f.mediaType, strings.TrimSuffix(r.mediaType, "*")):
+				s = 1
+			case r.mediaType == "*/*":
+				s = 0
+			}
+			if s >= 0 && (s > specific || s == specific && r.q > q) {
+				q, specific = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	return best
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// writeBook answers with a book, in the format the client asked for
+func writeBook(w http.ResponseWriter, req *http.Request, code int, id int, b Book) {
+	f := negotiated(w, req)
+	w.WriteHeader(code)
+	version, _ := apiVersion(req.URL.Path)
+	f.book(w, version, id, b)
+}
+
+func writeBooks(w http.ResponseWriter, req *http.Request, books map[int]Book) {
+	version, _ := apiVersion(req.URL.Path)
+	negotiated(w, req).books(w, version, books)
+}
+
+func negotiated(w http.ResponseWriter, req *http.Request) *bookFormat {
+	f := negotiate(req.Header.Get("Accept"))
+	if f == nil { // readBookRequest turned these away already
+		f = bookFormats[0]
+	}
+	w.Header().Set("Content-Type", f.mediaType)
+	return f
+}
+
+type bookBodyKey struct{}
+
+// bookBody is what readBookRequest made of the request
+type bookBody struct {
+	// what a PUT or POST changes, as a v1 query. nil if it doesn't say.
+	changes url.Values
+	// whether changes came from the body rather than the query
+	fromBody bool
+}
+
+// requestChanges is what a PUT or POST changes, from the body or the query,
+// as a v1 query. nil if it doesn't say.
+func requestChanges(req *http.Request) url.Values {
+	r, _ := req.Context().Value(bookBodyKey{}).(*bookBody)
+	if r == nil {
+		// not been through readBookRequest
+		if req.Method != http.MethodPut || len(req.URL.RawQuery) == 0 {
+			return nil
+		}
+		kvPairs, _, _ := parseBookQuery(req)
+		return kvPairs
+	}
+	return r.changes
+}
+
+// changesFromBody is whether requestChanges came from the body
+func changesFromBody(req *http.Request) bool {
+	r, _ := req.Context().Value(bookBodyKey{}).(*bookBody)
+	return r != nil && r.fromBody
+}
+
+// leaveStatus takes a Status the book has already out of what a body
+// changes, along with other changes, before it's authorized, so putting
+// back what a GET gave doesn't need circulate. If the book's checked in or
+// out in the meantime, the update leaves Status be. A Status on its own is
+// checking in or out, and needs circulate like the query does.
+func leaveStatus(req *http.Request) {
+	r, _ := req.Context().Value(bookBodyKey{}).(*bookBody)
+	if r == nil || !r.fromBody || len(r.changes) < 2 || len(r.changes["Status"]) != 1 {
+		return
+	}
+	id, err := getIDFromPath(req.URL.Path)
+	if err != nil {
+		return
+	}
+	if b, err := storeFor(req).Get(id); err == nil && isStatus(r.changes["Status"][0], b.Status) {
+		delete(r.changes, "Status")
+	}
+}
+
+// readBookRequest checks the Accept header and reads the body of a /book/
+// request, answering it itself if either won't do. It's done before the
+// middleware, so authorize can see what a body changes, and again by
+// bookHandler, which does nothing the second time.
+func readBookRequest(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	if req.Context().Value(bookBodyKey{}) != nil {
+		return req, true
+	}
+	if isCoverPath(req.URL.Path) || isReviewPath(req.URL.Path) {
+		// the body's an image, for putCover to read, or a review, which
+		// isn't a book
+		return req.WithContext(context.WithValue(req.Context(), bookBodyKey{}, &bookBody{})), true
+	}
+	w.Header().Add("Vary", "Accept")
+	if negotiate(req.Header.Get("Accept")) == nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(406)
+		io.WriteString(w, "Not Acceptable: books can be had as "+formatsOut+".")
+		return req, false
+	}
+	r := &bookBody{}
+	// a tag's all in the path
+	if (req.Method == http.MethodPut || req.Method == http.MethodPost) && !isTagPath(req.URL.Path) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBookBody))
+		if err != nil {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(413)
+			io.WriteString(w, "Request body too large.")
+			return req, false
+		}
+		code, message := 0, ""
+		if len(body) > 0 {
+			r.changes, code, message = parseBookBody(req, body)
+			r.fromBody = true
+		} else if req.Method == http.MethodPut && len(req.URL.RawQuery) != 0 {
+			r.changes, code, message = parseBookQuery(req)
+		}
+		if code != 0 {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(code)
+			io.WriteString(w, message)
+			return req, false
+		}
+	}
+	return req.WithContext(context.WithValue(req.Context(), bookBodyKey{}, r)), true
+}
+
+// readBody is readBookRequest as middleware
+func readBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req, ok := readBookRequest(w, req); ok {
+			next(w, req)
+		}
+	}
+}
+
+func parseBookBody(req *http.Request, body []byte) (changes url.Values, code int, message string) {
+	ct := req.Header.Get("Content-Type")
+	mt, _, err := mime.ParseMediaType(ct)
+	if ct == "" || err != nil {
+		return nil, 415, "Unsupported Media Type: send the body as " + formatsIn + "."
+	}
+	var read func(io.Reader) (url.Values, error)
+	if mt == "application/x-www-form-urlencoded" {
+		read = readFormBook
+	}
+	for _, f := range bookFormats {
+		if mt == f.mediaType || contains(f.aliases, mt) {
+			read = f.read
+		}
+	}
+	if read == nil {
+		return nil, 415, "Unsupported Media Type " + mt + ": send the body as " + formatsIn + "."
+	}
+	if len(req.URL.RawQuery) != 0 {
+		return nil, 400, "Send the changes in the query or in the body, not both."
+	}
+	changes, err = read(strings.NewReader(string(body)))
+	if err != nil {
+		return nil, 400, "Error parsing body: " + err.Error()
+	}
+	for _, k := range []string{"ID", "id"} {
+		if ids, there := changes[k]; there {
+			id, err := getIDFromPath(req.URL.Path)
+			if len(ids) != 1 || err != nil || ids[0] != strconv.Itoa(id) {
+				return nil, 400, "The ID in the body doesn't match the one in the path."
+			}
+			delete(changes, k)
+		}
+	}
+	// these come out, but they're worked out from the reviews, so going
+	// back in they're left alone
+	for _, k := range []string{"AverageRating", "RatingCount", "averageRating", "ratingCount"} {
+		delete(changes, k)
+	}
+	if version, _ := apiVersion(req.URL.Path); version == 2 {
+		if changes, err = fromV2(changes); err != nil {
+			return nil, 400, err.Error()
+		}
+		return changes, 0, ""
+	}
+	// Status and PublishDate can come back the way they go out
+	if v := changes["Status"]; len(v) == 1 {
+		switch v[0] {
+		case "0":
+			v[0] = "CheckedIn"
+		case "1":
+			v[0] = "CheckedOut"
+		}
+	}
+	if p, there := changes["PublishPrecision"]; there {
+		var precision DatePrecision
+		d, _, err := parsePublishDate(changes.Get("PublishDate"))
+		if len(p) != 1 || precision.UnmarshalText([]byte(p[0])) != nil || err != nil {
+			return nil, 400, "PublishPrecision must be day, month or year, with a PublishDate."
+		}
+		changes.Set("PublishDate", formatDate(d, precision, cfg.DateFormat))
+		delete(changes, "PublishPrecision")
+	}
+	return changes, 0, ""
+}
+
+func parseBookQuery(req *http.Request) (changes url.Values, code int, message string) {
+	changes, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, 400, "Error parsing query: " + err.Error()
+	}
+	if version, _ := apiVersion(req.URL.Path); version == 2 {
+		if changes, err = fromV2(changes); err != nil {
+			return nil, 400, err.Error()
+		}
+	}
+	return changes, 0, ""
+}
+
+func readFormBook(r io.Reader) (url.Values, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(string(b))
+}
+
+// JSON
+
+func jsonBook(w io.Writer, version, id int, b Book) error {
+	if version == 2 {
+		return json.NewEncoder(w).Encode(toV2(id, b))
+	}
+	return json.NewEncoder(w).Encode(b)
+}
+
+// v1 is an object keyed by ID
+func jsonBooks(w io.Writer, version int, books map[int]Book) error {
+	if version == 2 {
+		return json.NewEncoder(w).Encode(listV2(books))
+	}
+	return json.NewEncoder(w).Encode(books)
+}
+
+// an object of strings and numbers, and arrays of strings for Subjects and
+// Tags
+func readJSONBook(r io.Reader) (url.Values, error) {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	var m map[string]interface{}
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, errors.New("expected an object")
+	}
+	changes := url.Values{}
+	for k, v := range m {
+		switch v := v.(type) {
+		case string:
+			changes.Set(k, v)
+		case json.Number:
+			changes.Set(k, v.String())
+		case []interface{}:
+			if !listKeys[k] {
+				return nil, errors.New(k + " must be a string or a number")
+			}
+			// none is one empty value
+			if len(v) == 0 {
+				changes.Add(k, "")
+			}
+			for _, e := range v {
+				s, ok := e.(string)
+				if !ok {
+					return nil, errors.New(k + " must be strings")
+				}
+				changes.Add(k, s)
+			}
+		default:
+			return nil, errors.New(k + " must be a string or a number")
+		}
+	}
+	return changes, nil
+}
+
+// XML
+
+// <Book id="1"><Title>...</Title>...</Book>
+type xmlBook struct {
+	XMLName xml.Name `xml:"Book"`
+	ID      int      `xml:"id,attr"`
+	Book
+	Subjects xmlList `xml:",omitempty"`
+	Tags     xmlList `xml:",omitempty"`
+}
+
+// <Subjects><Subject>...</Subject>...</Subjects>. With Subjects>Subject
+// and omitempty, there'd be an empty <Subjects> for none.
+type xmlList []string
+
+func (l xmlList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	item := xml.StartElement{Name: xml.Name{Local: strings.TrimSuffix(start.Name.Local, "s")}}
+	e.EncodeToken(start)
+	for _, s := range l {
+		e.EncodeElement(s, item)
+	}
+	return e.EncodeToken(start.End())
+}
+
+type xmlBooks struct {
+	XMLName xml.Name  `xml:"Books"`
+	Books   []xmlBook `xml:"Book"`
+}
+
+func writeXML(w io.Writer, v interface{}) error {
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func xmlBookOut(w io.Writer, version, id int, b Book) error {
+	if version == 2 {
+		return writeXML(w, toV2(id, b))
+	}
+	return writeXML(w, xmlBook{ID: id, Book: b, Subjects: b.Subjects, Tags: b.Tags})
+}
+
+func xmlBooksOut(w io.Writer, version int, books map[int]Book) error {
+	if version == 2 {
+		return writeXML(w, booksV2{Books: listV2(books)})
+	}
+	out := xmlBooks{Books: []xmlBook{}}
+	for _, id := range sortedIDs(books) {
+		out.Books = append(out.Books, xmlBook{ID: id, Book: books[id], Subjects: books[id].Subjects, Tags: books[id].Tags})
+	}
+	return writeXML(w, out)
+}
+
+// a Book (or v2 book) element, with an element for each field it changes,
+// and one inside Subjects or Tags for each subject or tag
+func readXMLBook(r io.Reader) (url.Values, error) {
+	d := xml.NewDecoder(r)
+	changes := url.Values{}
+	depth, key, text := 0, "", ""
+	root := false
+	var items []string
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch depth {
+			case 1:
+				if root || t.Name.Local != "Book" && t.Name.Local != "book" {
+					return nil, errors.New("expected one <Book> element")
+				}
+				root = true
+				for _, a := range t.Attr {
+					if a.Name.Local == "id" {
+						changes.Add("id", a.Value)
+					}
+				}
+			case 2:
+				key, text, items = t.Name.Local, "", nil
+			case 3:
+				if !listKeys[key] {
+					return nil, errors.New("<" + key + "> can't have elements in it")
+				}
+				text = ""
+			default:
+				return nil, errors.New("<" + key + "> can't have elements in it")
+			}
+		case xml.CharData:
+			if depth == 2 || depth == 3 {
+				text += string(t)
+			}
+		case xml.EndElement:
+			switch {
+			case depth == 3:
+				items = append(items, text)
+			case depth == 2 && listKeys[key] && items != nil:
+				changes[key] = items
+			case depth == 2 && listKeys[key] && strings.TrimSpace(text) == "":
+				// <Subjects/> is none
+				changes.Add(key, "")
+			case depth == 2:
+				changes.Add(key, text)
+			}
+			depth--
+		}
+	}
+	if !root {
+		return nil, errors.New("expected one <Book> element")
+	}
+	return changes, nil
+}
+
+// CSV. v1 is the same columns booklistctl uses, so it only has the first
+// six fields. v2 has them all, with subjects and tags separated by
+// semicolons.
+
+var csvColumns = map[int][]string{
+	1: {"ID", "Title", "Author", "Publisher", "PublishDate", "Rating", "Status"},
+	2: {"id", "title", "author", "publisher", "publishDate", "rating", "status",
+		"edition", "language", "pages", "format", "series", "volume", "subjects", "description", "cover", "tags",
+		"averageRating", "ratingCount"},
+}
+
+// 0 is unknown, so it's left empty
+func csvInt(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return strconv.Itoa(i)
+}
+
+// likewise
+func csvFloat(f float64) string {
+	if f == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func csvRow(version, id int, b Book) []string {
+	if version == 2 {
+		v := toV2(id, b)
+		return []string{strconv.Itoa(id), v.Title, v.Author, v.Publisher, v.PublishDate, strconv.Itoa(v.Rating), v.Status,
+			v.Edition, v.Language, csvInt(v.Pages), v.Format, v.Series, csvInt(v.Volume), strings.Join(v.Subjects, "; "), v.Description, v.Cover, strings.Join(v.Tags, "; "),
+			csvFloat(v.AverageRating), csvInt(v.RatingCount)}
+	}
+	return []string{strconv.Itoa(id), b.Title, b.Author, b.Publisher,
+		b.publishDate(), strconv.Itoa(b.Rating), b.Status.String()}
+}
+
+func csvBook(w io.Writer, version, id int, b Book) error {
+	return csvBooks(w, version, map[int]Book{id: b})
+}
+
+func csvBooks(w io.Writer, version int, books map[int]Book) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvColumns[version])
+	for _, id := range sortedIDs(books) {
+		cw.Write(csvRow(version, id, books[id]))
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// a header line of field names, and a line of values
+func readCSVBook(r io.Reader) (url.Values, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) != 2 {
+		return nil, errors.New("expected a header line and one line of values")
+	}
+	changes := url.Values{}
+	for i, k := range records[0] {
+		if listKeys[k] && records[1][i] != "" {
+			changes[k] = strings.Split(records[1][i], ";")
+			continue
+		}
+		changes.Add(k, records[1][i])
+	}
+	return changes, nil
+}
+
+// YAML. There's no YAML package in the standard library, but books are
+// flat, so this is just enough of it for them.
+
+// JSON strings are YAML strings
+func yamlString(s string) string {
+	j, _ := json.Marshal(s)
+	return string(j)
+}
+
+// the book's lines, each starting with indent but the first, which starts
+// with first
+func yamlFields(w io.Writer, first, indent string, version, id int, b Book) error {
+	var lines []string
+	if version == 2 {
+		v := toV2(id, b)
+		lines = []string{"id: " + strconv.Itoa(id),
+			"title: " + yamlString(v.Title),
+			"author: " + yamlString(v.Author),
+			"publisher: " + yamlString(v.Publisher),
+			"publishDate: " + yamlString(v.PublishDate),
+			"rating: " + strconv.Itoa(v.Rating),
+			"status: " + v.Status}
+		lines = append(lines, yamlMetadata(version, b)...)
+	} else {
+		lines = []string{"Title: " + yamlString(b.Title),
+			"Author: " + yamlString(b.Author),
+			"Publisher: " + yamlString(b.Publisher),
+			"PublishDate: " + yamlString(b.PublishDate.Format(time.RFC3339))}
+		// like JSON, only when it's not the whole day
+		if b.PublishPrecision != DayPrecision {
+			lines = append(lines, "PublishPrecision: "+b.PublishPrecision.String())
+		}
+		lines = append(lines, "Rating: "+strconv.Itoa(b.Rating),
+			"Status: "+strconv.Itoa(int(b.Status)))
+		lines = append(lines, yamlMetadata(version, b)...)
+	}
+	_, err := io.WriteString(w, first+strings.Join(lines, "\n"+indent)+"\n")
+	return err
+}
+
+// the optional fields the book has, named as in version
+func yamlMetadata(version int, b Book) []string {
+	var lines []string
+	add := func(key, v string) {
+		if version == 2 {
+			key = strings.ToLower(key[:1]) + key[1:]
+		}
+		lines = append(lines, key+": "+v)
+	}
+	for _, f := range []struct{ key, v string }{{"Edition", b.Edition}, {"Language", b.Language}} {
+		if f.v != "" {
+			add(f.key, yamlString(f.v))
+		}
+	}
+	if b.Pages != 0 {
+		add("Pages", strconv.Itoa(b.Pages))
+	}
+	if b.Format != "" {
+		add("Format", b.Format)
+	}
+	if b.Series != "" {
+		add("Series", yamlString(b.Series))
+	}
+	if b.Volume != 0 {
+		add("Volume", strconv.Itoa(b.Volume))
+	}
+	sequence := func(key string, list []string) {
+		if len(list) > 0 {
+			var quoted []string
+			for _, s := range list {
+				quoted = append(quoted, yamlString(s))
+			}
+			add(key, "["+strings.Join(quoted, ", ")+"]")
+		}
+	}
+	sequence("Subjects", b.Subjects)
+	for _, f := range []struct{ key, v string }{{"Description", b.Description}, {"Cover", b.Cover}} {
+		if f.v != "" {
+			add(f.key, yamlString(f.v))
+		}
+	}
+	sequence("Tags", b.Tags)
+	if b.RatingCount != 0 {
+		add("AverageRating", strconv.FormatFloat(b.AverageRating, 'f', -1, 64))
+		add("RatingCount", strconv.Itoa(b.RatingCount))
+	}
+	return lines
+}
+
+func yamlBook(w io.Writer, version, id int, b Book) error {
+	return yamlFields(w, "", "", version, id, b)
+}
+
+// v1 is a mapping by ID, v2 a sequence
+func yamlBooks(w io.Writer, version int, books map[int]Book) error {
+	if len(books) == 0 {
+		empty := "{}\n"
+		if version == 2 {
+			empty = "[]\n"
+		}
+		_, err := io.WriteString(w, empty)
+		return err
+	}
+	for _, id := range sortedIDs(books) {
+		first := strconv.Itoa(id) + ":\n  "
+		if version == 2 {
+			first = "- "
+		}
+		if err := yamlFields(w, first, "  ", version, id, books[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a flat mapping of keys to scalars, and flow sequences of them for
+// Subjects and Tags
+func readYAMLBook(r io.Reader) (url.Values, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	changes := url.Values{}
+	for i, line := range strings.Split(string(b), "\n") {
+		at := "line " + strconv.Itoa(i+1) + ": "
+		line = strings.TrimRight(line, " \t\r")
+		if t := strings.TrimSpace(line); t == "" || t[0] == '#' || t == "---" || t == "..." {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' || line[0] == '-' {
+			return nil, errors.New(at + "only a flat mapping of keys to values is understood")
+		}
+		k, v, found := strings.Cut(line, ":")
+		if !found {
+			return nil, errors.New(at + "expected key: value")
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if listKeys[k] && strings.HasPrefix(v, "[") {
+			items, err := yamlSequence(v)
+			if err != nil {
+				return nil, errors.New(at + err.Error())
+			}
+			changes[k] = items
+			continue
+		}
+		v, err := yamlScalar(v)
+		if err != nil {
+			return nil, errors.New(at + err.Error())
+		}
+		changes.Add(k, v)
+	}
+	return changes, nil
+}
+
+func yamlScalar(v string) (string, error) {
+	if v == "" {
+		return "", errors.New("no value")
+	}
+	switch v[0] {
+	case '"':
+		// find the closing quote, skipping escaped ones
+		end := -1
+		for i := 1; i < len(v); i++ {
+			if v[i] == '\\' {
+				i++
+			} else if v[i] == '"' {
+				end = i
+				break
+			}
+		}
+		if end < 0 || !yamlRestOK(v[end+1:]) {
+			return "", errors.New("bad double-quoted string")
+		}
+		var s string
+		if err := json.Unmarshal([]byte(v[:end+1]), &s); err == nil {
+			return s, nil
+		}
+		s, err := strconv.Unquote(v[:end+1])
+		if err != nil {
+			return "", errors.New("bad double-quoted string")
+		}
+		return s, nil
+	case '\'':
+		var s strings.Builder
+		for i := 1; i < len(v); i++ {
+			if v[i] != '\'' {
+				s.WriteByte(v[i])
+			} else if i+1 < len(v) && v[i+1] == '\'' {
+				s.WriteByte('\'')
+				i++
+			} else if yamlRestOK(v[i+1:]) {
+				return s.String(), nil
+			} else {
+				break
+			}
+		}
+		return "", errors.New("bad single-quoted string")
+	case '[', '{', '|', '>', '&', '*', '!', '%', '@', '`':
+		return "", errors.New("only plain and quoted values are understood")
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v, nil
+}
+
+// yamlSequence reads a one line flow sequence of scalars, [a, "b"]. [] is
+// one empty value, like an empty list anywhere else.
+func yamlSequence(v string) ([]string, error) {
+	bad := errors.New("bad sequence. Only [value, ...] on one line is understood")
+	var items []string
+	rest := strings.TrimSpace(v[1:])
+	for !strings.HasPrefix(rest, "]") {
+		// up to the next comma or ] outside quotes
+		end, quote := -1, byte(0)
+		for i := 0; i < len(rest) && end < 0; i++ {
+			switch c := rest[i]; {
+			case quote == 0 && (c == '"' || c == '\''):
+				quote = c
+			case quote == '"' && c == '\\':
+				i++
+			case quote != 0 && c == quote:
+				quote = 0
+			case quote == 0 && (c == ',' || c == ']'):
+				end = i
+			}
+		}
+		if end < 0 {
+			return nil, bad
+		}
+		item, err := yamlScalar(strings.TrimSpace(rest[:end]))
+		if err != nil {
+			return nil, bad
+		}
+		items = append(items, item)
+		rest = strings.TrimSpace(rest[end:])
+		if rest[0] == ',' {
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+	if !yamlRestOK(rest[1:]) {
+		return nil, bad
+	}
+	if len(items) == 0 {
+		items = []string{""}
+	}
+	return items, nil
+}
+
+// whatever's after a quoted value can only be a comment
+func yamlRestOK(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return rest == "" || rest[0] == '#'
+}
+
+func sortedIDs(books map[int]Book) []int {
+	ids := make([]int, 0, len(books))
+	for id := range books {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
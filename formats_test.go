@@ -0,0 +1,270 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"":                                   "application/json",
+		"*/*":                                "application/json",
+		"application/xml":                    "application/xml",
+		"text/xml":                           "application/xml",
+		"text/*":                             "text/csv",
+		"application/x-yaml":                 "application/yaml",
+		"application/json;q=0.5, text/csv":   "text/csv",
+		"application/yaml, application/json": "application/json",
+		"application/*;q=0, */*":             "text/csv",
+		"text/html, */*;q=0.1":               "application/json",
+		"text/html":                          "",
+		"application/json;q=0":               "",
+		"nonsense":                           "",
+	} {
+		got := ""
+		if f := negotiate(accept); f != nil {
+			got = f.mediaType
+		}
+		if got != expected {
+			t.Errorf("Accept %q picked %q, expected %q", accept, got, expected)
+		}
+	}
+}
+
+// a request straight to bookHandler, with headers
+func formatRequest(method, target, accept, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	bookHandler(rec, req)
+	return rec
+}
+
+func TestBookFormatsOut(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil }()
+	store.Create(2, Book{Title: "Emma", Author: "Jane \"J\" Austen", PublishDate: time.Date(1815, 12, 23, 0, 0, 0, 0, time.UTC), Rating: 2})
+	store.Create(1, Book{Title: "Dune, again", Author: "Frank Herbert", Rating: 3, Status: CheckedOut})
+
+	for _, c := range []struct {
+		target, accept, contentType, body string
+	}{
+		{"/book/2", "application/xml", "application/xml",
+			xmlHeader + `<Book id="2"><Title>Emma</Title><Author>Jane &#34;J&#34; Austen</Author><Publisher></Publisher><PublishDate>1815-12-23T00:00:00Z</PublishDate><Rating>2</Rating><Status>0</Status></Book>` + "\n"},
+		{"/book/", "text/xml", "application/xml",
+			xmlHeader + `<Books><Book id="1"><Title>Dune, again</Title><Author>Frank Herbert</Author><Publisher></Publisher><PublishDate>0001-01-01T00:00:00Z</PublishDate><Rating>3</Rating><Status>1</Status></Book>` +
+				`<Book id="2"><Title>Emma</Title><Author>Jane &#34;J&#34; Austen</Author><Publisher></Publisher><PublishDate>1815-12-23T00:00:00Z</PublishDate><Rating>2</Rating><Status>0</Status></Book></Books>` + "\n"},
+		{"/book/2", "text/csv", "text/csv",
+			"ID,Title,Author,Publisher,PublishDate,Rating,Status\n2,Emma,\"Jane \"\"J\"\" Austen\",,1815-Dec-23,2,CheckedIn\n"},
+		{"/book/", "text/csv", "text/csv",
+			"ID,Title,Author,Publisher,PublishDate,Rating,Status\n1,\"Dune, again\",Frank Herbert,,0001-Jan-01,3,CheckedOut\n2,Emma,\"Jane \"\"J\"\" Austen\",,1815-Dec-23,2,CheckedIn\n"},
+		{"/book/2", "application/yaml", "application/yaml",
+			"Title: \"Emma\"\nAuthor: \"Jane \\\"J\\\" Austen\"\nPublisher: \"\"\nPublishDate: \"1815-12-23T00:00:00Z\"\nRating: 2\nStatus: 0\n"},
+		{"/book/2", "", "application/json",
+			`{"Title":"Emma","Author":"Jane \"J\" Austen","Publisher":"","PublishDate":"1815-12-23T00:00:00Z","Rating":2,"Status":0}` + "\n"},
+	} {
+		rec := formatRequest(http.MethodGet, c.target, c.accept, "", "")
+		if rec.Code != 200 || rec.Header().Get("Content-Type") != c.contentType || rec.Body.String() != c.body {
+			t.Errorf("GET %s as %q gave %d %s:\n%s\nexpected:\n%s", c.target, c.accept, rec.Code, rec.Header().Get("Content-Type"), rec.Body, c.body)
+		}
+		if rec.Header().Get("Vary") != "Accept" {
+			t.Errorf("GET %s as %q didn't say it varies by Accept", c.target, c.accept)
+		}
+	}
+
+	// the YAML list is a mapping by ID
+	rec := formatRequest(http.MethodGet, "/book/", "application/yaml", "", "")
+	if !strings.HasPrefix(rec.Body.String(), "1:\n  Title: \"Dune, again\"\n") || !strings.Contains(rec.Body.String(), "\n2:\n  Title: \"Emma\"\n") {
+		t.Errorf("got YAML list %s", rec.Body)
+	}
+
+	rec = formatRequest(http.MethodPost, "/book/3", "text/html", "", "")
+	if rec.Code != 406 || !strings.Contains(rec.Body.String(), "application/xml") {
+		t.Errorf("POST as text/html gave %d %s, expected 406", rec.Code, rec.Body)
+	}
+	if _, err := store.Get(3); err != errNotFound {
+		t.Error("the book was created anyway")
+	}
+}
+
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8"?>` + "\n"
+
+func TestBookFormatsIn(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil }()
+	store.Create(1, NewBook())
+
+	for _, c := range []struct {
+		contentType, body string
+		expected          Book
+	}{
+		{"application/json", `{"Title": "Dune", "Rating": 3, "PublishDate": "1965-08-01T00:00:00Z"}`,
+			Book{Title: "Dune", Rating: 3, PublishDate: time.Date(1965, 8, 1, 0, 0, 0, 0, time.UTC)}},
+		{"application/xml; charset=utf-8", `<?xml version="1.0"?><Book id="1"><Title>Emma &amp; co</Title><Status>1</Status></Book>`,
+			Book{Title: "Emma & co", Status: CheckedOut}},
+		{"text/csv", "ID,Title,PublishDate,Status\n1,\"Persuasion, 2\",1817-Dec-20,CheckedIn\n",
+			Book{Title: "Persuasion, 2", PublishDate: time.Date(1817, 12, 20, 0, 0, 0, 0, time.UTC)}},
+		{"application/x-yaml", "---\n# a comment\nTitle: 'It''s'\nAuthor: \"Anon\\ty\" # tab\nPublisher: Plain text # and a comment\nRating: 1\n",
+			Book{Title: "It's", Author: "Anon\ty", Publisher: "Plain text", Rating: 1}},
+		{"application/x-www-form-urlencoded", "Title=Form&Status=CheckedOut",
+			Book{Title: "Form", Status: CheckedOut}},
+	} {
+		before, _ := store.Get(1)
+		rec := formatRequest(http.MethodPut, "/book/1", "", c.contentType, c.body)
+		if rec.Code != 200 {
+			t.Errorf("PUT of %s gave %d %s", c.contentType, rec.Code, rec.Body)
+			continue
+		}
+		got, _ := store.Get(1)
+		e := c.expected
+		if e.Author == "" {
+			e.Author = before.Author
+		}
+		if e.Publisher == "" {
+			e.Publisher = before.Publisher
+		}
+		if e.PublishDate.IsZero() {
+			e.PublishDate = before.PublishDate
+		}
+		if e.Rating == 0 {
+			e.Rating = before.Rating
+		}
+		if !reflect.DeepEqual(got, e) {
+			t.Errorf("PUT of %s left %+v, expected %+v", c.contentType, got, e)
+		}
+	}
+
+	for _, c := range []struct {
+		method, target, contentType, body string
+		code                              int
+		message                           string
+	}{
+		{"PUT", "/book/1", "text/plain", "Title=x", 415, "Unsupported Media Type text/plain"},
+		{"PUT", "/book/1", "", "Title=x", 415, "Unsupported Media Type"},
+		{"PUT", "/book/1?Rating=2", "application/json", `{"Title": "x"}`, 400, "not both"},
+		{"PUT", "/book/1", "application/json", `{"ID": 2, "Title": "x"}`, 400, "doesn't match"},
+		{"PUT", "/book/1", "application/json", `{"Title": ["x"]}`, 400, "Title must be a string or a number"},
+		{"PUT", "/book/1", "application/json", `{}`, 400, "No changes in the body"},
+		{"PUT", "/book/1", "application/json", `{"Rating": 9}`, 400, "Invalid Rating"},
+		{"PUT", "/book/1", "application/xml", `<Book><Title><b>x</b></Title></Book>`, 400, "<Title> can't have elements in it"},
+		{"PUT", "/book/1", "application/xml", `<Books/>`, 400, "expected one <Book> element"},
+		{"PUT", "/book/1", "text/csv", "Title\nx\ny\n", 400, "one line of values"},
+		{"PUT", "/book/1", "application/yaml", "Title:\n  nested: x\n", 400, "line 1: no value"},
+		{"PUT", "/book/1", "application/yaml", "Title: [x]\n", 400, "only plain and quoted values"},
+		{"PUT", "/book/1", "application/yaml", "Colour: red\n", 400, "Invalid query key Colour"},
+		// it's checked out already, which in a body is no change
+		{"PUT", "/book/1", "application/json", `{"Status": 1}`, 200, `"Status":1`},
+		{"PUT", "/book/1", "application/json", strings.Repeat(" ", maxBookBody+1), 413, "too large"},
+		{"POST", "/book/1", "application/json", `{"Title": "x"}`, 409, ""},
+	} {
+		before, _ := store.Get(1)
+		rec := formatRequest(c.method, c.target, "", c.contentType, c.body)
+		if rec.Code != c.code || !strings.Contains(rec.Body.String(), c.message) {
+			t.Errorf("%s %s of %s %.40q gave %d %q, expected %d %q", c.method, c.target, c.contentType, c.body, rec.Code, rec.Body, c.code, c.message)
+		}
+		if after, _ := store.Get(1); !reflect.DeepEqual(after, before) {
+			t.Errorf("%.40q changed the book", c.body)
+		}
+	}
+
+	// a new book, with some of it filled in
+	rec := formatRequest(http.MethodPost, "/book/2", "text/csv", "application/yaml", "Title: Dune\nStatus: CheckedOut\n")
+	if rec.Code != 201 || !strings.Contains(rec.Body.String(), "\n2,Dune,") || !strings.HasSuffix(rec.Body.String(), ",CheckedOut\n") {
+		t.Errorf("POST with a body gave %d %s", rec.Code, rec.Body)
+	}
+	if rec := formatRequest(http.MethodPost, "/book/3", "", "application/json", `{"Status": "CheckedIn"}`); rec.Code != 201 {
+		t.Errorf("POST checked in gave %d %s", rec.Code, rec.Body)
+	}
+}
+
+// what a GET gives, PUT back as it is, changes nothing, checked in or out
+func TestBookFormatsRoundTrip(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil }()
+	store.Create(1, Book{Title: "Emma", Author: "Jane Austen", PublishDate: time.Date(1815, 12, 23, 0, 0, 0, 0, time.UTC), Rating: 2})
+	store.Create(2, Book{Title: "Dune", Author: "Frank Herbert", Rating: 3, Status: CheckedOut})
+
+	for _, target := range []string{"/book/1", "/book/2", "/v2/book/1", "/v2/book/2"} {
+		id, _ := getIDFromPath(target)
+		for _, mediaType := range []string{"application/json", "application/xml", "text/csv", "application/yaml"} {
+			before, _ := store.Get(id)
+			got := formatRequest(http.MethodGet, target, mediaType, "", "")
+			rec := formatRequest(http.MethodPut, target, mediaType, mediaType, got.Body.String())
+			if rec.Code != 200 || rec.Body.String() != got.Body.String() {
+				t.Errorf("PUT %s of %s back gave %d %s", target, mediaType, rec.Code, rec.Body)
+			}
+			if after, _ := store.Get(id); !reflect.DeepEqual(after, before) {
+				t.Errorf("PUT %s of %s back left %+v, expected %+v", target, mediaType, after, before)
+			}
+		}
+	}
+	// in the query, it's still a 409
+	if rec := formatRequest(http.MethodPut, "/book/2?Status=CheckedOut", "", "", ""); rec.Code != 409 {
+		t.Errorf("checking out a checked out book gave %d", rec.Code)
+	}
+}
+
+// what a body changes is authorized the same as the query would be
+func TestBodyActions(t *testing.T) {
+	policy = &policyHolder{policy: defaultPolicy()}
+	policy.current().Callers["cat"] = "cataloger"
+	store = newMemStore()
+	defer func() { store = nil; policy = &policyHolder{policy: defaultPolicy()} }()
+	store.Create(1, NewBook())
+	h := readBody(func(w http.ResponseWriter, req *http.Request) {
+		authorize(bookActions, bookHandler)(w, withCaller(req, Caller{Name: "cat"}))
+	})
+
+	for _, c := range []struct {
+		method, target, contentType, body string
+		code                              int
+	}{
+		{http.MethodPut, "/book/1", "application/json", `{"Title": "Fine"}`, 200},
+		{http.MethodPut, "/book/1", "application/json", `{"Status": "CheckedOut"}`, 403},
+		{http.MethodPut, "/book/1", "application/xml", `<Book><Title>Sneaky</Title><Status>1</Status></Book>`, 403},
+		{http.MethodPost, "/book/2", "application/json", `{"Title": "New"}`, 201},
+		{http.MethodPost, "/book/3", "application/json", `{"Status": "CheckedOut"}`, 403},
+	} {
+		req := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("cataloger %s of %s gave %d %s, expected %d", c.method, c.body, rec.Code, rec.Body, c.code)
+		}
+	}
+	if b, _ := store.Get(1); b.Title != "Fine" || b.Status != CheckedIn {
+		t.Errorf("got %+v", b)
+	}
+
+	// what a GET gave, with the Title changed, goes back without circulate,
+	// in both versions, but not with Status changed
+	for _, target := range []string{"/book/1", "/v2/book/1"} {
+		body := strings.Replace(formatRequest(http.MethodGet, target, "", "", "").Body.String(), `"Fine"`, `"Round Trip"`, 1)
+		req := httptest.NewRequest(http.MethodPut, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != 200 || !strings.Contains(rec.Body.String(), "Round Trip") {
+			t.Errorf("cataloger putting back %s gave %d %s", body, rec.Code, rec.Body)
+		}
+		store.Update(1, func(b *Book) error { b.Title = "Fine"; return nil })
+	}
+	body := strings.Replace(formatRequest(http.MethodGet, "/book/1", "", "", "").Body.String(), `"Status":0`, `"Status":1`, 1)
+	req := httptest.NewRequest(http.MethodPut, "/book/1", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	if b, _ := store.Get(1); rec.Code != 403 || b.Status != CheckedIn {
+		t.Errorf("cataloger putting back %s gave %d, and left %+v", body, rec.Code, b)
+	}
+}
@@ -0,0 +1,1215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GraphQL on /graphql, over the same store as /book/. schema.graphql is the
+// schema, graphqlparse.go reads the queries, and this runs them. Queries go
+// by GET or POST, mutations only by POST, and a subscription comes back as
+// server-sent events. Loans and patrons are worked out from the audit log,
+// since that's the only place checkouts are written down.
+
+//go:embed schema.graphql
+var schemaSDL string
+
+var gqlSchema map[string]*gqlTypeDef
+
+type gqlResolver func(x *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error)
+
+// what the caller's role must allow to ask for each field. Anything not
+// here comes along with whatever it's part of.
+var gqlNeeds = map[string]string{
+	"Query.book":               ActionRead,
+	"Query.books":              ActionRead,
+	"Query.authors":            ActionRead,
+	"Query.author":             ActionRead,
+	"Query.loans":              ActionCirculate,
+	"Query.patrons":            ActionCirculate,
+	"Query.patron":             ActionCirculate,
+	"Book.loans":               ActionCirculate,
+	"Mutation.createBook":      ActionCatalog,
+	"Mutation.updateBook":      ActionCatalog,
+	"Mutation.checkout":        ActionCirculate,
+	"Mutation.return":          ActionCirculate,
+	"Subscription.bookChanged": ActionRead,
+}
+
+func init() {
+	var err error
+	gqlSchema, err = parseSchema(schemaSDL)
+	if err != nil {
+		panic("schema.graphql: " + err.Error())
+	}
+	for name, t := range gqlSchema {
+		for _, f := range t.fields {
+			f.resolve = gqlResolvers[name+"."+f.name]
+			f.needs = gqlNeeds[name+"."+f.name]
+			if f.resolve == nil {
+				panic("schema.graphql: no resolver for " + name + "." + f.name)
+			}
+		}
+	}
+}
+
+// a book, as the resolvers pass it around
+type gqlBook struct {
+	ID int
+	Book
+}
+
+// one checkout, from the audit log. Patron is the caller that did it.
+type loan struct {
+	BookID        int
+	Patron        string
+	Out, Returned time.Time
+}
+
+// loanLedger works out the checkouts from the audit log, an entry at a
+// time. Going from checked in to checked out starts one, and the next
+// change back, or the book being deleted, ends it.
+type loanLedger struct {
+	loans []*loan
+	open  map[int]*loan
+}
+
+func (l *loanLedger) note(e AuditEntry) {
+	if o := l.open[e.BookID]; o != nil && e.Before != nil && (e.After == nil || e.After.Status == CheckedIn) {
+		o.Returned = e.Time
+		delete(l.open, e.BookID)
+		return
+	}
+	if e.Before != nil && e.After != nil && e.Before.Status == CheckedIn && e.After.Status == CheckedOut {
+		o := &loan{BookID: e.BookID, Patron: e.Actor, Out: e.Time}
+		l.loans = append(l.loans, o)
+		if l.open == nil {
+			l.open = map[int]*loan{}
+		}
+		l.open[e.BookID] = o
+	}
+}
+
+var gqlResolvers = map[string]gqlResolver{
+	"Query.book": func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+		id := args["id"].(int)
+		b, err := storeFor(x.req).Get(id)
+		if err == errNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, storeProblem(err, id)
+		}
+		return gqlBook{id, b}, nil
+	},
+	"Query.books": func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+		return x.books(func(b Book) bool {
+			if a, ok := args["author"].(string); ok && b.Author != a {
+				return false
+			}
+			if s, ok := args["status"].(Status); ok && b.Status != s {
+				return false
+			}
+			for arg, v := range map[string]string{"language": b.Language, "format": b.Format, "series": b.Series} {
+				if a, ok := args[arg].(string); ok && !strings.EqualFold(v, a) {
+					return false
+				}
+			}
+			for arg, list := range map[string][]string{"subjects": b.Subjects, "tags": b.Tags} {
+				want, _ := args[arg].([]interface{})
+				for _, s := range want {
+					if !containsFold(list, s.(string)) {
+						return false
+					}
+				}
+			}
+			return true
+		})
+	},
+	"Query.authors": func(x *gqlExec, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+		books, err := x.list()
+		if err != nil {
+			return nil, err
+		}
+		names := map[string]bool{}
+		for _, b := range books {
+			names[b.Author] = true
+		}
+		return sortedNames(names), nil
+	},
+	"Query.author": func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+		books, err := x.list()
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range books {
+			if b.Author == args["name"].(string) {
+				return b.Author, nil
+			}
+		}
+		return nil, nil
+	},
+	"Query.loans": func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+		return x.loans(func(l *loan) bool {
+			if id, ok := args["bookId"].(int); ok && l.BookID != id {
+				return false
+			}
+			if p, ok := args["patron"].(string); ok && l.Patron != p {
+				return false
+			}
+			if open, ok := args["open"].(bool); ok && open != l.Returned.IsZero() {
+				return false
+			}
+			return true
+		}), nil
+	},
+	"Query.patrons": func(x *gqlExec, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+		names := map[string]bool{}
+		for _, l := range x.auditLoans() {
+			if l.Patron != "" {
+				names[l.Patron] = true
+			}
+		}
+		return sortedNames(names), nil
+	},
+	"Query.patron": func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+		for _, l := range x.auditLoans() {
+			if l.Patron != "" && l.Patron == args["name"].(string) {
+				return l.Patron, nil
+			}
+		}
+		return nil, nil
+	},
+
+	"Book.id": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(gqlBook).ID, nil
+	},
+	"Book.title": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(gqlBook).Title, nil
+	},
+	"Book.author": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(gqlBook).Author, nil
+	},
+	"Book.publisher": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(gqlBook).Publisher, nil
+	},
+	"Book.rating": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(gqlBook).Rating, nil
+	},
+	"Book.status": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(gqlBook).Status, nil
+	},
+	"Book.publishDate": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(gqlBook).publishDate(), nil
+	},
+	"Book.publishPrecision": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(gqlBook).PublishPrecision.String(), nil
+	},
+	"Book.edition":     gqlOptional(func(b Book) interface{} { return b.Edition }),
+	"Book.language":    gqlOptional(func(b Book) interface{} { return b.Language }),
+	"Book.pages":       gqlOptional(func(b Book) interface{} { return b.Pages }),
+	"Book.format":      gqlOptional(func(b Book) interface{} { return b.Format }),
+	"Book.series":      gqlOptional(func(b Book) interface{} { return b.Series }),
+	"Book.volume":      gqlOptional(func(b Book) interface{} { return b.Volume }),
+	"Book.description": gqlOptional(func(b Book) interface{} { return b.Description }),
+	"Book.cover":       gqlOptional(func(b Book) interface{} { return b.Cover }),
+	"Book.subjects":    gqlStrings(func(b Book) []string { return b.Subjects }),
+	"Book.tags":        gqlStrings(func(b Book) []string { return b.Tags }),
+	"Book.averageRating": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		if b := p.(gqlBook); b.RatingCount > 0 {
+			return b.AverageRating, nil
+		}
+		return nil, nil
+	},
+	"Book.ratingCount": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(gqlBook).RatingCount, nil
+	},
+	"Book.loans": func(x *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return x.loans(func(l *loan) bool { return l.BookID == p.(gqlBook).ID }), nil
+	},
+
+	"Author.name": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) { return p, nil },
+	"Author.books": func(x *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return x.books(func(b Book) bool { return b.Author == p.(string) })
+	},
+
+	"Patron.name": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) { return p, nil },
+	"Patron.loans": func(x *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return x.loans(func(l *loan) bool { return l.Patron == p.(string) }), nil
+	},
+
+	"Loan.book": func(x *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return x.resolve("Query", "book", map[string]interface{}{"id": p.(*loan).BookID})
+	},
+	"Loan.bookId": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(*loan).BookID, nil
+	},
+	"Loan.patron": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		if p.(*loan).Patron == "" {
+			return nil, nil
+		}
+		return p.(*loan).Patron, nil
+	},
+	"Loan.checkedOut": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(*loan).Out.Format(time.RFC3339), nil
+	},
+	"Loan.returned": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		if p.(*loan).Returned.IsZero() {
+			return nil, nil
+		}
+		return p.(*loan).Returned.Format(time.RFC3339), nil
+	},
+
+	"BookEvent.type": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(BookEvent).Type, nil
+	},
+	"BookEvent.id": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(BookEvent).ID, nil
+	},
+	"BookEvent.book": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return gqlBook{p.(BookEvent).ID, p.(BookEvent).Book}, nil
+	},
+	"BookEvent.time": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		return p.(BookEvent).Time.Format(time.RFC3339), nil
+	},
+
+	"Mutation.createBook": func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+		id := args["id"].(int)
+		book, err := storeFor(x.req).Create(id, NewBook())
+		if err != nil {
+			p := storeProblem(err, id)
+			if err == errExists {
+				auditChange(x.req, id, &book, &book, p.status)
+			} else {
+				auditChange(x.req, id, nil, nil, p.status)
+			}
+			return nil, p
+		}
+		auditChange(x.req, id, nil, &book, 200)
+		publish(EventCreated, id, book)
+		return gqlBook{id, book}, nil
+	},
+	"Mutation.updateBook": func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+		kvPairs := url.Values{}
+		for arg, key := range map[string]string{"title": "Title", "author": "Author", "publisher": "Publisher", "publishDate": "PublishDate",
+			"edition": "Edition", "language": "Language", "format": "Format", "series": "Series", "description": "Description", "cover": "Cover"} {
+			if v, ok := args[arg].(string); ok {
+				kvPairs.Set(key, v)
+			}
+		}
+		for arg, key := range map[string]string{"rating": "Rating", "pages": "Pages", "volume": "Volume"} {
+			if v, ok := args[arg].(int); ok {
+				kvPairs.Set(key, strconv.Itoa(v))
+			}
+		}
+		for arg, key := range map[string]string{"subjects": "Subjects", "tags": "Tags"} {
+			values, ok := args[arg].([]interface{})
+			if !ok {
+				continue
+			}
+			// none is one empty value
+			list := []string{""}
+			if len(values) > 0 {
+				list = nil
+			}
+			for _, s := range values {
+				list = append(list, s.(string))
+			}
+			kvPairs[key] = list
+		}
+		return x.update(args["id"].(int), kvPairs)
+	},
+	"Mutation.checkout": func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+		return x.update(args["id"].(int), url.Values{"Status": {"CheckedOut"}})
+	},
+	"Mutation.return": func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+		return x.update(args["id"].(int), url.Values{"Status": {"CheckedIn"}})
+	},
+
+	// the subscription hands each event in as the parent
+	"Subscription.bookChanged": func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) { return p, nil },
+}
+
+// gqlOptional is the resolver for a nullable field of a book, which is null
+// when it's empty or 0
+func gqlOptional(field func(Book) interface{}) gqlResolver {
+	return func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		v := field(p.(gqlBook).Book)
+		if v == "" || v == 0 {
+			return nil, nil
+		}
+		return v, nil
+	}
+}
+
+// a list field is never null, just empty
+func gqlStrings(field func(Book) []string) gqlResolver {
+	return func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+		l := []interface{}{}
+		for _, s := range field(p.(gqlBook).Book) {
+			l = append(l, s)
+		}
+		return l, nil
+	}
+}
+
+func sortedNames(names map[string]bool) []interface{} {
+	l := make([]string, 0, len(names))
+	for n := range names {
+		l = append(l, n)
+	}
+	sort.Strings(l)
+	out := make([]interface{}, len(l))
+	for i, n := range l {
+		out[i] = n
+	}
+	return out
+}
+
+// gqlProblem is a resolver's error, with the status the same problem gets
+// on /book/, which is the outcome the audit log records
+type gqlProblem struct {
+	status int
+	msg    string
+}
+
+func (p *gqlProblem) Error() string {
+	return p.msg
+}
+
+var gqlCodes = map[int]string{
+	400: "BAD_USER_INPUT",
+	404: "NOT_FOUND",
+	409: "CONFLICT",
+	500: "INTERNAL_SERVER_ERROR",
+}
+
+func storeProblem(err error, id int) *gqlProblem {
+	switch err {
+	case errNotFound:
+		return &gqlProblem{404, "No book " + strconv.Itoa(id) + "."}
+	case errExists:
+		return &gqlProblem{409, "Book " + strconv.Itoa(id) + " already exists."}
+	}
+	return &gqlProblem{500, "Storage error: " + err.Error()}
+}
+
+type gqlError struct {
+	Message    string            `json:"message"`
+	Locations  []gqlLocation     `json:"locations,omitempty"`
+	Path       []interface{}     `json:"path,omitempty"`
+	Extensions map[string]string `json:"extensions,omitempty"`
+}
+
+func gqlErrorAt(msg string, at gqlLocation) *gqlError {
+	return &gqlError{Message: msg, Locations: []gqlLocation{at}}
+}
+
+// gqlObject is a result object, which keeps its fields in the order the
+// query asked for them
+type gqlObject []gqlPair
+
+type gqlPair struct {
+	key   string
+	value interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, p := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(p.key)
+		v, err := json.Marshal(p.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type gqlResult struct {
+	Data   interface{} `json:"data"`
+	Errors []*gqlError `json:"errors,omitempty"`
+}
+
+// gqlExec is one request on its way through
+type gqlExec struct {
+	req   *http.Request
+	doc   *gqlDocument
+	op    *gqlOperation
+	vars  map[string]interface{}
+	needs []string
+	// field errors so far
+	errors []*gqlError
+	// read once per request. In a mutation, the audit log doesn't have
+	// the request's own changes yet.
+	listed  map[int]Book
+	entries []*loan
+	read    bool
+}
+
+// limits, so one request can't ask for the whole library a thousand times
+// over
+const (
+	gqlMaxRequest = 1 << 20
+	gqlMaxDepth   = 10
+	gqlMaxFields  = 1000
+)
+
+var gqlRoots = map[string]string{"query": "Query", "mutation": "Mutation", "subscription": "Subscription"}
+
+// prepareGraphQL parses and checks the request, and works out what it
+// needs, before any of the middleware runs, so authorize knows what's being
+// asked. Anything wrong here is the client's mistake, and nothing runs.
+func prepareGraphQL(r gqlRequest) (*gqlExec, []*gqlError) {
+	if strings.TrimSpace(r.Query) == "" {
+		return nil, []*gqlError{{Message: "Must provide a query."}}
+	}
+	doc, err := parseGraphQL(r.Query)
+	if err != nil {
+		if se, ok := err.(*gqlSyntaxError); ok {
+			return nil, []*gqlError{gqlErrorAt(se.Error(), se.at)}
+		}
+		return nil, []*gqlError{{Message: err.Error()}}
+	}
+	x := &gqlExec{doc: doc, vars: map[string]interface{}{}}
+	for _, op := range doc.ops {
+		if op.name == r.OperationName || r.OperationName == "" && len(doc.ops) == 1 {
+			x.op = op
+		}
+	}
+	if x.op == nil {
+		if r.OperationName == "" {
+			return nil, []*gqlError{{Message: "Must provide operation name if query contains multiple operations."}}
+		}
+		return nil, []*gqlError{{Message: "Unknown operation named \"" + r.OperationName + "\"."}}
+	}
+	v := &gqlValidator{x: x, needs: map[string]bool{}, used: map[string]bool{}, visiting: map[string]bool{}}
+	v.variables(r.Variables)
+	if len(v.errs) > 0 {
+		return nil, v.errs
+	}
+	v.selections(gqlSchema[gqlRoots[x.op.kind]], x.op.sel, 1)
+	for _, d := range x.op.vars {
+		if !v.used[d.name] {
+			v.fail("Variable \"$"+d.name+"\" is never used.", d.at)
+		}
+	}
+	if x.op.kind == "subscription" && len(v.errs) == 0 {
+		if root := x.collect(gqlSchema["Subscription"], x.op.sel); len(root) != 1 || root[0].fields[0].name == "__typename" {
+			v.fail("A subscription must select only one top level field.", x.op.at)
+		}
+	}
+	if len(v.errs) > 0 {
+		return nil, v.errs
+	}
+	for a := range v.needs {
+		x.needs = append(x.needs, a)
+	}
+	sort.Strings(x.needs)
+	return x, nil
+}
+
+type gqlValidator struct {
+	x        *gqlExec
+	errs     []*gqlError
+	needs    map[string]bool
+	used     map[string]bool
+	visiting map[string]bool
+	fields   int
+}
+
+func (v *gqlValidator) fail(msg string, at gqlLocation) {
+	v.errs = append(v.errs, gqlErrorAt(msg, at))
+}
+
+// variables coerces the values the client sent to the types the operation
+// declares
+func (v *gqlValidator) variables(values map[string]interface{}) {
+	for _, d := range v.x.op.vars {
+		name := "\"$" + d.name + "\""
+		if _, there := v.x.vars[d.name]; there {
+			v.fail("There can be only one variable named "+name+".", d.at)
+			continue
+		}
+		base := d.typ
+		for base.of != nil {
+			base = base.of
+		}
+		if t, known := gqlSchema[base.name]; known && t.enum == nil || !known && !gqlScalars[base.name] {
+			v.fail("Variable "+name+" cannot be non-input type \""+d.typ.String()+"\".", d.at)
+			continue
+		}
+		value, there := values[d.name]
+		var err error
+		switch {
+		case there:
+			value, err = gqlCoerce(nil, value, d.typ, true)
+		case d.hasDef:
+			value, err = gqlCoerce(nil, d.def, d.typ, false)
+		case d.typ.nonNull:
+			err = errors.New("was not provided")
+		default:
+			continue
+		}
+		if err != nil {
+			v.fail("Variable "+name+" of type \""+d.typ.String()+"\" "+err.Error(), d.at)
+			continue
+		}
+		v.x.vars[d.name] = value
+	}
+}
+
+func (v *gqlValidator) selections(t *gqlTypeDef, sel []*gqlSelection, depth int) {
+	names := map[string]*gqlSelection{}
+	for _, s := range sel {
+		// spreads don't go any deeper, but each can double what's below
+		// it, so the field count is all that stops them
+		if v.fields > gqlMaxFields {
+			return
+		}
+		for _, d := range s.directives {
+			if d.name != "skip" && d.name != "include" {
+				v.fail("Unknown directive \"@"+d.name+"\".", d.at)
+				continue
+			}
+			v.arguments("@"+d.name, d, map[string]*gqlTypeRef{"if": {name: "Boolean", nonNull: true}})
+		}
+		switch {
+		case s.spread != "":
+			f := v.x.doc.fragments[s.spread]
+			if f == nil {
+				v.fail("Unknown fragment \""+s.spread+"\".", s.at)
+			} else if v.visiting[f.name] {
+				v.fail("Cannot spread fragment \""+f.name+"\" within itself.", s.at)
+			} else if v.condition(t, f.on, s.at) {
+				v.visiting[f.name] = true
+				v.selections(t, f.sel, depth)
+				delete(v.visiting, f.name)
+			}
+		case s.inline:
+			if s.on == "" || v.condition(t, s.on, s.at) {
+				v.selections(t, s.sel, depth)
+			}
+		default:
+			v.field(t, s, depth)
+			if other := names[s.key()]; other != nil && other.name != s.name {
+				v.fail("Fields \""+s.key()+"\" conflict because \""+other.name+"\" and \""+s.name+"\" are different fields.", s.at)
+			}
+			names[s.key()] = s
+		}
+	}
+}
+
+// condition checks a fragment's type condition. Every type here is an
+// object type, so it has to be this one.
+func (v *gqlValidator) condition(t *gqlTypeDef, on string, at gqlLocation) bool {
+	if ct, known := gqlSchema[on]; !known || ct.enum != nil {
+		v.fail("Unknown type \""+on+"\".", at)
+		return false
+	}
+	if on != t.name {
+		v.fail("Fragment cannot be spread here as objects of type \""+t.name+"\" can never be of type \""+on+"\".", at)
+		return false
+	}
+	return true
+}
+
+func (v *gqlValidator) field(t *gqlTypeDef, s *gqlSelection, depth int) {
+	v.fields++
+	if v.fields == gqlMaxFields+1 {
+		v.fail("Query is too big. The limit is "+strconv.Itoa(gqlMaxFields)+" fields.", s.at)
+	}
+	if s.name == "__typename" {
+		if s.sel != nil {
+			v.fail("Field \"__typename\" must not have a selection since type \"String!\" has no subfields.", s.at)
+		}
+		return
+	}
+	f := t.fields[s.name]
+	if f == nil {
+		v.fail("Cannot query field \""+s.name+"\" on type \""+t.name+"\".", s.at)
+		return
+	}
+	if f.needs != "" {
+		v.needs[f.needs] = true
+	}
+	v.arguments(t.name+"."+s.name, s, f.args)
+	base := f.typ
+	for base.of != nil {
+		base = base.of
+	}
+	ft := gqlSchema[base.name]
+	switch {
+	case ft == nil || ft.enum != nil:
+		if s.sel != nil {
+			v.fail("Field \""+s.name+"\" must not have a selection since type \""+f.typ.String()+"\" has no subfields.", s.at)
+		}
+	case s.sel == nil:
+		v.fail("Field \""+s.name+"\" of type \""+f.typ.String()+"\" must have a selection of subfields. Did you mean \""+s.name+" { ... }\"?", s.at)
+	case depth >= gqlMaxDepth:
+		v.fail("Query is too deep. The limit is "+strconv.Itoa(gqlMaxDepth)+" levels.", s.at)
+	default:
+		v.selections(ft, s.sel, depth+1)
+	}
+}
+
+func (v *gqlValidator) arguments(what string, s *gqlSelection, want map[string]*gqlTypeRef) {
+	for name, value := range s.args {
+		t := want[name]
+		if t == nil {
+			v.fail("Unknown argument \""+name+"\" on \""+what+"\".", s.at)
+			continue
+		}
+		v.value(what+"("+name+":)", value, t, s.at)
+	}
+	for name, t := range want {
+		if _, there := s.args[name]; !there && t.nonNull {
+			v.fail("Argument \""+name+"\" of type \""+t.String()+"\" is required on \""+what+"\", but it was not provided.", s.at)
+		}
+	}
+}
+
+func (v *gqlValidator) value(what string, value interface{}, t *gqlTypeRef, at gqlLocation) {
+	if name, ok := value.(gqlVariable); ok {
+		var d *gqlVarDef
+		for _, vd := range v.x.op.vars {
+			if vd.name == string(name) {
+				d = vd
+			}
+		}
+		if d == nil {
+			v.fail("Variable \"$"+string(name)+"\" is not defined.", at)
+			return
+		}
+		v.used[d.name] = true
+		dt := *d.typ
+		dt.nonNull = dt.nonNull || d.hasDef && d.def != nil
+		if !gqlCompatible(&dt, t) {
+			v.fail("Variable \"$"+d.name+"\" of type \""+d.typ.String()+"\" used in position expecting type \""+t.String()+"\".", at)
+		}
+		return
+	}
+	if l, ok := value.([]interface{}); ok && t.of != nil {
+		for _, e := range l {
+			v.value(what, e, t.of, at)
+		}
+		return
+	}
+	if _, err := gqlCoerce(v.x.vars, value, t, false); err != nil {
+		v.fail(what+" "+err.Error(), at)
+	}
+}
+
+// gqlCompatible says whether a variable of type v can go where loc is
+// expected
+func gqlCompatible(v, loc *gqlTypeRef) bool {
+	if loc.nonNull && !v.nonNull || (v.of == nil) != (loc.of == nil) {
+		return false
+	}
+	if v.of != nil {
+		return gqlCompatible(v.of, loc.of)
+	}
+	return v.name == loc.name
+}
+
+var gqlScalars = map[string]bool{"Int": true, "Float": true, "String": true, "Boolean": true}
+
+// gqlCoerce turns a value from the query, or from the variables (which are
+// JSON), into what the resolvers get: int, float64, string, bool, Status, a
+// list of those, or nil.
+func gqlCoerce(vars map[string]interface{}, value interface{}, t *gqlTypeRef, fromJSON bool) (interface{}, error) {
+	if name, ok := value.(gqlVariable); ok && !fromJSON {
+		// already coerced
+		value = vars[string(name)]
+		if value == nil && t.nonNull {
+			return nil, errors.New("expected type \"" + t.String() + "\", found null.")
+		}
+		return value, nil
+	}
+	if value == nil {
+		if t.nonNull {
+			return nil, errors.New("expected type \"" + t.String() + "\", found null.")
+		}
+		return nil, nil
+	}
+	if t.of != nil {
+		l, ok := value.([]interface{})
+		if !ok {
+			l = []interface{}{value}
+		}
+		out := make([]interface{}, len(l))
+		for i, e := range l {
+			var err error
+			if out[i], err = gqlCoerce(vars, e, t.of, fromJSON); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	switch v := value.(type) {
+	case int64:
+		if t.name == "Int" && v >= math.MinInt32 && v <= math.MaxInt32 {
+			return int(v), nil
+		}
+		if t.name == "Float" {
+			return float64(v), nil
+		}
+	case float64:
+		if t.name == "Int" && fromJSON && v == math.Trunc(v) && v >= math.MinInt32 && v <= math.MaxInt32 {
+			return int(v), nil
+		}
+		if t.name == "Float" {
+			return v, nil
+		}
+	case string:
+		if t.name == "String" {
+			return v, nil
+		}
+		if et := gqlSchema[t.name]; fromJSON && et != nil {
+			if s, ok := enumValue(et, v); ok {
+				return s, nil
+			}
+		}
+	case bool:
+		if t.name == "Boolean" {
+			return v, nil
+		}
+	case gqlEnum:
+		if et := gqlSchema[t.name]; et != nil {
+			if s, ok := enumValue(et, string(v)); ok {
+				return s, nil
+			}
+		}
+	}
+	found, _ := json.Marshal(value)
+	if e, ok := value.(gqlEnum); ok {
+		found = []byte(e)
+	}
+	return nil, errors.New("expected type \"" + t.String() + "\", found " + string(found) + ".")
+}
+
+// Status is the only enum, and its values are in the same order
+func enumValue(t *gqlTypeDef, name string) (Status, bool) {
+	for i, n := range t.enum {
+		if n == name {
+			return Status(i), true
+		}
+	}
+	return 0, false
+}
+
+type gqlCollected struct {
+	key    string
+	fields []*gqlSelection
+}
+
+// collect gathers the fields to resolve on t, through fragments, and
+// without the ones @skip or @include leave out. Fields asked for twice
+// under the same name are resolved once.
+func (x *gqlExec) collect(t *gqlTypeDef, sel []*gqlSelection) []*gqlCollected {
+	var out []*gqlCollected
+	index := map[string]*gqlCollected{}
+	var walk func(sel []*gqlSelection)
+	walk = func(sel []*gqlSelection) {
+		for _, s := range sel {
+			if !x.included(s) {
+				continue
+			}
+			switch {
+			case s.spread != "":
+				walk(x.doc.fragments[s.spread].sel)
+			case s.inline:
+				walk(s.sel)
+			default:
+				c := index[s.key()]
+				if c == nil {
+					c = &gqlCollected{key: s.key()}
+					index[c.key] = c
+					out = append(out, c)
+				}
+				c.fields = append(c.fields, s)
+			}
+		}
+	}
+	walk(sel)
+	return out
+}
+
+func (x *gqlExec) included(s *gqlSelection) bool {
+	for _, d := range s.directives {
+		cond, _ := gqlCoerce(x.vars, d.args["if"], &gqlTypeRef{name: "Boolean", nonNull: true}, false)
+		if cond == (d.name == "skip") {
+			return false
+		}
+	}
+	return true
+}
+
+// execute runs the operation, with root as the parent of the top level
+// fields. Field errors pile up in x.errors.
+func (x *gqlExec) execute(root interface{}) interface{} {
+	data, ok := x.selectionSet(gqlSchema[gqlRoots[x.op.kind]], root, x.op.sel, nil)
+	if !ok {
+		return nil
+	}
+	return data
+}
+
+// selectionSet resolves sel on parent. If a non-null field comes back null,
+// so does the whole object, which is what false means.
+func (x *gqlExec) selectionSet(t *gqlTypeDef, parent interface{}, sel []*gqlSelection, path []interface{}) (gqlObject, bool) {
+	out := gqlObject{}
+	for _, c := range x.collect(t, sel) {
+		s := c.fields[0]
+		at := append(append([]interface{}{}, path...), c.key)
+		if s.name == "__typename" {
+			out = append(out, gqlPair{c.key, t.name})
+			continue
+		}
+		f := t.fields[s.name]
+		args := map[string]interface{}{}
+		for name, at := range f.args {
+			if value, there := s.args[name]; there {
+				args[name], _ = gqlCoerce(x.vars, value, at, false)
+			}
+		}
+		v, err := f.resolve(x, parent, args)
+		if err != nil {
+			x.fail(err, s, at)
+			v = nil
+		}
+		var sub []*gqlSelection
+		for _, s := range c.fields {
+			sub = append(sub, s.sel...)
+		}
+		r, ok := x.complete(f.typ, v, sub, s, at, err != nil)
+		if !ok {
+			return nil, false
+		}
+		out = append(out, gqlPair{c.key, r})
+	}
+	return out, true
+}
+
+func (x *gqlExec) complete(t *gqlTypeRef, v interface{}, sub []*gqlSelection, s *gqlSelection, path []interface{}, failed bool) (interface{}, bool) {
+	if v == nil {
+		if t.nonNull && !failed {
+			x.fail(errors.New("Cannot return null for non-nullable field."), s, path)
+		}
+		return nil, !t.nonNull
+	}
+	if t.of != nil {
+		l := v.([]interface{})
+		out := make([]interface{}, len(l))
+		for i, e := range l {
+			r, ok := x.complete(t.of, e, sub, s, append(append([]interface{}{}, path...), i), false)
+			if !ok {
+				return nil, !t.nonNull
+			}
+			out[i] = r
+		}
+		return out, true
+	}
+	ft := gqlSchema[t.name]
+	if ft == nil {
+		return v, true
+	}
+	if ft.enum != nil {
+		return ft.enum[v.(Status)], true
+	}
+	obj, ok := x.selectionSet(ft, v, sub, path)
+	if !ok {
+		return nil, !t.nonNull
+	}
+	return obj, true
+}
+
+func (x *gqlExec) fail(err error, s *gqlSelection, path []interface{}) {
+	e := gqlErrorAt(err.Error(), s.at)
+	e.Path = path
+	code := "INTERNAL_SERVER_ERROR"
+	if p, ok := err.(*gqlProblem); ok {
+		code = gqlCodes[p.status]
+	}
+	e.Extensions = map[string]string{"code": code}
+	x.errors = append(x.errors, e)
+}
+
+// resolve calls another field's resolver, for fields that are the same
+// thing from another direction
+func (x *gqlExec) resolve(t, field string, args map[string]interface{}) (interface{}, error) {
+	return gqlSchema[t].fields[field].resolve(x, nil, args)
+}
+
+func (x *gqlExec) list() (map[int]Book, error) {
+	if x.listed == nil {
+		books, err := storeFor(x.req).List()
+		if err != nil {
+			return nil, storeProblem(err, -1)
+		}
+		x.listed = books
+	}
+	return x.listed, nil
+}
+
+// books is the books keep likes, by ID
+func (x *gqlExec) books(keep func(Book) bool) (interface{}, error) {
+	books, err := x.list()
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for id, b := range books {
+		if keep(b) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	out := make([]interface{}, len(ids))
+	for i, id := range ids {
+		out[i] = gqlBook{id, books[id]}
+	}
+	return out, nil
+}
+
+func (x *gqlExec) auditLoans() []*loan {
+	if !x.read && audit != nil {
+		x.entries = audit.loans()
+	}
+	x.read = true
+	return x.entries
+}
+
+// loans is the loans keep likes, oldest first
+func (x *gqlExec) loans(keep func(*loan) bool) []interface{} {
+	out := []interface{}{}
+	for _, l := range x.auditLoans() {
+		if keep(l) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// update is updateBook for the mutations: checked by validateQuery, done
+// by changeBook, and published and audited the same
+func (x *gqlExec) update(id int, kvPairs url.Values) (interface{}, error) {
+	if len(kvPairs) == 0 {
+		auditChange(x.req, id, nil, nil, 400)
+		return nil, &gqlProblem{400, "No fields in update. Nothing to do."}
+	}
+	if valid, message := validateQuery(kvPairs); !valid {
+		auditChange(x.req, id, nil, nil, 400)
+		return nil, &gqlProblem{400, strings.TrimSpace(message)}
+	}
+	statusEvent := ""
+	before, book, err := storeFor(x.req).Update(id, changeBook(kvPairs, &statusEvent))
+	if err == errConflict {
+		auditChange(x.req, id, &before, &before, 409)
+		already := "checked in"
+		if before.Status == CheckedOut {
+			already = "checked out"
+		}
+		return nil, &gqlProblem{409, "Book " + strconv.Itoa(id) + " is already " + already + "."}
+	}
+	if err != nil {
+		p := storeProblem(err, id)
+		auditChange(x.req, id, nil, nil, p.status)
+		return nil, p
+	}
+	auditChange(x.req, id, &before, &book, 200)
+	publishUpdate(id, book, kvPairs, statusEvent)
+	return gqlBook{id, book}, nil
+}
+
+type gqlExecKey struct{}
+
+// graphqlActions is authorize's needs for /graphql: whatever the fields
+// asked for need
+func graphqlActions(req *http.Request) []string {
+	x, _ := req.Context().Value(gqlExecKey{}).(*gqlExec)
+	if x == nil {
+		return []string{ActionRead}
+	}
+	return x.needs
+}
+
+// graphqlHandler serves /graphql. The request's read and checked before
+// the middleware wrap puts around it, which is told whether it's a
+// mutation, since those are what the audit log wants.
+//
+// GET /graphql                  the schema
+// GET /graphql?query=...        a query, with operationName and variables
+// POST /graphql                 JSON with query, operationName and variables
+func graphqlHandler(wrap func(mutates bool, h http.HandlerFunc) http.HandlerFunc) http.HandlerFunc {
+	read, write := wrap(false, serveGraphQL), wrap(true, serveGraphQL)
+	return func(w http.ResponseWriter, req *http.Request) {
+		var r gqlRequest
+		switch req.Method {
+		case http.MethodGet:
+			q := req.URL.Query()
+			if _, there := q["query"]; !there {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, schemaSDL)
+				return
+			}
+			r.Query, r.OperationName = q.Get("query"), q.Get("operationName")
+			if v := q.Get("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &r.Variables); err != nil {
+					writeGQL(w, 400, gqlResult{Errors: []*gqlError{{Message: "Error parsing variables: " + err.Error()}}})
+					return
+				}
+			}
+		case http.MethodPost:
+			if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt != "application/json" {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(415)
+				io.WriteString(w, "Content-Type must be application/json.")
+				return
+			}
+			if err := json.NewDecoder(io.LimitReader(req.Body, gqlMaxRequest)).Decode(&r); err != nil {
+				writeGQL(w, 400, gqlResult{Errors: []*gqlError{{Message: "Error parsing request: " + err.Error()}}})
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(405)
+			return
+		}
+		x, errs := prepareGraphQL(r)
+		if errs != nil {
+			writeGQL(w, 400, gqlResult{Errors: errs})
+			return
+		}
+		req = req.WithContext(context.WithValue(req.Context(), gqlExecKey{}, x))
+		if x.op.kind != "mutation" {
+			read(w, req)
+			return
+		}
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeGQL(w, 405, gqlResult{Errors: []*gqlError{{Message: "Mutations have to be sent with POST."}}})
+			return
+		}
+		write(w, req)
+	}
+}
+
+// writeGQL writes a result. Request errors have no data at all, not even
+// null, so they go without.
+func writeGQL(w http.ResponseWriter, code int, r gqlResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if code != 200 {
+		json.NewEncoder(w).Encode(struct {
+			Errors []*gqlError `json:"errors"`
+		}{r.Errors})
+		return
+	}
+	json.NewEncoder(w).Encode(r)
+}
+
+func serveGraphQL(w http.ResponseWriter, req *http.Request) {
+	x := req.Context().Value(gqlExecKey{}).(*gqlExec)
+	x.req = req
+	if x.op.kind == "subscription" {
+		x.subscribe(w)
+		return
+	}
+	data := x.execute(nil)
+	writeGQL(w, 200, gqlResult{data, x.errors})
+}
+
+// subscribe sends a result for each event the subscription wants, as
+// server-sent events, until the client goes away or the server stops.
+func (x *gqlExec) subscribe(w http.ResponseWriter) {
+	root := x.collect(gqlSchema["Subscription"], x.op.sel)[0].fields[0]
+	f := gqlSchema["Subscription"].fields[root.name]
+	var types []string
+	if l, there := root.args["types"]; there {
+		value, _ := gqlCoerce(x.vars, l, f.args["types"], false)
+		list, _ := value.([]interface{})
+		for _, t := range list {
+			types = append(types, t.(string))
+		}
+	}
+	for _, t := range types {
+		known := false
+		for _, e := range allEvents {
+			known = known || t == e
+		}
+		if !known {
+			writeGQL(w, 400, gqlResult{Errors: []*gqlError{gqlErrorAt("Invalid event "+t+". Valid events are "+strings.Join(allEvents, ", ")+".", root.at)}})
+			return
+		}
+	}
+	var id interface{}
+	if v, there := root.args["id"]; there {
+		id, _ = gqlCoerce(x.vars, v, f.args["id"], false)
+	}
+	filter := Webhook{Events: types}
+	events, cancel, ok := watchers.subscribe(watchBuffer)
+	defer cancel()
+	if !ok {
+		writeGQL(w, 503, gqlResult{Errors: []*gqlError{{Message: "Server shutting down."}}})
+		return
+	}
+	// the write timeout is for requests, not for streams
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	rc.Flush()
+	for {
+		select {
+		case <-x.req.Context().Done():
+			return
+		case ev, open := <-events:
+			if !open {
+				msg := "Fell too far behind."
+				if watchers.isClosed() {
+					msg = "Server shutting down."
+				}
+				next, _ := json.Marshal(gqlResult{Errors: []*gqlError{{Message: msg}}})
+				io.WriteString(w, "event: next\ndata: "+string(next)+"\n\nevent: complete\ndata:\n\n")
+				return
+			}
+			if !filter.wants(ev.Type) || id != nil && id.(int) != ev.ID {
+				continue
+			}
+			x.errors, x.listed, x.read = nil, nil, false
+			next, _ := json.Marshal(gqlResult{x.execute(ev), x.errors})
+			if _, err := io.WriteString(w, "event: next\ndata: "+string(next)+"\n\n"); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// /graphql with the middleware main puts around it
+func graphqlServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(logged("/graphql", graphqlHandler(func(mutates bool, h http.HandlerFunc) http.HandlerFunc {
+		h = authenticate(authorize(graphqlActions, h))
+		if mutates {
+			h = audited(h)
+		}
+		return h
+	})))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+type gqlReply struct {
+	Data   json.RawMessage
+	Errors []struct {
+		Message    string
+		Path       []interface{}
+		Extensions map[string]string
+	}
+}
+
+func graphql(t *testing.T, srv *httptest.Server, key, query string, vars map[string]interface{}) (int, gqlReply) {
+	body, _ := json.Marshal(gqlRequest{Query: query, Variables: vars})
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/graphql", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r gqlReply
+	if resp.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, r
+}
+
+func TestGraphQLBookWithLoans(t *testing.T) {
+	freshAudit()
+	auth = testAuthenticator(t)
+	saved := policy.policy
+	policy.policy = &Policy{Roles: saved.Roles, Callers: map[string]string{"frontdesk": "admin"}}
+	defer func() { store = nil; audit = nil; auth = nil; policy.policy = saved }()
+	srv := graphqlServer(t)
+
+	code, r := graphql(t, srv, "current-key", `mutation Add($title: String) {
+		a: createBook(id: 1) { id }
+		b: updateBook(id: 1, title: $title, rating: 3) { title rating }
+		c: checkout(id: 1) { status }
+		d: return(id: 1) { ...Status }
+		e: checkout(id: 1) { ...Status }
+		f: checkout(id: 1) { status }
+		g: return(id: 1) { status }
+	}
+	fragment Status on Book { status }`, map[string]interface{}{"title": "Dune"})
+	if code != 200 || string(r.Data) != `null` {
+		t.Errorf("mutation gave %d %s, expected the failed checkout to null it all", code, r.Data)
+	}
+	// and the return after it never happens
+	if len(r.Errors) != 1 || r.Errors[0].Extensions["code"] != "CONFLICT" || r.Errors[0].Path[0] != "f" {
+		t.Errorf("got errors %+v, expected a conflict on f", r.Errors)
+	}
+
+	// the web app's round trip
+	code, r = graphql(t, srv, "current-key", `{
+		book(id: 1) { title rating status loans { patron checkedOut returned } }
+		missing: book(id: 2) { title }
+		authors { name books { id } }
+	}`, nil)
+	var data struct {
+		Book struct {
+			Title  string
+			Rating int
+			Status string
+			Loans  []struct {
+				Patron     string
+				CheckedOut string
+				Returned   *string
+			}
+		}
+		Missing *struct{}
+		Authors []struct{ Name string }
+	}
+	if err := json.Unmarshal(r.Data, &data); code != 200 || err != nil || len(r.Errors) != 0 {
+		t.Fatalf("query gave %d %s %+v %v", code, r.Data, r.Errors, err)
+	}
+	b := data.Book
+	if b.Title != "Dune" || b.Rating != 3 || b.Status != "CHECKED_OUT" || data.Missing != nil || len(data.Authors) != 1 {
+		t.Errorf("got %s", r.Data)
+	}
+	if len(b.Loans) != 2 || b.Loans[0].Patron != "frontdesk" || b.Loans[0].Returned == nil || b.Loans[1].Returned != nil {
+		t.Errorf("got loans %+v, expected one returned and one out, both to frontdesk", b.Loans)
+	}
+	if !strings.HasPrefix(string(r.Data), `{"book":{"title":"Dune","rating":3,`) {
+		t.Errorf("fields came back out of order: %s", r.Data)
+	}
+
+	// an entry per field, each with its own outcome
+	l := audit.query(time.Time{}, time.Time{}, -1)
+	outcomes := []int{200, 200, 200, 200, 200, 409}
+	if len(l) != len(outcomes) {
+		t.Fatalf("got %d audit entries, expected %d", len(l), len(outcomes))
+	}
+	for i, o := range outcomes {
+		if l[i].Outcome != o || l[i].BookID != 1 || l[i].Path != "/graphql" {
+			t.Errorf("entry %d: %d on %d at %s, expected %d on 1", i+1, l[i].Outcome, l[i].BookID, l[i].Path, o)
+		}
+	}
+}
+
+func TestGraphQLTags(t *testing.T) {
+	freshAudit()
+	auth = testAuthenticator(t)
+	saved := policy.policy
+	policy.policy = &Policy{Roles: saved.Roles, Callers: map[string]string{"frontdesk": "cataloger"}}
+	defer func() { store = nil; audit = nil; auth = nil; policy.policy = saved }()
+	srv := graphqlServer(t)
+	store.Create(1, NewBook())
+	store.Create(2, NewBook())
+
+	code, r := graphql(t, srv, "current-key", `mutation {
+		a: updateBook(id: 1, tags: ["gift", "book-club"]) { tags }
+		b: updateBook(id: 2, tags: ["Gift"]) { tags }
+	}`, nil)
+	if code != 200 || string(r.Data) != `{"a":{"tags":["gift","book-club"]},"b":{"tags":["Gift"]}}` {
+		t.Errorf("tagging gave %d %s %+v", code, r.Data, r.Errors)
+	}
+	for query, expected := range map[string]string{
+		`{ books(tags: ["GIFT"]) { id } }`:              `{"books":[{"id":1},{"id":2}]}`,
+		`{ books(tags: ["gift", "book-club"]) { id } }`: `{"books":[{"id":1}]}`,
+		`{ books(tags: []) { id } }`:                    `{"books":[{"id":1},{"id":2}]}`,
+	} {
+		if code, r := graphql(t, srv, "current-key", query, nil); code != 200 || string(r.Data) != expected {
+			t.Errorf("%s gave %d %s %+v, expected %s", query, code, r.Data, r.Errors, expected)
+		}
+	}
+	// none clears them
+	code, r = graphql(t, srv, "current-key", `mutation { updateBook(id: 2, tags: []) { tags } }`, nil)
+	if code != 200 || string(r.Data) != `{"updateBook":{"tags":[]}}` {
+		t.Errorf("clearing gave %d %s %+v", code, r.Data, r.Errors)
+	}
+}
+
+func TestGraphQLErrors(t *testing.T) {
+	freshAudit()
+	auth = testAuthenticator(t)
+	defer func() { store = nil; audit = nil; auth = nil }()
+	srv := graphqlServer(t)
+	store.Create(1, NewBook())
+
+	for query, expected := range map[string]string{
+		`{ book(id: 1) { title } `:                                     "Syntax Error: Expected Name, found <EOF>.",
+		`{ book(id: 1) { isbn } }`:                                     `Cannot query field "isbn" on type "Book".`,
+		`{ book(id: 1) }`:                                              `Field "book" of type "Book" must have a selection of subfields. Did you mean "book { ... }"?`,
+		`{ book(id: 1) { title { a } } }`:                              `Field "title" must not have a selection since type "String!" has no subfields.`,
+		`{ book { title } }`:                                           `Argument "id" of type "Int!" is required on "Query.book", but it was not provided.`,
+		`{ book(id: "1") { title } }`:                                  `Query.book(id:) expected type "Int!", found "1".`,
+		`{ books(status: LOST) { id } }`:                               `Query.books(status:) expected type "Status", found LOST.`,
+		`query ($id: Int) { book(id: $id) { id } }`:                    `Variable "$id" of type "Int" used in position expecting type "Int!".`,
+		`{ book(id: $id) { id } }`:                                     `Variable "$id" is not defined.`,
+		`{ ...Nope }`:                                                  `Unknown fragment "Nope".`,
+		`{ ...A } fragment A on Query { ...A }`:                        `Cannot spread fragment "A" within itself.`,
+		`{ a: book(id: 1) { id } a: books { id } }`:                    `Fields "a" conflict because "book" and "books" are different fields.`,
+		`{ book(id: 1) { id @defer } }`:                                `Unknown directive "@defer".`,
+		`subscription { a: bookChanged { id } b: bookChanged { id } }`: "A subscription must select only one top level field.",
+		`{ loans { book { loans { book { loans { book { loans { book { loans { book { id } } } } } } } } } } }`: "Query is too deep. The limit is 10 levels.",
+	} {
+		if code, r := graphql(t, srv, "", query, nil); code != 400 || len(r.Errors) == 0 || r.Errors[0].Message != expected {
+			t.Errorf("%s: got %d %+v, expected 400 %s", query, code, r.Errors, expected)
+		}
+	}
+
+	// checked before anything else, so a bad query is a 400 even for strangers
+	if code, _ := graphql(t, srv, "", `{ book(id: 1) { title } }`, nil); code != 401 {
+		t.Errorf("query without a key gave %d", code)
+	}
+	if code, r := graphql(t, srv, "current-key", `{ book(id: 1) { title } }`, nil); code != 200 || string(r.Data) != `{"book":{"title":"Untitled"}}` {
+		t.Errorf("query as a reader gave %d %s", code, r.Data)
+	}
+	if code, _ := graphql(t, srv, "current-key", `{ book(id: 1) { loans { patron } } }`, nil); code != 403 {
+		t.Errorf("loan history as a reader gave %d, expected 403", code)
+	}
+	if code, _ := graphql(t, srv, "current-key", `mutation { checkout(id: 1) { id } }`, nil); code != 403 {
+		t.Errorf("checkout as a reader gave %d, expected 403", code)
+	}
+	auth = nil
+
+	// fragments that spread the one before twice, 2^25 fields in all
+	bomb := "{ book(id: 1) { ...F25 } } fragment F0 on Book { id }"
+	for i := 1; i <= 25; i++ {
+		bomb += fmt.Sprintf(" fragment F%d on Book { ...F%d ...F%d }", i, i-1, i-1)
+	}
+	start := time.Now()
+	if code, r := graphql(t, srv, "", bomb, nil); code != 400 || len(r.Errors) == 0 || r.Errors[0].Message != "Query is too big. The limit is 1000 fields." {
+		t.Errorf("fragment bomb gave %d %+v", code, r.Errors)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("fragment bomb took %v to turn away", d)
+	}
+
+	code, r := graphql(t, srv, "", `query ($r: Int!) { book(id: 1) { id } }`, map[string]interface{}{"r": 1})
+	if code != 400 || r.Errors[0].Message != `Variable "$r" is never used.` {
+		t.Errorf("unused variable gave %d %+v", code, r.Errors)
+	}
+	code, r = graphql(t, srv, "", `mutation ($r: Int!) { updateBook(id: 1, rating: $r) { rating } }`, map[string]interface{}{"r": 9})
+	if code != 200 || string(r.Data) != "null" || len(r.Errors) != 1 || r.Errors[0].Extensions["code"] != "BAD_USER_INPUT" || !strings.HasPrefix(r.Errors[0].Message, "Invalid Rating") {
+		t.Errorf("bad rating gave %d %s %+v", code, r.Data, r.Errors)
+	}
+	code, r = graphql(t, srv, "", `mutation ($r: Int!) { updateBook(id: 1, rating: $r) { rating } }`, map[string]interface{}{"r": 1.5})
+	if code != 400 || r.Errors[0].Message != `Variable "$r" of type "Int!" expected type "Int!", found 1.5.` {
+		t.Errorf("fractional rating gave %d %+v", code, r.Errors)
+	}
+
+	resp, _ := http.Get(srv.URL + "/graphql?query=" + url.QueryEscape(`mutation { createBook(id: 2) { id } }`))
+	if resp.StatusCode != 405 {
+		t.Errorf("mutation by GET gave %d", resp.StatusCode)
+	}
+	resp, _ = http.Get(srv.URL + "/graphql?query=" + url.QueryEscape(`query ($id: Int!) { book(id: $id) { __typename id } }`) + "&variables=" + url.QueryEscape(`{"id": 1}`))
+	var got gqlReply
+	json.NewDecoder(resp.Body).Decode(&got)
+	if resp.StatusCode != 200 || string(got.Data) != `{"book":{"__typename":"Book","id":1}}` {
+		t.Errorf("query by GET gave %d %s", resp.StatusCode, got.Data)
+	}
+	resp, _ = http.Post(srv.URL+"/graphql", "text/plain", strings.NewReader("{ books { id } }"))
+	if resp.StatusCode != 415 {
+		t.Errorf("text/plain POST gave %d", resp.StatusCode)
+	}
+	resp, _ = http.Get(srv.URL + "/graphql")
+	if sdl, _ := io.ReadAll(resp.Body); resp.StatusCode != 200 || !strings.Contains(string(sdl), "type Query {") {
+		t.Errorf("schema gave %d %.40q", resp.StatusCode, sdl)
+	}
+}
+
+func TestGraphQLSubscription(t *testing.T) {
+	freshAudit()
+	defer func() { store = nil; audit = nil }()
+	srv := graphqlServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body, _ := json.Marshal(gqlRequest{Query: `subscription ($id: Int) {
+		bookChanged(types: ["book.checkedOut", "book.returned"], id: $id) { type book { id status } }
+	}`, Variables: map[string]interface{}{"id": 2}})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/graphql", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		var r gqlReply
+		json.NewDecoder(resp.Body).Decode(&r)
+		t.Fatalf("got %d %+v, expected an event stream", resp.StatusCode, r.Errors)
+	}
+
+	graphql(t, srv, "", `mutation {
+		a: createBook(id: 1) { id } b: createBook(id: 2) { id }
+		c: checkout(id: 1) { id } d: checkout(id: 2) { id } e: return(id: 2) { id }
+	}`, nil)
+	lines := bufio.NewScanner(resp.Body)
+	for _, expected := range []string{
+		`{"data":{"bookChanged":{"type":"book.checkedOut","book":{"id":2,"status":"CHECKED_OUT"}}}}`,
+		`{"data":{"bookChanged":{"type":"book.returned","book":{"id":2,"status":"CHECKED_IN"}}}}`,
+	} {
+		var event, data string
+		for lines.Scan() && lines.Text() != "" {
+			if strings.HasPrefix(lines.Text(), "event: ") {
+				event = strings.TrimPrefix(lines.Text(), "event: ")
+			}
+			if strings.HasPrefix(lines.Text(), "data: ") {
+				data = strings.TrimPrefix(lines.Text(), "data: ")
+			}
+		}
+		if event != "next" || data != expected {
+			t.Errorf("got %s %s, expected next %s", event, data, expected)
+		}
+	}
+
+	if code, r := graphql(t, srv, "", `subscription { bookChanged(types: ["book.eaten"]) { id } }`, nil); code != 400 || len(r.Errors) != 1 {
+		t.Errorf("unknown event gave %d %+v", code, r.Errors)
+	}
+}
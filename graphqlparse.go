@@ -0,0 +1,828 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The GraphQL language, as much of it as /graphql needs: operations with
+// variables, fields with aliases and arguments, fragments, inline fragments
+// and directives. And enough of the type system language to read
+// schema.graphql: object types and enums, with descriptions.
+
+type gqlDocument struct {
+	ops       []*gqlOperation
+	fragments map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind string // query, mutation or subscription
+	name string
+	vars []*gqlVarDef
+	sel  []*gqlSelection
+	at   gqlLocation
+}
+
+type gqlVarDef struct {
+	name   string
+	typ    *gqlTypeRef
+	def    interface{}
+	hasDef bool
+	at     gqlLocation
+}
+
+type gqlFragment struct {
+	name, on string
+	sel      []*gqlSelection
+	at       gqlLocation
+}
+
+// gqlSelection is a field, a fragment spread (spread is set) or an inline
+// fragment (inline is set, on is the type condition, if any).
+type gqlSelection struct {
+	alias, name string
+	args        map[string]interface{}
+	directives  []*gqlSelection // a directive is a name and arguments
+	sel         []*gqlSelection
+	spread      string
+	inline      bool
+	on          string
+	at          gqlLocation
+}
+
+func (s *gqlSelection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// values in arguments and defaults are nil, bool, int64, float64, string,
+// []interface{} and map[string]interface{} as you'd expect, and these two
+type gqlVariable string
+type gqlEnum string
+
+// gqlTypeRef is a type as written: a name, or a list of some type, maybe
+// non-null
+type gqlTypeRef struct {
+	name    string
+	of      *gqlTypeRef
+	nonNull bool
+}
+
+func (t *gqlTypeRef) String() string {
+	s := t.name
+	if t.of != nil {
+		s = "[" + t.of.String() + "]"
+	}
+	if t.nonNull {
+		s += "!"
+	}
+	return s
+}
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type gqlSyntaxError struct {
+	msg string
+	at  gqlLocation
+}
+
+func (e *gqlSyntaxError) Error() string {
+	return "Syntax Error: " + e.msg
+}
+
+const (
+	tokEOF = iota
+	tokPunct
+	tokName
+	tokInt
+	tokFloat
+	tokString
+)
+
+type gqlToken struct {
+	kind int
+	text string // for strings, the value, unescaped
+	at   gqlLocation
+}
+
+func (t gqlToken) describe() string {
+	switch t.kind {
+	case tokEOF:
+		return "<EOF>"
+	case tokString:
+		return "String " + strconv.Quote(t.text)
+	case tokName:
+		return "Name \"" + t.text + "\""
+	case tokInt, tokFloat:
+		return "Number " + t.text
+	}
+	return "\"" + t.text + "\""
+}
+
+type gqlLexer struct {
+	src       string
+	pos       int
+	line, col int // of pos
+}
+
+func (l *gqlLexer) fail(msg string) error {
+	return &gqlSyntaxError{msg, gqlLocation{l.line, l.col}}
+}
+
+func (l *gqlLexer) advance(n int) {
+	for i := 0; i < n; i++ {
+		if l.src[l.pos] == '\n' {
+			l.line++
+			l.col = 1
+		} else if l.src[l.pos] < 0x80 || l.src[l.pos] >= 0xc0 {
+			l.col++
+		}
+		l.pos++
+	}
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	// whitespace, commas and comments don't count
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.advance(1)
+			}
+		} else if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			l.advance(1)
+		} else if strings.HasPrefix(l.src[l.pos:], "\uFEFF") {
+			l.advance(3)
+		} else {
+			break
+		}
+	}
+	t := gqlToken{at: gqlLocation{l.line, l.col}}
+	if l.pos >= len(l.src) {
+		return t, nil
+	}
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+		t.kind, t.text = tokPunct, string(c)
+		l.advance(1)
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		t.kind, t.text = tokPunct, "..."
+		l.advance(3)
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for l.pos < len(l.src) && isNameByte(l.src[l.pos]) {
+			l.advance(1)
+		}
+		t.kind, t.text = tokName, l.src[start:l.pos]
+	case c == '-' || c >= '0' && c <= '9':
+		return l.number(t)
+	case c == '"':
+		if strings.HasPrefix(l.src[l.pos:], `"""`) {
+			return l.blockString(t)
+		}
+		return l.str(t)
+	default:
+		r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+		return t, l.fail("Unexpected character " + strconv.QuoteRune(r) + ".")
+	}
+	return t, nil
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (l *gqlLexer) digits() int {
+	n := 0
+	for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+		l.advance(1)
+		n++
+	}
+	return n
+}
+
+func (l *gqlLexer) number(t gqlToken) (gqlToken, error) {
+	start := l.pos
+	t.kind = tokInt
+	if l.src[l.pos] == '-' {
+		l.advance(1)
+	}
+	first := l.pos
+	if l.digits() == 0 {
+		return t, l.fail("Invalid number, expected digit.")
+	}
+	if l.pos-first > 1 && l.src[first] == '0' {
+		return t, l.fail("Invalid number, unexpected digit after 0.")
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		t.kind = tokFloat
+		l.advance(1)
+		if l.digits() == 0 {
+			return t, l.fail("Invalid number, expected digit.")
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		t.kind = tokFloat
+		l.advance(1)
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.advance(1)
+		}
+		if l.digits() == 0 {
+			return t, l.fail("Invalid number, expected digit.")
+		}
+	}
+	if l.pos < len(l.src) && (isNameByte(l.src[l.pos]) || l.src[l.pos] == '.') {
+		return t, l.fail("Invalid number, unexpected " + strconv.Quote(l.src[l.pos:l.pos+1]) + ".")
+	}
+	t.text = l.src[start:l.pos]
+	return t, nil
+}
+
+func (l *gqlLexer) str(t gqlToken) (gqlToken, error) {
+	t.kind = tokString
+	l.advance(1)
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' || l.src[l.pos] == '\r' {
+			return t, l.fail("Unterminated string.")
+		}
+		c := l.src[l.pos]
+		if c == '"' {
+			l.advance(1)
+			t.text = b.String()
+			return t, nil
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			l.advance(1)
+			continue
+		}
+		if l.pos+1 >= len(l.src) {
+			return t, l.fail("Unterminated string.")
+		}
+		switch e := l.src[l.pos+1]; e {
+		case '"', '\\', '/':
+			b.WriteByte(e)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if l.pos+6 > len(l.src) {
+				return t, l.fail("Invalid Unicode escape sequence.")
+			}
+			r, err := strconv.ParseUint(l.src[l.pos+2:l.pos+6], 16, 32)
+			if err != nil {
+				return t, l.fail("Invalid Unicode escape sequence.")
+			}
+			b.WriteRune(rune(r))
+			l.advance(4)
+		default:
+			return t, l.fail("Invalid character escape sequence: \\" + string(e) + ".")
+		}
+		l.advance(2)
+	}
+}
+
+// block strings, without the common indentation and blank first and last
+// lines
+func (l *gqlLexer) blockString(t gqlToken) (gqlToken, error) {
+	t.kind = tokString
+	l.advance(3)
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) {
+			return t, l.fail("Unterminated string.")
+		}
+		if strings.HasPrefix(l.src[l.pos:], `\"""`) {
+			b.WriteString(`"""`)
+			l.advance(4)
+			continue
+		}
+		if strings.HasPrefix(l.src[l.pos:], `"""`) {
+			l.advance(3)
+			break
+		}
+		b.WriteByte(l.src[l.pos])
+		l.advance(1)
+	}
+	lines := strings.Split(strings.ReplaceAll(b.String(), "\r\n", "\n"), "\n")
+	indent := -1
+	for _, s := range lines[1:] {
+		trimmed := strings.TrimLeft(s, " \t")
+		if trimmed != "" && (indent < 0 || len(s)-len(trimmed) < indent) {
+			indent = len(s) - len(trimmed)
+		}
+	}
+	for i := 1; i < len(lines) && indent > 0; i++ {
+		if len(lines[i]) >= indent {
+			lines[i] = lines[i][indent:]
+		} else {
+			lines[i] = ""
+		}
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+	t.text = strings.Join(lines, "\n")
+	return t, nil
+}
+
+type gqlParser struct {
+	lex gqlLexer
+	tok gqlToken
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{lex: gqlLexer{src: src, line: 1, col: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	doc := &gqlDocument{fragments: map[string]*gqlFragment{}}
+	if p.tok.kind == tokEOF {
+		return nil, p.unexpected()
+	}
+	for p.tok.kind != tokEOF {
+		if p.peekName("fragment") {
+			f, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			doc.fragments[f.name] = f
+			continue
+		}
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		doc.ops = append(doc.ops, op)
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) advance() error {
+	t, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = t
+	return nil
+}
+
+func (p *gqlParser) unexpected() error {
+	return &gqlSyntaxError{"Unexpected " + p.tok.describe() + ".", p.tok.at}
+}
+
+func (p *gqlParser) peek(punct string) bool {
+	return p.tok.kind == tokPunct && p.tok.text == punct
+}
+
+func (p *gqlParser) peekName(name string) bool {
+	return p.tok.kind == tokName && p.tok.text == name
+}
+
+// skip moves past punct if it's next, and says whether it was
+func (p *gqlParser) skip(punct string) (bool, error) {
+	if !p.peek(punct) {
+		return false, nil
+	}
+	return true, p.advance()
+}
+
+func (p *gqlParser) expect(punct string) error {
+	if !p.peek(punct) {
+		return &gqlSyntaxError{"Expected \"" + punct + "\", found " + p.tok.describe() + ".", p.tok.at}
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != tokName {
+		return "", &gqlSyntaxError{"Expected Name, found " + p.tok.describe() + ".", p.tok.at}
+	}
+	n := p.tok.text
+	return n, p.advance()
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: "query", at: p.tok.at}
+	if p.peek("{") {
+		sel, err := p.selectionSet()
+		op.sel = sel
+		return op, err
+	}
+	if !p.peekName("query") && !p.peekName("mutation") && !p.peekName("subscription") {
+		return nil, p.unexpected()
+	}
+	op.kind = p.tok.text
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var err error
+	if p.tok.kind == tokName {
+		if op.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if op.vars, err = p.varDefs(); err != nil {
+		return nil, err
+	}
+	// directives on operations are allowed, and ignored
+	if _, err = p.directives(); err != nil {
+		return nil, err
+	}
+	op.sel, err = p.selectionSet()
+	return op, err
+}
+
+func (p *gqlParser) varDefs() ([]*gqlVarDef, error) {
+	if ok, err := p.skip("("); !ok || err != nil {
+		return nil, err
+	}
+	var defs []*gqlVarDef
+	for {
+		d := &gqlVarDef{at: p.tok.at}
+		if err := p.expect("$"); err != nil {
+			return nil, err
+		}
+		var err error
+		if d.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if err = p.expect(":"); err != nil {
+			return nil, err
+		}
+		if d.typ, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+		if d.hasDef, err = p.skip("="); err != nil {
+			return nil, err
+		}
+		if d.hasDef {
+			if d.def, err = p.value(true); err != nil {
+				return nil, err
+			}
+		}
+		if _, err = p.directives(); err != nil {
+			return nil, err
+		}
+		defs = append(defs, d)
+		if ok, err := p.skip(")"); ok || err != nil {
+			return defs, err
+		}
+	}
+}
+
+func (p *gqlParser) typeRef() (*gqlTypeRef, error) {
+	t := &gqlTypeRef{}
+	var err error
+	if ok, err := p.skip("["); err != nil {
+		return nil, err
+	} else if ok {
+		if t.of, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+		if err = p.expect("]"); err != nil {
+			return nil, err
+		}
+	} else if t.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	t.nonNull, err = p.skip("!")
+	return t, err
+}
+
+func (p *gqlParser) fragment() (*gqlFragment, error) {
+	f := &gqlFragment{at: p.tok.at}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var err error
+	if f.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if f.name == "on" {
+		return nil, &gqlSyntaxError{"Unexpected Name \"on\".", f.at}
+	}
+	if !p.peekName("on") {
+		return nil, &gqlSyntaxError{"Expected \"on\", found " + p.tok.describe() + ".", p.tok.at}
+	}
+	if err = p.advance(); err != nil {
+		return nil, err
+	}
+	if f.on, err = p.name(); err != nil {
+		return nil, err
+	}
+	if _, err = p.directives(); err != nil {
+		return nil, err
+	}
+	f.sel, err = p.selectionSet()
+	return f, err
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sel []*gqlSelection
+	for {
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, s)
+		if ok, err := p.skip("}"); ok || err != nil {
+			return sel, err
+		}
+	}
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	s := &gqlSelection{at: p.tok.at}
+	var err error
+	if ok, err := p.skip("..."); err != nil {
+		return nil, err
+	} else if ok {
+		if p.tok.kind == tokName && p.tok.text != "on" {
+			s.spread = p.tok.text
+			if err = p.advance(); err != nil {
+				return nil, err
+			}
+			s.directives, err = p.directives()
+			return s, err
+		}
+		s.inline = true
+		if p.peekName("on") {
+			if err = p.advance(); err != nil {
+				return nil, err
+			}
+			if s.on, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if s.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		s.sel, err = p.selectionSet()
+		return s, err
+	}
+	if s.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if ok, err := p.skip(":"); err != nil {
+		return nil, err
+	} else if ok {
+		s.alias = s.name
+		if s.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if s.args, err = p.arguments(); err != nil {
+		return nil, err
+	}
+	if s.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.peek("{") {
+		s.sel, err = p.selectionSet()
+	}
+	return s, err
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	if ok, err := p.skip("("); !ok || err != nil {
+		return args, err
+	}
+	for {
+		at := p.tok.at
+		n, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if _, there := args[n]; there {
+			return nil, &gqlSyntaxError{"There can be only one argument named \"" + n + "\".", at}
+		}
+		if err = p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[n], err = p.value(false); err != nil {
+			return nil, err
+		}
+		if ok, err := p.skip(")"); ok || err != nil {
+			return args, err
+		}
+	}
+}
+
+func (p *gqlParser) directives() ([]*gqlSelection, error) {
+	var ds []*gqlSelection
+	for p.peek("@") {
+		d := &gqlSelection{at: p.tok.at}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		var err error
+		if d.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if d.args, err = p.arguments(); err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// value parses a literal. Variables aren't allowed in constants, like
+// defaults.
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	t := p.tok
+	switch {
+	case t.kind == tokPunct && t.text == "$" && !constant:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		n, err := p.name()
+		return gqlVariable(n), err
+	case t.kind == tokPunct && t.text == "[":
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		l := []interface{}{}
+		for {
+			if ok, err := p.skip("]"); ok || err != nil {
+				return l, err
+			}
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+	case t.kind == tokPunct && t.text == "{":
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		o := map[string]interface{}{}
+		for {
+			if ok, err := p.skip("}"); ok || err != nil {
+				return o, err
+			}
+			n, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			if o[n], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+	case t.kind == tokInt:
+		i, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, &gqlSyntaxError{"Int cannot represent " + t.text + ".", t.at}
+		}
+		return i, p.advance()
+	case t.kind == tokFloat:
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return f, p.advance()
+	case t.kind == tokString:
+		return t.text, p.advance()
+	case t.kind == tokName:
+		var v interface{} = gqlEnum(t.text)
+		switch t.text {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		}
+		return v, p.advance()
+	}
+	return nil, p.unexpected()
+}
+
+// gqlTypeDef is an object type or an enum from schema.graphql
+type gqlTypeDef struct {
+	name   string
+	enum   []string
+	fields map[string]*gqlField
+}
+
+type gqlField struct {
+	name  string
+	typ   *gqlTypeRef
+	args  map[string]*gqlTypeRef
+	needs string // the action the caller's role must allow, if any
+	// resolve is filled in from gqlResolvers
+	resolve gqlResolver
+}
+
+func parseSchema(src string) (map[string]*gqlTypeDef, error) {
+	p := &gqlParser{lex: gqlLexer{src: src, line: 1, col: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	types := map[string]*gqlTypeDef{}
+	for p.tok.kind != tokEOF {
+		if err := p.description(); err != nil {
+			return nil, err
+		}
+		kind, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if kind != "type" && kind != "enum" {
+			return nil, &gqlSyntaxError{"Unsupported definition " + kind + ".", p.tok.at}
+		}
+		t := &gqlTypeDef{fields: map[string]*gqlField{}}
+		if t.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if err = p.expect("{"); err != nil {
+			return nil, err
+		}
+		for {
+			if ok, err := p.skip("}"); ok || err != nil {
+				if err != nil {
+					return nil, err
+				}
+				break
+			}
+			if err = p.description(); err != nil {
+				return nil, err
+			}
+			n, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if kind == "enum" {
+				t.enum = append(t.enum, n)
+				continue
+			}
+			f := &gqlField{name: n, args: map[string]*gqlTypeRef{}}
+			if ok, err := p.skip("("); err != nil {
+				return nil, err
+			} else if ok {
+				for {
+					if ok, err := p.skip(")"); ok || err != nil {
+						if err != nil {
+							return nil, err
+						}
+						break
+					}
+					if err = p.description(); err != nil {
+						return nil, err
+					}
+					a, err := p.name()
+					if err != nil {
+						return nil, err
+					}
+					if err = p.expect(":"); err != nil {
+						return nil, err
+					}
+					if f.args[a], err = p.typeRef(); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			if f.typ, err = p.typeRef(); err != nil {
+				return nil, err
+			}
+			t.fields[n] = f
+		}
+		types[t.name] = t
+	}
+	return types, nil
+}
+
+// descriptions are for people reading the schema. Skipped.
+func (p *gqlParser) description() error {
+	if p.tok.kind == tokString {
+		return p.advance()
+	}
+	return nil
+}
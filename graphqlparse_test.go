@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	doc, err := parseGraphQL(`
+		# a comment
+		query Shelf($id: Int! = 3, $types: [String!]) @cached {
+			first: book(id: $id) { ...Basics, loans { patron } }
+			books(author: "J. D. \"Jerome\" Salinger!", status: CHECKED_OUT) {
+				... on Book @include(if: true) { title }
+			}
+			desc: author(name: """
+				Frank
+				  Herbert
+			""") { name }
+		}
+		fragment Basics on Book { id title }
+		mutation { checkout(id: -4) { id } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.ops) != 2 || doc.ops[0].name != "Shelf" || doc.ops[1].kind != "mutation" {
+		t.Fatalf("got operations %+v", doc.ops)
+	}
+	op := doc.ops[0]
+	if len(op.vars) != 2 || op.vars[0].typ.String() != "Int!" || op.vars[0].def != int64(3) || op.vars[1].typ.String() != "[String!]" || op.vars[1].hasDef {
+		t.Errorf("got variables %+v %+v", op.vars[0], op.vars[1])
+	}
+	first := op.sel[0]
+	if first.alias != "first" || first.name != "book" || first.args["id"] != gqlVariable("id") || first.sel[0].spread != "Basics" || first.at != (gqlLocation{4, 4}) {
+		t.Errorf("got first field %+v", first)
+	}
+	books := op.sel[1]
+	if books.args["author"] != `J. D. "Jerome" Salinger!` || books.args["status"] != gqlEnum("CHECKED_OUT") {
+		t.Errorf("got books arguments %v", books.args)
+	}
+	if in := books.sel[0]; !in.inline || in.on != "Book" || in.directives[0].name != "include" || in.directives[0].args["if"] != true {
+		t.Errorf("got inline fragment %+v", in)
+	}
+	if name := op.sel[2].args["name"]; name != "Frank\n  Herbert" {
+		t.Errorf("block string came out as %q", name)
+	}
+	if f := doc.fragments["Basics"]; f == nil || f.on != "Book" || len(f.sel) != 2 {
+		t.Errorf("got fragment %+v", f)
+	}
+	if id := doc.ops[1].sel[0].args["id"]; id != int64(-4) {
+		t.Errorf("negative argument came out as %v", id)
+	}
+}
+
+func TestParseGraphQLErrors(t *testing.T) {
+	for src, expected := range map[string]string{
+		"":                           "Syntax Error: Unexpected <EOF>.",
+		"{ book(id: 1) { title }":    "Syntax Error: Expected Name, found <EOF>.",
+		"{ book(id: 01) { id } }":    "Syntax Error: Invalid number, unexpected digit after 0.",
+		"{ book(id: \"1) { id } }":   "Syntax Error: Unterminated string.",
+		"{ book(id: 1 id: 2) { a }":  "Syntax Error: There can be only one argument named \"id\".",
+		"{ books ? }":                "Syntax Error: Unexpected character '?'.",
+		"subscribe { a }":            "Syntax Error: Unexpected Name \"subscribe\".",
+		"fragment on on Book { a }":  "Syntax Error: Unexpected Name \"on\".",
+		"query ($a: Int = $b) { a }": "Syntax Error: Unexpected \"$\".",
+	} {
+		if _, err := parseGraphQL(src); err == nil || err.Error() != expected {
+			t.Errorf("%q: got %v, expected %s", src, err, expected)
+		}
+	}
+	_, err := parseGraphQL("{\n  book(id: 1) {\n    title\n  }\n  ]\n}")
+	if se, ok := err.(*gqlSyntaxError); !ok || se.at != (gqlLocation{5, 3}) {
+		t.Errorf("got %#v, expected an error at 5:3", err)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC, without grpc-go. The standard library does the HTTP/2, this does
+// the length-prefixed framing and the grpc-status trailers, and proto.go
+// does the messages. Each method goes through the same middleware as the
+// HTTP routes, so keys, roles, rate limits and the audit log all apply.
+// Rejections from the middleware go out as plain HTTP 401, 403 and 429,
+// which gRPC clients turn into UNAUTHENTICATED, PERMISSION_DENIED and
+// UNAVAILABLE.
+
+const grpcService = "booklist.v1.Booklist"
+
+// from google.golang.org/grpc/codes
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+)
+
+// the outcome the audit log records for each, to read the same as HTTP
+var grpcOutcomes = map[int]int{
+	grpcInvalidArgument:    400,
+	grpcNotFound:           404,
+	grpcAlreadyExists:      409,
+	grpcFailedPrecondition: 409,
+	grpcInternal:           500,
+}
+
+// the biggest message we'll take. Nothing legitimate comes close.
+const grpcMaxMessage = 1 << 20
+
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return "grpc status " + strconv.Itoa(e.code) + ": " + e.msg
+}
+
+func grpcErrorf(code int, msg string) error {
+	return &grpcError{code, msg}
+}
+
+// storeStatus is the gRPC answer to an error from the store
+func storeStatus(err error, id int) error {
+	switch err {
+	case errNotFound:
+		return grpcErrorf(grpcNotFound, "no book "+strconv.Itoa(id))
+	case errExists:
+		return grpcErrorf(grpcAlreadyExists, "book "+strconv.Itoa(id)+" already exists")
+	case errConflict:
+		return grpcErrorf(grpcFailedPrecondition, "book "+strconv.Itoa(id)+" is already that")
+	}
+	return grpcErrorf(grpcInternal, "Storage error: "+err.Error())
+}
+
+type grpcMethod struct {
+	name    string
+	mutates bool
+	// what the caller's role must allow, given the request message
+	needs func(in []byte) []string
+	// one of these
+	unary  func(req *http.Request, in []byte) ([]byte, error)
+	stream func(w http.ResponseWriter, req *http.Request, in []byte) error
+}
+
+func readOnly([]byte) []string {
+	return []string{ActionRead}
+}
+
+var grpcMethods = []*grpcMethod{
+	{name: "GetBook", needs: readOnly, unary: grpcGetBook},
+	{name: "CreateBook", mutates: true, needs: func([]byte) []string { return []string{ActionCatalog} }, unary: grpcCreateBook},
+	{name: "UpdateBook", mutates: true, needs: updateNeeds, unary: grpcUpdateBook},
+	{name: "DeleteBook", mutates: true, needs: func([]byte) []string { return []string{ActionDelete} }, unary: grpcDeleteBook},
+	{name: "ListBooks", needs: readOnly, unary: grpcListBooks},
+	{name: "WatchBooks", needs: readOnly, stream: grpcWatchBooks},
+}
+
+type grpcMessageKey struct{}
+
+// the request message, read off the wire before the middleware runs so
+// authorize can see what an update touches
+func grpcMessage(req *http.Request) []byte {
+	b, _ := req.Context().Value(grpcMessageKey{}).([]byte)
+	return b
+}
+
+// grpcHandler serves /booklist.v1.Booklist/*. wrap puts the middleware
+// around each method, given its route and whether it changes anything.
+func grpcHandler(wrap func(route string, m *grpcMethod, h http.HandlerFunc) http.HandlerFunc) http.HandlerFunc {
+	routes := make(map[string]http.HandlerFunc)
+	for _, m := range grpcMethods {
+		route := "/" + grpcService + "/" + m.name
+		routes[route] = wrap(route, m, m.serve)
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		ct := req.Header.Get("Content-Type")
+		if req.Method != http.MethodPost || (ct != "application/grpc" && ct != "application/grpc+proto") {
+			w.WriteHeader(415)
+			return
+		}
+		h, there := routes[req.URL.Path]
+		if !there {
+			writeGRPCStatus(w, grpcErrorf(grpcUnimplemented, "no method "+req.URL.Path))
+			return
+		}
+		in, err := readGRPCMessage(req.Body)
+		if err != nil {
+			writeGRPCStatus(w, err)
+			return
+		}
+		h(w, req.WithContext(context.WithValue(req.Context(), grpcMessageKey{}, in)))
+	}
+}
+
+// actions is authorize's needs for a gRPC method
+func (m *grpcMethod) actions(req *http.Request) []string {
+	return m.needs(grpcMessage(req))
+}
+
+func (m *grpcMethod) serve(w http.ResponseWriter, req *http.Request) {
+	in := grpcMessage(req)
+	if m.stream != nil {
+		writeGRPCStatus(w, m.stream(w, req, in))
+		return
+	}
+	out, err := m.unary(req, in)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/grpc")
+		writeGRPCMessage(w, out)
+	}
+	if ge, ok := err.(*grpcError); ok && grpcOutcomes[ge.code] != 0 {
+		auditOutcome(req, grpcOutcomes[ge.code])
+	}
+	writeGRPCStatus(w, err)
+}
+
+// readGRPCMessage reads the one message a unary or server-streaming call
+// sends: a compressed flag, a four byte length, and the message.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading message: "+err.Error())
+	}
+	if head[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages aren't supported")
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "message too big")
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading message: "+err.Error())
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// writeGRPCStatus finishes the call with err's status in the trailers. If
+// nothing's been written yet, the headers go out with them when the handler
+// returns.
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	code, msg := grpcOK, ""
+	if err != nil {
+		code, msg = grpcInternal, err.Error()
+		if ge, ok := err.(*grpcError); ok {
+			code, msg = ge.code, ge.msg
+		}
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(msg))
+	}
+}
+
+// grpc-message is percent-encoded, anything outside printable ASCII and %
+func grpcPercentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < ' ' || c > '~' || c == '%' {
+			b.WriteString("%" + strings.ToUpper(strconv.FormatUint(uint64(c)>>4, 16)+strconv.FormatUint(uint64(c)&15, 16)))
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func grpcGetBook(req *http.Request, in []byte) ([]byte, error) {
+	r, err := unmarshalBookRequest(in)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, err.Error())
+	}
+	id := int(r.ID)
+	book, err := storeFor(req).Get(id)
+	if err != nil {
+		return nil, storeStatus(err, id)
+	}
+	return marshalBook(book), nil
+}
+
+func grpcCreateBook(req *http.Request, in []byte) ([]byte, error) {
+	r, err := unmarshalBookRequest(in)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, err.Error())
+	}
+	id := int(r.ID)
+	book, err := storeFor(req).Create(id, NewBook())
+	if err == errExists {
+		auditBooks(req, id, &book, &book)
+	}
+	if err != nil {
+		return nil, storeStatus(err, id)
+	}
+	auditBooks(req, id, nil, &book)
+	publish(EventCreated, id, book)
+	return marshalBook(book), nil
+}
+
+func updateNeeds(in []byte) []string {
+	r, err := unmarshalUpdateBookRequest(in)
+	if err != nil {
+		// it won't get anywhere, but it can't be let through unchecked
+		return []string{ActionCatalog}
+	}
+	return updateActions(r.query())
+}
+
+// grpcUpdateBook is updateBook, with the message standing in for the query
+func grpcUpdateBook(req *http.Request, in []byte) ([]byte, error) {
+	r, err := unmarshalUpdateBookRequest(in)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, err.Error())
+	}
+	id := int(r.ID)
+	kvPairs := r.query()
+	if len(kvPairs) == 0 {
+		return nil, grpcErrorf(grpcInvalidArgument, "No fields in update. Nothing to do.")
+	}
+	if valid, message := validateQuery(kvPairs); !valid {
+		return nil, grpcErrorf(grpcInvalidArgument, strings.TrimSpace(message))
+	}
+	statusEvent := ""
+	before, book, err := storeFor(req).Update(id, changeBook(kvPairs, &statusEvent))
+	if err == errConflict {
+		auditBooks(req, id, &before, &before)
+	}
+	if err != nil {
+		return nil, storeStatus(err, id)
+	}
+	auditBooks(req, id, &before, &book)
+	publishUpdate(id, book, kvPairs, statusEvent)
+	return marshalBook(book), nil
+}
+
+func grpcDeleteBook(req *http.Request, in []byte) ([]byte, error) {
+	r, err := unmarshalBookRequest(in)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, err.Error())
+	}
+	id := int(r.ID)
+	book, err := storeFor(req).Delete(id)
+	if err != nil {
+		return nil, storeStatus(err, id)
+	}
+	forgetCover(id)
+	forgetBook(id)
+	forgetReviews(id)
+	auditBooks(req, id, &book, nil)
+	publish(EventDeleted, id, book)
+	return marshalBook(book), nil
+}
+
+func grpcListBooks(req *http.Request, in []byte) ([]byte, error) {
+	books, err := storeFor(req).List()
+	if err != nil {
+		return nil, storeStatus(err, -1)
+	}
+	return marshalListBooksResponse(books), nil
+}
+
+// how far a watcher can fall behind before it's cut off
+const watchBuffer = 256
+
+// grpcWatchBooks streams events until the client goes away or the server
+// stops.
+func grpcWatchBooks(w http.ResponseWriter, req *http.Request, in []byte) error {
+	r, err := unmarshalWatchBooksRequest(in)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, err.Error())
+	}
+	for _, t := range r.Types {
+		known := false
+		for _, e := range allEvents {
+			known = known || t == e
+		}
+		if !known {
+			return grpcErrorf(grpcInvalidArgument, "Invalid event "+t+". Valid events are "+strings.Join(allEvents, ", ")+".")
+		}
+	}
+	filter := Webhook{Events: r.Types}
+	events, cancel, ok := watchers.subscribe(watchBuffer)
+	defer cancel()
+	if !ok {
+		return grpcErrorf(grpcUnavailable, "server shutting down")
+	}
+	// the write timeout is for requests, not for streams
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(200)
+	rc.Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			return nil
+		case ev, open := <-events:
+			if !open {
+				if watchers.isClosed() {
+					return grpcErrorf(grpcUnavailable, "server shutting down")
+				}
+				return grpcErrorf(grpcResourceExhausted, "fell too far behind")
+			}
+			if !filter.wants(ev.Type) || r.ID != nil && int(*r.ID) != ev.ID {
+				continue
+			}
+			if err := writeGRPCMessage(w, marshalBookEvent(ev)); err != nil {
+				return nil
+			}
+			rc.Flush()
+		}
+	}
+}
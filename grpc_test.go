@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// an h2c server with the gRPC routes wrapped the way main does it
+func grpcServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewUnstartedServer(grpcHandler(func(route string, m *grpcMethod, h http.HandlerFunc) http.HandlerFunc {
+		h = authenticate(authorize(m.actions, h))
+		if m.mutates {
+			h = audited(h)
+		}
+		return logged(route, h)
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func grpcClient() *http.Client {
+	p := new(http.Protocols)
+	p.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: p}}
+}
+
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// grpcCall makes a unary call, returning the reply and the grpc-status
+func grpcCall(t *testing.T, srv *httptest.Server, method string, in []byte, header http.Header) ([]byte, int) {
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/"+grpcService+"/"+method, bytes.NewReader(grpcFrame(in)))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := grpcClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, -resp.StatusCode
+	}
+	out, err := readGRPCMessage(resp.Body)
+	if err != nil {
+		out = nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	code, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("%s: no grpc-status in %v", method, resp.Trailer)
+	}
+	return out, code
+}
+
+func TestGRPCBooks(t *testing.T) {
+	freshAudit()
+	defer func() { store = nil; audit = nil }()
+	srv := grpcServer(t)
+	one := bookRequest{ID: 1}.marshal()
+
+	if _, code := grpcCall(t, srv, "GetBook", one, nil); code != grpcNotFound {
+		t.Errorf("get of a missing book gave %d", code)
+	}
+	out, code := grpcCall(t, srv, "CreateBook", one, nil)
+	if b, _ := unmarshalBook(out); code != grpcOK || !reflect.DeepEqual(b, NewBook()) {
+		t.Errorf("create gave %d %+v", code, b)
+	}
+	if _, code := grpcCall(t, srv, "CreateBook", one, nil); code != grpcAlreadyExists {
+		t.Errorf("second create gave %d", code)
+	}
+
+	title, rating, status := "Nine Stories", int32(3), CheckedOut
+	out, code = grpcCall(t, srv, "UpdateBook", updateBookRequest{ID: 1, Title: &title, Rating: &rating, Status: &status}.marshal(), nil)
+	if b, _ := unmarshalBook(out); code != grpcOK || b.Title != title || b.Rating != 3 || b.Status != CheckedOut {
+		t.Errorf("update gave %d %+v", code, b)
+	}
+	if _, code := grpcCall(t, srv, "UpdateBook", updateBookRequest{ID: 1, Status: &status}.marshal(), nil); code != grpcFailedPrecondition {
+		t.Errorf("second checkout gave %d", code)
+	}
+	rating = 9
+	if _, code := grpcCall(t, srv, "UpdateBook", updateBookRequest{ID: 1, Rating: &rating}.marshal(), nil); code != grpcInvalidArgument {
+		t.Errorf("rating of 9 gave %d", code)
+	}
+	if _, code := grpcCall(t, srv, "UpdateBook", bookRequest{ID: 1}.marshal(), nil); code != grpcInvalidArgument {
+		t.Errorf("empty update gave %d", code)
+	}
+
+	grpcCall(t, srv, "CreateBook", bookRequest{ID: 2}.marshal(), nil)
+	out, code = grpcCall(t, srv, "ListBooks", nil, nil)
+	if l, _ := unmarshalListBooksResponse(out); code != grpcOK || len(l) != 2 || l[1].Title != title {
+		t.Errorf("list gave %d %+v", code, l)
+	}
+	if _, code := grpcCall(t, srv, "DeleteBook", one, nil); code != grpcOK {
+		t.Errorf("delete gave %d", code)
+	}
+	if _, code := grpcCall(t, srv, "Frobnicate", nil, nil); code != grpcUnimplemented {
+		t.Errorf("unknown method gave %d", code)
+	}
+
+	// the same log entries the HTTP routes would make
+	l := audit.query(time.Time{}, time.Time{}, -1)
+	outcomes := []int{200, 409, 200, 409, 400, 400, 200, 200}
+	if len(l) != len(outcomes) {
+		t.Fatalf("got %d audit entries, expected %d", len(l), len(outcomes))
+	}
+	for i, o := range outcomes {
+		if l[i].Outcome != o {
+			t.Errorf("entry %d: outcome %d, expected %d", i+1, l[i].Outcome, o)
+		}
+	}
+}
+
+func TestGRPCAuthorization(t *testing.T) {
+	freshAudit()
+	auth = testAuthenticator(t)
+	defer func() { store = nil; audit = nil; auth = nil }()
+	srv := grpcServer(t)
+	store.Create(1, NewBook())
+	key := http.Header{"X-Api-Key": {"current-key"}}
+
+	if _, code := grpcCall(t, srv, "GetBook", bookRequest{ID: 1}.marshal(), nil); code != -401 {
+		t.Errorf("get without a key gave %d, expected HTTP 401", code)
+	}
+	if _, code := grpcCall(t, srv, "GetBook", bookRequest{ID: 1}.marshal(), key); code != grpcOK {
+		t.Errorf("get as a reader gave %d", code)
+	}
+	status := CheckedOut
+	if _, code := grpcCall(t, srv, "UpdateBook", updateBookRequest{ID: 1, Status: &status}.marshal(), key); code != -403 {
+		t.Errorf("checkout as a reader gave %d, expected HTTP 403", code)
+	}
+}
+
+func TestGRPCWatchBooks(t *testing.T) {
+	freshAudit()
+	defer func() { store = nil; audit = nil }()
+	srv := grpcServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	id := int64(2)
+	in := watchBooksRequest{Types: []string{EventCreated, EventCheckedOut}, ID: &id}.marshal()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/"+grpcService+"/WatchBooks", bytes.NewReader(grpcFrame(in)))
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := grpcClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the headers are only back once it's subscribed
+	grpcCall(t, srv, "CreateBook", bookRequest{ID: 1}.marshal(), nil)
+	grpcCall(t, srv, "CreateBook", bookRequest{ID: 2}.marshal(), nil)
+	title, status := "Two", CheckedOut
+	grpcCall(t, srv, "UpdateBook", updateBookRequest{ID: 2, Title: &title}.marshal(), nil)
+	grpcCall(t, srv, "UpdateBook", updateBookRequest{ID: 2, Status: &status}.marshal(), nil)
+
+	for _, expected := range []string{EventCreated, EventCheckedOut} {
+		msg, err := readGRPCMessage(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev, err := unmarshalBookEvent(msg)
+		if err != nil || ev.Type != expected || ev.ID != 2 {
+			t.Errorf("got %+v %v, expected %s for book 2", ev, err, expected)
+		}
+	}
+
+	in = watchBooksRequest{Types: []string{"book.eaten"}}.marshal()
+	if _, code := grpcCall(t, srv, "WatchBooks", in, nil); code != grpcInvalidArgument {
+		t.Errorf("watching for an unknown event gave %d", code)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// where the access log goes. nil means nowhere.
+var accessLog *slog.Logger
+
+func newAccessLog(dest string) *slog.Logger {
+	var w io.Writer
+	switch dest {
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		return nil
+	}
+	return slog.New(slog.NewJSONHandler(w, nil))
+}
+
+// What the middleware on the way in learns about a request that the
+// middleware on the way out wants to know. authenticate fills in the caller.
+type requestInfo struct {
+	ID     string
+	Caller string
+}
+
+type requestInfoKey struct{}
+
+func infoFrom(req *http.Request) *requestInfo {
+	i, _ := req.Context().Value(requestInfoKey{}).(*requestInfo)
+	return i
+}
+
+// withRequestInfo makes sure req has a requestInfo with an ID, and that the
+// request and the response both carry that ID in X-Request-ID.
+func withRequestInfo(w http.ResponseWriter, req *http.Request) *http.Request {
+	if infoFrom(req) != nil {
+		return req
+	}
+	id := requestID(req)
+	req.Header.Set("X-Request-ID", id)
+	w.Header().Set("X-Request-ID", id)
+	return req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, &requestInfo{ID: id}))
+}
+
+func noteCaller(req *http.Request, c Caller) {
+	if i := infoFrom(req); i != nil {
+		i.Caller = c.Name
+	}
+}
+
+// requestID is the X-Request-ID the client sent, if it's reasonable, or a
+// new one. Reasonable is short and printable, since it ends up in the logs.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-ID"); id != "" && len(id) <= 128 {
+		ok := true
+		for _, r := range id {
+			ok = ok && r > ' ' && r < 0x7f
+		}
+		if ok {
+			return id
+		}
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func sourceIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// remembers the status code and body size on their way out
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// so http.NewResponseController can get at Flush and the deadlines
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = 200
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// warn logs something an admin should know about, to the access log if
+// there is one, and otherwise wherever the standard logger goes
+func warn(req *http.Request, msg string, attrs ...slog.Attr) {
+	l := accessLog
+	if l == nil {
+		l = slog.Default()
+	}
+	if info := infoFrom(req); info != nil {
+		attrs = append(attrs, slog.String("request_id", info.ID))
+	}
+	attrs = append(attrs, slog.String("method", req.Method), slog.String("path", req.URL.Path), slog.String("remote", sourceIP(req)))
+	l.LogAttrs(req.Context(), slog.LevelWarn, msg, attrs...)
+}
+
+// logged goes outside everything but the metrics. It hands out the request
+// ID, tacks it on the end of plain text error messages so a client has
+// something to quote at us, and writes one line of JSON per request.
+func logged(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		req = withRequestInfo(w, req)
+		info := infoFrom(req)
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next(sr, req)
+		if sr.code == 0 {
+			sr.code = 200
+		}
+		if sr.code >= 400 && sr.bytes > 0 && strings.HasPrefix(sr.Header().Get("Content-Type"), "text/plain") {
+			io.WriteString(sr, "\nRequest ID: "+info.ID+"\n")
+		}
+		if accessLog == nil {
+			return
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", info.ID),
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.String("route", route),
+			slog.Int("status", sr.code),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", sr.bytes),
+			slog.String("caller", info.Caller),
+			slog.String("remote", sourceIP(req))}
+		if s := spanFrom(req.Context()); s != nil {
+			attrs = append(attrs, slog.String("trace_id", s.TraceID))
+		}
+		accessLog.LogAttrs(req.Context(), slog.LevelInfo, "request", attrs...)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	freshAudit()
+	defer func() { audit = nil; auth = nil; accessLog = nil }()
+	auth = testAuthenticator(t)
+	var buf bytes.Buffer
+	accessLog = slog.New(slog.NewJSONHandler(&buf, nil))
+	h := logged("/book/", audited(authenticate(bookHandler)))
+
+	req := httptest.NewRequest(http.MethodPost, "/book/3?Title=Logged", nil)
+	req.Header.Set("X-API-Key", "current-key")
+	req.Header.Set("X-Request-ID", "abc123")
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	if rec.Header().Get("X-Request-ID") != "abc123" {
+		t.Errorf("response X-Request-ID %q, expected the one sent", rec.Header().Get("X-Request-ID"))
+	}
+
+	var line struct {
+		RequestID string `json:"request_id"`
+		Method    string
+		Path      string
+		Route     string
+		Status    int
+		Bytes     int
+		Caller    string
+		LatencyMS *float64 `json:"latency_ms"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("access log line %q isn't JSON: %v", buf.String(), err)
+	}
+	if line.RequestID != "abc123" || line.Method != "POST" || line.Path != "/book/3" || line.Route != "/book/" ||
+		line.Status != 201 || line.Caller != "frontdesk" || line.Bytes != rec.Body.Len() || line.LatencyMS == nil {
+		t.Errorf("unexpected access log line %s", buf.String())
+	}
+	// the audit log and the access log agree on the ID
+	if e := audit.query(time.Time{}, time.Time{}, 3); len(e) != 1 || e[0].RequestID != "abc123" {
+		t.Errorf("audit entries %+v, expected one with request ID abc123", e)
+	}
+}
+
+func TestRequestIDInErrors(t *testing.T) {
+	freshAudit()
+	defer func() { audit = nil }()
+	h := logged("/book/", audited(bookHandler))
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPut, "/book/1?Rating=nine", nil))
+	id := rec.Header().Get("X-Request-ID")
+	if rec.Code != 400 || id == "" {
+		t.Fatalf("got %d with request ID %q, expected 400 and a generated ID", rec.Code, id)
+	}
+	if !strings.HasSuffix(rec.Body.String(), "Request ID: "+id+"\n") {
+		t.Errorf("error body %q doesn't end with the request ID", rec.Body.String())
+	}
+
+	// nothing to append to, nothing appended
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodDelete, "/book/1", nil))
+	if rec.Code != 404 || rec.Body.Len() != 0 {
+		t.Errorf("got %d %q, expected an empty 404", rec.Code, rec.Body.String())
+	}
+
+	// junk IDs get replaced
+	req := httptest.NewRequest(http.MethodGet, "/book/1", nil)
+	req.Header.Set("X-Request-ID", "two\nlines")
+	rec = httptest.NewRecorder()
+	h(rec, req)
+	if id := rec.Header().Get("X-Request-ID"); id == "" || strings.Contains(id, "\n") {
+		t.Errorf("request ID %q passed through", id)
+	}
+}
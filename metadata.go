@@ -0,0 +1,262 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The rest of a book, past the six fields it started with: edition,
+// language, pages, format, series and volume, subjects, a description and
+// a cover. They're all optional, and an empty value (or 0) clears one.
+// Each is a query key like the others, so PUT, the bodies, gRPC and
+// GraphQL all set them through validateQuery and changeBook, and GET
+// /book/ takes them, and the rest, as filters.
+
+// what Format can be
+var bookFormatNames = []string{"hardcover", "paperback", "ebook", "audio"}
+
+// keys that take any number of values, a subject or tag each. One empty
+// value is none.
+var listKeys = map[string]bool{"Subjects": true, "subjects": true, "Tags": true, "tags": true}
+
+// every query key, in order, for the error messages
+var queryKeys = []string{"Title", "Author", "Publisher", "PublishDate", "Rating", "Status",
+	"Edition", "Language", "Pages", "Format", "Series", "Volume", "Subjects", "Description", "Cover", "Tags"}
+
+// a well-formed BCP 47 tag (RFC 5646 section 2.1), apart from the
+// grandfathered ones
+var languageTag = regexp.MustCompile(`^(?i:` +
+	`([a-z]{2,3}(-[a-z]{3}){0,3}|[a-z]{4}|[a-z]{5,8})` + // language and extlangs
+	`(-[a-z]{4})?` + // script
+	`(-([a-z]{2}|[0-9]{3}))?` + // region
+	`(-([a-z0-9]{5,8}|[0-9][a-z0-9]{3}))*` + // variants
+	`(-[0-9a-wyz](-[a-z0-9]{2,8})+)*` + // extensions
+	`(-x(-[a-z0-9]{1,8})+)?` + // private use
+	`|x(-[a-z0-9]{1,8})+)$`)
+
+// canonicalLanguage is tag with its subtags cased the usual way, en-GB or
+// zh-Hant-TW, or false if it isn't a language tag
+func canonicalLanguage(tag string) (string, bool) {
+	if !languageTag.MatchString(tag) {
+		return "", false
+	}
+	subtags := strings.Split(strings.ToLower(tag), "-")
+	for i, s := range subtags {
+		if i > 0 && len(subtags[i-1]) == 1 {
+			// after a singleton it's an extension or private use
+			break
+		}
+		switch {
+		case i > 0 && len(s) == 2:
+			subtags[i] = strings.ToUpper(s)
+		case i > 0 && len(s) == 4 && s[0] > '9':
+			subtags[i] = strings.ToUpper(s[:1]) + s[1:]
+		}
+	}
+	return strings.Join(subtags, "-"), true
+}
+
+// subjectList is the subjects, or tags, a query gives, without blanks or
+// repeats
+func subjectList(v []string) []string {
+	var subjects []string
+	for _, s := range v {
+		s = strings.TrimSpace(s)
+		if s != "" && !containsFold(subjects, s) {
+			subjects = append(subjects, s)
+		}
+	}
+	return subjects
+}
+
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMetadata checks the keys validateQuery doesn't have its own case
+// for. known is false for keys that aren't any of them.
+func validateMetadata(k string, v []string) (known bool, message string) {
+	oneValMessage := "Each query key must have exactly one value.\n"
+	switch k {
+	case "Edition", "Series", "Description":
+		if len(v) != 1 {
+			return true, oneValMessage
+		}
+	case "Language":
+		if len(v) != 1 {
+			return true, oneValMessage
+		}
+		if _, ok := canonicalLanguage(v[0]); !ok && v[0] != "" {
+			return true, "Invalid Language. Value must be a BCP 47 language tag, like en, en-GB or zh-Hant.\n"
+		}
+	case "Pages", "Volume":
+		if len(v) != 1 {
+			return true, oneValMessage
+		}
+		if i, err := strconv.Atoi(v[0]); v[0] != "" && (err != nil || i < 0) {
+			return true, "Error parsing " + k + ". Value must be a whole number, or 0 if it isn't known.\n"
+		}
+	case "Format":
+		if len(v) != 1 {
+			return true, oneValMessage
+		}
+		if v[0] != "" && !contains(bookFormatNames, v[0]) {
+			return true, "Invalid Format. Value must be one of " + strings.Join(bookFormatNames, ", ") + ".\n"
+		}
+	case "Subjects", "Tags":
+		// CSV has them all in one cell, separated by semicolons
+		for _, s := range v {
+			if strings.Contains(s, ";") {
+				return true, "Invalid " + k + ". A " + strings.ToLower(strings.TrimSuffix(k, "s")) + " can't have a ; in it.\n"
+			}
+		}
+	case "Cover":
+		if len(v) != 1 {
+			return true, oneValMessage
+		}
+		if u, err := url.Parse(v[0]); v[0] != "" && (err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "") {
+			return true, "Invalid Cover. Value must be an http or https URL of the cover image.\n"
+		}
+	default:
+		return false, ""
+	}
+	return true, ""
+}
+
+// changeMetadata does the keys validateMetadata knows to book
+func changeMetadata(book *Book, k string, v []string) {
+	switch k {
+	case "Edition":
+		book.Edition = v[0]
+	case "Language":
+		book.Language, _ = canonicalLanguage(v[0])
+	case "Pages":
+		book.Pages, _ = strconv.Atoi(v[0])
+	case "Format":
+		book.Format = v[0]
+	case "Series":
+		book.Series = v[0]
+	case "Volume":
+		book.Volume, _ = strconv.Atoi(v[0])
+	case "Subjects":
+		book.Subjects = subjectList(v)
+	case "Description":
+		book.Description = v[0]
+	case "Cover":
+		book.Cover = v[0]
+	case "Tags":
+		book.Tags = subjectList(v)
+	}
+}
+
+// bookFilter is which books GET /book/ lists, going by its query: those
+// that match every key in it. Strings match ignoring case, Description
+// anywhere in it, Subjects and Tags if the book has all of them, and a
+// PublishDate anywhere in the year or month it gives. An empty value
+// matches books without one. If the query's no good, message says why.
+func bookFilter(req *http.Request) (match func(Book) bool, message string) {
+	q, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, "Error parsing query: " + err.Error()
+	}
+	if version, _ := apiVersion(req.URL.Path); version == 2 {
+		if q, err = fromV2(q); err != nil {
+			return nil, err.Error()
+		}
+	}
+	if valid, message := validateQuery(q); !valid {
+		return nil, message
+	}
+	// as changeBook would set them, so they compare the same. Status is
+	// left out, since it'd be a conflict.
+	rest := url.Values{}
+	for k, v := range q {
+		if k != "Status" {
+			rest[k] = v
+		}
+	}
+	var want Book
+	changeBook(rest, new(string))(&want)
+	if q.Get("Status") == "CheckedOut" {
+		want.Status = CheckedOut
+	}
+	return func(b Book) bool {
+		for k := range q {
+			ok := true
+			switch k {
+			case "Title":
+				ok = strings.EqualFold(b.Title, want.Title)
+			case "Author":
+				ok = strings.EqualFold(b.Author, want.Author)
+			case "Publisher":
+				ok = strings.EqualFold(b.Publisher, want.Publisher)
+			case "PublishDate":
+				ok = sameDate(b.PublishDate, want.PublishDate, want.PublishPrecision)
+			case "Rating":
+				ok = b.Rating == want.Rating
+			case "Status":
+				ok = b.Status == want.Status
+			case "Edition":
+				ok = strings.EqualFold(b.Edition, want.Edition)
+			case "Language":
+				ok = strings.EqualFold(b.Language, want.Language)
+			case "Pages":
+				ok = b.Pages == want.Pages
+			case "Format":
+				ok = b.Format == want.Format
+			case "Series":
+				ok = strings.EqualFold(b.Series, want.Series)
+			case "Volume":
+				ok = b.Volume == want.Volume
+			case "Subjects":
+				ok = hasAll(b.Subjects, want.Subjects)
+			case "Tags":
+				ok = hasAll(b.Tags, want.Tags)
+			case "Description":
+				ok = strings.Contains(strings.ToLower(b.Description), strings.ToLower(want.Description))
+				if want.Description == "" {
+					ok = b.Description == ""
+				}
+			case "Cover":
+				ok = b.Cover == want.Cover
+			}
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}, ""
+}
+
+// hasAll says whether list has everything in want, or is empty if want is
+func hasAll(list, want []string) bool {
+	if len(want) == 0 {
+		return len(list) == 0
+	}
+	for _, s := range want {
+		if !containsFold(list, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameDate says whether d is in the day, month or year that want stands for
+func sameDate(d, want time.Time, p DatePrecision) bool {
+	switch p {
+	case YearPrecision:
+		return d.Year() == want.Year()
+	case MonthPrecision:
+		return d.Year() == want.Year() && d.Month() == want.Month()
+	}
+	return d.Year() == want.Year() && d.YearDay() == want.YearDay()
+}
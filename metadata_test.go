@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalLanguage(t *testing.T) {
+	for tag, expected := range map[string]string{
+		"en":                  "en",
+		"EN-gb":               "en-GB",
+		"zh-hant-tw":          "zh-Hant-TW",
+		"es-419":              "es-419",
+		"sl-rozaj-biske":      "sl-rozaj-biske",
+		"de-CH-1901":          "de-CH-1901",
+		"zh-yue-HK":           "zh-yue-HK",
+		"en-US-u-ca-gregory":  "en-US-u-ca-gregory",
+		"en-a-bbb-x-AB-cdefg": "en-a-bbb-x-ab-cdefg",
+		"x-whatever":          "x-whatever",
+	} {
+		if got, ok := canonicalLanguage(tag); !ok || got != expected {
+			t.Errorf("%s gave %q %v, expected %q", tag, got, ok, expected)
+		}
+	}
+	for _, tag := range []string{"", "e", "englishlang", "en-", "en_GB", "en-GB-", "en-x", "123", "en-Latn-Cyrl"} {
+		if got, ok := canonicalLanguage(tag); ok {
+			t.Errorf("%q was a language tag, %q", tag, got)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil }()
+	store.Create(1, NewBook())
+
+	rec := formatRequest(http.MethodPut, "/book/1?Edition=2nd&Language=en-gb&Pages=412&Format=paperback&Series=Dune&Volume=1"+
+		"&Subjects=Science+fiction&Subjects=Ecology&Subjects=+ecology+&Description=Spice.&Cover=https://covers.example/dune.jpg", "", "", "")
+	b, _ := store.Get(1)
+	expected := NewBook()
+	expected.Edition, expected.Language, expected.Pages, expected.Format, expected.Series, expected.Volume = "2nd", "en-GB", 412, "paperback", "Dune", 1
+	expected.Subjects, expected.Description, expected.Cover = []string{"Science fiction", "Ecology"}, "Spice.", "https://covers.example/dune.jpg"
+	if rec.Code != 200 || !reflect.DeepEqual(b, expected) {
+		t.Fatalf("PUT gave %d %s, left %+v", rec.Code, rec.Body, b)
+	}
+
+	for _, c := range []struct {
+		target, accept, expected string
+	}{
+		{"/book/1", "", `"Status":0,"Edition":"2nd","Language":"en-GB","Pages":412,"Format":"paperback","Series":"Dune","Volume":1,` +
+			`"Subjects":["Science fiction","Ecology"],"Description":"Spice.","Cover":"https://covers.example/dune.jpg"}`},
+		{"/book/1", "application/xml", `<Status>0</Status><Edition>2nd</Edition><Language>en-GB</Language><Pages>412</Pages><Format>paperback</Format>` +
+			`<Series>Dune</Series><Volume>1</Volume><Description>Spice.</Description><Cover>https://covers.example/dune.jpg</Cover>` +
+			`<Subjects><Subject>Science fiction</Subject><Subject>Ecology</Subject></Subjects></Book>`},
+		{"/book/1", "application/yaml", "Status: 0\nEdition: \"2nd\"\nLanguage: \"en-GB\"\nPages: 412\nFormat: paperback\nSeries: \"Dune\"\nVolume: 1\n" +
+			"Subjects: [\"Science fiction\", \"Ecology\"]\nDescription: \"Spice.\"\nCover: \"https://covers.example/dune.jpg\"\n"},
+		{"/v2/book/1", "", `"status":"checkedIn","edition":"2nd","language":"en-GB","pages":412,"format":"paperback","series":"Dune","volume":1,` +
+			`"subjects":["Science fiction","Ecology"],"description":"Spice.","cover":"https://covers.example/dune.jpg"}`},
+		{"/v2/book/1", "application/xml", `<subjects><subject>Science fiction</subject><subject>Ecology</subject></subjects>`},
+		{"/v2/book/1", "text/csv", ",checkedIn,2nd,en-GB,412,paperback,Dune,1,Science fiction; Ecology,Spice.,https://covers.example/dune.jpg,,,\n"},
+		// v1 CSV stays what booklistctl reads
+		{"/book/1", "text/csv", "ID,Title,Author,Publisher,PublishDate,Rating,Status\n"},
+	} {
+		if rec := formatRequest(http.MethodGet, c.target, c.accept, "", ""); !strings.Contains(rec.Body.String(), c.expected) {
+			t.Errorf("GET %s as %q gave %s, expected %s in it", c.target, c.accept, rec.Body, c.expected)
+		}
+	}
+
+	// whatever comes out goes back in
+	for _, c := range []struct {
+		target, contentType, body string
+		subjects                  []string
+	}{
+		{"/book/1", "application/json", `{"Subjects": ["Politics", "Religion"]}`, []string{"Politics", "Religion"}},
+		{"/book/1", "application/xml", `<Book><Subjects><Subject>Ecology</Subject></Subjects></Book>`, []string{"Ecology"}},
+		{"/book/1", "application/yaml", "Subjects: [Ecology, 'Science fiction', \"A, B\"] # three\n", []string{"Ecology", "Science fiction", "A, B"}},
+		{"/v2/book/1", "text/csv", "subjects\nEcology; Politics\n", []string{"Ecology", "Politics"}},
+		{"/book/1", "application/x-www-form-urlencoded", "Subjects=Spice&Subjects=Sand", []string{"Spice", "Sand"}},
+		{"/book/1", "application/json", `{"Subjects": []}`, nil},
+		{"/book/1", "application/xml", `<Book><Subjects/></Book>`, nil},
+		{"/book/1", "application/yaml", "Subjects: []\n", nil},
+	} {
+		rec := formatRequest(http.MethodPut, c.target, "", c.contentType, c.body)
+		b, _ := store.Get(1)
+		if rec.Code != 200 || !reflect.DeepEqual(b.Subjects, c.subjects) {
+			t.Errorf("PUT %s of %s %q gave %d %s, left %q", c.target, c.contentType, c.body, rec.Code, rec.Body, b.Subjects)
+		}
+	}
+
+	for _, c := range []struct {
+		target, contentType, body, message string
+	}{
+		{"/book/1?Language=en_GB", "", "", "Invalid Language."},
+		{"/book/1?Pages=-1", "", "", "Error parsing Pages."},
+		{"/book/1?Volume=first", "", "", "Error parsing Volume."},
+		{"/book/1?Format=scroll", "", "", "Value must be one of hardcover, paperback, ebook, audio."},
+		{"/book/1?Cover=covers/dune.jpg", "", "", "Invalid Cover."},
+		{"/book/1?Cover=ftp://covers.example/dune.jpg", "", "", "Invalid Cover."},
+		{"/book/1?Subjects=a%3Bb", "", "", "can't have a ; in it"},
+		{"/book/1?Edition=1&Edition=2", "", "", "exactly one value"},
+		{"/book/1?Colour=red", "", "", "Valid keys are Title, Author, Publisher, PublishDate, Rating, Status, Edition, Language, Pages, Format, Series, Volume, Subjects, Description, Cover, and Tags."},
+		{"/v2/book/1?Pages=3", "", "", "subjects, description, cover, and tags."},
+		{"/book/1", "application/json", `{"Title": []}`, "Title must be a string or a number"},
+		{"/book/1", "application/json", `{"Subjects": [1]}`, "Subjects must be strings"},
+		{"/book/1", "application/yaml", "Subjects: [a, b\n", "bad sequence"},
+		{"/book/1", "application/xml", `<Book><Series><b>x</b></Series></Book>`, "<Series> can't have elements in it"},
+	} {
+		before, _ := store.Get(1)
+		rec := formatRequest(http.MethodPut, c.target, "", c.contentType, c.body)
+		if rec.Code != 400 || !strings.Contains(rec.Body.String(), c.message) {
+			t.Errorf("PUT %s %s gave %d %q, expected 400 %q", c.target, c.body, rec.Code, rec.Body, c.message)
+		}
+		if after, _ := store.Get(1); !reflect.DeepEqual(after, before) {
+			t.Errorf("PUT %s %s changed the book", c.target, c.body)
+		}
+	}
+
+	// and an empty one clears it
+	rec = formatRequest(http.MethodPut, "/book/1?Edition=&Language=&Pages=0&Format=&Volume=", "", "", "")
+	if b, _ := store.Get(1); rec.Code != 200 || b.Edition != "" || b.Language != "" || b.Pages != 0 || b.Format != "" || b.Volume != 0 || b.Series != "Dune" {
+		t.Errorf("clearing gave %d %s, left %+v", rec.Code, rec.Body, b)
+	}
+}
+
+func TestBookFilter(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil }()
+	for id, q := range map[int]string{
+		1: "Title=Dune&Author=Frank+Herbert&Language=en&Format=paperback&Series=Dune&Volume=1&Subjects=Science+fiction&Subjects=Ecology&PublishDate=1965-08-01&Description=Desert+planet",
+		2: "Title=Dune+Messiah&Author=Frank+Herbert&Language=en&Format=hardcover&Series=Dune&Volume=2&Subjects=Science+fiction&PublishDate=1969",
+		3: "Title=Emma&Author=Jane+Austen&Language=en-GB&Format=ebook&PublishDate=1815-12",
+		4: "Title=Der+Wüstenplanet&Language=de&Format=audio&Series=Dune&Subjects=science+FICTION&Status=CheckedOut",
+	} {
+		store.Create(id, NewBook())
+		if rec := formatRequest(http.MethodPut, "/book/"+string(rune('0'+id))+"?"+q, "", "", ""); rec.Code != 200 {
+			t.Fatalf("book %d: %d %s", id, rec.Code, rec.Body)
+		}
+	}
+
+	for _, c := range []struct {
+		query string
+		ids   string
+	}{
+		{"", "1 2 3 4"},
+		{"Series=dune", "1 2 4"},
+		{"Series=Dune&Volume=2", "2"},
+		{"Subjects=science+fiction", "1 2 4"},
+		{"Subjects=Science+fiction&Subjects=ecology", "1"},
+		{"Subjects=", "3"},
+		{"Language=EN", "1 2"},
+		{"Language=en-gb", "3"},
+		{"Format=audio", "4"},
+		{"Status=CheckedOut", "4"},
+		{"Status=CheckedIn&Author=frank+herbert", "1 2"},
+		{"PublishDate=1965", "1"},
+		{"PublishDate=1815-12-25", ""},
+		{"PublishDate=1815-12", "3"},
+		{"Description=PLANET", "1"},
+		{"Description=", "2 3 4"},
+		{"Series=", "3"},
+	} {
+		rec := formatRequest(http.MethodGet, "/book/?"+c.query, "text/csv", "", "")
+		var ids []string
+		for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n")[1:] {
+			ids = append(ids, strings.Split(line, ",")[0])
+		}
+		if rec.Code != 200 || strings.Join(ids, " ") != c.ids {
+			t.Errorf("GET /book/?%s gave %d %v, expected %s", c.query, rec.Code, ids, c.ids)
+		}
+	}
+	// v2 names
+	if rec := formatRequest(http.MethodGet, "/v2/book/?series=Dune&volume=1", "", "", ""); rec.Code != 200 || !strings.HasPrefix(rec.Body.String(), `[{"id":1,`) || strings.Count(rec.Body.String(), `"id"`) != 1 {
+		t.Errorf("v2 filter gave %d %s", rec.Code, rec.Body)
+	}
+
+	for target, message := range map[string]string{
+		"/book/?Format=scroll":    "Invalid Format.",
+		"/book/?Colour=red":       "Invalid query key Colour.",
+		"/book/?Rating=9":         "Invalid Rating.",
+		"/v2/book/?Series=Dune":   "Invalid key Series.",
+		"/book/?PublishDate=soon": "Error parsing PublishDate.",
+	} {
+		if rec := formatRequest(http.MethodGet, target, "", "", ""); rec.Code != 400 || !strings.Contains(rec.Body.String(), message) {
+			t.Errorf("GET %s gave %d %q, expected 400 %q", target, rec.Code, rec.Body, message)
+		}
+	}
+}
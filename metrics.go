@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Just enough of the Prometheus text format to be scraped. No client
+// library, same as everything else in here.
+
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+var lockWaitBuckets = []float64{.00001, .0001, .001, .01, .1, 1}
+
+type histogram struct {
+	bounds []float64
+	// counts[i] is how many were <= bounds[i] but not <= bounds[i-1]. The
+	// last one is everything above the top bound.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, b := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, strconv.FormatFloat(b, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+type routeMethod struct {
+	route, method string
+}
+
+type routeMethodCode struct {
+	route, method string
+	code          int
+}
+
+type metricsRegistry struct {
+	lock     sync.Mutex
+	requests map[routeMethodCode]uint64
+	latency  map[routeMethod]*histogram
+
+	// separate, since it's hit with the store lock held
+	waitLock sync.Mutex
+	lockWait *histogram
+}
+
+func newMetrics() *metricsRegistry {
+	return &metricsRegistry{
+		requests: make(map[routeMethodCode]uint64),
+		latency:  make(map[routeMethod]*histogram),
+		lockWait: newHistogram(lockWaitBuckets)}
+}
+
+var metrics = newMetrics()
+
+func (m *metricsRegistry) observeRequest(route, method string, code int, d time.Duration) {
+	m.lock.Lock()
+	m.requests[routeMethodCode{route, method, code}]++
+	h, there := m.latency[routeMethod{route, method}]
+	if !there {
+		h = newHistogram(latencyBuckets)
+		m.latency[routeMethod{route, method}] = h
+	}
+	h.observe(d.Seconds())
+	m.lock.Unlock()
+}
+
+func (m *metricsRegistry) observeLockWait(d time.Duration) {
+	m.waitLock.Lock()
+	m.lockWait.observe(d.Seconds())
+	m.waitLock.Unlock()
+}
+
+func labelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func (m *metricsRegistry) write(w io.Writer) {
+	m.lock.Lock()
+	reqKeys := make([]routeMethodCode, 0, len(m.requests))
+	for k := range m.requests {
+		reqKeys = append(reqKeys, k)
+	}
+	sort.Slice(reqKeys, func(i, j int) bool {
+		a, b := reqKeys[i], reqKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	io.WriteString(w, "# HELP booklist_requests_total Requests handled, by route, method and status code.\n")
+	io.WriteString(w, "# TYPE booklist_requests_total counter\n")
+	for _, k := range reqKeys {
+		fmt.Fprintf(w, "booklist_requests_total{route=\"%s\",method=\"%s\",code=\"%d\"} %d\n",
+			labelValue(k.route), labelValue(k.method), k.code, m.requests[k])
+	}
+	latKeys := make([]routeMethod, 0, len(m.latency))
+	for k := range m.latency {
+		latKeys = append(latKeys, k)
+	}
+	sort.Slice(latKeys, func(i, j int) bool {
+		if latKeys[i].route != latKeys[j].route {
+			return latKeys[i].route < latKeys[j].route
+		}
+		return latKeys[i].method < latKeys[j].method
+	})
+	io.WriteString(w, "# HELP booklist_request_duration_seconds Time to handle a request, by route and method.\n")
+	io.WriteString(w, "# TYPE booklist_request_duration_seconds histogram\n")
+	for _, k := range latKeys {
+		m.latency[k].write(w, "booklist_request_duration_seconds",
+			"route=\""+labelValue(k.route)+"\",method=\""+labelValue(k.method)+"\"")
+	}
+	m.lock.Unlock()
+
+	m.waitLock.Lock()
+	io.WriteString(w, "# HELP booklist_store_lock_wait_seconds Time spent waiting for the book list lock.\n")
+	io.WriteString(w, "# TYPE booklist_store_lock_wait_seconds histogram\n")
+	m.lockWait.write(w, "booklist_store_lock_wait_seconds", "")
+	m.waitLock.Unlock()
+}
+
+// instrumented goes outermost, so it counts everything, turned away or not.
+func instrumented(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next(sr, req)
+		if sr.code == 0 {
+			sr.code = 200
+		}
+		metrics.observeRequest(route, metricMethod(req.Method), sr.code, time.Since(start))
+	}
+}
+
+// metricMethod is the method label. Anyone can send any method, before
+// they've shown who they are, so the ones HTTP doesn't define are all
+// OTHER, or there'd be a new series for each.
+func metricMethod(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return m
+	}
+	return "OTHER"
+}
+
+// GET /healthz: the process is up.
+func healthHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "ok\n")
+}
+
+// GET /readyz: the process is up and the store answers.
+func readyHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if store == nil {
+		w.WriteHeader(503)
+		io.WriteString(w, "storage not open\n")
+		return
+	}
+	if err := store.Ping(); err != nil {
+		w.WriteHeader(503)
+		io.WriteString(w, "storage not answering: "+err.Error()+"\n")
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// GET /metrics
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.write(w)
+	if store == nil {
+		return
+	}
+	books, err := store.List()
+	if err != nil {
+		return
+	}
+	out := 0
+	for _, b := range books {
+		if b.Status == CheckedOut {
+			out++
+		}
+	}
+	io.WriteString(w, "# HELP booklist_books Books in the list.\n")
+	io.WriteString(w, "# TYPE booklist_books gauge\n")
+	fmt.Fprintf(w, "booklist_books %d\n", len(books))
+	io.WriteString(w, "# HELP booklist_books_checked_out Books checked out.\n")
+	io.WriteString(w, "# TYPE booklist_books_checked_out gauge\n")
+	fmt.Fprintf(w, "booklist_books_checked_out %d\n", out)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 5})
+	h.observe(0.5)
+	h.observe(1)
+	h.observe(3)
+	h.observe(9)
+	var sb strings.Builder
+	h.write(&sb, "x", `a="b"`)
+	expected := `x_bucket{a="b",le="1"} 2
+x_bucket{a="b",le="5"} 3
+x_bucket{a="b",le="+Inf"} 4
+x_sum{a="b"} 13.5
+x_count{a="b"} 4
+`
+	if sb.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", sb.String(), expected)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	metrics = newMetrics()
+	store = newMemStore()
+	defer func() { metrics = newMetrics(); store = nil }()
+
+	h := instrumented("/book/", bookHandler)
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/book/1", nil))
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/book/2", nil))
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/book/2?Status=CheckedOut", nil))
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/book/3", nil))
+	h(httptest.NewRecorder(), httptest.NewRequest("ZZZ1", "/book/3", nil))
+	h(httptest.NewRecorder(), httptest.NewRequest("ZZZ2", "/book/3", nil))
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`booklist_requests_total{route="/book/",method="POST",code="201"} 2`,
+		`booklist_requests_total{route="/book/",method="GET",code="404"} 1`,
+		`booklist_request_duration_seconds_count{route="/book/",method="PUT"} 1`,
+		`booklist_request_duration_seconds_count{route="/book/",method="OTHER"} 2`,
+		`booklist_store_lock_wait_seconds_count `,
+		"booklist_books 2\n",
+		"booklist_books_checked_out 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q. got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "ZZZ") {
+		t.Errorf("made-up methods got their own series:\n%s", body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected metrics content type %v", ct)
+	}
+}
+
+// a store that won't answer
+type brokenStore struct {
+	*memStore
+}
+
+func (brokenStore) Ping() error {
+	return errors.New("disk on fire")
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	defer func() { store = nil }()
+	rec := httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != 200 {
+		t.Errorf("healthz returned %d, expected 200", rec.Code)
+	}
+
+	store = nil
+	rec = httptest.NewRecorder()
+	readyHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != 503 {
+		t.Errorf("readyz with no store returned %d, expected 503", rec.Code)
+	}
+	store = brokenStore{newMemStore()}
+	rec = httptest.NewRecorder()
+	readyHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != 503 || !strings.Contains(rec.Body.String(), "disk on fire") {
+		t.Errorf("readyz with broken store returned %d %q, expected 503", rec.Code, rec.Body.String())
+	}
+	store = newMemStore()
+	rec = httptest.NewRecorder()
+	readyHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != 200 {
+		t.Errorf("readyz returned %d, expected 200", rec.Code)
+	}
+}
+
+func TestReadyzOnContainer(t *testing.T) {
+	_, _, code := sendGet("/readyz", t)
+	if code != 200 {
+		t.Errorf("container readyz returned %d, expected 200", code)
+	}
+	content, cType, _ := sendGet("/metrics", t)
+	if !strings.HasPrefix(cType, "text/plain") || !strings.Contains(string(content), "booklist_books ") {
+		t.Errorf("container metrics look wrong. type %v, content %v", cType, string(content))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// The OpenAPI document for the /book/ routes. It's written for the default
+// config. openAPIDoc fixes up the bits the config can change.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// dig follows keys (strings for objects, ints for arrays) down into a
+// decoded JSON document. nil if anything on the way isn't there.
+func dig(v interface{}, keys ...interface{}) map[string]interface{} {
+	for _, k := range keys {
+		switch k := k.(type) {
+		case string:
+			m, _ := v.(map[string]interface{})
+			v = m[k]
+		case int:
+			a, _ := v.([]interface{})
+			if k >= len(a) {
+				return nil
+			}
+			v = a[k]
+		}
+	}
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+// openAPIDoc is the document with c's rating range and date format in it.
+func openAPIDoc(c *Config) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		return nil, err
+	}
+	put := dig(doc, "paths", "/book/{id}", "put")
+	params, _ := put["parameters"].([]interface{})
+	for i := range params {
+		p := dig(params, i)
+		schema := dig(p, "schema")
+		switch p["name"] {
+		case "Rating":
+			schema["minimum"], schema["maximum"] = c.MinRating, c.MaxRating
+		case "PublishDate":
+			if c.DateFormat != TIME_FMT {
+				delete(schema, "pattern")
+				schema["example"] = time.Date(1999, 12, 31, 0, 0, 0, 0, time.UTC).Format(c.DateFormat)
+				p["description"] = "In the server's date format, " + c.DateFormat + ", or ISO 8601. YYYY-MM or YYYY when the day isn't known."
+			}
+		}
+	}
+	rating := dig(doc, "components", "schemas", "Book", "properties", "Rating")
+	rating["minimum"], rating["maximum"] = c.MinRating, c.MaxRating
+	return doc, nil
+}
+
+// GET /openapi.json
+func openAPIHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(405)
+		return
+	}
+	doc, err := openAPIDoc(cfg)
+	if err != nil { // it's compiled in. the test would have caught it.
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a store that has fallen over completely
+type downStore struct {
+	*memStore
+}
+
+var errDown = errors.New("disk on fire")
+
+func (downStore) Get(int) (Book, error)          { return Book{}, errDown }
+func (downStore) Create(int, Book) (Book, error) { return Book{}, errDown }
+func (downStore) Delete(int) (Book, error)       { return Book{}, errDown }
+func (downStore) List() (map[int]Book, error)    { return nil, errDown }
+func (downStore) Update(int, func(*Book) error) (Book, Book, error) {
+	return Book{}, Book{}, errDown
+}
+
+// resolve follows a $ref, if v is one
+func resolve(doc, v map[string]interface{}) map[string]interface{} {
+	ref, ok := v["$ref"].(string)
+	if !ok {
+		return v
+	}
+	keys := []interface{}{}
+	for _, k := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		keys = append(keys, k)
+	}
+	return resolve(doc, dig(doc, keys...))
+}
+
+// checkSchema is as much of JSON Schema as the document uses
+func checkSchema(doc, schema map[string]interface{}, v interface{}, at string) []string {
+	schema = resolve(doc, schema)
+	var problems []string
+	bad := func(format string, args ...interface{}) {
+		problems = append(problems, at+": "+fmt.Sprintf(format, args...))
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			bad("%v isn't one of %v", v, enum)
+		}
+	}
+	switch schema["type"] {
+	case "object":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			bad("not an object")
+			return problems
+		}
+		props := dig(schema, "properties")
+		required, _ := schema["required"].([]interface{})
+		for _, r := range required {
+			if _, there := m[r.(string)]; !there {
+				bad("missing %s", r)
+			}
+		}
+		for k, pv := range m {
+			p := dig(props, k)
+			if p == nil {
+				p = dig(schema, "additionalProperties")
+			}
+			if p == nil {
+				bad("undocumented property %s", k)
+				continue
+			}
+			problems = append(problems, checkSchema(doc, p, pv, at+"."+k)...)
+		}
+	case "array":
+		l, ok := v.([]interface{})
+		if !ok {
+			bad("not an array")
+			return problems
+		}
+		for i, e := range l {
+			problems = append(problems, checkSchema(doc, dig(schema, "items"), e, at+"["+strconv.Itoa(i)+"]")...)
+		}
+	case "integer":
+		f, ok := v.(float64)
+		if !ok || f != float64(int(f)) {
+			bad("%v isn't an integer", v)
+			return problems
+		}
+		if min, ok := schema["minimum"].(float64); ok && f < min {
+			bad("%v is below the minimum %v", f, min)
+		}
+		if max, ok := schema["maximum"].(float64); ok && f > max {
+			bad("%v is above the maximum %v", f, max)
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			bad("%v isn't a string", v)
+			return problems
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				bad("%q isn't a date-time", s)
+			}
+		}
+		if p, ok := schema["pattern"].(string); ok && !regexp.MustCompile(p).MatchString(s) {
+			bad("%q doesn't match %s", s, p)
+		}
+	}
+	return problems
+}
+
+func servedSpec(t *testing.T) map[string]interface{} {
+	rec := httptest.NewRecorder()
+	openAPIHandler(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	var doc map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("/openapi.json isn't JSON: %v", err)
+	}
+	return doc
+}
+
+// checkResponse says what's wrong with rec as an answer to method on path,
+// according to doc
+func checkResponse(doc map[string]interface{}, method, path string, rec *httptest.ResponseRecorder) []string {
+	at := method + " " + path + " " + strconv.Itoa(rec.Code)
+	op := dig(doc, "paths", path, strings.ToLower(method))
+	resp := dig(op, "responses", strconv.Itoa(rec.Code))
+	if resp == nil {
+		return []string{at + ": status not documented"}
+	}
+	resp = resolve(doc, resp)
+	for h := range dig(resp, "headers") {
+		if rec.Header().Get(h) == "" {
+			return []string{at + ": missing header " + h}
+		}
+	}
+	content := dig(resp, "content")
+	if content == nil {
+		if rec.Body.Len() != 0 {
+			return []string{at + ": documented without a body, but got " + strconv.Quote(rec.Body.String())}
+		}
+		return nil
+	}
+	mt, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	media := dig(content, mt)
+	if media == nil {
+		return []string{at + ": undocumented content type " + strconv.Quote(mt)}
+	}
+	if mt != "application/json" {
+		return nil
+	}
+	var body interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		return []string{at + ": body isn't JSON"}
+	}
+	return checkSchema(doc, dig(media, "schema"), body, at)
+}
+
+func TestHandlersMatchOpenAPI(t *testing.T) {
+	store = newMemStore()
+	auth = testAuthenticator(t)
+	saved := policy.current()
+	defer func() { store = nil; auth = nil; limiter = nil; policy.policy = saved }()
+	doc := servedSpec(t)
+	h := authenticate(rateLimited("/book/", authorize(bookActions, bookHandler)))
+
+	steps := []struct {
+		method, target string
+		key            string
+		setup          func()
+		code           int
+	}{
+		{"GET", "/book/1", "current-key", nil, 404},
+		{"GET", "/book/one", "current-key", nil, 404},
+		{"POST", "/book/1", "nope", nil, 401},
+		{"POST", "/book/1", "current-key", nil, 403},
+		{"POST", "/book/1", "current-key", func() {
+			policy.policy = &Policy{Roles: saved.Roles, Callers: map[string]string{"frontdesk": "admin"}}
+		}, 201},
+		{"POST", "/book/1", "current-key", nil, 409},
+		{"GET", "/book/1", "current-key", nil, 200},
+		{"GET", "/book/", "current-key", nil, 200},
+		{"PUT", "/book/1?Title=Spec&Rating=3&PublishDate=1999-Dec-31", "current-key", nil, 200},
+		{"PUT", "/book/1?Rating=4", "current-key", nil, 400},
+		{"PUT", "/book/1", "current-key", nil, 400},
+		{"PUT", "/book/1?Status=CheckedIn", "current-key", nil, 409},
+		{"PUT", "/book/2?Status=CheckedIn", "current-key", nil, 404},
+		{"DELETE", "/book/1", "current-key", nil, 200},
+		{"DELETE", "/book/1", "current-key", nil, 404},
+		{"GET", "/book/1", "current-key", func() {
+			limiter, _ = newRateLimiter([]RateRule{{Route: "/book/", Method: "*", Rate: 0.001, Burst: 1}})
+		}, 404},
+		{"GET", "/book/1", "current-key", nil, 429},
+		{"GET", "/book/1", "current-key", func() { limiter = nil; store = downStore{newMemStore()} }, 500},
+		{"GET", "/book/", "current-key", nil, 500},
+		{"POST", "/book/1", "current-key", nil, 500},
+		{"PUT", "/book/1?Title=x", "current-key", nil, 500},
+		{"DELETE", "/book/1", "current-key", nil, 500},
+	}
+	for _, s := range steps {
+		if s.setup != nil {
+			s.setup()
+		}
+		req := httptest.NewRequest(s.method, s.target, nil)
+		req.Header.Set("X-API-Key", s.key)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != s.code {
+			t.Errorf("%s %s returned %d, expected %d", s.method, s.target, rec.Code, s.code)
+		}
+		path := "/book/{id}"
+		if strings.HasSuffix(s.target, "/") {
+			path = "/book/"
+		}
+		for _, p := range checkResponse(doc, s.method, path, rec) {
+			t.Errorf("%s %s: %s", s.method, s.target, p)
+		}
+	}
+}
+
+// every query parameter the spec lists for PUT works, and nothing else does
+func TestUpdateParametersMatchOpenAPI(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil }()
+	doc := servedSpec(t)
+	params, _ := dig(doc, "paths", "/book/{id}", "put")["parameters"].([]interface{})
+	if len(params) == 0 {
+		t.Fatal("no PUT parameters documented")
+	}
+	for i := range params {
+		p := dig(params, i)
+		schema := dig(p, "schema")
+		name := p["name"].(string)
+		value := "x"
+		switch {
+		case schema["example"] != nil:
+			value = schema["example"].(string)
+		case schema["enum"] != nil:
+			// the last, since the first is probably what it already is
+			enum := schema["enum"].([]interface{})
+			value = enum[len(enum)-1].(string)
+		case schema["type"] == "integer" && schema["maximum"] != nil:
+			value = strconv.Itoa(int(schema["maximum"].(float64)))
+		case schema["type"] == "integer":
+			value = strconv.Itoa(int(schema["minimum"].(float64)) + 1)
+		}
+		if schema["pattern"] != nil && !regexp.MustCompile(schema["pattern"].(string)).MatchString(value) {
+			t.Errorf("example %q for %s doesn't match its own pattern", value, name)
+		}
+		store.Create(1, NewBook())
+		rec := httptest.NewRecorder()
+		bookHandler(rec, httptest.NewRequest(http.MethodPut, "/book/1?"+name+"="+value, nil))
+		if rec.Code != 200 {
+			t.Errorf("documented parameter %s=%s got %d %q", name, value, rec.Code, rec.Body.String())
+		}
+		for _, problem := range checkResponse(doc, http.MethodPut, "/book/{id}", rec) {
+			t.Error(problem)
+		}
+		store.Delete(1)
+	}
+	store.Create(1, NewBook())
+	rec := httptest.NewRecorder()
+	bookHandler(rec, httptest.NewRequest(http.MethodPut, "/book/1?Colour=red", nil))
+	if rec.Code != 400 {
+		t.Errorf("undocumented parameter got %d, expected 400", rec.Code)
+	}
+}
+
+func TestOpenAPIFollowsConfig(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = defaultConfig()
+	cfg.MaxRating = 5
+	cfg.DateFormat = "2006-01-02"
+	doc := servedSpec(t)
+	if max := dig(doc, "components", "schemas", "Book", "properties", "Rating")["maximum"]; max != 5.0 {
+		t.Errorf("Book Rating maximum %v, expected 5", max)
+	}
+	for _, p := range dig(doc, "paths", "/book/{id}", "put")["parameters"].([]interface{}) {
+		p := p.(map[string]interface{})
+		if p["name"] == "PublishDate" && (dig(p, "schema")["example"] != "1999-12-31" || dig(p, "schema")["pattern"] != nil) {
+			t.Errorf("PublishDate parameter %v doesn't follow date_format", p)
+		}
+	}
+}
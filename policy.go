@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Actions a role can be allowed.
+const (
+	ActionRead      string = "read"      // getBook
+	ActionCirculate string = "circulate" // check in and out
+	ActionCatalog   string = "catalog"   // create, and update anything but Status
+	ActionDelete    string = "delete"    // deleteBook
+	ActionAdmin     string = "admin"     // webhooks and the like
+	ActionReview    string = "review"    // rate and review books, as yourself
+	ActionModerate  string = "moderate"  // publish, reject and delete anyone's reviews
+)
+
+var allActions = []string{ActionRead, ActionCirculate, ActionCatalog, ActionDelete, ActionAdmin, ActionReview, ActionModerate}
+
+// The policy file looks like
+//
+//	{
+//	  "Roles": {
+//	    "reader":    ["read", "review"],
+//	    "clerk":     ["read", "review", "circulate"],
+//	    "cataloger": ["read", "review", "catalog"],
+//	    "admin":     ["read", "review", "circulate", "catalog", "delete", "admin", "moderate"]
+//	  },
+//	  "Callers": {"frontdesk": "clerk", "liam": "admin"},
+//	  "DefaultRole": "reader"
+//	}
+//
+// Callers are the names from the keys file. Anyone not listed gets
+// DefaultRole, and if that's empty, nothing at all.
+type Policy struct {
+	Roles       map[string][]string
+	Callers     map[string]string
+	DefaultRole string
+}
+
+func defaultPolicy() *Policy {
+	return &Policy{
+		Roles: map[string][]string{
+			"reader":    {ActionRead, ActionReview},
+			"clerk":     {ActionRead, ActionReview, ActionCirculate},
+			"cataloger": {ActionRead, ActionReview, ActionCatalog},
+			"admin":     {ActionRead, ActionReview, ActionCirculate, ActionCatalog, ActionDelete, ActionAdmin, ActionModerate}},
+		Callers:     map[string]string{},
+		DefaultRole: "reader"}
+}
+
+func (p *Policy) validate() error {
+	for role, actions := range p.Roles {
+		for _, a := range actions {
+			known := false
+			for _, k := range allActions {
+				known = known || a == k
+			}
+			if !known {
+				return errors.New("role " + role + " has unknown action " + a + ". Valid actions are " + strings.Join(allActions, ", "))
+			}
+		}
+	}
+	for caller, role := range p.Callers {
+		if _, there := p.Roles[role]; !there {
+			return errors.New("caller " + caller + " has undefined role " + role)
+		}
+	}
+	if _, there := p.Roles[p.DefaultRole]; p.DefaultRole != "" && !there {
+		return errors.New("undefined DefaultRole " + p.DefaultRole)
+	}
+	return nil
+}
+
+func (p *Policy) roleOf(c Caller) string {
+	if r, there := p.Callers[c.Name]; there {
+		return r
+	}
+	return p.DefaultRole
+}
+
+func (p *Policy) allows(role, action string) bool {
+	for _, a := range p.Roles[role] {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+type policyHolder struct {
+	lock   sync.RWMutex
+	path   string
+	policy *Policy
+}
+
+var policy = &policyHolder{policy: defaultPolicy()}
+
+func loadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, errors.New("parsing " + path + ": " + err.Error())
+	}
+	if p.Callers == nil {
+		p.Callers = map[string]string{}
+	}
+	if err := p.validate(); err != nil {
+		return nil, errors.New("parsing " + path + ": " + err.Error())
+	}
+	return p, nil
+}
+
+// reload re-reads the policy file, if there is one. A bad file leaves the
+// old policy in place.
+func (h *policyHolder) reload() error {
+	if h.path == "" {
+		return nil
+	}
+	p, err := loadPolicy(h.path)
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	h.policy = p
+	h.lock.Unlock()
+	return nil
+}
+
+func (h *policyHolder) current() *Policy {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.policy
+}
+
+// bookActions is what a request to bookHandler needs to be allowed to do.
+// A PUT is circulation if it only touches Status, cataloging if it only
+// touches the rest, and both if it does both. Tagging is cataloging, and
+// reviews are in reviewActions.
+func bookActions(req *http.Request) []string {
+	if isTagPath(req.URL.Path) {
+		return []string{ActionCatalog}
+	}
+	if isReviewPath(req.URL.Path) {
+		return reviewActions(req)
+	}
+	switch req.Method {
+	case http.MethodGet:
+		return []string{ActionRead}
+	case http.MethodPost:
+		// a body can create it checked out
+		if _, there := requestChanges(req)["Status"]; there {
+			return []string{ActionCatalog, ActionCirculate}
+		}
+		return []string{ActionCatalog}
+	case http.MethodDelete:
+		return []string{ActionDelete}
+	case http.MethodPut:
+		leaveStatus(req)
+		return updateActions(requestChanges(req))
+	}
+	return []string{}
+}
+
+func updateActions(kvPairs url.Values) []string {
+	actions := []string{}
+	if _, there := kvPairs["Status"]; there {
+		actions = append(actions, ActionCirculate)
+	}
+	if len(kvPairs) > len(actions) || len(kvPairs) == 0 {
+		actions = append(actions, ActionCatalog)
+	}
+	return actions
+}
+
+// uiActions is what a request to the web UI needs. Checking in and out is
+// circulation, adding and editing is cataloging, same as the API.
+func uiActions(req *http.Request) []string {
+	if req.Method != http.MethodPost {
+		return []string{ActionRead}
+	}
+	switch req.URL.Path {
+	case "/ui/logout":
+		return []string{}
+	case "/ui/new":
+		return []string{ActionCatalog}
+	}
+	switch req.PostFormValue("action") {
+	case "checkout", "return":
+		return []string{ActionCirculate}
+	}
+	return []string{ActionCatalog}
+}
+
+func adminActions(req *http.Request) []string {
+	return []string{ActionAdmin}
+}
+
+// readActions is for what only ever reads
+func readActions(req *http.Request) []string {
+	return []string{ActionRead}
+}
+
+// authorize goes inside authenticate. It turns away callers whose role
+// doesn't allow everything the request needs. When authentication is off
+// there's no caller to check, so everything goes through.
+func authorize(needs func(*http.Request) []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		c, ok := callerFrom(req)
+		if !ok {
+			next(w, req)
+			return
+		}
+		p := policy.current()
+		role := p.roleOf(c)
+		denied := []string{}
+		for _, a := range needs(req) {
+			if !p.allows(role, a) {
+				denied = append(denied, a)
+			}
+		}
+		if len(denied) > 0 {
+			sort.Strings(denied)
+			if role == "" {
+				role = "(none)"
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(403)
+			io.WriteString(w, "Forbidden: "+c.Name+" has role "+role+", which may not "+strings.Join(denied, " or ")+".")
+			return
+		}
+		next(w, req)
+	}
+}
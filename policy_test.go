@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// runs a request from caller through authorize in front of bookHandler's
+// actions, and says whether it got through
+func authorizeRequest(caller string, method, target string) int {
+	req := httptest.NewRequest(method, target, nil)
+	if caller != "" {
+		req = withCaller(req, Caller{Name: caller})
+	}
+	rec := httptest.NewRecorder()
+	authorize(bookActions, func(w http.ResponseWriter, req *http.Request) {})(rec, req)
+	return rec.Code
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	policy = &policyHolder{policy: defaultPolicy()}
+	p := policy.current()
+	p.Callers["desk"] = "clerk"
+	p.Callers["cat"] = "cataloger"
+	p.Callers["boss"] = "admin"
+	defer func() { policy = &policyHolder{policy: defaultPolicy()} }()
+
+	cases := []struct {
+		caller, method, target string
+		code                   int
+	}{
+		{"nobody", http.MethodGet, "/book/1", 200},
+		{"nobody", http.MethodPut, "/book/1?Status=CheckedOut", 403},
+		{"nobody", http.MethodDelete, "/book/1", 403},
+		{"desk", http.MethodPut, "/book/1?Status=CheckedOut", 200},
+		{"desk", http.MethodPut, "/book/1?Status=CheckedOut&Title=Sneaky", 403},
+		{"desk", http.MethodPost, "/book/1", 403},
+		{"cat", http.MethodPost, "/book/1", 200},
+		{"cat", http.MethodPut, "/book/1?Title=Fine", 200},
+		{"cat", http.MethodPut, "/book/1?Status=CheckedIn", 403},
+		{"cat", http.MethodDelete, "/book/1", 403},
+		{"boss", http.MethodDelete, "/book/1", 200},
+		{"boss", http.MethodPut, "/book/1?Status=CheckedOut&Title=Fine", 200},
+		// no caller means authentication is off
+		{"", http.MethodDelete, "/book/1", 200},
+	}
+	for _, c := range cases {
+		if code := authorizeRequest(c.caller, c.method, c.target); code != c.code {
+			t.Errorf("%s %s %s returned code %d, expected %d", c.caller, c.method, c.target, code, c.code)
+		}
+	}
+}
+
+func TestPolicyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	ioutil.WriteFile(path, []byte(`{
+		"Roles": {"clerk": ["read", "circulate"], "admin": ["read", "circulate", "catalog", "delete", "admin"]},
+		"Callers": {"desk": "clerk", "boss": "admin"}
+	}`), 0600)
+	policy = &policyHolder{path: path}
+	defer func() { policy = &policyHolder{policy: defaultPolicy()} }()
+	if err := policy.reload(); err != nil {
+		t.Fatal(err)
+	}
+	// no DefaultRole, so strangers get nothing
+	if code := authorizeRequest("stranger", http.MethodGet, "/book/1"); code != 403 {
+		t.Errorf("stranger reading returned code %d, expected 403", code)
+	}
+	if code := authorizeRequest("desk", http.MethodGet, "/book/1"); code != 200 {
+		t.Errorf("clerk reading returned code %d, expected 200", code)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"Roles": {"clerk": ["read", "juggle"]}}`), 0600)
+	if err := policy.reload(); err == nil {
+		t.Error("policy with unknown action accepted")
+	}
+	ioutil.WriteFile(path, []byte(`{"Roles": {"clerk": ["read"]}, "Callers": {"desk": "wizard"}}`), 0600)
+	if err := policy.reload(); err == nil {
+		t.Error("policy with undefined role accepted")
+	}
+	// the bad reloads should have left the good policy alone
+	if code := authorizeRequest("boss", http.MethodDelete, "/book/1"); code != 200 {
+		t.Errorf("admin deleting returned code %d after bad reload, expected 200", code)
+	}
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Protocol buffers, by hand, for the messages in booklist.proto. Only the
+// wire types those use: varints, length-delimited, and 64 bits for the
+// double. Anything else that turns up is skipped, as unknown fields should
+// be.
+
+const (
+	wireVarint = 0
+	wire64     = 1
+	wireBytes  = 2
+	wire32     = 5
+)
+
+var errProtoTruncated = errors.New("protobuf: message truncated")
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendTag(b []byte, num, wire int) []byte {
+	return appendVarint(b, uint64(num)<<3|uint64(wire))
+}
+
+// proto3 leaves out fields at their zero value, so these do too.
+
+func appendIntField(b []byte, num int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendVarint(appendTag(b, num, wireVarint), uint64(v))
+}
+
+func appendStringField(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendBytesField(b, num, []byte(s))
+}
+
+func appendBytesField(b []byte, num int, data []byte) []byte {
+	b = appendVarint(appendTag(b, num, wireBytes), uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendDoubleField(b []byte, num int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.LittleEndian.AppendUint64(appendTag(b, num, wire64), math.Float64bits(v))
+}
+
+// except these, for optional fields and submessages, which are there
+// whenever they're set
+
+func appendOptionalInt(b []byte, num int, v int64) []byte {
+	return appendVarint(appendTag(b, num, wireVarint), uint64(v))
+}
+
+func appendTimestamp(b []byte, num int, t time.Time) []byte {
+	var ts []byte
+	ts = appendIntField(ts, 1, t.Unix())
+	ts = appendIntField(ts, 2, int64(t.Nanosecond()))
+	return appendBytesField(b, num, ts)
+}
+
+func readVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errProtoTruncated
+}
+
+// protoField is one field off the wire. For varints the value is in v, and
+// for length-delimited fields it's in data.
+type protoField struct {
+	num  int
+	wire int
+	v    uint64
+	data []byte
+}
+
+func readFields(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n, err := readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+		f := protoField{num: int(tag >> 3), wire: int(tag & 7)}
+		if f.num == 0 {
+			return nil, errors.New("protobuf: field number 0")
+		}
+		switch f.wire {
+		case wireVarint:
+			f.v, n, err = readVarint(b)
+			if err != nil {
+				return nil, err
+			}
+		case wireBytes:
+			l, m, err := readVarint(b)
+			if err != nil {
+				return nil, err
+			}
+			if l > uint64(len(b)-m) {
+				return nil, errProtoTruncated
+			}
+			f.data = b[m : m+int(l)]
+			n = m + int(l)
+		case wire64:
+			if len(b) < 8 {
+				return nil, errProtoTruncated
+			}
+			f.v, n = binary.LittleEndian.Uint64(b), 8
+		case wire32:
+			n = 4
+		default:
+			return nil, errors.New("protobuf: unsupported wire type " + strconv.Itoa(f.wire))
+		}
+		if n > len(b) {
+			return nil, errProtoTruncated
+		}
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// wrongWire is for a known field that came with the wrong wire type
+func wrongWire(f protoField) error {
+	return errors.New("protobuf: field " + strconv.Itoa(f.num) + " has the wrong wire type")
+}
+
+func readTimestamp(b []byte) (time.Time, error) {
+	fields, err := readFields(b)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var secs, nanos int64
+	for _, f := range fields {
+		switch {
+		case f.num == 1 && f.wire == wireVarint:
+			secs = int64(f.v)
+		case f.num == 2 && f.wire == wireVarint:
+			nanos = int64(int32(f.v))
+		}
+	}
+	return time.Unix(secs, nanos).UTC(), nil
+}
+
+func marshalBook(book Book) []byte {
+	var b []byte
+	b = appendStringField(b, 1, book.Title)
+	b = appendStringField(b, 2, book.Author)
+	b = appendStringField(b, 3, book.Publisher)
+	if !book.PublishDate.IsZero() {
+		b = appendTimestamp(b, 4, book.PublishDate)
+	}
+	b = appendIntField(b, 5, int64(book.Rating))
+	b = appendIntField(b, 6, int64(book.Status))
+	b = appendIntField(b, 7, int64(book.PublishPrecision))
+	b = appendStringField(b, 8, book.Edition)
+	b = appendStringField(b, 9, book.Language)
+	b = appendIntField(b, 10, int64(book.Pages))
+	b = appendStringField(b, 11, book.Format)
+	b = appendStringField(b, 12, book.Series)
+	b = appendIntField(b, 13, int64(book.Volume))
+	for _, s := range book.Subjects {
+		b = appendBytesField(b, 14, []byte(s))
+	}
+	b = appendStringField(b, 15, book.Description)
+	b = appendStringField(b, 16, book.Cover)
+	for _, t := range book.Tags {
+		b = appendBytesField(b, 17, []byte(t))
+	}
+	b = appendDoubleField(b, 18, book.AverageRating)
+	b = appendIntField(b, 19, int64(book.RatingCount))
+	return b
+}
+
+func unmarshalBook(data []byte) (Book, error) {
+	var book Book
+	fields, err := readFields(data)
+	if err != nil {
+		return book, err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case 1, 2, 3, 8, 9, 11, 12, 14, 15, 16, 17:
+			if f.wire != wireBytes {
+				return book, wrongWire(f)
+			}
+			switch f.num {
+			case 1:
+				book.Title = string(f.data)
+			case 2:
+				book.Author = string(f.data)
+			case 3:
+				book.Publisher = string(f.data)
+			case 8:
+				book.Edition = string(f.data)
+			case 9:
+				book.Language = string(f.data)
+			case 11:
+				book.Format = string(f.data)
+			case 12:
+				book.Series = string(f.data)
+			case 14:
+				book.Subjects = append(book.Subjects, string(f.data))
+			case 15:
+				book.Description = string(f.data)
+			case 16:
+				book.Cover = string(f.data)
+			case 17:
+				book.Tags = append(book.Tags, string(f.data))
+			}
+		case 4:
+			if f.wire != wireBytes {
+				return book, wrongWire(f)
+			}
+			if book.PublishDate, err = readTimestamp(f.data); err != nil {
+				return book, err
+			}
+		case 5:
+			book.Rating = int(int32(f.v))
+		case 6:
+			book.Status = Status(int32(f.v))
+		case 7:
+			book.PublishPrecision = DatePrecision(int32(f.v))
+		case 10:
+			book.Pages = int(int32(f.v))
+		case 13:
+			book.Volume = int(int32(f.v))
+		case 18:
+			if f.wire != wire64 {
+				return book, wrongWire(f)
+			}
+			book.AverageRating = math.Float64frombits(f.v)
+		case 19:
+			book.RatingCount = int(int32(f.v))
+		}
+	}
+	return book, nil
+}
+
+// BookRequest, for Get, Create and Delete
+type bookRequest struct {
+	ID int64
+}
+
+func unmarshalBookRequest(data []byte) (bookRequest, error) {
+	var r bookRequest
+	fields, err := readFields(data)
+	if err != nil {
+		return r, err
+	}
+	for _, f := range fields {
+		if f.num == 1 {
+			if f.wire != wireVarint {
+				return r, wrongWire(f)
+			}
+			r.ID = int64(f.v)
+		}
+	}
+	return r, nil
+}
+
+func (r bookRequest) marshal() []byte {
+	return appendIntField(nil, 1, r.ID)
+}
+
+// UpdateBookRequest. nil means not set.
+type updateBookRequest struct {
+	ID                       int64
+	Title, Author, Publisher *string
+	PublishDate              *time.Time
+	PublishPrecision         DatePrecision
+	Rating                   *int32
+	Status                   *Status
+	Edition, Language        *string
+	Pages                    *int32
+	Format, Series           *string
+	Volume                   *int32
+	// set, even to none, when the subjects or tags change
+	Subjects           *[]string
+	Description, Cover *string
+	Tags               *[]string
+}
+
+type stringField struct {
+	num int
+	key string
+	p   **string
+}
+
+// the string fields past the first three, with their field numbers and
+// query keys
+func (r *updateBookRequest) metadataStrings() []stringField {
+	return []stringField{
+		{9, "Edition", &r.Edition},
+		{10, "Language", &r.Language},
+		{12, "Format", &r.Format},
+		{13, "Series", &r.Series},
+		{16, "Description", &r.Description},
+		{17, "Cover", &r.Cover},
+	}
+}
+
+type listField struct {
+	num int
+	key string
+	p   **[]string
+}
+
+// the lists, each in a message of its own so it can be set to none
+func (r *updateBookRequest) metadataLists() []listField {
+	return []listField{
+		{15, "Subjects", &r.Subjects},
+		{18, "Tags", &r.Tags},
+	}
+}
+
+func unmarshalUpdateBookRequest(data []byte) (updateBookRequest, error) {
+	var r updateBookRequest
+	fields, err := readFields(data)
+	if err != nil {
+		return r, err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			r.ID = int64(f.v)
+		case 2, 3, 4:
+			if f.wire != wireBytes {
+				return r, wrongWire(f)
+			}
+			s := string(f.data)
+			switch f.num {
+			case 2:
+				r.Title = &s
+			case 3:
+				r.Author = &s
+			case 4:
+				r.Publisher = &s
+			}
+		case 5:
+			if f.wire != wireBytes {
+				return r, wrongWire(f)
+			}
+			d, err := readTimestamp(f.data)
+			if err != nil {
+				return r, err
+			}
+			r.PublishDate = &d
+		case 6:
+			v := int32(f.v)
+			r.Rating = &v
+		case 7:
+			s := Status(int32(f.v))
+			r.Status = &s
+		case 8:
+			r.PublishPrecision = DatePrecision(int32(f.v))
+		case 9, 10, 12, 13, 16, 17:
+			if f.wire != wireBytes {
+				return r, wrongWire(f)
+			}
+			s := string(f.data)
+			for _, m := range r.metadataStrings() {
+				if m.num == f.num {
+					*m.p = &s
+				}
+			}
+		case 11:
+			v := int32(f.v)
+			r.Pages = &v
+		case 14:
+			v := int32(f.v)
+			r.Volume = &v
+		case 15, 18:
+			if f.wire != wireBytes {
+				return r, wrongWire(f)
+			}
+			items, err := readFields(f.data)
+			if err != nil {
+				return r, err
+			}
+			list := []string{}
+			for _, s := range items {
+				if s.num == 1 && s.wire == wireBytes {
+					list = append(list, string(s.data))
+				}
+			}
+			for _, l := range r.metadataLists() {
+				if l.num == f.num {
+					*l.p = &list
+				}
+			}
+		}
+	}
+	return r, nil
+}
+
+func (r updateBookRequest) marshal() []byte {
+	b := appendIntField(nil, 1, r.ID)
+	for i, s := range []*string{r.Title, r.Author, r.Publisher} {
+		if s != nil {
+			b = appendBytesField(b, i+2, []byte(*s))
+		}
+	}
+	if r.PublishDate != nil {
+		b = appendTimestamp(b, 5, *r.PublishDate)
+	}
+	if r.Rating != nil {
+		b = appendOptionalInt(b, 6, int64(*r.Rating))
+	}
+	if r.Status != nil {
+		b = appendOptionalInt(b, 7, int64(*r.Status))
+	}
+	b = appendIntField(b, 8, int64(r.PublishPrecision))
+	for _, f := range r.metadataStrings() {
+		if *f.p != nil {
+			b = appendBytesField(b, f.num, []byte(**f.p))
+		}
+	}
+	if r.Pages != nil {
+		b = appendOptionalInt(b, 11, int64(*r.Pages))
+	}
+	if r.Volume != nil {
+		b = appendOptionalInt(b, 14, int64(*r.Volume))
+	}
+	for _, l := range r.metadataLists() {
+		if *l.p != nil {
+			var list []byte
+			for _, s := range **l.p {
+				list = appendBytesField(list, 1, []byte(s))
+			}
+			b = appendBytesField(b, l.num, list)
+		}
+	}
+	return b
+}
+
+// query is the update as the query string PUT /book/{id} would take, so
+// it can go through validateQuery and changeBook the same way.
+func (r updateBookRequest) query() url.Values {
+	q := url.Values{}
+	if r.Title != nil {
+		q.Set("Title", *r.Title)
+	}
+	if r.Author != nil {
+		q.Set("Author", *r.Author)
+	}
+	if r.Publisher != nil {
+		q.Set("Publisher", *r.Publisher)
+	}
+	if r.PublishDate != nil {
+		q.Set("PublishDate", formatDate(*r.PublishDate, r.PublishPrecision, cfg.DateFormat))
+	}
+	if r.Rating != nil {
+		q.Set("Rating", strconv.Itoa(int(*r.Rating)))
+	}
+	if r.Status != nil {
+		switch *r.Status {
+		case CheckedIn:
+			q.Set("Status", "CheckedIn")
+		case CheckedOut:
+			q.Set("Status", "CheckedOut")
+		default:
+			// validateQuery will say what's wrong with it
+			q.Set("Status", strconv.Itoa(int(*r.Status)))
+		}
+	}
+	for _, f := range r.metadataStrings() {
+		if *f.p != nil {
+			q.Set(f.key, **f.p)
+		}
+	}
+	if r.Pages != nil {
+		q.Set("Pages", strconv.Itoa(int(*r.Pages)))
+	}
+	if r.Volume != nil {
+		q.Set("Volume", strconv.Itoa(int(*r.Volume)))
+	}
+	for _, l := range r.metadataLists() {
+		if *l.p != nil {
+			// none is one empty value
+			q[l.key] = append([]string{}, **l.p...)
+			if len(**l.p) == 0 {
+				q.Set(l.key, "")
+			}
+		}
+	}
+	return q
+}
+
+func marshalListBooksResponse(books map[int]Book) []byte {
+	ids := make([]int, 0, len(books))
+	for id := range books {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var b []byte
+	for _, id := range ids {
+		entry := appendIntField(nil, 1, int64(id))
+		entry = appendBytesField(entry, 2, marshalBook(books[id]))
+		b = appendBytesField(b, 1, entry)
+	}
+	return b
+}
+
+func unmarshalListBooksResponse(data []byte) (map[int]Book, error) {
+	fields, err := readFields(data)
+	if err != nil {
+		return nil, err
+	}
+	books := make(map[int]Book)
+	for _, f := range fields {
+		if f.num != 1 || f.wire != wireBytes {
+			continue
+		}
+		entry, err := readFields(f.data)
+		if err != nil {
+			return nil, err
+		}
+		var id int
+		var book Book
+		for _, e := range entry {
+			switch {
+			case e.num == 1 && e.wire == wireVarint:
+				id = int(int64(e.v))
+			case e.num == 2 && e.wire == wireBytes:
+				if book, err = unmarshalBook(e.data); err != nil {
+					return nil, err
+				}
+			}
+		}
+		books[id] = book
+	}
+	return books, nil
+}
+
+type watchBooksRequest struct {
+	Types []string
+	ID    *int64
+}
+
+func unmarshalWatchBooksRequest(data []byte) (watchBooksRequest, error) {
+	var r watchBooksRequest
+	fields, err := readFields(data)
+	if err != nil {
+		return r, err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			if f.wire != wireBytes {
+				return r, wrongWire(f)
+			}
+			r.Types = append(r.Types, string(f.data))
+		case 2:
+			id := int64(f.v)
+			r.ID = &id
+		}
+	}
+	return r, nil
+}
+
+func (r watchBooksRequest) marshal() []byte {
+	var b []byte
+	for _, t := range r.Types {
+		b = appendBytesField(b, 1, []byte(t))
+	}
+	if r.ID != nil {
+		b = appendOptionalInt(b, 2, *r.ID)
+	}
+	return b
+}
+
+func marshalBookEvent(ev BookEvent) []byte {
+	b := appendStringField(nil, 1, ev.Type)
+	b = appendIntField(b, 2, int64(ev.ID))
+	b = appendBytesField(b, 3, marshalBook(ev.Book))
+	return appendTimestamp(b, 4, ev.Time)
+}
+
+func unmarshalBookEvent(data []byte) (BookEvent, error) {
+	var ev BookEvent
+	fields, err := readFields(data)
+	if err != nil {
+		return ev, err
+	}
+	for _, f := range fields {
+		switch {
+		case f.num == 1 && f.wire == wireBytes:
+			ev.Type = string(f.data)
+		case f.num == 2 && f.wire == wireVarint:
+			ev.ID = int(int64(f.v))
+		case f.num == 3 && f.wire == wireBytes:
+			if ev.Book, err = unmarshalBook(f.data); err != nil {
+				return ev, err
+			}
+		case f.num == 4 && f.wire == wireBytes:
+			if ev.Time, err = readTimestamp(f.data); err != nil {
+				return ev, err
+			}
+		}
+	}
+	return ev, nil
+}
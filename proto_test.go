@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBookRoundTrip(t *testing.T) {
+	books := []Book{
+		{},
+		NewBook(),
+		{Title: "The Catcher in the Rye", Author: "J. D. Salinger", Publisher: "Little, Brown", PublishDate: time.Date(1951, 7, 16, 0, 0, 0, 0, time.UTC), Rating: 3, Status: CheckedOut},
+		{Title: "Before Epoch", PublishDate: time.Date(1066, 10, 14, 0, 0, 0, 0, time.UTC), Rating: -1},
+		{Title: "Only the Year", PublishDate: time.Date(1605, 1, 1, 0, 0, 0, 0, time.UTC), PublishPrecision: YearPrecision},
+		{Title: "Dune", Edition: "2nd", Language: "en-GB", Pages: 412, Format: "paperback", Series: "Dune", Volume: 1,
+			Subjects: []string{"Science fiction", "Ecology"}, Description: "Spice.", Cover: "https://covers.example/dune.jpg"},
+		{Title: "Tagged", Tags: []string{"book-club", "Signed copy"}},
+		{Title: "Reviewed", AverageRating: 4.33, RatingCount: 3},
+	}
+	for _, b := range books {
+		got, err := unmarshalBook(marshalBook(b))
+		if err != nil || !reflect.DeepEqual(got, b) {
+			t.Errorf("%+v came back as %+v %v", b, got, err)
+		}
+	}
+}
+
+func TestProtoUnknownAndBrokenFields(t *testing.T) {
+	b := marshalBook(Book{Title: "Known"})
+	// an unknown varint, fixed64, fixed32 and string, all to be skipped
+	b = appendVarint(appendTag(b, 20, wireVarint), 300)
+	b = append(appendTag(b, 21, wire64), 1, 2, 3, 4, 5, 6, 7, 8)
+	b = append(appendTag(b, 22, wire32), 1, 2, 3, 4)
+	b = appendBytesField(b, 23, []byte("later"))
+	got, err := unmarshalBook(b)
+	if err != nil || got.Title != "Known" {
+		t.Errorf("with unknown fields got %+v %v", got, err)
+	}
+
+	whole := marshalBook(Book{Title: "Truncated", Rating: 3})
+	for i := 1; i < len(whole); i++ {
+		if _, err := unmarshalBook(whole[:i]); err == nil && !bytes.Equal(marshalBook(Book{Title: "Truncated"}), whole[:i]) {
+			t.Errorf("%d of %d bytes unmarshalled without an error", i, len(whole))
+		}
+	}
+	if _, err := unmarshalBook(appendVarint(appendTag(nil, 1, wireVarint), 1)); err == nil {
+		t.Error("a title sent as a varint unmarshalled without an error")
+	}
+	if _, err := unmarshalBook([]byte{0x0b}); err == nil {
+		t.Error("a group start unmarshalled without an error")
+	}
+}
+
+func TestUpdateBookRequestQuery(t *testing.T) {
+	defer func(f string) { cfg.DateFormat = f }(cfg.DateFormat)
+	cfg.DateFormat = "2006-Jan-02"
+	title, rating, status := "Dune", int32(0), CheckedOut
+	date := time.Date(1965, 8, 1, 0, 0, 0, 0, time.UTC)
+	r := updateBookRequest{ID: 7, Title: &title, PublishDate: &date, Rating: &rating, Status: &status}
+	got, err := unmarshalUpdateBookRequest(r.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := url.Values{"Title": {"Dune"}, "PublishDate": {"1965-Aug-01"}, "Rating": {"0"}, "Status": {"CheckedOut"}}
+	if got.ID != 7 || got.Author != nil || got.query().Encode() != expected.Encode() {
+		t.Errorf("got %d %v, expected 7 %v", got.ID, got.query(), expected)
+	}
+	// a rating of zero is set, and so still counts
+	if valid, _ := validateQuery(got.query()); valid {
+		t.Error("a rating of 0 passed validation")
+	}
+
+	r = updateBookRequest{ID: 7, PublishDate: &date, PublishPrecision: MonthPrecision}
+	if got, err := unmarshalUpdateBookRequest(r.marshal()); err != nil || got.query().Get("PublishDate") != "1965-08" {
+		t.Errorf("with a month got %v %v", got.query(), err)
+	}
+
+	language, series, pages, subjects, tags := "en-GB", "", int32(412), []string{"Ecology", "Politics"}, []string{"gift"}
+	r = updateBookRequest{ID: 7, Language: &language, Series: &series, Pages: &pages, Subjects: &subjects, Tags: &tags}
+	got, err = unmarshalUpdateBookRequest(r.marshal())
+	expected = url.Values{"Language": {"en-GB"}, "Series": {""}, "Pages": {"412"}, "Subjects": {"Ecology", "Politics"}, "Tags": {"gift"}}
+	if err != nil || got.query().Encode() != expected.Encode() {
+		t.Errorf("with metadata got %v %v, expected %v", got.query(), err, expected)
+	}
+	// no subjects clears them
+	subjects = nil
+	r = updateBookRequest{ID: 7, Subjects: &subjects}
+	if got, err := unmarshalUpdateBookRequest(r.marshal()); err != nil || got.query().Encode() != "Subjects=" {
+		t.Errorf("with no subjects got %v %v", got.query(), err)
+	}
+}
+
+func TestListAndEventRoundTrip(t *testing.T) {
+	books := map[int]Book{1: NewBook(), 3: {Title: "Three", Status: CheckedOut}}
+	got, err := unmarshalListBooksResponse(marshalListBooksResponse(books))
+	if err != nil || len(got) != 2 || !reflect.DeepEqual(got[1], books[1]) || !reflect.DeepEqual(got[3], books[3]) {
+		t.Errorf("list came back as %+v %v", got, err)
+	}
+	ev := BookEvent{Type: EventCheckedOut, ID: 3, Book: books[3], Time: time.Date(2024, 5, 6, 7, 8, 9, 10, time.UTC)}
+	if got, err := unmarshalBookEvent(marshalBookEvent(ev)); err != nil || !reflect.DeepEqual(got, ev) {
+		t.Errorf("event came back as %+v %v", got, err)
+	}
+	id := int64(3)
+	w, err := unmarshalWatchBooksRequest(watchBooksRequest{Types: []string{EventCreated, EventDeleted}, ID: &id}.marshal())
+	if err != nil || len(w.Types) != 2 || w.Types[1] != EventDeleted || w.ID == nil || *w.ID != 3 {
+		t.Errorf("watch request came back as %+v %v", w, err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The rate limit file looks like
+//
+//	{
+//	  "Rules": [
+//	    {"Route": "/book/", "Method": "GET", "Rate": 20, "Burst": 40},
+//	    {"Route": "/book/", "Method": "*", "Rate": 5, "Burst": 10},
+//	    {"Route": "*", "Method": "*", "Rate": 1, "Burst": 5}
+//	  ],
+//	  "AuthFailures": {"Rate": 0.2, "Burst": 10}
+//	}
+//
+// Rate is requests per second, Burst is the bucket size. The first rule that
+// matches a request's route and method applies, and requests no rule matches
+// aren't limited. Each caller (or each client IP, if nobody authenticated)
+// gets its own bucket per rule.
+//
+// AuthFailures is how often each IP can get its credentials wrong. It's
+// counted before anything else, since until they're right there's no
+// caller to count against, and with no file it's the one above. An IP
+// that's used it up gets a 429 without its credentials being looked at.
+type RateRule struct {
+	Route  string
+	Method string
+	Rate   float64
+	Burst  int
+}
+
+type rateLimitFile struct {
+	Rules        []RateRule
+	AuthFailures *RateRule
+}
+
+var defaultAuthFailures = RateRule{Route: "*", Method: "*", Rate: 0.2, Burst: 10}
+
+// the bucketKey rule for AuthFailures
+const authFailureRule = -1
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketKey struct {
+	rule   int
+	client string
+}
+
+type rateLimiter struct {
+	lock     sync.Mutex
+	rules    []RateRule
+	failures RateRule
+	buckets  map[bucketKey]*bucket
+	sweeps   int
+	// so the tests can move time along
+	now func() time.Time
+}
+
+var limiter *rateLimiter
+
+func newRateLimiter(rules []RateRule) (*rateLimiter, error) {
+	for i, r := range rules {
+		if r.Route == "" || r.Method == "" || r.Rate <= 0 || r.Burst < 1 {
+			return nil, errors.New("rate limit rule " + strconv.Itoa(i+1) + " needs a Route, a Method, a Rate above 0 and a Burst of at least 1")
+		}
+	}
+	return &rateLimiter{rules: rules, failures: defaultAuthFailures, buckets: make(map[bucketKey]*bucket), now: time.Now}, nil
+}
+
+func loadRateLimiter(path string) (*rateLimiter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f rateLimitFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, errors.New("parsing " + path + ": " + err.Error())
+	}
+	l, err := newRateLimiter(f.Rules)
+	if err != nil {
+		return nil, errors.New("parsing " + path + ": " + err.Error())
+	}
+	if r := f.AuthFailures; r != nil {
+		if r.Rate <= 0 || r.Burst < 1 {
+			return nil, errors.New("parsing " + path + ": AuthFailures needs a Rate above 0 and a Burst of at least 1")
+		}
+		l.failures = RateRule{Route: "*", Method: "*", Rate: r.Rate, Burst: r.Burst}
+	}
+	return l, nil
+}
+
+func (l *rateLimiter) rule(route, method string) (int, *RateRule) {
+	for i := range l.rules {
+		r := &l.rules[i]
+		if (r.Route == "*" || r.Route == route) && (r.Method == "*" || r.Method == method) {
+			return i, r
+		}
+	}
+	return -1, nil
+}
+
+// take tries to take a token from client's bucket for route and method.
+// It returns whether it got one, plus what goes in the headers: the limit,
+// what's left, seconds until the bucket is full again, and if it didn't get
+// one, seconds until it could.
+func (l *rateLimiter) take(route, method, client string) (ok bool, r *RateRule, remaining int, reset int, retry int) {
+	i, r := l.rule(route, method)
+	if r == nil {
+		return true, nil, 0, 0, 0
+	}
+	now := l.now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := l.fill(bucketKey{i, client}, r, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		retry = int(math.Ceil((1 - b.tokens) / r.Rate))
+	}
+	reset = int(math.Ceil((float64(r.Burst) - b.tokens) / r.Rate))
+	l.sweep(now)
+	return ok, r, int(b.tokens), reset, retry
+}
+
+// fill tops up key's bucket for the time since it was last looked at.
+// Must hold l.lock.
+func (l *rateLimiter) fill(key bucketKey, r *RateRule, now time.Time) *bucket {
+	b, there := l.buckets[key]
+	if !there {
+		b = &bucket{tokens: float64(r.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(r.Burst), b.tokens+now.Sub(b.last).Seconds()*r.Rate)
+	b.last = now
+	return b
+}
+
+// authBlocked says how many seconds until ip can have its credentials
+// looked at again, or 0 if it can now. It doesn't use anything up.
+func (l *rateLimiter) authBlocked(ip string) int {
+	now := l.now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := l.fill(bucketKey{authFailureRule, ip}, &l.failures, now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return int(math.Ceil((1 - b.tokens) / l.failures.Rate))
+}
+
+// authFailed counts a failed authentication against ip
+func (l *rateLimiter) authFailed(ip string) {
+	now := l.now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if b := l.fill(bucketKey{authFailureRule, ip}, &l.failures, now); b.tokens >= 1 {
+		b.tokens--
+	}
+	l.sweep(now)
+}
+
+// every so often, drop the buckets that have filled back up. A full bucket
+// is the same as no bucket. Must hold l.lock.
+func (l *rateLimiter) sweep(now time.Time) {
+	l.sweeps++
+	if l.sweeps < 1000 {
+		return
+	}
+	l.sweeps = 0
+	for k, b := range l.buckets {
+		r := l.failures
+		if k.rule != authFailureRule {
+			r = l.rules[k.rule]
+		}
+		if b.tokens+now.Sub(b.last).Seconds()*r.Rate >= float64(r.Burst) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// rateLimited goes inside authenticate, so it can tell callers apart by
+// key rather than just by address. Failed authentications are limited by
+// authenticate itself.
+func rateLimited(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if limiter == nil {
+			next(w, req)
+			return
+		}
+		client := "ip:" + sourceIP(req)
+		if c, ok := callerFrom(req); ok {
+			client = "caller:" + c.Name
+		}
+		ok, r, remaining, reset, retry := limiter.take(route, req.Method, client)
+		if r != nil {
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(r.Burst))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(reset))
+		}
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(429)
+			io.WriteString(w, "Too many requests. Try again in "+strconv.Itoa(retry)+" seconds.")
+			return
+		}
+		next(w, req)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	l, err := newRateLimiter([]RateRule{
+		{Route: "/book/", Method: "GET", Rate: 1, Burst: 3},
+		{Route: "/book/", Method: "*", Rate: 0.5, Burst: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _, remaining, _, _ := l.take("/book/", "GET", "a"); !ok || remaining != 2-i {
+			t.Errorf("take %d: got ok %v remaining %d, expected true %d", i+1, ok, remaining, 2-i)
+		}
+	}
+	ok, _, _, reset, retry := l.take("/book/", "GET", "a")
+	if ok || retry != 1 || reset != 3 {
+		t.Errorf("take from empty bucket: got ok %v retry %d reset %d, expected false 1 3", ok, retry, reset)
+	}
+	// someone else has their own bucket
+	if ok, _, _, _, _ := l.take("/book/", "GET", "b"); !ok {
+		t.Error("second client limited by the first one's bucket")
+	}
+	// as does another rule
+	if ok, _, _, _, _ := l.take("/book/", "PUT", "a"); !ok {
+		t.Error("PUT limited by the GET bucket")
+	}
+	if ok, _, _, _, retry := l.take("/book/", "DELETE", "a"); ok || retry != 2 {
+		t.Errorf("DELETE right after PUT: got ok %v retry %d, expected false 2", ok, retry)
+	}
+	now = now.Add(1500 * time.Millisecond)
+	if ok, _, _, _, _ := l.take("/book/", "GET", "a"); !ok {
+		t.Error("bucket didn't refill")
+	}
+	// no rule, no limit
+	for i := 0; i < 10; i++ {
+		if ok, r, _, _, _ := l.take("/webhooks/", "GET", "a"); !ok || r != nil {
+			t.Error("unmatched route was limited")
+		}
+	}
+
+	if _, err := newRateLimiter([]RateRule{{Route: "/book/", Method: "GET", Rate: 0, Burst: 1}}); err == nil {
+		t.Error("rule with no rate accepted")
+	}
+}
+
+func TestRateLimitedHandler(t *testing.T) {
+	var err error
+	limiter, err = newRateLimiter([]RateRule{{Route: "/book/", Method: "*", Rate: 0.1, Burst: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { limiter = nil }()
+	h := rateLimited("/book/", func(w http.ResponseWriter, req *http.Request) {})
+
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/book/1", nil)
+		req.RemoteAddr = remoteAddr
+		h(rec, req)
+		return rec
+	}
+	send("10.0.0.1:1234")
+	rec := send("10.0.0.1:5678")
+	if rec.Code != 200 || rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("second request got %d with limit %q remaining %q, expected 200 2 0", rec.Code,
+			rec.Header().Get("RateLimit-Limit"), rec.Header().Get("RateLimit-Remaining"))
+	}
+	rec = send("10.0.0.1:9999")
+	if rec.Code != 429 || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("third request got %d with Retry-After %q, expected 429 and a Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec = send("10.0.0.2:1234"); rec.Code != 200 {
+		t.Errorf("other address got %d, expected 200", rec.Code)
+	}
+}
+
+func TestAuthFailureLimit(t *testing.T) {
+	auth = testAuthenticator(t)
+	audit = newAuditLog()
+	limiter, _ = newRateLimiter(nil)
+	var logs bytes.Buffer
+	accessLog = slog.New(slog.NewJSONHandler(&logs, nil))
+	defer func() { auth = nil; audit = nil; limiter = nil; accessLog = nil }()
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	h := audited(authenticate(func(w http.ResponseWriter, req *http.Request) {}))
+
+	send := func(remoteAddr, key string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/book/1", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-API-Key", key)
+		h(rec, req)
+		return rec.Code
+	}
+	for i := 0; i < 10; i++ {
+		if code := send("10.0.0.1:1234", "guess"); code != 401 {
+			t.Fatalf("wrong key %d got %d", i+1, code)
+		}
+	}
+	if code := send("10.0.0.1:1234", "guess"); code != 429 {
+		t.Errorf("eleventh wrong key got %d", code)
+	}
+	// so the right one doesn't say it's right
+	if code := send("10.0.0.1:1234", "current-key"); code != 429 {
+		t.Errorf("right key while blocked got %d", code)
+	}
+	if code := send("10.0.0.2:1234", "current-key"); code != 200 {
+		t.Errorf("other address got %d", code)
+	}
+	now = now.Add(5 * time.Second)
+	if code := send("10.0.0.1:1234", "current-key"); code != 200 {
+		t.Errorf("right key after waiting got %d", code)
+	}
+	// the 429s are in it, like any other rejected request, and logged
+	l := audit.query(time.Time{}, time.Time{}, -1)
+	if len(l) != 14 || l[10].Outcome != 429 || l[11].Outcome != 429 || l[10].SourceIP != "10.0.0.1" {
+		t.Errorf("audited %d requests, expected 14 with the two 429s", len(l))
+	}
+	if logged := logs.String(); strings.Count(logged, `"level":"WARN","msg":"too many failed authentications"`) != 2 || !strings.Contains(logged, `"remote":"10.0.0.1"`) {
+		t.Errorf("logged %s", logged)
+	}
+}
+
+func TestAuthFailuresInFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	ioutil.WriteFile(path, []byte(`{"Rules": [], "AuthFailures": {"Rate": 1, "Burst": 3}}`), 0600)
+	l, err := loadRateLimiter(path)
+	if err != nil || l.failures.Burst != 3 || l.failures.Rate != 1 {
+		t.Errorf("got %+v %v", l, err)
+	}
+	ioutil.WriteFile(path, []byte(`{"AuthFailures": {"Rate": 1}}`), 0600)
+	if _, err := loadRateLimiter(path); err == nil || !strings.Contains(err.Error(), "AuthFailures needs") {
+		t.Errorf("AuthFailures without a Burst gave %v", err)
+	}
+}
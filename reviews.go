@@ -0,0 +1,666 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Reviews are readers' own ratings of books, on the reviews.min to
+// reviews.max scale (1 to 5 unless it's been changed), with some text if
+// they like. Each caller gets one review of each book, going by who their
+// key or token says they are. That's separate from Rating, which is the
+// library's own, and anyone cataloging can change.
+//
+//	GET    /book/{id}/reviews  the published reviews of the book, oldest first
+//	GET    /book/{id}/review   the caller's own
+//	PUT    /book/{id}/review   writes it, or rewrites it
+//	DELETE /book/{id}/review   takes it back
+//
+// and for moderators
+//
+//	GET    /reviews/?status=&book=&reviewer=  all of them, by ID
+//	GET    /reviews/{id}
+//	PUT    /reviews/{id}                      publishes or rejects it
+//	DELETE /reviews/{id}
+//
+// Bodies are JSON. With reviews.moderation post (the default) a review is
+// published as soon as it's written, and a moderator can reject it after.
+// With pre, one with text waits as pending until a moderator publishes it.
+// A rating on its own has nothing to moderate, so it's published, unless
+// a moderator's rejected the review, which sticks until one says otherwise.
+// Taking back a rejected review doesn't get round that either: it's kept,
+// withdrawn, so writing it again finds it still rejected, until a moderator
+// publishes it or deletes it for good. Only published reviews count towards a book's AverageRating and
+// RatingCount.
+
+const (
+	ReviewPublished = "published"
+	ReviewPending   = "pending"
+	ReviewRejected  = "rejected"
+)
+
+// Review is what the endpoints send and take
+type Review struct {
+	ID       int
+	BookID   int
+	Reviewer string
+	Rating   int
+	Text     string `json:",omitempty"`
+	Status   string
+	// taken back by its reviewer after it was rejected. Its reviewer
+	// doesn't see it, but it's kept so the rejection sticks.
+	Withdrawn bool `json:",omitempty"`
+	// when it was first written, and last rewritten
+	Created, Updated time.Time
+}
+
+// longest Text, in characters
+const maxReviewText = 5000
+
+// Where the reviews live. All the methods are safe to call concurrently.
+type ReviewStore interface {
+	// errNotFound if there's no such review
+	Get(id int) (Review, error)
+	// Write hands fn reviewer's review of book, or a new one with ID 0 if
+	// they haven't written one, under the lock, and saves whatever fn
+	// leaves in it, unless fn returns an error. A new one gets an ID.
+	Write(book int, reviewer string, fn func(*Review) error) (Review, error)
+	// Update is the same for review id, errNotFound if there isn't one
+	Update(id int, fn func(*Review) error) (Review, error)
+	Delete(id int) (Review, error)
+	// by ID
+	List() ([]Review, error)
+	// RemoveBook deletes every review of book id
+	RemoveBook(id int) error
+}
+
+var reviews ReviewStore = newMemReviews()
+
+type memReviews struct {
+	lock    sync.Mutex
+	reviews map[int]Review
+	nextID  int
+	// called with the lock held after every change. If it fails, the
+	// change is undone.
+	changed func() error
+}
+
+func newMemReviews() *memReviews {
+	return &memReviews{reviews: map[int]Review{}, nextID: 1}
+}
+
+func (s *memReviews) Get(id int) (Review, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, there := s.reviews[id]
+	if !there {
+		return Review{}, errNotFound
+	}
+	return r, nil
+}
+
+func (s *memReviews) Write(book int, reviewer string, fn func(*Review) error) (Review, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r := Review{BookID: book, Reviewer: reviewer}
+	for _, e := range s.reviews {
+		if e.BookID == book && e.Reviewer == reviewer {
+			r = e
+		}
+	}
+	return s.save(r, fn)
+}
+
+func (s *memReviews) Update(id int, fn func(*Review) error) (Review, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, there := s.reviews[id]
+	if !there {
+		return Review{}, errNotFound
+	}
+	return s.save(r, fn)
+}
+
+// save puts what fn makes of r in place of r, with the lock held
+func (s *memReviews) save(r Review, fn func(*Review) error) (Review, error) {
+	before, existed := s.reviews[r.ID]
+	after := r
+	if err := fn(&after); err != nil {
+		return r, err
+	}
+	// these aren't fn's to change
+	after.ID, after.BookID, after.Reviewer = r.ID, r.BookID, r.Reviewer
+	if after.ID == 0 {
+		after.ID = s.nextID
+		s.nextID++
+	}
+	s.reviews[after.ID] = after
+	if err := s.persist(); err != nil {
+		if existed {
+			s.reviews[r.ID] = before
+		} else {
+			delete(s.reviews, after.ID)
+		}
+		return r, err
+	}
+	return after, nil
+}
+
+func (s *memReviews) Delete(id int) (Review, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, there := s.reviews[id]
+	if !there {
+		return Review{}, errNotFound
+	}
+	delete(s.reviews, id)
+	if err := s.persist(); err != nil {
+		s.reviews[id] = r
+		return Review{}, err
+	}
+	return r, nil
+}
+
+func (s *memReviews) List() ([]Review, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l := make([]Review, 0, len(s.reviews))
+	for _, r := range s.reviews {
+		l = append(l, r)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].ID < l[j].ID })
+	return l, nil
+}
+
+func (s *memReviews) RemoveBook(id int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	removed := map[int]Review{}
+	for rid, r := range s.reviews {
+		if r.BookID == id {
+			removed[rid] = r
+			delete(s.reviews, rid)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if err := s.persist(); err != nil {
+		for rid, r := range removed {
+			s.reviews[rid] = r
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *memReviews) persist() error {
+	if s.changed == nil {
+		return nil
+	}
+	return s.changed()
+}
+
+// fileReviews writes them all out to a JSON file after every change, the
+// same as fileStore does the books
+type fileReviews struct {
+	*memReviews
+	path string
+}
+
+func openFileReviews(path string) (*fileReviews, error) {
+	s := &fileReviews{memReviews: newMemReviews(), path: path}
+	if err := readJSONFile(path, &s.reviews); err != nil {
+		return nil, err
+	}
+	// IDs aren't used again, at least while the highest is still there
+	for id := range s.reviews {
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	s.changed = s.write
+	return s, nil
+}
+
+func (s *fileReviews) write() error {
+	return writeJSONFile(s.path, s.reviews)
+}
+
+// openReviews keeps the reviews next to the books when they're in a file,
+// and in memory when the books are
+func openReviews(c *Config) (ReviewStore, error) {
+	if c.Storage == "file" {
+		return openFileReviews(c.StoragePath + ".reviews")
+	}
+	return newMemReviews(), nil
+}
+
+// forgetReviews deletes a deleted book's reviews, so the next book with
+// its ID doesn't get them
+func forgetReviews(id int) {
+	if err := reviews.RemoveBook(id); err != nil {
+		log.Println("deleting reviews of book", id, err)
+	}
+}
+
+// isReviewPath says whether p is a book's reviews, or one of them, which
+// aren't books, and don't come in any of the book formats
+func isReviewPath(p string) bool {
+	_, rest := apiVersion(p)
+	segments := strings.Split(rest, "/")
+	return len(segments) == 4 && segments[1] == "book" && (segments[3] == "review" || segments[3] == "reviews")
+}
+
+// reviewActions is what a request for a book's reviews needs. Reading
+// them is reading, and writing your own is reviewing.
+func reviewActions(req *http.Request) []string {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return []string{ActionRead}
+	}
+	return []string{ActionReview}
+}
+
+// moderateActions is what /reviews/ needs, whatever the method
+func moderateActions(req *http.Request) []string {
+	return []string{ActionModerate}
+}
+
+// reviewer is who the caller is, for their own review. Without someone to
+// be from, there's no review, so it answers 401 itself.
+func reviewer(w http.ResponseWriter, req *http.Request) (string, bool) {
+	if c, ok := callerFrom(req); ok && c.Name != "" {
+		return c.Name, true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="booklist"`)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(401)
+	io.WriteString(w, "Unauthorized: a review is by whoever writes it, so it needs an API key or token.")
+	return "", false
+}
+
+// GET /book/{id}/reviews
+func listReviews(w http.ResponseWriter, req *http.Request) {
+	id, err := bookID(req)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	if _, err := storeFor(req).Get(id); err == errNotFound {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	all, err := reviews.List()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	l := []Review{}
+	for _, r := range all {
+		if r.BookID == id && r.Status == ReviewPublished {
+			l = append(l, r)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
+
+// GET /book/{id}/review
+func getReview(w http.ResponseWriter, req *http.Request) {
+	id, err := bookID(req)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	name, ok := reviewer(w, req)
+	if !ok {
+		return
+	}
+	all, err := reviews.List()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	for _, r := range all {
+		if r.BookID == id && r.Reviewer == name && !r.Withdrawn {
+			writeReview(w, 200, r)
+			return
+		}
+	}
+	w.WriteHeader(404)
+}
+
+// the body of PUT /book/{id}/review
+type reviewBody struct {
+	Rating *int
+	Text   string
+}
+
+// PUT /book/{id}/review. 201 the first time, 200 after.
+func putReview(w http.ResponseWriter, req *http.Request) {
+	id, err := bookID(req)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	name, ok := reviewer(w, req)
+	if !ok {
+		return
+	}
+	var body reviewBody
+	if !readJSONBody(w, req, &body) {
+		return
+	}
+	body.Text = strings.TrimSpace(body.Text)
+	scale := strconv.Itoa(cfg.MinReviewRating) + " to " + strconv.Itoa(cfg.MaxReviewRating)
+	message := ""
+	switch {
+	case body.Rating == nil:
+		message = "A review needs a Rating, from " + scale + "."
+	case *body.Rating < cfg.MinReviewRating || *body.Rating > cfg.MaxReviewRating:
+		message = "Invalid Rating. Value must be from " + scale + "."
+	case utf8.RuneCountInString(body.Text) > maxReviewText:
+		message = "Text too long. It can be at most " + strconv.Itoa(maxReviewText) + " characters."
+	}
+	if message != "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, message)
+		return
+	}
+	if _, err := storeFor(req).Get(id); err == errNotFound {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	created := false
+	r, err := reviews.Write(id, name, func(r *Review) error {
+		now := time.Now().UTC()
+		if r.ID == 0 || r.Withdrawn {
+			created, r.Created = true, now
+		}
+		r.Status = reviewStatus(*r, body.Text)
+		r.Rating, r.Text, r.Updated, r.Withdrawn = *body.Rating, body.Text, now, false
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	rescore(req, id)
+	if created {
+		writeReview(w, 201, r)
+		return
+	}
+	writeReview(w, 200, r)
+}
+
+// reviewStatus is what r's status is once it has text. A new one with ID
+// 0 has no status yet.
+func reviewStatus(r Review, text string) string {
+	switch {
+	case r.Status == ReviewRejected:
+		// rewriting it doesn't get round the moderator, whatever's in it
+		return ReviewRejected
+	case text == "":
+		return ReviewPublished
+	case r.ID != 0 && text == r.Text && r.Status != "":
+		return r.Status
+	case cfg.ReviewModeration == "pre":
+		return ReviewPending
+	}
+	return ReviewPublished
+}
+
+// DELETE /book/{id}/review
+func deleteReview(w http.ResponseWriter, req *http.Request) {
+	id, err := bookID(req)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	name, ok := reviewer(w, req)
+	if !ok {
+		return
+	}
+	all, err := reviews.List()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	for _, r := range all {
+		if r.BookID == id && r.Reviewer == name && !r.Withdrawn {
+			if r.Status == ReviewRejected {
+				withdrawReview(w, r.ID)
+				return
+			}
+			removeReview(w, req, r.ID)
+			return
+		}
+	}
+	w.WriteHeader(404)
+}
+
+// withdrawReview takes back rejected review id for its reviewer, keeping
+// it so the rejection sticks. It never counted, so the scores stay as they
+// are.
+func withdrawReview(w http.ResponseWriter, id int) {
+	r, err := reviews.Update(id, func(r *Review) error {
+		r.Withdrawn = true
+		return nil
+	})
+	if err == errNotFound {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	writeReview(w, 200, r)
+}
+
+func removeReview(w http.ResponseWriter, req *http.Request, id int) {
+	r, err := reviews.Delete(id)
+	if err == errNotFound {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	rescore(req, r.BookID)
+	writeReview(w, 200, r)
+}
+
+// /reviews/, for moderators
+func reviewsHandler(w http.ResponseWriter, req *http.Request) {
+	p := strings.TrimPrefix(req.URL.Path, "/reviews/")
+	if p == "" {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(405)
+			return
+		}
+		moderationQueue(w, req)
+		return
+	}
+	id, err := strconv.Atoi(p)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		r, err := reviews.Get(id)
+		if err == errNotFound {
+			w.WriteHeader(404)
+			return
+		} else if err != nil {
+			storageError(w, err)
+			return
+		}
+		writeReview(w, 200, r)
+	case http.MethodPut:
+		moderateReview(w, req, id)
+	case http.MethodDelete:
+		removeReview(w, req, id)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.WriteHeader(405)
+	}
+}
+
+// GET /reviews/?status=pending&book=1&reviewer=liam. Each is optional.
+func moderationQueue(w http.ResponseWriter, req *http.Request) {
+	q, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, "Error parsing query: "+err.Error())
+		return
+	}
+	book := -1
+	if b := q.Get("book"); b != "" {
+		if book, err = strconv.Atoi(b); err != nil {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(400)
+			io.WriteString(w, "Error parsing book. It's a book ID.")
+			return
+		}
+	}
+	status := q.Get("status")
+	if status != "" && status != ReviewPublished && status != ReviewPending && status != ReviewRejected {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid status. Value must be one of published, pending, rejected.")
+		return
+	}
+	all, err := reviews.List()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	l := []Review{}
+	for _, r := range all {
+		if (book < 0 || r.BookID == book) && (status == "" || r.Status == status) && (q.Get("reviewer") == "" || r.Reviewer == q.Get("reviewer")) {
+			l = append(l, r)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
+
+// PUT /reviews/{id} with {"Status": "published"} or {"Status": "rejected"}
+func moderateReview(w http.ResponseWriter, req *http.Request, id int) {
+	var body struct{ Status string }
+	if !readJSONBody(w, req, &body) {
+		return
+	}
+	if body.Status != ReviewPublished && body.Status != ReviewRejected {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid Status. Value must be either published or rejected.")
+		return
+	}
+	r, err := reviews.Update(id, func(r *Review) error {
+		r.Status = body.Status
+		// published, it's back for its reviewer
+		r.Withdrawn = r.Withdrawn && r.Status == ReviewRejected
+		return nil
+	})
+	if err == errNotFound {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	rescore(req, r.BookID)
+	writeReview(w, 200, r)
+}
+
+// readJSONBody reads a JSON body into v, answering the request itself if
+// it won't do
+func readJSONBody(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	if mt, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(415)
+		io.WriteString(w, "Unsupported Media Type: send it as application/json.")
+		return false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBookBody))
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(413)
+		io.WriteString(w, "Request body too large.")
+		return false
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, "Error parsing body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeReview(w http.ResponseWriter, code int, r Review) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(r)
+}
+
+var errUnchanged = errors.New("nothing to change")
+
+// rescore works book id's AverageRating and RatingCount out again from its
+// published reviews. It's done under the book's lock, so whichever goes
+// last sees every review that's been written. If they change, it's a
+// change to the book like any other, audited and published.
+func rescore(req *http.Request, id int) {
+	before, after, err := storeFor(req).Update(id, func(b *Book) error {
+		all, err := reviews.List()
+		if err != nil {
+			return err
+		}
+		sum, n := 0, 0
+		for _, r := range all {
+			if r.BookID == id && r.Status == ReviewPublished {
+				sum, n = sum+r.Rating, n+1
+			}
+		}
+		average := 0.0
+		if n > 0 {
+			average = math.Round(float64(sum)/float64(n)*100) / 100
+		}
+		if b.AverageRating == average && b.RatingCount == n {
+			return errUnchanged
+		}
+		b.AverageRating, b.RatingCount = average, n
+		return nil
+	})
+	switch err {
+	case nil:
+		auditBooks(req, id, &before, &after)
+		publish(EventUpdated, id, after)
+	case errUnchanged, errNotFound:
+	default:
+		log.Println("rescoring book", id, err)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// reviewRequest sends a request to /book/ or /reviews/ as who, or no one
+func reviewRequest(who, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if who != "" {
+		req = withCaller(req, Caller{Name: who})
+	}
+	rec := httptest.NewRecorder()
+	if strings.HasPrefix(target, "/reviews/") {
+		reviewsHandler(rec, req)
+	} else {
+		bookHandler(rec, req)
+	}
+	return rec
+}
+
+func TestReviews(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil; reviews = newMemReviews() }()
+	reviews = newMemReviews()
+	store.Create(1, NewBook())
+	store.Create(2, NewBook())
+
+	for _, c := range []struct {
+		who, method, target, body string
+		code                      int
+		expected                  string
+	}{
+		{"liam", "GET", "/book/1/reviews", "", 200, "[]"},
+		{"liam", "GET", "/book/1/review", "", 404, ""},
+		{"liam", "PUT", "/book/1/review", `{"Rating": 4, "Text": " Loved it. "}`, 201, `"Rating":4,"Text":"Loved it.","Status":"published"`},
+		{"liam", "PUT", "/book/1/review", `{"Rating": 5, "Text": "Loved it."}`, 200, `"ID":1,"BookID":1,"Reviewer":"liam","Rating":5`},
+		{"emma", "PUT", "/v2/book/1/review", `{"Rating": 2}`, 201, `"ID":2,"BookID":1,"Reviewer":"emma","Rating":2,"Status":"published"`},
+		{"emma", "GET", "/book/1/review", "", 200, `"Reviewer":"emma"`},
+		{"liam", "GET", "/book/1/reviews", "", 200, `[{"ID":1,`},
+
+		{"", "PUT", "/book/1/review", `{"Rating": 3}`, 401, "API key or token"},
+		{"liam", "PUT", "/book/1/review", `{"Rating": 6}`, 400, "from 1 to 5"},
+		{"liam", "PUT", "/book/1/review", `{"Rating": 0}`, 400, "from 1 to 5"},
+		{"liam", "PUT", "/book/1/review", `{"Text": "No rating."}`, 400, "needs a Rating"},
+		{"liam", "PUT", "/book/1/review", `{"Rating": 3, "Text": "` + strings.Repeat("a", maxReviewText+1) + `"}`, 400, "Text too long"},
+		{"liam", "PUT", "/book/1/review", `{"Rating": "3"}`, 400, "Error parsing body"},
+		{"liam", "PUT", "/book/3/review", `{"Rating": 3}`, 404, ""},
+		{"liam", "GET", "/book/3/reviews", "", 404, ""},
+	} {
+		rec := reviewRequest(c.who, c.method, c.target, c.body)
+		if rec.Code != c.code || !strings.Contains(rec.Body.String(), c.expected) {
+			t.Errorf("%s %s %s as %q gave %d %s, expected %d %s", c.method, c.target, c.body, c.who, rec.Code, rec.Body, c.code, c.expected)
+		}
+	}
+	if b, _ := store.Get(1); b.AverageRating != 3.5 || b.RatingCount != 2 {
+		t.Errorf("book 1 scored %v from %d", b.AverageRating, b.RatingCount)
+	}
+
+	// rejected ones don't count, and stay rejected when they're rewritten
+	if rec := reviewRequest("mod", "PUT", "/reviews/1", `{"Status": "rejected"}`); rec.Code != 200 {
+		t.Fatalf("rejecting gave %d %s", rec.Code, rec.Body)
+	}
+	if b, _ := store.Get(1); b.AverageRating != 2 || b.RatingCount != 1 {
+		t.Errorf("after rejecting, book 1 scored %v from %d", b.AverageRating, b.RatingCount)
+	}
+	for _, body := range []string{`{"Rating": 5, "Text": "Still loved it."}`, `{"Rating": 1}`} {
+		if rec := reviewRequest("liam", "PUT", "/book/1/review", body); !strings.Contains(rec.Body.String(), `"Status":"rejected"`) {
+			t.Errorf("rewriting a rejected review as %s gave %d %s", body, rec.Code, rec.Body)
+		}
+	}
+	if b, _ := store.Get(1); b.AverageRating != 2 || b.RatingCount != 1 {
+		t.Errorf("after rewriting a rejected review, book 1 scored %v from %d", b.AverageRating, b.RatingCount)
+	}
+	if rec := reviewRequest("liam", "GET", "/book/1/reviews", ""); strings.Contains(rec.Body.String(), "liam") {
+		t.Errorf("a rejected review was listed: %s", rec.Body)
+	}
+	// nor when they're taken back and written again
+	for _, c := range []struct {
+		method, body string
+		code         int
+		expected     string
+	}{
+		{"DELETE", "", 200, `"Status":"rejected","Withdrawn":true`},
+		{"GET", "", 404, ""},
+		{"DELETE", "", 404, ""},
+		{"PUT", `{"Rating": 5}`, 201, `"ID":1,"BookID":1,"Reviewer":"liam","Rating":5,"Status":"rejected"`},
+		{"GET", "", 200, `"Status":"rejected"`},
+	} {
+		rec := reviewRequest("liam", c.method, "/book/1/review", c.body)
+		if rec.Code != c.code || !strings.Contains(rec.Body.String(), c.expected) {
+			t.Errorf("%s of a rejected review %s gave %d %s, expected %d %s", c.method, c.body, rec.Code, rec.Body, c.code, c.expected)
+		}
+	}
+	if b, _ := store.Get(1); b.AverageRating != 2 || b.RatingCount != 1 {
+		t.Errorf("after taking back and rewriting a rejected review, book 1 scored %v from %d", b.AverageRating, b.RatingCount)
+	}
+	for _, c := range []struct {
+		target string
+		code   int
+		ids    string
+	}{
+		{"/reviews/", 200, "1 2"},
+		{"/reviews/?status=rejected", 200, "1"},
+		{"/reviews/?book=1&reviewer=emma", 200, "2"},
+		{"/reviews/?book=2", 200, ""},
+		{"/reviews/?status=lost", 400, ""},
+		{"/reviews/?book=one", 400, ""},
+	} {
+		rec := reviewRequest("mod", "GET", c.target, "")
+		var ids []string
+		for _, part := range strings.Split(rec.Body.String(), `"ID":`)[1:] {
+			ids = append(ids, strings.SplitN(part, ",", 2)[0])
+		}
+		if rec.Code != c.code || strings.Join(ids, " ") != c.ids {
+			t.Errorf("GET %s gave %d %s", c.target, rec.Code, rec.Body)
+		}
+	}
+	if rec := reviewRequest("mod", "PUT", "/reviews/1", `{"Status": "pending"}`); rec.Code != 400 {
+		t.Errorf("PUT pending gave %d", rec.Code)
+	}
+	if rec := reviewRequest("mod", "GET", "/reviews/9", ""); rec.Code != 404 {
+		t.Errorf("GET /reviews/9 gave %d", rec.Code)
+	}
+
+	// taking them back takes them out of the scores
+	if rec := reviewRequest("emma", "DELETE", "/book/1/review", ""); rec.Code != 200 {
+		t.Errorf("emma's DELETE gave %d", rec.Code)
+	}
+	if rec := reviewRequest("emma", "DELETE", "/book/1/review", ""); rec.Code != 404 {
+		t.Errorf("emma's second DELETE gave %d", rec.Code)
+	}
+	if b, _ := store.Get(1); b.AverageRating != 0 || b.RatingCount != 0 {
+		t.Errorf("with none published, book 1 scored %v from %d", b.AverageRating, b.RatingCount)
+	}
+	if rec := reviewRequest("mod", "DELETE", "/reviews/1", ""); rec.Code != 200 {
+		t.Errorf("moderator's DELETE gave %d", rec.Code)
+	}
+
+	// and they go with the book
+	reviewRequest("liam", "PUT", "/book/2/review", `{"Rating": 1}`)
+	formatRequest(http.MethodDelete, "/book/2", "", "", "")
+	if l, _ := reviews.List(); len(l) != 0 {
+		t.Errorf("deleting book 2 left %+v", l)
+	}
+}
+
+func TestReviewScores(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil; reviews = newMemReviews() }()
+	reviews = newMemReviews()
+	store.Create(1, NewBook())
+	for i, who := range []string{"a", "b", "c"} {
+		reviewRequest(who, "PUT", "/book/1/review", `{"Rating": `+[]string{"5", "4", "4"}[i]+`}`)
+	}
+	if b, _ := store.Get(1); b.AverageRating != 4.33 || b.RatingCount != 3 {
+		t.Errorf("scored %v from %d", b.AverageRating, b.RatingCount)
+	}
+	// they're read only
+	formatRequest(http.MethodPut, "/book/1", "", "application/json", `{"Title": "Dune", "AverageRating": 1, "RatingCount": 9}`)
+	if b, _ := store.Get(1); b.AverageRating != 4.33 || b.RatingCount != 3 {
+		t.Errorf("a PUT made it %v from %d", b.AverageRating, b.RatingCount)
+	}
+	if rec := formatRequest(http.MethodGet, "/v2/book/1", "", "", ""); !strings.Contains(rec.Body.String(), `"averageRating":4.33,"ratingCount":3`) {
+		t.Errorf("v2 gave %s", rec.Body)
+	}
+}
+
+func TestReviewPremoderation(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil; reviews = newMemReviews(); cfg.ReviewModeration = "post" }()
+	reviews = newMemReviews()
+	cfg.ReviewModeration = "pre"
+	store.Create(1, NewBook())
+
+	status := func(rec *httptest.ResponseRecorder) string {
+		return strings.SplitN(strings.SplitN(rec.Body.String(), `"Status":"`, 2)[1], `"`, 2)[0]
+	}
+	for _, c := range []struct {
+		who, method, target, body, status string
+	}{
+		// a rating on its own has nothing to hold back
+		{"liam", "PUT", "/book/1/review", `{"Rating": 4}`, "published"},
+		{"liam", "PUT", "/book/1/review", `{"Rating": 4, "Text": "Good."}`, "pending"},
+		{"mod", "PUT", "/reviews/1", `{"Status": "published"}`, "published"},
+		// the same text again doesn't need looking at again
+		{"liam", "PUT", "/book/1/review", `{"Rating": 3, "Text": "Good."}`, "published"},
+		{"liam", "PUT", "/book/1/review", `{"Rating": 3, "Text": "Good, mostly."}`, "pending"},
+		{"mod", "PUT", "/reviews/1", `{"Status": "rejected"}`, "rejected"},
+		{"liam", "PUT", "/book/1/review", `{"Rating": 3, "Text": "Fine."}`, "rejected"},
+		{"liam", "PUT", "/book/1/review", `{"Rating": 3}`, "rejected"},
+	} {
+		rec := reviewRequest(c.who, c.method, c.target, c.body)
+		if rec.Code/100 != 2 || status(rec) != c.status {
+			t.Errorf("%s %s %s gave %d %s, expected %s", c.method, c.target, c.body, rec.Code, rec.Body, c.status)
+		}
+	}
+	if b, _ := store.Get(1); b.RatingCount != 0 {
+		t.Errorf("a pending review counted, %v from %d", b.AverageRating, b.RatingCount)
+	}
+}
+
+func TestReviewPermissions(t *testing.T) {
+	store = newMemStore()
+	auth = testAuthenticator(t)
+	saved := policy.current()
+	defer func() { store = nil; auth = nil; policy.policy = saved; reviews = newMemReviews() }()
+	reviews = newMemReviews()
+	store.Create(1, NewBook())
+	do := func(h http.HandlerFunc, method, target, body string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "current-key")
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+	book := readBody(authenticate(authorize(bookActions, bookHandler)))
+	moderate := authenticate(authorize(moderateActions, reviewsHandler))
+
+	// readers review, as themselves
+	if code := do(book, http.MethodPut, "/book/1/review", `{"Rating": 4}`); code != 201 {
+		t.Errorf("reader's review gave %d", code)
+	}
+	if r, _ := reviews.Get(1); r.Reviewer != "frontdesk" {
+		t.Errorf("review is by %q", r.Reviewer)
+	}
+	if code := do(book, http.MethodGet, "/book/1/reviews", ""); code != 200 {
+		t.Errorf("reader's GET gave %d", code)
+	}
+	if code := do(moderate, http.MethodPut, "/reviews/1", `{"Status": "rejected"}`); code != 403 {
+		t.Errorf("reader moderated, %d", code)
+	}
+	policy.policy = &Policy{Roles: saved.Roles, Callers: map[string]string{"frontdesk": "cataloger"}}
+	if code := do(moderate, http.MethodGet, "/reviews/", ""); code != 403 {
+		t.Errorf("cataloger moderated, %d", code)
+	}
+	policy.policy = &Policy{Roles: saved.Roles, Callers: map[string]string{"frontdesk": "admin"}}
+	if code := do(moderate, http.MethodPut, "/reviews/1", `{"Status": "rejected"}`); code != 200 {
+		t.Errorf("admin's moderation gave %d", code)
+	}
+}
+
+func TestFileReviews(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.json.reviews")
+	s, err := openFileReviews(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, who := range []string{"a", "b"} {
+		if _, err := s.Write(1, who, func(r *Review) error { r.Rating, r.Status = 3, ReviewPublished; return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// and it's all still there when it's opened again, and IDs carry on
+	s, err = openFileReviews(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := s.Get(1); err != nil || r.Reviewer != "a" || r.Rating != 3 {
+		t.Errorf("reopened, got %+v %v", r, err)
+	}
+	r, err := s.Write(1, "c", func(r *Review) error { return nil })
+	if err != nil || r.ID != 2 {
+		t.Errorf("next review got %+v %v", r, err)
+	}
+	if err := s.RemoveBook(1); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ = openFileReviews(path); len(s.reviews) != 0 {
+		t.Errorf("removed reviews came back: %+v", s.reviews)
+	}
+
+	cfg := defaultConfig()
+	cfg.Storage, cfg.StoragePath = "file", filepath.Join(t.TempDir(), "books.json")
+	if s, err := openReviews(cfg); err != nil || s.(*fileReviews).path != cfg.StoragePath+".reviews" {
+		t.Errorf("file storage gave %v %v", s, err)
+	}
+}
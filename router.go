@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The router for /book/. Each version of the API is a group of routes
+// under its own prefix, with its own handlers and wire format, and the old
+// ones say they're on the way out with Deprecation and Sunset headers.
+// Routes match a method and a path, where a {name} segment matches
+// anything, and handlers get what it matched from pathParam.
+
+type route struct {
+	method   string
+	segments []string
+	h        http.HandlerFunc
+}
+
+type router struct {
+	routes []route
+}
+
+func (rt *router) handle(method, pattern string, h http.HandlerFunc) {
+	rt.routes = append(rt.routes, route{method, strings.Split(pattern, "/"), h})
+}
+
+// match says whether the route's pattern matches path, and what its
+// parameters are
+func (r route) match(path string) (map[string]string, bool) {
+	segments := strings.Split(path, "/")
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, s := range r.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") && segments[i] != "" {
+			params[s[1:len(s)-1]] = segments[i]
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+type pathParamsKey struct{}
+
+// the first route that matches gets it. 405 if some do, but not for this
+// method, 404 if none do.
+func (rt *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var allowed []string
+	for _, r := range rt.routes {
+		params, ok := r.match(req.URL.Path)
+		if !ok {
+			continue
+		}
+		if r.method != req.Method && !(r.method == http.MethodGet && req.Method == http.MethodHead) {
+			allowed = append(allowed, r.method)
+			continue
+		}
+		r.h(w, req.WithContext(context.WithValue(req.Context(), pathParamsKey{}, params)))
+		return
+	}
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.WriteHeader(405)
+		return
+	}
+	w.WriteHeader(404)
+}
+
+// param is what the parameter would be in path, for the middleware, which
+// runs before the router has had a look
+func (rt *router) param(path, name string) string {
+	for _, r := range rt.routes {
+		if params, ok := r.match(path); ok {
+			return params[name]
+		}
+	}
+	return ""
+}
+
+// pathParam is the part of the path that matched {name}
+func pathParam(req *http.Request, name string) string {
+	params, _ := req.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+// bookID is the {id} in the path
+func bookID(req *http.Request) (int, error) {
+	return strconv.Atoi(pathParam(req, "id"))
+}
+
+// what a version of the API does for each route
+type bookRoutes struct {
+	list, get, create, update, delete http.HandlerFunc
+	getCover, putCover                http.HandlerFunc
+	addTag, removeTag                 http.HandlerFunc
+	listReviews, getReview            http.HandlerFunc
+	putReview, deleteReview           http.HandlerFunc
+}
+
+type apiGroup struct {
+	version int
+	// where it's served. /book/ is v1, from before there were versions.
+	prefixes []string
+	// when it's deprecated and when it goes away, zero if it isn't and
+	// won't, and the prefix of the version to use instead
+	deprecated, sunset func() time.Time
+	successor          string
+}
+
+var apiGroups = []*apiGroup{
+	{
+		version:    1,
+		prefixes:   []string{"/v1", ""},
+		deprecated: func() time.Time { return cfg.V1Deprecated },
+		sunset:     func() time.Time { return cfg.V1Sunset },
+		successor:  "/v2",
+	},
+	{
+		version:    2,
+		prefixes:   []string{"/v2"},
+		deprecated: func() time.Time { return time.Time{} },
+		sunset:     func() time.Time { return time.Time{} },
+	},
+}
+
+// every version of /book/. It's made in init, since the handlers need
+// apiGroups to know which version they're writing.
+var books *router
+
+func init() {
+	// v2 only differs in its wire format, so far
+	v1 := bookRoutes{list: listBooks, get: getBook, create: createBook, update: updateBook, delete: deleteBook,
+		getCover: getCover, putCover: putCover, addTag: addTag, removeTag: removeTag,
+		listReviews: listReviews, getReview: getReview, putReview: putReview, deleteReview: deleteReview}
+	books = bookRouter(map[int]bookRoutes{1: v1, 2: v1})
+}
+
+func bookRouter(handlers map[int]bookRoutes) *router {
+	rt := &router{}
+	for _, g := range apiGroups {
+		h := handlers[g.version]
+		for _, p := range g.prefixes {
+			rt.handle(http.MethodGet, p+"/book/", g.serve(spanned("listBooks", h.list)))
+			rt.handle(http.MethodGet, p+"/book/{id}", g.serve(spanned("getBook", h.get)))
+			rt.handle(http.MethodPost, p+"/book/{id}", g.serve(spanned("createBook", h.create)))
+			rt.handle(http.MethodPut, p+"/book/{id}", g.serve(spanned("updateBook", h.update)))
+			rt.handle(http.MethodDelete, p+"/book/{id}", g.serve(spanned("deleteBook", h.delete)))
+			rt.handle(http.MethodGet, p+"/book/{id}/cover", g.serve(spanned("getCover", h.getCover)))
+			rt.handle(http.MethodPut, p+"/book/{id}/cover", g.serve(spanned("putCover", h.putCover)))
+			rt.handle(http.MethodPut, p+"/book/{id}/tags/{tag}", g.serve(spanned("addTag", h.addTag)))
+			rt.handle(http.MethodDelete, p+"/book/{id}/tags/{tag}", g.serve(spanned("removeTag", h.removeTag)))
+			rt.handle(http.MethodGet, p+"/book/{id}/reviews", g.serve(spanned("listReviews", h.listReviews)))
+			rt.handle(http.MethodGet, p+"/book/{id}/review", g.serve(spanned("getReview", h.getReview)))
+			rt.handle(http.MethodPut, p+"/book/{id}/review", g.serve(spanned("putReview", h.putReview)))
+			rt.handle(http.MethodDelete, p+"/book/{id}/review", g.serve(spanned("deleteReview", h.deleteReview)))
+		}
+	}
+	return rt
+}
+
+// serve puts the group's deprecation headers on h's answers. Deprecation
+// is a structured date (RFC 9745), Sunset an HTTP date (RFC 8594).
+func (g *apiGroup) serve(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if d := g.deprecated(); !d.IsZero() {
+			w.Header().Set("Deprecation", "@"+strconv.FormatInt(d.Unix(), 10))
+			if g.successor != "" {
+				_, rest := apiVersion(req.URL.Path)
+				w.Header().Add("Link", "<"+g.successor+rest+">; rel=\"successor-version\"")
+			}
+		}
+		if s := g.sunset(); !s.IsZero() {
+			w.Header().Set("Sunset", s.UTC().Format(http.TimeFormat))
+		}
+		h(w, req)
+	}
+}
+
+// apiVersion is which version of the API a path is for, and the path
+// without the version's prefix
+func apiVersion(p string) (int, string) {
+	for _, g := range apiGroups {
+		for _, prefix := range g.prefixes {
+			if prefix != "" && strings.HasPrefix(p, prefix+"/") {
+				return g.version, p[len(prefix):]
+			}
+		}
+	}
+	return 1, p
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRouter(t *testing.T) {
+	rt := &router{}
+	for _, r := range []struct{ method, pattern string }{
+		{"GET", "/shelf/"},
+		{"GET", "/shelf/{id}"},
+		{"PUT", "/shelf/{id}"},
+		{"GET", "/shelf/{id}/book/{book}"},
+	} {
+		pattern := r.pattern
+		rt.handle(r.method, pattern, func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(pattern + " " + pathParam(req, "id") + " " + pathParam(req, "book")))
+		})
+	}
+
+	for _, c := range []struct {
+		method, target string
+		code           int
+		body, allow    string
+	}{
+		{"GET", "/shelf/", 200, "/shelf/  ", ""},
+		{"GET", "/shelf/3", 200, "/shelf/{id} 3 ", ""},
+		{"HEAD", "/shelf/3", 200, "", ""},
+		{"PUT", "/shelf/3", 200, "/shelf/{id} 3 ", ""},
+		{"GET", "/shelf/3/book/x", 200, "/shelf/{id}/book/{book} 3 x", ""},
+		{"DELETE", "/shelf/3", 405, "", "GET, PUT"},
+		{"POST", "/shelf/", 405, "", "GET"},
+		{"GET", "/shelf/3/", 404, "", ""},
+		{"GET", "/shelf//book/x", 404, "", ""},
+		{"GET", "/shelves/", 404, "", ""},
+	} {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(c.method, c.target, nil))
+		if rec.Code != c.code || (c.method != "HEAD" && rec.Body.String() != c.body) || rec.Header().Get("Allow") != c.allow {
+			t.Errorf("%s %s gave %d %q Allow %q, expected %d %q Allow %q", c.method, c.target, rec.Code, rec.Body, rec.Header().Get("Allow"), c.code, c.body, c.allow)
+		}
+	}
+
+	if id := rt.param("/shelf/7/book/x", "id"); id != "7" {
+		t.Errorf("param gave %q", id)
+	}
+}
+
+func TestDeprecationHeaders(t *testing.T) {
+	store = newMemStore()
+	old := cfg
+	defer func() { store = nil; cfg = old }()
+	cfg = defaultConfig()
+	store.Create(1, NewBook())
+
+	cfg.V1Deprecated = time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	cfg.V1Sunset = time.Date(2027, 10, 19, 0, 0, 0, 0, time.UTC)
+	for target, link := range map[string]string{
+		"/book/1":    "</v2/book/1>; rel=\"successor-version\"",
+		"/v1/book/1": "</v2/book/1>; rel=\"successor-version\"",
+		"/v1/book/":  "</v2/book/>; rel=\"successor-version\"",
+	} {
+		rec := formatRequest(http.MethodGet, target, "", "", "")
+		h := rec.Header()
+		if rec.Code != 200 || h.Get("Deprecation") != "@1792368000" || h.Get("Sunset") != "Tue, 19 Oct 2027 00:00:00 GMT" || h.Get("Link") != link {
+			t.Errorf("GET %s gave %d Deprecation %q Sunset %q Link %q", target, rec.Code, h.Get("Deprecation"), h.Get("Sunset"), h.Get("Link"))
+		}
+	}
+	// even when it's an error
+	if rec := formatRequest(http.MethodGet, "/v1/book/9", "", "", ""); rec.Code != 404 || rec.Header().Get("Deprecation") == "" {
+		t.Errorf("missing book gave %d Deprecation %q", rec.Code, rec.Header().Get("Deprecation"))
+	}
+
+	rec := formatRequest(http.MethodGet, "/v2/book/1", "", "", "")
+	for _, k := range []string{"Deprecation", "Sunset", "Link"} {
+		if rec.Header().Get(k) != "" {
+			t.Errorf("v2 has a %s header %q", k, rec.Header().Get(k))
+		}
+	}
+
+	// not deprecated after all
+	cfg.V1Deprecated, cfg.V1Sunset = time.Time{}, time.Time{}
+	rec = formatRequest(http.MethodGet, "/book/1", "", "", "")
+	if rec.Header().Get("Deprecation") != "" || rec.Header().Get("Sunset") != "" {
+		t.Errorf("undeprecated v1 gave Deprecation %q Sunset %q", rec.Header().Get("Deprecation"), rec.Header().Get("Sunset"))
+	}
+}
+
+func TestBookMethods(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil }()
+	store.Create(1, NewBook())
+
+	for _, c := range []struct {
+		method, target string
+		code           int
+		allow          string
+	}{
+		{"PATCH", "/v2/book/1", 405, "GET, POST, PUT, DELETE"},
+		{"DELETE", "/book/", 405, "GET"},
+		{"HEAD", "/v1/book/1", 200, ""},
+		{"GET", "/v3/book/1", 404, ""},
+		{"GET", "/book/1/2", 404, ""},
+	} {
+		rec := formatRequest(c.method, c.target, "", "", "")
+		if rec.Code != c.code || rec.Header().Get("Allow") != c.allow {
+			t.Errorf("%s %s gave %d Allow %q, expected %d %q", c.method, c.target, rec.Code, rec.Header().Get("Allow"), c.code, c.allow)
+		}
+	}
+	if b, err := store.Get(1); err != nil || !reflect.DeepEqual(b, NewBook()) {
+		t.Errorf("got %+v %v", b, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// newServer sets up the http.Server from c. A nil handler means the
+// default mux, which is where main registers everything. HTTP/2 without
+// TLS (h2c) is on too, for gRPC.
+func newServer(c *Config, handler http.Handler) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{
+		Addr:           c.Listen,
+		Handler:        handler,
+		ReadTimeout:    c.ReadTimeout,
+		WriteTimeout:   c.WriteTimeout,
+		IdleTimeout:    c.IdleTimeout,
+		MaxHeaderBytes: c.MaxHeaderBytes,
+		Protocols:      protocols}
+	// streams don't finish by themselves, so Shutdown ends them
+	srv.RegisterOnShutdown(watchers.close)
+	return srv
+}
+
+// waitForStop returns on SIGINT or SIGTERM. docker stop sends SIGTERM.
+func waitForStop() {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	signal.Stop(stop)
+}
+
+// drain stops srv taking new connections, lets the requests in flight
+// finish, gives the webhooks a chance to go out, and then closes the store
+// and the audit log and sends off the last of the spans. Whatever hasn't
+// finished when ctx is done gets cut off, but the store is closed
+// regardless, so nothing already accepted is lost.
+func drain(ctx context.Context, srv *http.Server) {
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("waiting for requests:", err)
+	}
+	if hooks != nil {
+		if err := hooks.waitContext(ctx); err != nil {
+			log.Println("waiting for webhook deliveries:", err)
+		}
+	}
+	if store != nil {
+		if err := store.Close(); err != nil {
+			log.Println("closing storage:", err)
+		}
+	}
+	if audit != nil {
+		if err := audit.close(); err != nil {
+			log.Println("closing audit log:", err)
+		}
+	}
+	if tracer != nil {
+		if err := tracer.close(ctx); err != nil {
+			log.Println("sending the last spans:", err)
+		}
+	}
+}
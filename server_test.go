@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDrainFinishesRequestsAndClosesStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.json")
+	fs, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = fs
+	defer func() { store = nil }()
+
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		store.Create(1, NewBook())
+		w.WriteHeader(201)
+	})
+	c := defaultConfig()
+	srv := newServer(c, mux)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+
+	codes := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/slow")
+		if err != nil {
+			codes <- -1
+			return
+		}
+		resp.Body.Close()
+		codes <- resp.StatusCode
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	drain(ctx, srv)
+
+	if code := <-codes; code != 201 {
+		t.Errorf("request in flight during shutdown got %d, expected 201", code)
+	}
+	if _, err := http.Get("http://" + l.Addr().String() + "/slow"); err == nil {
+		t.Error("server still taking requests after drain")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil || len(data) < 3 {
+		t.Errorf("store file not written on close: %q %v", data, err)
+	}
+}
+
+func TestServerSettings(t *testing.T) {
+	c := defaultConfig()
+	c.ReadTimeout = 3 * time.Second
+	c.MaxHeaderBytes = 4096
+	srv := newServer(c, nil)
+	if srv.ReadTimeout != 3*time.Second || srv.WriteTimeout != c.WriteTimeout || srv.IdleTimeout != c.IdleTimeout || srv.MaxHeaderBytes != 4096 {
+		t.Errorf("server not set up from config: %+v", srv)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errNotFound = errors.New("no such book")
+var errExists = errors.New("book already exists")
+var errConflict = errors.New("conflicting update")
+
+// Where the books live. All the methods are safe to call concurrently.
+type Store interface {
+	Get(id int) (Book, error)
+	// Create adds b as book id. If id is taken, it returns the book that's
+	// already there and errExists.
+	Create(id int, b Book) (Book, error)
+	// Update hands fn a copy of book id, under the lock, and saves whatever
+	// fn leaves in it, unless fn returns an error. Either way it returns the
+	// book as it was, and as it is now.
+	Update(id int, fn func(*Book) error) (before, after Book, err error)
+	Delete(id int) (Book, error)
+	List() (map[int]Book, error)
+	// Ping says whether the store is answering.
+	Ping() error
+	Close() error
+}
+
+var store Store
+
+// the original map and lock, more or less
+type memStore struct {
+	lock  sync.Mutex
+	books map[int]Book
+	// called with the lock held after every change. If it fails, the
+	// change is undone.
+	changed func() error
+}
+
+func newMemStore() *memStore {
+	return &memStore{books: make(map[int]Book)}
+}
+
+func (s *memStore) Get(id int) (Book, error) {
+	s.acquire()
+	book, there := s.books[id]
+	s.lock.Unlock()
+	if !there {
+		return Book{}, errNotFound
+	}
+	return book, nil
+}
+
+func (s *memStore) Create(id int, b Book) (Book, error) {
+	s.acquire()
+	defer s.lock.Unlock()
+	if book, there := s.books[id]; there {
+		return book, errExists
+	}
+	s.books[id] = b
+	if err := s.save(); err != nil {
+		delete(s.books, id)
+		return Book{}, err
+	}
+	return b, nil
+}
+
+func (s *memStore) Update(id int, fn func(*Book) error) (Book, Book, error) {
+	s.acquire()
+	defer s.lock.Unlock()
+	before, there := s.books[id]
+	if !there {
+		return Book{}, Book{}, errNotFound
+	}
+	after := before
+	if err := fn(&after); err != nil {
+		return before, before, err
+	}
+	s.books[id] = after
+	if err := s.save(); err != nil {
+		s.books[id] = before
+		return before, before, err
+	}
+	return before, after, nil
+}
+
+func (s *memStore) Delete(id int) (Book, error) {
+	s.acquire()
+	defer s.lock.Unlock()
+	book, there := s.books[id]
+	if !there {
+		return Book{}, errNotFound
+	}
+	delete(s.books, id)
+	if err := s.save(); err != nil {
+		s.books[id] = book
+		return Book{}, err
+	}
+	return book, nil
+}
+
+func (s *memStore) List() (map[int]Book, error) {
+	s.acquire()
+	defer s.lock.Unlock()
+	l := make(map[int]Book, len(s.books))
+	for id, b := range s.books {
+		l[id] = b
+	}
+	return l, nil
+}
+
+func (s *memStore) Ping() error {
+	s.acquire()
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+// acquire takes the lock, keeping track of how long that took
+func (s *memStore) acquire() {
+	start := time.Now()
+	s.lock.Lock()
+	metrics.observeLockWait(time.Since(start))
+}
+
+func (s *memStore) save() error {
+	if s.changed == nil {
+		return nil
+	}
+	return s.changed()
+}
+
+// fileStore is a memStore that writes the whole list out to a JSON file
+// after every change. Fine for a few thousand books, which is what we've got.
+type fileStore struct {
+	*memStore
+	path string
+}
+
+func openFileStore(path string) (*fileStore, error) {
+	s := &fileStore{memStore: newMemStore(), path: path}
+	if err := readJSONFile(path, &s.books); err != nil {
+		return nil, err
+	}
+	s.changed = s.write
+	return s, nil
+}
+
+func (s *fileStore) write() error {
+	return writeJSONFile(s.path, s.books)
+}
+
+// readJSONFile reads what writeJSONFile wrote into v. If there's no file
+// yet, v is left as it is.
+func readJSONFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("reading " + path + ": " + err.Error())
+	}
+	return nil
+}
+
+// writeJSONFile writes v to a temp file next to path and renames it over, so
+// a crash halfway through leaves the old file alone
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *fileStore) Ping() error {
+	s.acquire()
+	defer s.lock.Unlock()
+	_, err := os.Stat(filepath.Dir(s.path))
+	return err
+}
+
+func (s *fileStore) Close() error {
+	s.acquire()
+	defer s.lock.Unlock()
+	return s.write()
+}
+
+func openStore(c *Config) (Store, error) {
+	switch c.Storage {
+	case "file":
+		return openFileStore(c.StoragePath)
+	}
+	return newMemStore(), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemStore(t *testing.T) {
+	s := newMemStore()
+	b := NewBook()
+	if _, err := s.Get(1); err != errNotFound {
+		t.Errorf("get of missing book returned %v, expected errNotFound", err)
+	}
+	if _, err := s.Create(1, b); err != nil {
+		t.Fatal(err)
+	}
+	b2 := b
+	b2.Title = "Other"
+	if got, err := s.Create(1, b2); err != errExists || got.Title != b.Title {
+		t.Errorf("duplicate create returned %v %v, expected the original book and errExists", got, err)
+	}
+	before, after, err := s.Update(1, func(b *Book) error {
+		b.Title = "Changed"
+		return nil
+	})
+	if err != nil || before.Title != b.Title || after.Title != "Changed" {
+		t.Errorf("update returned %v %v %v", before, after, err)
+	}
+	_, after, err = s.Update(1, func(b *Book) error {
+		b.Title = "Not saved"
+		return errConflict
+	})
+	if err != errConflict || after.Title != "Changed" {
+		t.Errorf("failed update returned %v %v", after, err)
+	}
+	if got, _ := s.Get(1); got.Title != "Changed" {
+		t.Errorf("failed update was saved anyway: %v", got.Title)
+	}
+	if l, _ := s.List(); len(l) != 1 {
+		t.Errorf("list has %d books, expected 1", len(l))
+	}
+	if _, err := s.Delete(1); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.Delete(1); err != errNotFound {
+		t.Errorf("second delete returned %v, expected errNotFound", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.json")
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBook()
+	b.Title = "Kept"
+	s.Create(1, b)
+	s.Create(2, NewBook())
+	s.Delete(2)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s2, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := s2.List()
+	if len(l) != 1 || l[1].Title != "Kept" {
+		t.Errorf("reopened store has %v, expected just book 1", l)
+	}
+
+	// if the file can't be written, the change shouldn't stick
+	s2.path = filepath.Join(t.TempDir(), "gone", "books.json")
+	if _, err := s2.Create(3, NewBook()); err == nil {
+		t.Error("create succeeded without being saved")
+	}
+	if _, err := s2.Get(3); err != errNotFound {
+		t.Error("unsaved create left the book in the store")
+	}
+
+	ioutil.WriteFile(path, []byte("not json"), 0600)
+	if _, err := openFileStore(path); err == nil {
+		t.Error("opened a corrupt store file")
+	}
+	os.Remove(path)
+	if _, err := openFileStore(path); err != nil {
+		t.Error("missing store file should just mean no books yet: ", err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Tags are free-form labels on a book, for grouping them however the
+// library likes. They're set with the rest of a book, as Tags, and one at
+// a time with
+//
+//	PUT    /book/{id}/tags/{tag}  adds it
+//	DELETE /book/{id}/tags/{tag}  takes it off
+//
+// both of which answer with the book. GET /book/?Tags=... lists the books
+// with all of the tags given, and GET /tags every tag there is. Like
+// subjects, tags compare ignoring case, and can't have a ; in them.
+
+// isTagPath says whether p is one of a book's tags, which has no body
+func isTagPath(p string) bool {
+	_, rest := apiVersion(p)
+	segments := strings.Split(rest, "/")
+	return len(segments) == 5 && segments[1] == "book" && segments[3] == "tags"
+}
+
+// PUT /book/{id}/tags/{tag}. Adding one it already has changes nothing.
+func addTag(w http.ResponseWriter, req *http.Request) {
+	changeTag(w, req, func(book *Book, tag string) error {
+		if !containsFold(book.Tags, tag) {
+			book.Tags = append(book.Tags, tag)
+		}
+		return nil
+	})
+}
+
+// DELETE /book/{id}/tags/{tag}. 404 if the book doesn't have it.
+func removeTag(w http.ResponseWriter, req *http.Request) {
+	changeTag(w, req, func(book *Book, tag string) error {
+		var tags []string
+		for _, t := range book.Tags {
+			if !strings.EqualFold(t, tag) {
+				tags = append(tags, t)
+			}
+		}
+		if len(tags) == len(book.Tags) {
+			return errNotFound
+		}
+		book.Tags = tags
+		return nil
+	})
+}
+
+func changeTag(w http.ResponseWriter, req *http.Request, change func(*Book, string) error) {
+	id, err := bookID(req)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	tag := strings.TrimSpace(pathParam(req, "tag"))
+	if tag == "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, "A tag can't be blank.")
+		return
+	}
+	if valid, message := validateQuery(url.Values{"Tags": {tag}}); !valid {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, message)
+		return
+	}
+	before, book, err := storeFor(req).Update(id, func(b *Book) error { return change(b, tag) })
+	switch err {
+	case nil:
+	case errNotFound:
+		w.WriteHeader(404)
+		return
+	default:
+		storageError(w, err)
+		return
+	}
+	if len(book.Tags) != len(before.Tags) {
+		auditBooks(req, id, &before, &book)
+		publish(EventUpdated, id, book)
+	}
+	writeBook(w, req, 200, id, book)
+}
+
+// one line of GET /tags
+type tagCount struct {
+	Tag string
+	// how many books have it
+	Books int
+}
+
+// GET /tags. Every tag on a book, by name, spelt the way the book with the
+// lowest ID has it.
+func tagsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(405)
+		return
+	}
+	books, err := storeFor(req).List()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	counts := map[string]*tagCount{}
+	for _, id := range sortedIDs(books) {
+		for _, t := range books[id].Tags {
+			key := strings.ToLower(t)
+			if counts[key] == nil {
+				counts[key] = &tagCount{Tag: t}
+			}
+			counts[key].Books++
+		}
+	}
+	list := []tagCount{}
+	for _, c := range counts {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].Tag) < strings.ToLower(list[j].Tag) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
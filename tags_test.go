@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil }()
+	store.Create(1, NewBook())
+	store.Create(2, NewBook())
+
+	for _, c := range []struct {
+		method, target string
+		code           int
+		tags           []string
+	}{
+		{"PUT", "/book/1/tags/book-club", 200, []string{"book-club"}},
+		{"PUT", "/book/1/tags/Signed%20copy", 200, []string{"book-club", "Signed copy"}},
+		// already there
+		{"PUT", "/book/1/tags/BOOK-CLUB", 200, []string{"book-club", "Signed copy"}},
+		{"PUT", "/v2/book/1/tags/gift", 200, []string{"book-club", "Signed copy", "gift"}},
+		{"PUT", "/book/1/tags/a%3Bb", 400, []string{"book-club", "Signed copy", "gift"}},
+		{"PUT", "/book/1/tags/%20", 400, []string{"book-club", "Signed copy", "gift"}},
+		{"PUT", "/book/3/tags/gift", 404, nil},
+		{"DELETE", "/book/1/tags/signed%20COPY", 200, []string{"book-club", "gift"}},
+		{"DELETE", "/book/1/tags/signed%20copy", 404, []string{"book-club", "gift"}},
+		{"GET", "/book/1/tags/gift", 405, []string{"book-club", "gift"}},
+	} {
+		rec := formatRequest(c.method, c.target, "", "", "")
+		b, _ := store.Get(1)
+		if rec.Code != c.code || c.code != 404 && !reflect.DeepEqual(b.Tags, c.tags) {
+			t.Errorf("%s %s gave %d %s, left %q", c.method, c.target, rec.Code, rec.Body, b.Tags)
+		}
+	}
+	// the answer's the book, in whatever format was asked for
+	if rec := formatRequest(http.MethodPut, "/v2/book/2/tags/gift", "application/xml", "", ""); rec.Code != 200 || !strings.Contains(rec.Body.String(), "<tags><tag>gift</tag></tags>") {
+		t.Errorf("v2 XML gave %d %s", rec.Code, rec.Body)
+	}
+	if rec := formatRequest(http.MethodPut, "/book/2?Tags=Staff+pick&Tags=gift", "", "", ""); rec.Code != 200 {
+		t.Fatalf("PUT Tags gave %d %s", rec.Code, rec.Body)
+	}
+
+	for query, ids := range map[string]string{
+		"Tags=GIFT":                 "1 2",
+		"Tags=gift&Tags=book-club":  "1",
+		"Tags=staff+pick":           "2",
+		"Tags=nothing":              "",
+		"Tags=gift&Tags=staff+pick": "2",
+	} {
+		rec := formatRequest(http.MethodGet, "/book/?"+query, "text/csv", "", "")
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n")[1:] {
+			got = append(got, strings.Split(line, ",")[0])
+		}
+		if rec.Code != 200 || strings.Join(got, " ") != ids {
+			t.Errorf("GET /book/?%s gave %d %v, expected %s", query, rec.Code, got, ids)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	tagsHandler(rec, httptest.NewRequest(http.MethodGet, "/tags", nil))
+	if expected := `[{"Tag":"book-club","Books":1},{"Tag":"gift","Books":2},{"Tag":"Staff pick","Books":1}]`; strings.TrimSpace(rec.Body.String()) != expected {
+		t.Errorf("GET /tags gave %s, expected %s", rec.Body, expected)
+	}
+	rec = httptest.NewRecorder()
+	tagsHandler(rec, httptest.NewRequest(http.MethodPost, "/tags", nil))
+	if rec.Code != 405 {
+		t.Errorf("POST /tags gave %d", rec.Code)
+	}
+}
+
+func TestTagPermissions(t *testing.T) {
+	store = newMemStore()
+	auth = testAuthenticator(t)
+	saved := policy.current()
+	defer func() { store = nil; auth = nil; policy.policy = saved }()
+	store.Create(1, NewBook())
+	h := readBody(authenticate(authorize(bookActions, bookHandler)))
+	tag := func(method string) int {
+		req := httptest.NewRequest(method, "/book/1/tags/gift", nil)
+		req.Header.Set("X-API-Key", "current-key")
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+	if code := tag(http.MethodPut); code != 403 {
+		t.Errorf("reader tagged a book, %d", code)
+	}
+	// clerks circulate, and tagging isn't that
+	policy.policy = &Policy{Roles: saved.Roles, Callers: map[string]string{"frontdesk": "clerk"}}
+	if code := tag(http.MethodPut); code != 403 {
+		t.Errorf("clerk tagged a book, %d", code)
+	}
+	policy.policy = &Policy{Roles: saved.Roles, Callers: map[string]string{"frontdesk": "cataloger"}}
+	if code := tag(http.MethodPut); code != 200 {
+		t.Errorf("cataloger's tag gave %d", code)
+	}
+	// taking one off is cataloging too, not deleting
+	if code := tag(http.MethodDelete); code != 200 {
+		t.Errorf("cataloger's untag gave %d", code)
+	}
+}
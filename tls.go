@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// certReloader holds the server certificate and the client CA bundle, so
+// they can be swapped on SIGHUP without dropping connections.
+type certReloader struct {
+	certFile, keyFile, caFile string
+	clientAuth                tls.ClientAuthType
+
+	lock sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+var certs *certReloader
+
+func clientAuthType(s string) tls.ClientAuthType {
+	switch s {
+	case "optional":
+		return tls.VerifyClientCertIfGiven
+	case "require":
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
+
+func newCertReloader(c *Config) (*certReloader, error) {
+	r := &certReloader{
+		certFile:   c.TLSCert,
+		keyFile:    c.TLSKey,
+		caFile:     c.TLSClientCA,
+		clientAuth: clientAuthType(c.TLSClientAuth)}
+	return r, r.reload()
+}
+
+// reload reads the files again. If anything is wrong with them the old ones
+// stay in use.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New(r.caFile + ": no certificates found")
+		}
+	}
+	r.lock.Lock()
+	r.cert = &cert
+	r.pool = pool
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			return r.cert, nil
+		},
+		// every handshake gets whatever was loaded last
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientCAs:    r.pool,
+				ClientAuth:   r.clientAuth,
+				// this replaces the server's config, ALPN and all, so
+				// HTTP/2 (and so gRPC) needs asking for here
+				NextProtos: []string{"h2", "http/1.1"}}, nil
+		}}
+}
+
+// certCaller is who the client certificate says is calling, if there is
+// one and it checked out against the CA bundle. The certificate's common
+// name is the caller name, so the policy file can give it a role.
+func certCaller(req *http.Request) (Caller, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return Caller{}, false
+	}
+	cn := req.TLS.VerifiedChains[0][0].Subject.CommonName
+	if cn == "" {
+		return Caller{}, false
+	}
+	return Caller{Name: cn}, true
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// makeCert makes a certificate for cn, signed by parent, or self-signed if
+// parent is nil
+func makeCert(t *testing.T, cn string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")}}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})}
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
+
+func writeCerts(t *testing.T, dir string, server, ca *testCert) *Config {
+	c := defaultConfig()
+	c.TLSCert = filepath.Join(dir, "server.pem")
+	c.TLSKey = filepath.Join(dir, "server.key")
+	c.TLSClientCA = filepath.Join(dir, "ca.pem")
+	c.TLSClientAuth = "require"
+	ioutil.WriteFile(c.TLSCert, server.certPEM, 0600)
+	ioutil.WriteFile(c.TLSKey, server.keyPEM, 0600)
+	ioutil.WriteFile(c.TLSClientCA, ca.certPEM, 0600)
+	return c
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := makeCert(t, "Booklist Test CA", nil, true)
+	server := makeCert(t, "booklist", ca, false)
+	clerk := makeCert(t, "frontdesk", ca, false)
+	stranger := makeCert(t, "frontdesk", makeCert(t, "Some Other CA", nil, true), false)
+
+	c := writeCerts(t, t.TempDir(), server, ca)
+	r, err := newCertReloader(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	who := make(chan string, 1)
+	srv := httptest.NewUnstartedServer(authenticate(func(w http.ResponseWriter, req *http.Request) {
+		caller, _ := callerFrom(req)
+		who <- caller.Name
+	}))
+	srv.TLS = r.tlsConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(cert *testCert) *http.Client {
+		cfg := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{cert.tlsCert()}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	}
+
+	resp, err := client(clerk).Get(srv.URL + "/book/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if name := <-who; name != "frontdesk" {
+		t.Errorf("client certificate mapped to caller %q, expected frontdesk", name)
+	}
+
+	if resp, err := client(nil).Get(srv.URL + "/book/1"); err == nil {
+		resp.Body.Close()
+		t.Error("connection without a client certificate accepted")
+	}
+	if resp, err := client(stranger).Get(srv.URL + "/book/1"); err == nil {
+		resp.Body.Close()
+		t.Error("client certificate from the wrong CA accepted")
+	}
+}
+
+// with tls.client_auth optional and no keys file, a client without a
+// certificate is nobody, not someone authorize doesn't check
+func TestOptionalClientCertWithoutKeys(t *testing.T) {
+	ca := makeCert(t, "Booklist Test CA", nil, true)
+	server := makeCert(t, "booklist", ca, false)
+	clerk := makeCert(t, "frontdesk", ca, false)
+	c := writeCerts(t, t.TempDir(), server, ca)
+	c.TLSClientAuth = "optional"
+	r, err := newCertReloader(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = c
+
+	srv := httptest.NewUnstartedServer(authenticate(authorize(adminActions, func(w http.ResponseWriter, req *http.Request) {})))
+	srv.TLS = r.tlsConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(cert *testCert) int {
+		cfg := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{cert.tlsCert()}
+		}
+		resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}).Get(srv.URL + "/webhooks/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(nil); code != 401 {
+		t.Errorf("anonymous client got %d", code)
+	}
+	// a reader, by default
+	if code := get(clerk); code != 403 {
+		t.Errorf("client with a certificate got %d", code)
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	ca := makeCert(t, "Booklist Test CA", nil, true)
+	first := makeCert(t, "first", ca, false)
+	second := makeCert(t, "second", ca, false)
+	dir := t.TempDir()
+	c := writeCerts(t, dir, first, ca)
+	r, err := newCertReloader(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		cfg, _ := r.tlsConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+		leaf, _ := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	if cn := served(); cn != "first" {
+		t.Errorf("serving %q, expected first", cn)
+	}
+	writeCerts(t, dir, second, ca)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := served(); cn != "second" {
+		t.Errorf("serving %q after reload, expected second", cn)
+	}
+	// a broken key leaves the last good pair in place
+	ioutil.WriteFile(c.TLSKey, []byte("not a key"), 0600)
+	if err := r.reload(); err == nil {
+		t.Error("reload accepted a bad key")
+	}
+	if cn := served(); cn != "second" {
+		t.Errorf("serving %q after bad reload, expected second", cn)
+	}
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	if _, err := loadConfig([]string{"-tls-cert", "a.pem"}, envFrom(nil)); err == nil {
+		t.Error("tls.cert without tls.key accepted")
+	}
+	if _, err := loadConfig([]string{"-tls-cert", "a.pem", "-tls-key", "a.key", "-tls-client-auth", "require"}, envFrom(nil)); err == nil {
+		t.Error("required client certificates without a CA accepted")
+	}
+	if _, err := loadConfig([]string{"-tls-client-auth", "maybe"}, envFrom(nil)); err == nil {
+		t.Error("unknown tls.client_auth accepted")
+	}
+}
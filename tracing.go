@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing, OpenTelemetry style, without OpenTelemetry. Spans go out in
+// batches as OTLP/HTTP JSON to a collector, or as a line of JSON each on
+// stdout. Requests join the trace in their W3C traceparent header if they
+// have one.
+
+type span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string `json:",omitempty"`
+	Name     string
+	// server for the request span, internal for handlers, client for the store
+	Kind  string
+	Start time.Time
+	End   time.Time
+	Attrs map[string]interface{}
+	Error string `json:",omitempty"`
+
+	sampled bool
+}
+
+// set records an attribute. Safe on a nil span, which is what startSpan hands
+// out when tracing is off.
+func (s *span) set(key string, value interface{}) {
+	if s != nil {
+		s.Attrs[key] = value
+	}
+}
+
+func (s *span) fail(err error) {
+	if s != nil && err != nil {
+		s.Error = err.Error()
+	}
+}
+
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if s.sampled && tracer != nil {
+		tracer.add(s)
+	}
+}
+
+// traceparent is the header value that makes s the parent of whatever gets
+// it.
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + s.TraceID + "-" + s.SpanID + "-" + flags
+}
+
+type spanKey struct{}
+
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSpan starts a span under the one in ctx, or a new trace if there
+// isn't one. With tracing off it returns ctx and nil.
+func startSpan(ctx context.Context, name, kind string) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &span{SpanID: randomHex(8), Name: name, Kind: kind, Start: time.Now(), Attrs: map[string]interface{}{}, sampled: true}
+	if parent := spanFrom(ctx); parent != nil {
+		s.TraceID, s.ParentID, s.sampled = parent.TraceID, parent.SpanID, parent.sampled
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// parseTraceparent pulls the trace ID, parent span ID and sampled flag out
+// of a W3C traceparent header. Anything malformed means start a new trace.
+func parseTraceparent(h string) (traceID, parentID string, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	// version 00 has exactly four parts. later versions may add more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return "", "", false, false
+	}
+	for _, p := range parts[:4] {
+		if _, err := hex.DecodeString(p); err != nil || strings.ToLower(p) != p {
+			return "", "", false, false
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", false, false
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	return parts[1], parts[2], flags&1 == 1, true
+}
+
+// traced goes outside logged, so the access log can carry the trace ID. It
+// starts the server span for the request, under the caller's traceparent if
+// it sent one.
+func traced(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if tracer == nil {
+			next(w, req)
+			return
+		}
+		ctx := req.Context()
+		if traceID, parentID, sampled, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanKey{}, &span{TraceID: traceID, SpanID: parentID, sampled: sampled})
+		}
+		ctx, s := startSpan(ctx, req.Method+" "+route, "server")
+		s.set("http.method", req.Method)
+		s.set("http.route", route)
+		s.set("http.target", req.URL.Path)
+		sr := &statusRecorder{ResponseWriter: w}
+		next(sr, req.WithContext(ctx))
+		if sr.code == 0 {
+			sr.code = 200
+		}
+		s.set("http.status_code", sr.code)
+		if sr.code >= 500 {
+			s.Error = http.StatusText(sr.code)
+		}
+		s.end()
+	}
+}
+
+// spanned puts one of the book handlers in a span of its own, with the book
+// ID and the status it answered with.
+func spanned(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx, s := startSpan(req.Context(), name, "internal")
+		if s == nil {
+			h(w, req)
+			return
+		}
+		if id, err := bookID(req); err == nil {
+			s.set("book.id", id)
+		}
+		sr := &statusRecorder{ResponseWriter: w}
+		h(sr, req.WithContext(ctx))
+		if sr.code == 0 {
+			sr.code = 200
+		}
+		s.set("outcome", sr.code)
+		s.end()
+	}
+}
+
+// tracedStore is the store, with a span around each call. storeFor hands
+// one out per request so the spans land under the right handler.
+type tracedStore struct {
+	Store
+	ctx context.Context
+}
+
+func storeFor(req *http.Request) Store {
+	if tracer == nil {
+		return store
+	}
+	return tracedStore{Store: store, ctx: req.Context()}
+}
+
+func (s tracedStore) start(op string, id int) *span {
+	_, sp := startSpan(s.ctx, "store."+op, "client")
+	sp.set("db.operation", op)
+	if id >= 0 {
+		sp.set("book.id", id)
+	}
+	return sp
+}
+
+// finish records how the call went. Not found and the like are answers,
+// not failures.
+func finish(sp *span, err error) {
+	switch err {
+	case nil:
+		sp.set("outcome", "ok")
+	case errNotFound, errExists, errConflict:
+		sp.set("outcome", err.Error())
+	default:
+		sp.set("outcome", "error")
+		sp.fail(err)
+	}
+	sp.end()
+}
+
+func (s tracedStore) Get(id int) (Book, error) {
+	sp := s.start("Get", id)
+	b, err := s.Store.Get(id)
+	finish(sp, err)
+	return b, err
+}
+
+func (s tracedStore) Create(id int, b Book) (Book, error) {
+	sp := s.start("Create", id)
+	b, err := s.Store.Create(id, b)
+	finish(sp, err)
+	return b, err
+}
+
+func (s tracedStore) Update(id int, fn func(*Book) error) (Book, Book, error) {
+	sp := s.start("Update", id)
+	before, after, err := s.Store.Update(id, fn)
+	finish(sp, err)
+	return before, after, err
+}
+
+func (s tracedStore) Delete(id int) (Book, error) {
+	sp := s.start("Delete", id)
+	b, err := s.Store.Delete(id)
+	finish(sp, err)
+	return b, err
+}
+
+func (s tracedStore) List() (map[int]Book, error) {
+	sp := s.start("List", -1)
+	l, err := s.Store.List()
+	finish(sp, err)
+	return l, err
+}
+
+// spanTracer collects finished spans and sends them out in batches.
+type spanTracer struct {
+	lock    sync.Mutex
+	pending []*span
+	dropped int
+	// most spans held between exports. past this, new ones are dropped.
+	limit  int
+	export func([]*span) error
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+var tracer *spanTracer
+
+// newTracer starts a tracer that exports every interval. dest is "stdout",
+// or "otlp" to post to endpoint.
+func newTracer(dest, endpoint string, interval time.Duration) *spanTracer {
+	t := &spanTracer{limit: 4096, stop: make(chan struct{}), done: make(chan struct{})}
+	switch dest {
+	case "stdout":
+		t.export = writeSpans(os.Stdout)
+	case "otlp":
+		t.export = postSpans(&http.Client{Timeout: 10 * time.Second}, strings.TrimSuffix(endpoint, "/")+"/v1/traces")
+	default:
+		return nil
+	}
+	go t.run(interval)
+	return t
+}
+
+func (t *spanTracer) add(s *span) {
+	t.lock.Lock()
+	if len(t.pending) < t.limit {
+		t.pending = append(t.pending, s)
+	} else {
+		t.dropped++
+	}
+	t.lock.Unlock()
+}
+
+func (t *spanTracer) run(interval time.Duration) {
+	defer close(t.done)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			t.flush()
+		case <-t.stop:
+			t.flush()
+			return
+		}
+	}
+}
+
+func (t *spanTracer) flush() {
+	t.lock.Lock()
+	batch, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.lock.Unlock()
+	if dropped > 0 {
+		log.Println("tracing:", dropped, "spans dropped, the exporter isn't keeping up")
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if err := t.export(batch); err != nil {
+		log.Println("exporting spans:", err)
+	}
+}
+
+// close sends whatever is left, and stops. Nothing is exported after.
+func (t *spanTracer) close(ctx context.Context) error {
+	close(t.stop)
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func writeSpans(w io.Writer) func([]*span) error {
+	enc := json.NewEncoder(w)
+	return func(batch []*span) error {
+		for _, s := range batch {
+			if err := enc.Encode(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func postSpans(client *http.Client, url string) func([]*span) error {
+	return func(batch []*span) error {
+		body, err := json.Marshal(otlpRequest(batch))
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return errors.New("collector returned " + resp.Status)
+		}
+		return nil
+	}
+}
+
+// The OTLP/HTTP JSON encoding, as much of it as we use.
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttr(k string, v interface{}) otlpKeyValue {
+	var val otlpValue
+	switch v := v.(type) {
+	case int:
+		s := strconv.Itoa(v)
+		val.IntValue = &s
+	case bool:
+		val.BoolValue = &v
+	case float64:
+		val.DoubleValue = &v
+	case string:
+		val.StringValue = &v
+	default:
+		s, _ := json.Marshal(v)
+		str := string(s)
+		val.StringValue = &str
+	}
+	return otlpKeyValue{Key: k, Value: val}
+}
+
+var otlpKinds = map[string]int{"internal": 1, "server": 2, "client": 3}
+
+func otlpRequest(batch []*span) otlpExport {
+	var scope otlpScopeSpans
+	scope.Scope.Name = "booklist"
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              otlpKinds[s.Kind],
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        []otlpKeyValue{},
+			Status:            otlpStatus{Code: 1}}
+		if s.Error != "" {
+			o.Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		for k, v := range s.Attrs {
+			o.Attributes = append(o.Attributes, otlpAttr(k, v))
+		}
+		scope.Spans = append(scope.Spans, o)
+	}
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpKeyValue{otlpAttr("service.name", "booklist")}
+	rs.ScopeSpans = []otlpScopeSpans{scope}
+	return otlpExport{ResourceSpans: []otlpResourceSpans{rs}}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	for _, c := range []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	} {
+		traceID, parentID, sampled, ok := parseTraceparent(c.header)
+		if ok != c.ok || sampled != c.sampled {
+			t.Errorf("%q: got ok %v sampled %v, expected %v %v", c.header, ok, sampled, c.ok, c.sampled)
+		}
+		if ok && (traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || parentID != "00f067aa0ba902b7") {
+			t.Errorf("%q: got trace %s parent %s", c.header, traceID, parentID)
+		}
+	}
+}
+
+// collects spans instead of exporting them
+func testTracer() (*spanTracer, func() []*span) {
+	var lock sync.Mutex
+	var got []*span
+	tr := &spanTracer{limit: 100, stop: make(chan struct{}), done: make(chan struct{})}
+	tr.export = func(batch []*span) error {
+		lock.Lock()
+		got = append(got, batch...)
+		lock.Unlock()
+		return nil
+	}
+	go tr.run(time.Hour)
+	return tr, func() []*span {
+		tr.close(context.Background())
+		lock.Lock()
+		defer lock.Unlock()
+		return got
+	}
+}
+
+func TestSpans(t *testing.T) {
+	store = newMemStore()
+	tr, spans := testTracer()
+	tracer = tr
+	defer func() { tracer = nil; store = nil }()
+
+	h := traced("/book/", bookHandler)
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/book/7", nil))
+	req := httptest.NewRequest(http.MethodGet, "/book/8", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h(httptest.NewRecorder(), req)
+	req = httptest.NewRequest(http.MethodGet, "/book/7", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	h(httptest.NewRecorder(), req)
+
+	l := spans()
+	if len(l) != 6 {
+		t.Fatalf("got %d spans, expected 6 (the unsampled request shouldn't show up)", len(l))
+	}
+	// spans end innermost first
+	st, handler, server := l[0], l[1], l[2]
+	if st.Name != "store.Create" || handler.Name != "createBook" || server.Name != "POST /book/" {
+		t.Fatalf("got spans %s, %s, %s", st.Name, handler.Name, server.Name)
+	}
+	if st.ParentID != handler.SpanID || handler.ParentID != server.SpanID || server.ParentID != "" ||
+		st.TraceID != server.TraceID || handler.TraceID != server.TraceID {
+		t.Error("POST spans aren't nested in one trace")
+	}
+	if st.Attrs["book.id"] != 7 || st.Attrs["outcome"] != "ok" || handler.Attrs["outcome"] != 201 ||
+		server.Attrs["http.status_code"] != 201 {
+		t.Errorf("unexpected attributes %v %v %v", st.Attrs, handler.Attrs, server.Attrs)
+	}
+
+	st, server = l[3], l[5]
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentID != "00f067aa0ba902b7" {
+		t.Errorf("GET span in trace %s under %s, expected the traceparent's", server.TraceID, server.ParentID)
+	}
+	if st.Attrs["outcome"] != errNotFound.Error() || st.Error != "" {
+		t.Errorf("missing book marked as %v %q, expected not found and no error", st.Attrs["outcome"], st.Error)
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	got := make(chan otlpExport, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var e otlpExport
+		if req.URL.Path != "/v1/traces" || json.NewDecoder(req.Body).Decode(&e) != nil {
+			w.WriteHeader(400)
+			return
+		}
+		got <- e
+	}))
+	defer collector.Close()
+
+	tr := newTracer("otlp", collector.URL, time.Hour)
+	tracer = tr
+	_, s := startSpan(context.Background(), "store.Get", "client")
+	s.set("book.id", 3)
+	s.fail(errNotFound)
+	s.end()
+	tracer = nil
+	tr.close(context.Background())
+
+	e := <-got
+	spans := e.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("collector got %d spans, expected 1", len(spans))
+	}
+	o := spans[0]
+	if o.Name != "store.Get" || o.Kind != 3 || o.Status.Code != 2 || len(o.TraceID) != 32 || len(o.SpanID) != 16 {
+		t.Errorf("unexpected span %+v", o)
+	}
+	if len(o.Attributes) != 1 || o.Attributes[0].Key != "book.id" || o.Attributes[0].Value.IntValue == nil || *o.Attributes[0].Value.IntValue != "3" {
+		t.Errorf("unexpected attributes %+v", o.Attributes)
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The web UI, for the front desk, at /ui/. Plain HTML forms over the same
+// store and rules as /book/: changes go through validateQuery and
+// changeBook, get audited, and fire the webhooks. Every form carries a CSRF
+// token. With authentication on, staff sign in with their API key, which
+// is traded for a bearer token kept in a cookie.
+
+//go:embed ui/*.html
+var uiFiles embed.FS
+
+var uiPages = map[string]*template.Template{
+	"books": uiTemplate("ui/books.html"),
+	"book":  uiTemplate("ui/book.html"),
+	"login": uiTemplate("ui/login.html"),
+}
+
+func uiTemplate(page string) *template.Template {
+	return template.Must(template.ParseFS(uiFiles, "ui/layout.html", page))
+}
+
+const (
+	uiSessionCookie = "booklist_session"
+	uiCSRFCookie    = "booklist_csrf"
+	// about a shift
+	uiSessionTTL = 8 * time.Hour
+)
+
+// what the pages say after a change, by the note parameter
+var uiNotes = map[string]string{
+	"saved":      "Saved.",
+	"unchanged":  "Nothing was changed.",
+	"created":    "Added.",
+	"checkedout": "Checked out.",
+	"returned":   "Checked in.",
+	"cover":      "Cover uploaded.",
+}
+
+// the fields the forms edit, named as in the query to PUT /book/{id}
+var uiFields = []string{"Title", "Author", "Publisher", "PublishDate", "Rating",
+	"Edition", "Language", "Pages", "Format", "Series", "Volume", "Subjects", "Description", "Cover", "Tags"}
+
+// uiPage is what the templates get
+type uiPage struct {
+	Title, Note, Problem string
+	// who's signed in, for the sign out button
+	Caller string
+	CSRF   string
+	// the list
+	Books                []uiBook
+	Search, StatusFilter string
+	// the form. Book is nil for a new one.
+	Book   *uiBook
+	Fields map[string]string
+	Errors map[string]string
+	// where to go after signing in
+	Next string
+}
+
+func (uiPage) DateFormat() string { return cfg.DateFormat }
+func (uiPage) MinRating() int     { return cfg.MinRating }
+func (uiPage) MaxRating() int     { return cfg.MaxRating }
+func (uiPage) Formats() []string  { return bookFormatNames }
+
+type uiBook struct {
+	ID int
+	Book
+}
+
+func (b uiBook) Date() string   { return b.publishDate() }
+func (b uiBook) Out() bool      { return b.Status == CheckedOut }
+func (b uiBook) HasCover() bool { return covers.Has(b.ID) }
+
+func renderUI(w http.ResponseWriter, req *http.Request, code int, name string, p uiPage) {
+	p.CSRF = csrfToken(w, req)
+	if _, err := req.Cookie(uiSessionCookie); err == nil {
+		if c, ok := callerFrom(req); ok {
+			p.Caller = c.Name
+		}
+	}
+	var buf bytes.Buffer
+	if err := uiPages[name].ExecuteTemplate(&buf, "layout", p); err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(500)
+		io.WriteString(w, "Error rendering page: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
+
+// csrfToken is the token the forms carry, which has to match the cookie.
+// Another site can get the browser to send the cookie, but can't read it
+// to put in the form.
+func csrfToken(w http.ResponseWriter, req *http.Request) string {
+	if c, err := req.Cookie(uiCSRFCookie); err == nil && len(c.Value) == 32 {
+		return c.Value
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{Name: uiCSRFCookie, Value: token, Path: "/ui/", HttpOnly: true, Secure: req.TLS != nil, SameSite: http.SameSiteStrictMode})
+	return token
+}
+
+func csrfOK(req *http.Request) bool {
+	c, err := req.Cookie(uiCSRFCookie)
+	return err == nil && len(c.Value) == 32 && subtle.ConstantTimeCompare([]byte(c.Value), []byte(req.PostFormValue("csrf"))) == 1
+}
+
+func csrfFailed(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(403)
+	io.WriteString(w, "Forbidden: the form had expired, or came from another site. Go back, reload the page and try again.")
+}
+
+// how much bigger than a cover a form with one in it can be
+const uiFormSlack = 64 * 1024
+
+// uiSession goes in front of authenticate on /ui/. It hands the session
+// cookie on as a bearer token, and sends anyone without a good one off to
+// sign in, rather than at a 401. It also caps the size of the forms, before
+// anything reads them.
+func uiSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		req.Body = http.MaxBytesReader(w, req.Body, int64(cfg.MaxCoverBytes)+uiFormSlack)
+		if auth == nil || req.Header.Get("Authorization") != "" || req.Header.Get("X-API-Key") != "" {
+			next(w, req)
+			return
+		}
+		if c, err := req.Cookie(uiSessionCookie); err == nil {
+			if _, err := auth.checkToken(c.Value, time.Now()); err == nil {
+				req.Header.Set("Authorization", "Bearer "+c.Value)
+				next(w, req)
+				return
+			}
+		}
+		if _, ok := certCaller(req); ok {
+			next(w, req)
+			return
+		}
+		to := "/ui/login"
+		if req.Method == http.MethodGet {
+			to += "?next=" + url.QueryEscape(req.URL.RequestURI())
+		}
+		http.Redirect(w, req, to, 303)
+	}
+}
+
+// GET and POST /ui/login. Goes straight to the list when there's no
+// authentication to do.
+func uiLogin(w http.ResponseWriter, req *http.Request) {
+	next := req.FormValue("next")
+	if !strings.HasPrefix(next, "/ui/") {
+		next = "/ui/"
+	}
+	if auth == nil {
+		http.Redirect(w, req, next, 303)
+		return
+	}
+	p := uiPage{Title: "Sign in", Next: next}
+	switch req.Method {
+	case http.MethodGet:
+		renderUI(w, req, 200, "login", p)
+	case http.MethodPost:
+		if !csrfOK(req) {
+			csrfFailed(w)
+			return
+		}
+		// guessing keys here is no quicker than anywhere else
+		ip := sourceIP(req)
+		if limiter != nil {
+			if retry := limiter.authBlocked(ip); retry > 0 {
+				warn(req, "too many failed authentications", slog.Int("retry_after", retry))
+				w.Header().Set("Retry-After", strconv.Itoa(retry))
+				p.Problem = "Too many wrong keys. Try again in " + strconv.Itoa(retry) + " seconds."
+				renderUI(w, req, 429, "login", p)
+				return
+			}
+		}
+		c, ok := auth.checkAPIKey(req.PostFormValue("key"), time.Now())
+		if !ok {
+			if limiter != nil {
+				limiter.authFailed(ip)
+			}
+			p.Problem = "That key isn't valid."
+			renderUI(w, req, 401, "login", p)
+			return
+		}
+		token, err := auth.issueToken(c, uiSessionTTL, time.Now())
+		if err != nil {
+			p.Problem = "Can't sign anyone in right now: " + err.Error()
+			renderUI(w, req, 503, "login", p)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: uiSessionCookie, Value: token, Path: "/ui/", MaxAge: int(uiSessionTTL.Seconds()), HttpOnly: true, Secure: req.TLS != nil, SameSite: http.SameSiteLaxMode})
+		http.Redirect(w, req, next, 303)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// uiHandler is everything under /ui/ but signing in.
+//
+// GET /ui/?q=...&status=in|out    the list, searched
+// GET and POST /ui/new            add a book
+// GET and POST /ui/book/{id}      edit, check out and check in
+// GET and POST /ui/book/{id}/cover  the cover, and uploading one
+// POST /ui/logout
+func uiHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		w.WriteHeader(405)
+		return
+	}
+	if req.Method == http.MethodPost && formTooLarge(req) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(413)
+		io.WriteString(w, "Request body too large. A cover can be at most "+strconv.Itoa(cfg.MaxCoverBytes)+" bytes.")
+		return
+	}
+	if req.Method == http.MethodPost && !csrfOK(req) {
+		csrfFailed(w)
+		return
+	}
+	p := strings.TrimPrefix(req.URL.Path, "/ui/")
+	switch {
+	case p == "" && req.Method == http.MethodGet:
+		uiList(w, req)
+	case p == "new":
+		uiNew(w, req)
+	case p == "logout" && req.Method == http.MethodPost:
+		http.SetCookie(w, &http.Cookie{Name: uiSessionCookie, Path: "/ui/", MaxAge: -1})
+		http.Redirect(w, req, "/ui/login", 303)
+	case strings.HasPrefix(p, "book/") && strings.HasSuffix(p, "/cover"):
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(p, "book/"), "/cover"))
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		uiCover(w, req, id)
+	case strings.HasPrefix(p, "book/"):
+		id, err := strconv.Atoi(strings.TrimPrefix(p, "book/"))
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		uiEdit(w, req, id)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// formTooLarge says whether the form was cut off by uiSession. The form's
+// been read already, by uiActions, so this is the error that left behind.
+func formTooLarge(req *http.Request) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(req.ParseMultipartForm(1<<20), &tooLarge)
+}
+
+func uiList(w http.ResponseWriter, req *http.Request) {
+	books, err := storeFor(req).List()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	p := uiPage{
+		Title:        "Books",
+		Note:         uiNotes[req.FormValue("note")],
+		Search:       req.FormValue("q"),
+		StatusFilter: req.FormValue("status")}
+	q := strings.ToLower(strings.TrimSpace(p.Search))
+	ids := []int{}
+	for id, b := range books {
+		text := strings.ToLower(b.Title + "\n" + b.Author + "\n" + b.Publisher)
+		if q != "" && !strings.Contains(text, q) {
+			continue
+		}
+		if p.StatusFilter == "in" && b.Status != CheckedIn || p.StatusFilter == "out" && b.Status != CheckedOut {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		p.Books = append(p.Books, uiBook{id, books[id]})
+	}
+	renderUI(w, req, 200, "books", p)
+}
+
+func bookFields(b Book) map[string]string {
+	return map[string]string{
+		"Title":       b.Title,
+		"Author":      b.Author,
+		"Publisher":   b.Publisher,
+		"PublishDate": b.publishDate(),
+		"Rating":      strconv.Itoa(b.Rating),
+		"Edition":     b.Edition,
+		"Language":    b.Language,
+		"Pages":       csvInt(b.Pages),
+		"Format":      b.Format,
+		"Series":      b.Series,
+		"Volume":      csvInt(b.Volume),
+		"Subjects":    strings.Join(b.Subjects, "; "),
+		"Description": b.Description,
+		"Cover":       b.Cover,
+		"Tags":        strings.Join(b.Tags, "; ")}
+}
+
+// formChanges is what the posted form changes about b, as the query PUT
+// /book/{id} would take, and what validateQuery makes of each field. It
+// also puts what was posted into fields, to show again.
+func formChanges(req *http.Request, b Book, fields map[string]string) (url.Values, map[string]string) {
+	current := bookFields(b)
+	changes := url.Values{}
+	problems := map[string]string{}
+	for _, k := range uiFields {
+		if _, there := req.PostForm[k]; !there {
+			continue
+		}
+		v := strings.TrimSpace(req.PostFormValue(k))
+		fields[k] = v
+		if v == current[k] {
+			continue
+		}
+		changes.Set(k, v)
+		if listKeys[k] && v != "" {
+			// one box, with the subjects or tags separated by semicolons
+			changes[k] = strings.Split(v, ";")
+		}
+		if valid, message := validateQuery(url.Values{k: changes[k]}); !valid {
+			problems[k] = strings.TrimSpace(message)
+		}
+	}
+	return changes, problems
+}
+
+func uiNew(w http.ResponseWriter, req *http.Request) {
+	book := NewBook()
+	p := uiPage{Title: "Add a book", Fields: bookFields(book), Errors: map[string]string{}}
+	if req.Method == http.MethodGet {
+		// suggest the next ID up
+		next := 0
+		if books, err := storeFor(req).List(); err == nil {
+			for id := range books {
+				if id >= next {
+					next = id + 1
+				}
+			}
+		}
+		p.Fields["ID"] = strconv.Itoa(next)
+		renderUI(w, req, 200, "book", p)
+		return
+	}
+	p.Fields["ID"] = strings.TrimSpace(req.PostFormValue("ID"))
+	id, err := strconv.Atoi(p.Fields["ID"])
+	if err != nil || id < 0 {
+		p.Errors["ID"] = "The ID must be a whole number, 0 or more."
+	}
+	changes, problems := formChanges(req, book, p.Fields)
+	for k, v := range problems {
+		p.Errors[k] = v
+	}
+	if len(p.Errors) > 0 {
+		p.Problem = "Please fix the fields marked below."
+		renderUI(w, req, 400, "book", p)
+		return
+	}
+	statusEvent := ""
+	changeBook(changes, &statusEvent)(&book)
+	there, err := storeFor(req).Create(id, book)
+	switch err {
+	case nil:
+	case errExists:
+		auditBooks(req, id, &there, &there)
+		p.Errors["ID"] = "There's already a book " + strconv.Itoa(id) + ", " + there.Title + "."
+		p.Problem = "Please fix the fields marked below."
+		renderUI(w, req, 409, "book", p)
+		return
+	default:
+		storageError(w, err)
+		return
+	}
+	auditBooks(req, id, nil, &book)
+	publish(EventCreated, id, book)
+	http.Redirect(w, req, "/ui/book/"+strconv.Itoa(id)+"?note=created", 303)
+}
+
+func uiEdit(w http.ResponseWriter, req *http.Request, id int) {
+	book, err := storeFor(req).Get(id)
+	switch err {
+	case nil:
+	case errNotFound:
+		http.NotFound(w, req)
+		return
+	default:
+		storageError(w, err)
+		return
+	}
+	p := uiPage{Title: book.Title, Note: uiNotes[req.FormValue("note")], Book: &uiBook{id, book}, Fields: bookFields(book), Errors: map[string]string{}}
+	if req.Method == http.MethodGet {
+		renderUI(w, req, 200, "book", p)
+		return
+	}
+	var changes url.Values
+	note := "saved"
+	switch req.PostFormValue("action") {
+	case "checkout":
+		changes, note = url.Values{"Status": {"CheckedOut"}}, "checkedout"
+	case "return":
+		changes, note = url.Values{"Status": {"CheckedIn"}}, "returned"
+	case "save":
+		var problems map[string]string
+		changes, problems = formChanges(req, book, p.Fields)
+		if len(problems) > 0 {
+			auditBooks(req, id, nil, nil)
+			p.Errors = problems
+			p.Problem = "Please fix the fields marked below."
+			renderUI(w, req, 400, "book", p)
+			return
+		}
+		if len(changes) == 0 {
+			http.Redirect(w, req, "/ui/book/"+strconv.Itoa(id)+"?note=unchanged", 303)
+			return
+		}
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, "Unknown action.")
+		return
+	}
+	statusEvent := ""
+	before, after, err := storeFor(req).Update(id, changeBook(changes, &statusEvent))
+	switch err {
+	case nil:
+	case errNotFound:
+		http.NotFound(w, req)
+		return
+	case errConflict:
+		auditBooks(req, id, &before, &before)
+		p.Book = &uiBook{id, before}
+		p.Note = ""
+		p.Problem = "It's already checked in."
+		if before.Status == CheckedOut {
+			p.Problem = "It's already checked out."
+		}
+		renderUI(w, req, 409, "book", p)
+		return
+	default:
+		storageError(w, err)
+		return
+	}
+	auditBooks(req, id, &before, &after)
+	publishUpdate(id, after, changes, statusEvent)
+	http.Redirect(w, req, "/ui/book/"+strconv.Itoa(id)+"?note="+note, 303)
+}
+
+// GET /ui/book/{id}/cover is the cover, like GET /book/{id}/cover, so the
+// pages can show it with the session cookie. POST uploads a new one, from
+// the form's cover file.
+func uiCover(w http.ResponseWriter, req *http.Request, id int) {
+	if req.Method == http.MethodGet {
+		serveCover(w, req, id)
+		return
+	}
+	book, err := storeFor(req).Get(id)
+	switch err {
+	case nil:
+	case errNotFound:
+		http.NotFound(w, req)
+		return
+	default:
+		storageError(w, err)
+		return
+	}
+	// the book itself doesn't change
+	auditBooks(req, id, nil, nil)
+	p := uiPage{Title: book.Title, Book: &uiBook{id, book}, Fields: bookFields(book), Errors: map[string]string{}}
+	f, _, err := req.FormFile("cover")
+	if err != nil {
+		p.Errors["cover"] = "Choose a JPEG or PNG to upload."
+		p.Problem = "Please fix the fields marked below."
+		renderUI(w, req, 400, "book", p)
+		return
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	c, code, message := readCover(data)
+	if code != 0 {
+		p.Errors["cover"] = message
+		p.Problem = "Please fix the fields marked below."
+		renderUI(w, req, code, "book", p)
+		return
+	}
+	if err := covers.Put(id, c); err != nil {
+		storageError(w, err)
+		return
+	}
+	http.Redirect(w, req, "/ui/book/"+strconv.Itoa(id)+"?note=cover", 303)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func uiServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ui/", uiSession(audited(authenticate(authorize(uiActions, uiHandler)))))
+	mux.HandleFunc("/ui/login", uiLogin)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// a browser, more or less: keeps cookies, doesn't follow redirects
+type uiBrowser struct {
+	t    *testing.T
+	srv  *httptest.Server
+	c    *http.Client
+	csrf string
+}
+
+func newUIBrowser(t *testing.T, srv *httptest.Server) *uiBrowser {
+	jar, _ := cookiejar.New(nil)
+	return &uiBrowser{t: t, srv: srv, c: &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}}
+}
+
+var csrfField = regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`)
+
+// returns the code and the page, or where it was sent
+func (b *uiBrowser) do(req *http.Request) (int, string) {
+	resp, err := b.c.Do(req)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if m := csrfField.FindSubmatch(body); m != nil {
+		b.csrf = string(m[1])
+	}
+	if resp.StatusCode == 303 {
+		return 303, resp.Header.Get("Location")
+	}
+	return resp.StatusCode, string(body)
+}
+
+func (b *uiBrowser) get(path string) (int, string) {
+	req, _ := http.NewRequest(http.MethodGet, b.srv.URL+path, nil)
+	return b.do(req)
+}
+
+// posts the form, with the last page's csrf token
+func (b *uiBrowser) post(path string, form url.Values) (int, string) {
+	if form.Get("csrf") == "" {
+		form.Set("csrf", b.csrf)
+	}
+	req, _ := http.NewRequest(http.MethodPost, b.srv.URL+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(req)
+}
+
+func TestUIBrowse(t *testing.T) {
+	freshAudit()
+	defer func() { store = nil; audit = nil }()
+	store.Create(1, Book{Title: "Dune", Author: "Frank Herbert", Publisher: "Chilton", PublishDate: time.Date(1965, 8, 1, 0, 0, 0, 0, time.UTC), Rating: 5, Status: CheckedOut})
+	store.Create(2, Book{Title: "Emma", Author: "Jane Austen", PublishDate: time.Date(1815, 12, 23, 0, 0, 0, 0, time.UTC), Rating: 4})
+	store.Create(3, Book{Title: "<script>", Author: "Mallory"})
+	b := newUIBrowser(t, uiServer(t))
+
+	for path, expected := range map[string][]string{
+		"/ui/":                {"Dune", "Emma", "&lt;script&gt;"},
+		"/ui/?q=austen":       {"Emma"},
+		"/ui/?q=CHILTON":      {"Dune"},
+		"/ui/?status=out":     {"Dune"},
+		"/ui/?status=in":      {"Emma", "&lt;script&gt;"},
+		"/ui/?q=nope":         {"No books match that search."},
+		"/ui/book/1":          {"Checked out.", `value="Frank Herbert"`, `value="1965-Aug-01"`, `value="return"`},
+		"/ui/book/2?note=nah": {`value="checkout"`},
+	} {
+		code, page := b.get(path)
+		if code != 200 {
+			t.Errorf("GET %s gave %d", path, code)
+		}
+		for _, s := range expected {
+			if !strings.Contains(page, s) {
+				t.Errorf("GET %s: no %q in the page", path, s)
+			}
+		}
+		if strings.Contains(page, "<script>") {
+			t.Errorf("GET %s didn't escape the title", path)
+		}
+	}
+	if code, _ := b.get("/ui/?q=emma"); code != 200 || strings.Contains(b.csrf, " ") || len(b.csrf) != 32 {
+		t.Errorf("got csrf token %q", b.csrf)
+	}
+	if code, _ := b.get("/ui/book/9"); code != 404 {
+		t.Errorf("missing book gave %d, expected 404", code)
+	}
+}
+
+func TestUIEdit(t *testing.T) {
+	freshAudit()
+	defer func() { store = nil; audit = nil }()
+	store.Create(1, Book{Title: "Dune", Rating: 3})
+	b := newUIBrowser(t, uiServer(t))
+	b.get("/ui/book/1")
+
+	code, _ := b.post("/ui/book/1", url.Values{"action": {"save"}, "Rating": {"5"}, "csrf": {"0123456789abcdef0123456789abcdef"}})
+	if code != 403 {
+		t.Errorf("forged csrf token gave %d, expected 403", code)
+	}
+
+	code, page := b.post("/ui/book/1", url.Values{"action": {"save"}, "Title": {"Dune Messiah"}, "Rating": {"11"}})
+	if code != 400 || !strings.Contains(page, `class="error">Invalid Rating. Value must be a whole number from 1 to 3.`) || !strings.Contains(page, `value="Dune Messiah"`) {
+		t.Errorf("bad rating gave %d %s", code, page)
+	}
+	if got, _ := store.Get(1); got.Title != "Dune" || got.Rating != 3 {
+		t.Errorf("bad form still changed the book: %+v", got)
+	}
+
+	code, where := b.post("/ui/book/1", url.Values{"action": {"save"}, "Title": {"Dune Messiah"}, "Rating": {"2"}, "Author": {""}})
+	if code != 303 || where != "/ui/book/1?note=saved" {
+		t.Errorf("save gave %d %s", code, where)
+	}
+	if got, _ := store.Get(1); got.Title != "Dune Messiah" || got.Rating != 2 {
+		t.Errorf("save left %+v", got)
+	}
+	if code, where := b.post("/ui/book/1", url.Values{"action": {"save"}, "Title": {"Dune Messiah"}}); where != "/ui/book/1?note=unchanged" {
+		t.Errorf("saving nothing gave %d %s", code, where)
+	}
+
+	if code, where := b.post("/ui/book/1", url.Values{"action": {"checkout"}}); code != 303 || where != "/ui/book/1?note=checkedout" {
+		t.Errorf("checkout gave %d %s", code, where)
+	}
+	if code, page := b.post("/ui/book/1", url.Values{"action": {"checkout"}}); code != 409 || !strings.Contains(page, "already checked out") {
+		t.Errorf("second checkout gave %d", code)
+	}
+	if code, _ := b.post("/ui/book/1", url.Values{"action": {"return"}}); code != 303 {
+		t.Errorf("return gave %d", code)
+	}
+	if got, _ := store.Get(1); got.Status != CheckedIn {
+		t.Errorf("return left it %v", got.Status)
+	}
+
+	l := audit.query(time.Time{}, time.Time{}, 1)
+	outcomes := []int{400, 303, 303, 409, 303}
+	if len(l) != len(outcomes) {
+		t.Fatalf("got %d audit entries, expected %d", len(l), len(outcomes))
+	}
+	for i, o := range outcomes {
+		if l[i].Outcome != o {
+			t.Errorf("entry %d has outcome %d, expected %d", i+1, l[i].Outcome, o)
+		}
+	}
+}
+
+func TestUINew(t *testing.T) {
+	freshAudit()
+	defer func() { store = nil; audit = nil }()
+	store.Create(4, Book{Title: "Dune"})
+	b := newUIBrowser(t, uiServer(t))
+
+	if code, page := b.get("/ui/new"); code != 200 || !strings.Contains(page, `name="ID" value="5"`) {
+		t.Errorf("new form gave %d, expected ID 5 suggested", code)
+	}
+	code, page := b.post("/ui/new", url.Values{"ID": {"x"}, "Title": {"Emma"}, "PublishDate": {"soon"}})
+	if code != 400 || !strings.Contains(page, "whole number") || !strings.Contains(page, "Error parsing PublishDate.") {
+		t.Errorf("bad new book gave %d %s", code, page)
+	}
+	if code, page := b.post("/ui/new", url.Values{"ID": {"4"}, "Title": {"Emma"}}); code != 409 || !strings.Contains(page, "There&#39;s already a book 4, Dune.") {
+		t.Errorf("duplicate ID gave %d %s", code, page)
+	}
+	if code, where := b.post("/ui/new", url.Values{"ID": {"5"}, "Title": {"Emma"}, "Rating": {"2"}}); code != 303 || where != "/ui/book/5?note=created" {
+		t.Errorf("new book gave %d %s", code, where)
+	}
+	if got, err := store.Get(5); err != nil || got.Title != "Emma" || got.Rating != 2 {
+		t.Errorf("got %+v %v", got, err)
+	}
+}
+
+func TestUILogin(t *testing.T) {
+	freshAudit()
+	auth = testAuthenticator(t)
+	saved := policy.policy
+	policy.policy = &Policy{Roles: saved.Roles, Callers: map[string]string{"frontdesk": "clerk"}}
+	defer func() { store = nil; audit = nil; auth = nil; policy.policy = saved }()
+	store.Create(1, Book{Title: "Dune"})
+	b := newUIBrowser(t, uiServer(t))
+
+	if code, where := b.get("/ui/book/1"); code != 303 || where != "/ui/login?next=%2Fui%2Fbook%2F1" {
+		t.Fatalf("signed out GET gave %d %s", code, where)
+	}
+	b.get("/ui/login?next=%2Fui%2Fbook%2F1")
+	if code, _ := b.post("/ui/login", url.Values{"key": {"old-key"}, "next": {"/ui/book/1"}}); code != 401 {
+		t.Errorf("expired key gave %d, expected 401", code)
+	}
+	if code, where := b.post("/ui/login", url.Values{"key": {"current-key"}, "next": {"https://elsewhere/"}}); code != 303 || where != "/ui/" {
+		t.Errorf("sign in gave %d %s, expected to stay on /ui/", code, where)
+	}
+
+	code, page := b.get("/ui/book/1")
+	if code != 200 || !strings.Contains(page, "Signed in as frontdesk") {
+		t.Errorf("signed in GET gave %d", code)
+	}
+	if code, _ := b.post("/ui/book/1", url.Values{"action": {"checkout"}}); code != 303 {
+		t.Errorf("clerk checkout gave %d", code)
+	}
+	if code, page := b.post("/ui/book/1", url.Values{"action": {"save"}, "Title": {"Emma"}}); code != 403 || !strings.Contains(page, "may not catalog") {
+		t.Errorf("clerk edit gave %d %s", code, page)
+	}
+	if l := audit.query(time.Time{}, time.Time{}, 1); len(l) == 0 || l[0].Actor != "frontdesk" {
+		t.Errorf("got audit %+v, expected the checkout by frontdesk", l)
+	}
+
+	if code, where := b.post("/ui/logout", url.Values{}); code != 303 || where != "/ui/login" {
+		t.Errorf("sign out gave %d %s", code, where)
+	}
+	if code, _ := b.get("/ui/"); code != 303 {
+		t.Errorf("GET after signing out gave %d, expected a redirect", code)
+	}
+
+	// wrong keys count against the address, like anywhere else
+	limiter, _ = newRateLimiter(nil)
+	defer func() { limiter = nil }()
+	limiter.failures = RateRule{Route: "*", Method: "*", Rate: 0.001, Burst: 1}
+	b.get("/ui/login")
+	if code, _ := b.post("/ui/login", url.Values{"key": {"guess"}}); code != 401 {
+		t.Errorf("wrong key gave %d, expected 401", code)
+	}
+	if code, page := b.post("/ui/login", url.Values{"key": {"current-key"}}); code != 429 || !strings.Contains(page, "Too many wrong keys") {
+		t.Errorf("sign in after a wrong key gave %d, expected 429", code)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/url"
+)
+
+// Version 2 of the /book/ wire format, at /v2/book/: camelCase keys, the
+// ID in the book, Status as checkedIn or checkedOut, and dates as plain
+// YYYY-MM-DD, or YYYY-MM or YYYY when that's all that's known. /book/ and /v1/book/ keep the old shape for the clients that
+// already use it. Changes sent to v2 are turned into the v1 query they
+// stand for, so they're checked and authorized exactly the same.
+
+const v2DateFormat = "2006-01-02"
+
+type bookV2 struct {
+	XMLName     xml.Name `json:"-" xml:"book"`
+	ID          int      `json:"id" xml:"id,attr"`
+	Title       string   `json:"title" xml:"title"`
+	Author      string   `json:"author" xml:"author"`
+	Publisher   string   `json:"publisher" xml:"publisher"`
+	PublishDate string   `json:"publishDate" xml:"publishDate"`
+	Rating      int      `json:"rating" xml:"rating"`
+	Status      string   `json:"status" xml:"status"`
+	Edition     string   `json:"edition,omitempty" xml:"edition,omitempty"`
+	Language    string   `json:"language,omitempty" xml:"language,omitempty"`
+	Pages       int      `json:"pages,omitempty" xml:"pages,omitempty"`
+	Format      string   `json:"format,omitempty" xml:"format,omitempty"`
+	Series      string   `json:"series,omitempty" xml:"series,omitempty"`
+	Volume      int      `json:"volume,omitempty" xml:"volume,omitempty"`
+	Subjects    xmlList  `json:"subjects,omitempty" xml:"subjects,omitempty"`
+	Description string   `json:"description,omitempty" xml:"description,omitempty"`
+	Cover       string   `json:"cover,omitempty" xml:"cover,omitempty"`
+	Tags        xmlList  `json:"tags,omitempty" xml:"tags,omitempty"`
+	// worked out from the reviews
+	AverageRating float64 `json:"averageRating,omitempty" xml:"averageRating,omitempty"`
+	RatingCount   int     `json:"ratingCount,omitempty" xml:"ratingCount,omitempty"`
+}
+
+type booksV2 struct {
+	XMLName xml.Name `xml:"books"`
+	Books   []bookV2 `xml:"book"`
+}
+
+func toV2(id int, b Book) bookV2 {
+	status := "checkedIn"
+	if b.Status == CheckedOut {
+		status = "checkedOut"
+	}
+	return bookV2{
+		ID:            id,
+		Title:         b.Title,
+		Author:        b.Author,
+		Publisher:     b.Publisher,
+		PublishDate:   formatDate(b.PublishDate, b.PublishPrecision, v2DateFormat),
+		Rating:        b.Rating,
+		Status:        status,
+		Edition:       b.Edition,
+		Language:      b.Language,
+		Pages:         b.Pages,
+		Format:        b.Format,
+		Series:        b.Series,
+		Volume:        b.Volume,
+		Subjects:      b.Subjects,
+		Description:   b.Description,
+		Cover:         b.Cover,
+		Tags:          b.Tags,
+		AverageRating: b.AverageRating,
+		RatingCount:   b.RatingCount}
+}
+
+// a v2 list is an array, by ID
+func listV2(books map[int]Book) []bookV2 {
+	list := []bookV2{}
+	for _, id := range sortedIDs(books) {
+		list = append(list, toV2(id, books[id]))
+	}
+	return list
+}
+
+// the v1 query keys, by their v2 names
+var v2Keys = map[string]string{
+	"title":       "Title",
+	"author":      "Author",
+	"publisher":   "Publisher",
+	"publishDate": "PublishDate",
+	"rating":      "Rating",
+	"status":      "Status",
+	"edition":     "Edition",
+	"language":    "Language",
+	"pages":       "Pages",
+	"format":      "Format",
+	"series":      "Series",
+	"volume":      "Volume",
+	"subjects":    "Subjects",
+	"description": "Description",
+	"cover":       "Cover",
+	"tags":        "Tags",
+}
+
+// fromV2 turns v2 changes into the v1 query they stand for. It checks what
+// v1 would say differently; validateQuery does the rest.
+func fromV2(changes url.Values) (url.Values, error) {
+	kvPairs := url.Values{}
+	for k, vs := range changes {
+		key, there := v2Keys[k]
+		if !there {
+			return nil, errors.New("Invalid key " + k + ". Valid keys are title, author, publisher, publishDate, rating, status, " +
+				"edition, language, pages, format, series, volume, subjects, description, cover, and tags.")
+		}
+		for _, v := range vs {
+			switch key {
+			case "Status":
+				switch v {
+				case "checkedIn":
+					v = "CheckedIn"
+				case "checkedOut":
+					v = "CheckedOut"
+				default:
+					return nil, errors.New("Invalid status. Value must be either checkedIn or checkedOut.")
+				}
+			case "PublishDate":
+				d, p, err := parseISODate(v)
+				if err != nil {
+					return nil, errors.New("Error parsing publishDate. Please use the format YYYY-MM-DD. When the day isn't known, use YYYY-MM or YYYY.")
+				}
+				v = formatDate(d, p, cfg.DateFormat)
+			}
+			kvPairs.Add(key, v)
+		}
+	}
+	return kvPairs, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestV2Out(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil }()
+	store.Create(2, Book{Title: "Emma", Author: "Jane Austen", PublishDate: time.Date(1815, 12, 23, 0, 0, 0, 0, time.UTC), Rating: 2})
+	store.Create(1, Book{Title: "Dune", Rating: 3, Status: CheckedOut})
+
+	emma := `{"id":2,"title":"Emma","author":"Jane Austen","publisher":"","publishDate":"1815-12-23","rating":2,"status":"checkedIn"}`
+	for _, c := range []struct {
+		target, accept, body string
+	}{
+		{"/v2/book/2", "", emma + "\n"},
+		{"/v2/book/", "", `[{"id":1,"title":"Dune","author":"","publisher":"","publishDate":"0001-01-01","rating":3,"status":"checkedOut"},` + emma + "]\n"},
+		{"/v2/book/2", "application/xml", xmlHeader +
+			`<book id="2"><title>Emma</title><author>Jane Austen</author><publisher></publisher><publishDate>1815-12-23</publishDate><rating>2</rating><status>checkedIn</status></book>` + "\n"},
+		{"/v2/book/", "text/csv", "id,title,author,publisher,publishDate,rating,status,edition,language,pages,format,series,volume,subjects,description,cover,tags,averageRating,ratingCount\n" +
+			"1,Dune,,,0001-01-01,3,checkedOut,,,,,,,,,,,,\n2,Emma,Jane Austen,,1815-12-23,2,checkedIn,,,,,,,,,,,,\n"},
+		{"/v2/book/", "application/yaml", "- id: 1\n  title: \"Dune\"\n  author: \"\"\n  publisher: \"\"\n  publishDate: \"0001-01-01\"\n  rating: 3\n  status: checkedOut\n" +
+			"- id: 2\n  title: \"Emma\"\n  author: \"Jane Austen\"\n  publisher: \"\"\n  publishDate: \"1815-12-23\"\n  rating: 2\n  status: checkedIn\n"},
+		// the old shape's still there
+		{"/v1/book/2", "", `{"Title":"Emma","Author":"Jane Austen","Publisher":"","PublishDate":"1815-12-23T00:00:00Z","Rating":2,"Status":0}` + "\n"},
+		{"/v1/book/", "text/csv", "ID,Title,Author,Publisher,PublishDate,Rating,Status\n1,Dune,,,0001-Jan-01,3,CheckedOut\n2,Emma,Jane Austen,,1815-Dec-23,2,CheckedIn\n"},
+	} {
+		rec := formatRequest(http.MethodGet, c.target, c.accept, "", "")
+		if rec.Code != 200 || rec.Body.String() != c.body {
+			t.Errorf("GET %s as %q gave %d:\n%s\nexpected:\n%s", c.target, c.accept, rec.Code, rec.Body, c.body)
+		}
+	}
+
+	store = newMemStore()
+	for accept, empty := range map[string]string{"": "[]\n", "application/yaml": "[]\n", "application/xml": xmlHeader + "<books></books>\n"} {
+		if rec := formatRequest(http.MethodGet, "/v2/book/", accept, "", ""); rec.Body.String() != empty {
+			t.Errorf("empty list as %q was %q, expected %q", accept, rec.Body, empty)
+		}
+	}
+}
+
+func TestV2In(t *testing.T) {
+	store = newMemStore()
+	defer func() { store = nil }()
+	store.Create(1, NewBook())
+
+	rec := formatRequest(http.MethodPut, "/v2/book/1?title=Dune&publishDate=1965-08-01&status=checkedOut", "", "", "")
+	if rec.Code != 200 || !strings.HasPrefix(rec.Body.String(), `{"id":1,"title":"Dune",`) || !strings.Contains(rec.Body.String(), `"publishDate":"1965-08-01","rating":`) {
+		t.Errorf("v2 query gave %d %s", rec.Code, rec.Body)
+	}
+	rec = formatRequest(http.MethodPut, "/v2/book/1", "", "application/json", `{"id": 1, "rating": 3, "status": "checkedIn"}`)
+	if rec.Code != 200 || !strings.HasSuffix(rec.Body.String(), `"rating":3,"status":"checkedIn"}`+"\n") {
+		t.Errorf("v2 body gave %d %s", rec.Code, rec.Body)
+	}
+	rec = formatRequest(http.MethodPost, "/v2/book/2", "application/yaml", "application/xml", `<book id="2"><title>Emma</title></book>`)
+	if rec.Code != 201 || !strings.HasPrefix(rec.Body.String(), "id: 2\ntitle: \"Emma\"\n") {
+		t.Errorf("v2 create gave %d %s", rec.Code, rec.Body)
+	}
+	if b, _ := store.Get(1); b.Title != "Dune" || b.PublishDate != time.Date(1965, 8, 1, 0, 0, 0, 0, time.UTC) || b.Rating != 3 || b.Status != CheckedIn {
+		t.Errorf("got %+v", b)
+	}
+
+	for _, c := range []struct {
+		target, contentType, body string
+		message                   string
+	}{
+		{"/v2/book/1?Title=x", "", "", "Invalid key Title. Valid keys are title"},
+		{"/v2/book/1?status=CheckedOut", "", "", "Invalid status. Value must be either checkedIn or checkedOut."},
+		{"/v2/book/1?publishDate=1965-Aug-01", "", "", "Please use the format YYYY-MM-DD."},
+		{"/v2/book/1?rating=9", "", "", "Invalid Rating."},
+		{"/v2/book/1", "application/json", `{"id": 2, "title": "x"}`, "doesn't match"},
+		{"/v2/book/1", "application/json", `{"Status": 1}`, "Invalid key Status."},
+	} {
+		before, _ := store.Get(1)
+		rec := formatRequest(http.MethodPut, c.target, "", c.contentType, c.body)
+		if rec.Code != 400 || !strings.Contains(rec.Body.String(), c.message) {
+			t.Errorf("PUT %s %s gave %d %q, expected 400 %q", c.target, c.body, rec.Code, rec.Body, c.message)
+		}
+		if after, _ := store.Get(1); !reflect.DeepEqual(after, before) {
+			t.Errorf("PUT %s %s changed the book", c.target, c.body)
+		}
+	}
+}
+
+func TestV2Paths(t *testing.T) {
+	for p, expected := range map[string]int{"/book/3": 3, "/v1/book/4": 4, "/v2/book/5": 5} {
+		if id, err := getIDFromPath(p); err != nil || id != expected {
+			t.Errorf("%s gave %d %v", p, id, err)
+		}
+	}
+	// a v2 status change is circulation, even without readBody in front
+	for target, expected := range map[string]string{
+		"/v2/book/1?status=checkedOut":         "circulate",
+		"/v2/book/1?title=x":                   "catalog",
+		"/v2/book/1?status=checkedIn&rating=2": "circulate catalog",
+	} {
+		got := strings.Join(bookActions(httptest.NewRequest(http.MethodPut, target, nil)), " ")
+		if got != expected {
+			t.Errorf("%s needs %q, expected %q", target, got, expected)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types. These are what a webhook subscribes to, and what shows up
+// in the Type field of the payload.
+const (
+	EventCreated    string = "book.created"
+	EventUpdated    string = "book.updated"
+	EventDeleted    string = "book.deleted"
+	EventCheckedOut string = "book.checkedOut"
+	EventReturned   string = "book.returned"
+)
+
+var allEvents = []string{EventCreated, EventUpdated, EventDeleted, EventCheckedOut, EventReturned}
+
+// the payload sent to the hooks
+type BookEvent struct {
+	Type string
+	ID   int
+	Book Book
+	Time time.Time
+}
+
+type Webhook struct {
+	ID  int
+	URL string
+	// never sent back out. The admin supplied it, they know it.
+	Secret string `json:"-"`
+	// empty means everything
+	Events []string
+}
+
+func (h Webhook) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// a delivery that ran out of attempts
+type DeadLetter struct {
+	Hook      int
+	URL       string
+	Event     BookEvent
+	Attempts  int
+	LastError string
+	Time      time.Time
+}
+
+type webhookDispatcher struct {
+	lock        sync.Mutex
+	hooks       map[int]Webhook
+	nextID      int
+	dead        []DeadLetter
+	client      *http.Client
+	maxAttempts int
+	// how many dead letters to keep. the oldest go first.
+	maxDead int
+	// wait before the first retry. doubles each time after that.
+	backoff time.Duration
+	// so we can wait for deliveries in flight
+	pending sync.WaitGroup
+}
+
+func newWebhookDispatcher() *webhookDispatcher {
+	return &webhookDispatcher{
+		hooks:       make(map[int]Webhook),
+		nextID:      1,
+		maxDead:     1000,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: 5,
+		backoff:     time.Second}
+}
+
+var hooks *webhookDispatcher
+
+// publish hands an event to anything that cares: the webhooks, and whoever
+// is watching.
+func publish(event string, id int, book Book) {
+	ev := BookEvent{Type: event, ID: id, Book: book, Time: time.Now().UTC()}
+	if hooks != nil {
+		hooks.dispatch(ev)
+	}
+	watchers.send(ev)
+}
+
+// eventBroker fans events out to subscribers in this process, like the
+// WatchBooks streams.
+type eventBroker struct {
+	lock   sync.Mutex
+	subs   map[chan BookEvent]bool
+	closed bool
+}
+
+var watchers = newEventBroker()
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subs: make(map[chan BookEvent]bool)}
+}
+
+// subscribe returns a channel of events, and a function to call when done
+// with it. The channel is closed if the subscriber falls more than buffer
+// events behind, or the broker is closed. ok is false if it already was.
+func (b *eventBroker) subscribe(buffer int) (events <-chan BookEvent, cancel func(), ok bool) {
+	ch := make(chan BookEvent, buffer)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil, func() {}, false
+	}
+	b.subs[ch] = true
+	return ch, func() {
+		b.lock.Lock()
+		if b.subs[ch] {
+			delete(b.subs, ch)
+			close(ch)
+		}
+		b.lock.Unlock()
+	}, true
+}
+
+// send never blocks. A subscriber that isn't keeping up gets dropped.
+func (b *eventBroker) send(ev BookEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *eventBroker) isClosed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.closed
+}
+
+// close ends every subscription, and refuses new ones. For shutting down.
+func (b *eventBroker) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+func (d *webhookDispatcher) register(h Webhook) Webhook {
+	d.lock.Lock()
+	h.ID = d.nextID
+	d.nextID++
+	d.hooks[h.ID] = h
+	d.lock.Unlock()
+	return h
+}
+
+func (d *webhookDispatcher) unregister(id int) (Webhook, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	h, there := d.hooks[id]
+	if there {
+		delete(d.hooks, id)
+	}
+	return h, there
+}
+
+func (d *webhookDispatcher) list() []Webhook {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	l := make([]Webhook, 0, len(d.hooks))
+	for i := 1; i < d.nextID; i++ {
+		if h, there := d.hooks[i]; there {
+			l = append(l, h)
+		}
+	}
+	return l
+}
+
+func (d *webhookDispatcher) deadLetters() []DeadLetter {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	l := make([]DeadLetter, len(d.dead))
+	copy(l, d.dead)
+	return l
+}
+
+func (d *webhookDispatcher) clearDeadLetters() {
+	d.lock.Lock()
+	d.dead = nil
+	d.lock.Unlock()
+}
+
+// dispatch sends ev to each interested hook, each in its own goroutine so a
+// slow receiver doesn't hold up the request that caused the event.
+func (d *webhookDispatcher) dispatch(ev BookEvent) {
+	payload, err := json.Marshal(ev)
+	if err != nil { // a Book always marshals...
+		panic(err)
+	}
+	d.lock.Lock()
+	for _, h := range d.hooks {
+		if h.wants(ev.Type) {
+			d.pending.Add(1)
+			go d.deliver(h, ev, payload)
+		}
+	}
+	d.lock.Unlock()
+}
+
+// wait blocks until all the deliveries in flight have succeeded or died.
+func (d *webhookDispatcher) wait() {
+	d.pending.Wait()
+}
+
+// waitContext is wait, but gives up when ctx is done.
+func (d *webhookDispatcher) waitContext(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *webhookDispatcher) deliver(h Webhook, ev BookEvent, payload []byte) {
+	defer d.pending.Done()
+	sig := signPayload(h.Secret, payload)
+	delivery := strconv.FormatInt(ev.Time.UnixNano(), 36) + "-" + strconv.Itoa(h.ID)
+	wait := d.backoff
+	var lastErr string
+	attempts := 0
+	for attempts < d.maxAttempts {
+		attempts++
+		if attempts > 1 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(payload))
+		if err != nil { // bad url. retrying won't help
+			lastErr = err.Error()
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Booklist-Event", ev.Type)
+		req.Header.Set("X-Booklist-Delivery", delivery)
+		req.Header.Set("X-Booklist-Signature", sig)
+		resp, err := d.client.Do(req)
+		if err != nil {
+			lastErr = err.Error()
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return
+		}
+		lastErr = "receiver returned " + resp.Status
+	}
+	d.lock.Lock()
+	d.dead = append(d.dead, DeadLetter{
+		Hook:      h.ID,
+		URL:       h.URL,
+		Event:     ev,
+		Attempts:  attempts,
+		LastError: lastErr,
+		Time:      time.Now().UTC()})
+	if len(d.dead) > d.maxDead {
+		d.dead = append([]DeadLetter(nil), d.dead[len(d.dead)-d.maxDead:]...)
+	}
+	d.lock.Unlock()
+}
+
+// signPayload is what goes in X-Booklist-Signature. Receivers should compute
+// the HMAC-SHA256 of the raw body with their secret and compare.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// /webhooks/             GET lists, POST registers (URL, Secret, Events in the query)
+// /webhooks/{id}         DELETE unregisters
+// /webhooks/deadletters  GET lists, DELETE clears
+func webhookHandler(w http.ResponseWriter, req *http.Request) {
+	p := strings.TrimPrefix(req.URL.Path, "/webhooks")
+	p = strings.Trim(p, "/")
+	switch {
+	case p == "" && req.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hooks.list())
+	case p == "" && req.Method == http.MethodPost:
+		createWebhook(w, req)
+	case p == "deadletters" && req.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hooks.deadLetters())
+	case p == "deadletters" && req.Method == http.MethodDelete:
+		hooks.clearDeadLetters()
+		w.WriteHeader(204)
+	case req.Method == http.MethodDelete:
+		id, err := strconv.Atoi(p)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		h, there := hooks.unregister(id)
+		if !there {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func createWebhook(w http.ResponseWriter, req *http.Request) {
+	kvPairs, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, "Error parsing query: "+err.Error())
+		return
+	}
+	valid, message := validateWebhookQuery(kvPairs)
+	if !valid {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		io.WriteString(w, message)
+		return
+	}
+	h := hooks.register(Webhook{URL: kvPairs.Get("URL"), Secret: kvPairs.Get("Secret"), Events: kvPairs["Events"]})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201) // created
+	json.NewEncoder(w).Encode(h)
+}
+
+func validateWebhookQuery(kvPairs map[string][]string) (valid bool, message string) {
+	valid = true
+	message = ""
+	oneValMessage := "Each query key must have exactly one value.\n"
+	if len(kvPairs["URL"]) == 0 {
+		message = message + "Missing URL.\n"
+		valid = false
+	}
+	if len(kvPairs["Secret"]) == 0 {
+		message = message + "Missing Secret.\n"
+		valid = false
+	}
+	for k, v := range kvPairs {
+		switch k {
+		case "URL":
+			if len(v) != 1 {
+				message = message + oneValMessage
+				valid = false
+			} else if u, err := url.Parse(v[0]); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				message = message + "Invalid URL. Must be an absolute http or https URL.\n"
+				valid = false
+			}
+		case "Secret":
+			if len(v) != 1 {
+				message = message + oneValMessage
+				valid = false
+			} else if len(v[0]) == 0 {
+				message = message + "Secret must not be empty.\n"
+				valid = false
+			}
+		case "Events":
+			for _, e := range v {
+				known := false
+				for _, a := range allEvents {
+					known = known || e == a
+				}
+				if !known {
+					message = message + "Invalid event " + e + ". Valid events are " + strings.Join(allEvents, ", ") + ".\n"
+					valid = false
+				}
+			}
+		default:
+			message = message + "Invalid query key " + k + ". Valid keys are URL, Secret and Events.\n"
+			valid = false
+		}
+	}
+	return valid, message
+}
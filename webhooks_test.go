@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// These don't need the container. The receiver is an httptest server, and
+// the dispatcher is driven directly.
+
+func TestWebhookDelivery(t *testing.T) {
+	got := make(chan BookEvent, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if sig := req.Header.Get("X-Booklist-Signature"); sig != signPayload("s3cret", body) {
+			t.Error("bad signature on delivery:", sig)
+		}
+		if e := req.Header.Get("X-Booklist-Event"); e != EventCreated {
+			t.Errorf("unexpected event header %v, expected %v", e, EventCreated)
+		}
+		var ev BookEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Error("error unmarshalling payload. json: ", string(body))
+		}
+		got <- ev
+	}))
+	defer receiver.Close()
+
+	d := newWebhookDispatcher()
+	d.register(Webhook{URL: receiver.URL, Secret: "s3cret"})
+	b := NewBook()
+	b.Title = "Hooked"
+	d.dispatch(BookEvent{Type: EventCreated, ID: 7, Book: b, Time: time.Now()})
+	d.wait()
+	select {
+	case ev := <-got:
+		if ev.ID != 7 || ev.Book.Title != "Hooked" {
+			t.Errorf("unexpected payload %+v", ev)
+		}
+	default:
+		t.Error("receiver never got the event")
+	}
+	if dl := d.deadLetters(); len(dl) != 0 {
+		t.Errorf("unexpected dead letters %+v", dl)
+	}
+}
+
+func TestWebhookEventFilter(t *testing.T) {
+	hits := 0
+	var hitLock sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hitLock.Lock()
+		hits++
+		hitLock.Unlock()
+	}))
+	defer receiver.Close()
+
+	d := newWebhookDispatcher()
+	d.register(Webhook{URL: receiver.URL, Secret: "x", Events: []string{EventDeleted}})
+	d.dispatch(BookEvent{Type: EventCreated, ID: 1, Book: NewBook()})
+	d.dispatch(BookEvent{Type: EventDeleted, ID: 1, Book: NewBook()})
+	d.wait()
+	if hits != 1 {
+		t.Errorf("receiver got %d deliveries, expected 1", hits)
+	}
+}
+
+func TestWebhookRetryThenDeadLetter(t *testing.T) {
+	hits := 0
+	var hitLock sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hitLock.Lock()
+		hits++
+		hitLock.Unlock()
+		w.WriteHeader(500)
+	}))
+	defer receiver.Close()
+
+	d := newWebhookDispatcher()
+	d.maxAttempts = 3
+	d.backoff = time.Millisecond
+	h := d.register(Webhook{URL: receiver.URL, Secret: "x"})
+	d.dispatch(BookEvent{Type: EventUpdated, ID: 3, Book: NewBook()})
+	d.wait()
+	if hits != 3 {
+		t.Errorf("receiver got %d attempts, expected 3", hits)
+	}
+	dl := d.deadLetters()
+	if len(dl) != 1 {
+		t.Fatalf("got %d dead letters, expected 1", len(dl))
+	}
+	if dl[0].Hook != h.ID || dl[0].Event.ID != 3 || dl[0].Attempts != 3 {
+		t.Errorf("unexpected dead letter %+v", dl[0])
+	}
+	d.clearDeadLetters()
+	if len(d.deadLetters()) != 0 {
+		t.Error("dead letters not cleared")
+	}
+}
+
+// a URL that won't make a request is one attempt, and the dead letters
+// don't pile up past maxDead
+func TestWebhookBadURLDeadLetters(t *testing.T) {
+	d := newWebhookDispatcher()
+	d.maxDead = 2
+	d.backoff = time.Millisecond
+	d.register(Webhook{URL: "http://%zz", Secret: "x"})
+	for id := 1; id <= 3; id++ {
+		d.dispatch(BookEvent{Type: EventUpdated, ID: id, Book: NewBook()})
+		d.wait()
+	}
+	dl := d.deadLetters()
+	if len(dl) != 2 {
+		t.Fatalf("got %d dead letters, expected 2", len(dl))
+	}
+	if dl[0].Event.ID != 2 || dl[1].Event.ID != 3 || dl[1].Attempts != 1 || dl[1].LastError == "" {
+		t.Errorf("unexpected dead letters %+v", dl)
+	}
+}
+
+func TestWebhookRetrySucceeds(t *testing.T) {
+	hits := 0
+	var hitLock sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hitLock.Lock()
+		hits++
+		h := hits
+		hitLock.Unlock()
+		if h < 2 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer receiver.Close()
+
+	d := newWebhookDispatcher()
+	d.backoff = time.Millisecond
+	d.register(Webhook{URL: receiver.URL, Secret: "x"})
+	d.dispatch(BookEvent{Type: EventCheckedOut, ID: 3, Book: NewBook()})
+	d.wait()
+	if hits != 2 {
+		t.Errorf("receiver got %d attempts, expected 2", hits)
+	}
+	if len(d.deadLetters()) != 0 {
+		t.Error("delivery that eventually succeeded ended up dead")
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	hooks = newWebhookDispatcher()
+	defer func() { hooks = nil }()
+
+	query := "URL=" + url.QueryEscape("http://localhost:9999/hook") + "&Secret=abc&Events=" + EventReturned
+	rec := httptest.NewRecorder()
+	webhookHandler(rec, httptest.NewRequest(http.MethodPost, "/webhooks/?"+query, nil))
+	if rec.Code != 201 {
+		t.Errorf("registering webhook returned code %d, expected 201", rec.Code)
+	}
+	var h Webhook
+	if err := json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+		t.Error("error unmarshalling webhook. json: ", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	webhookHandler(rec, httptest.NewRequest(http.MethodPost, "/webhooks/?URL=ftp://nope&Secret=abc&Events=book.eaten", nil))
+	if rec.Code != 400 {
+		t.Errorf("registering bad webhook returned code %d, expected 400", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	webhookHandler(rec, httptest.NewRequest(http.MethodGet, "/webhooks/", nil))
+	var l []Webhook
+	json.Unmarshal(rec.Body.Bytes(), &l)
+	if len(l) != 1 || l[0].URL != "http://localhost:9999/hook" {
+		t.Errorf("unexpected webhook list %v", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	webhookHandler(rec, httptest.NewRequest(http.MethodDelete, "/webhooks/1", nil))
+	if rec.Code != 200 {
+		t.Errorf("deleting webhook returned code %d, expected 200", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	webhookHandler(rec, httptest.NewRequest(http.MethodDelete, "/webhooks/1", nil))
+	if rec.Code != 404 {
+		t.Errorf("deleting deleted webhook returned code %d, expected 404", rec.Code)
+	}
+}